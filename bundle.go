@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+
+	"project/spf-flattener/config"
+	"project/spf-flattener/dns"
+	"project/spf-flattener/pipeline"
+)
+
+// A bundle is a directory holding what is needed to replay a run without network access:
+//
+//	config.yaml   the configuration of the run, defaults applied, with the nameservers
+//	              queried: the answers are keyed by server, and servers read from
+//	              resolv.conf differ from one machine to the next
+//	answers.zone  every DNS answer the resolver received (see dns.Recorder.WriteAnswers)
+//	records.txt   the generated records, as printed
+//	summary.txt   the RESULT line of the run
+//
+// The published records are fetched through the same resolver and are captured too, so a
+// replay repeats the comparison with them. Ad hoc runs are replayed by passing the same
+// -domain again.
+const (
+	bundleConfig  = "config.yaml"
+	bundleAnswers = "answers.zone"
+	bundleRecords = "records.txt"
+	bundleSummary = "summary.txt"
+)
+
+// capture records the DNS answers and the output of p, for writeBundle.
+type capture struct {
+	recorder *dns.Recorder
+	records  bytes.Buffer
+}
+
+// startCapture routes the DNS queries and the records of p through a capture.
+func startCapture(p *pipeline.Pipeline) *capture {
+	c := &capture{recorder: dns.NewRecorder()}
+	p.SetExchanger(c.recorder)
+	p.Out = io.MultiWriter(p.Out, &c.records)
+	return c
+}
+
+// writeBundle writes the captured run of cfg, which queried nameservers, into dir.
+func (c *capture) writeBundle(dir string, cfg *config.Config, nameservers []string, summary pipeline.Summary) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	bundled := cfg.Redacted()
+	bundled.Nameserver, bundled.Nameservers = "", nameservers
+	cfgYAML, err := yaml.Marshal(bundled)
+	if err != nil {
+		return err
+	}
+	var answers bytes.Buffer
+	if err := c.recorder.WriteAnswers(&answers); err != nil {
+		return err
+	}
+	for name, data := range map[string][]byte{
+		bundleConfig:  cfgYAML,
+		bundleAnswers: answers.Bytes(),
+		bundleRecords: c.records.Bytes(),
+		bundleSummary: []byte(summary.String() + "\n"),
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+			return err
+		}
+	}
+	log.Printf("INFO: Run captured in %s", dir)
+	return nil
+}
+
+// startReplay answers the DNS queries of p from the bundle in dir, without network
+// access, and returns the buffer receiving the records for checkReplay.
+func startReplay(p *pipeline.Pipeline, dir string) (*bytes.Buffer, error) {
+	replayer, err := dns.LoadAnswers(filepath.Join(dir, bundleAnswers))
+	if err != nil {
+		return nil, fmt.Errorf("replay bundle: %w", err)
+	}
+	p.SetExchanger(replayer)
+	var records bytes.Buffer
+	p.Out = io.MultiWriter(p.Out, &records)
+	return &records, nil
+}
+
+// checkReplay reports whether the replayed records are those of the captured run.
+func checkReplay(dir string, records *bytes.Buffer) {
+	captured, err := os.ReadFile(filepath.Join(dir, bundleRecords))
+	switch {
+	case err != nil:
+		log.Printf("WARN: Replay: cannot read the captured records: %v", err)
+	case bytes.Equal(captured, records.Bytes()):
+		log.Printf("REPLAY: The generated records are identical to the captured run.")
+	default:
+		log.Printf("REPLAY: DIFFERENCE: The generated records differ from the captured run (%s).", filepath.Join(dir, bundleRecords))
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"slices"
+	"testing"
+
+	"project/spf-flattener/config"
+	"project/spf-flattener/dns/dnstest"
+	"project/spf-flattener/pipeline"
+)
+
+func TestBundleRoundTrip(t *testing.T) {
+	const zone = `
+spf-unflat.example.com. 300 IN TXT "v=spf1 ip4:192.0.2.0/24 include:_spf.mailer.example -all"
+_spf.mailer.example. 300 IN TXT "v=spf1 ip4:198.51.100.0/24 ip6:2001:db8::/32 -all"
+_spf.example.com. 300 IN TXT "v=spf1 ip4:192.0.2.0/24 -all"
+`
+	tests := []struct {
+		name string
+		opts []config.Option
+	}{
+		// Without a configured nameserver, the servers come from this machine's resolv.conf
+		{"system nameservers", nil},
+		{"configured nameservers", []config.Option{config.WithNameserver("192.0.2.53")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			cfg, err := config.New(append([]config.Option{config.WithTargetDomain("example.com")}, tt.opts...)...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p, err := pipeline.New(cfg, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.Out = io.Discard
+			captured := startCapture(p)
+			captured.recorder.Next = dnstest.New(t, zone)
+			if err := p.Run(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if err := captured.writeBundle(dir, cfg, p.Nameservers(), p.Summary()); err != nil {
+				t.Fatal(err)
+			}
+
+			replayCfg, err := loadConfig(options{replayBundle: dir})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := replayCfg.Upstreams(); !slices.Equal(got, p.Nameservers()) {
+				t.Errorf("bundled nameservers = %v, want those of the capture %v", got, p.Nameservers())
+			}
+			replay, err := pipeline.New(replayCfg, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			replay.Out = io.Discard
+			records, err := startReplay(replay, dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := replay.Run(context.Background()); err != nil {
+				t.Fatalf("replay: %v", err)
+			}
+			if !bytes.Equal(records.Bytes(), captured.records.Bytes()) {
+				t.Errorf("replayed records:\n%s\nwant the captured ones:\n%s", records, &captured.records)
+			}
+			if got, want := replay.Summary().Status, p.Summary().Status; got != want {
+				t.Errorf("replayed status = %s, want %s", got, want)
+			}
+		})
+	}
+}
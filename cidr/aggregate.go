@@ -0,0 +1,97 @@
+// Fichier: cidr/aggregate.go (agrégation des réseaux adjacents)
+
+package cidr
+
+import "net"
+
+// Aggregate merges networks that are exactly the two halves of a parent network into that
+// parent, repeatedly, so two /32 become a /31 and two /31 a /30. IPv4 and IPv6 networks
+// are never merged together, and networks that merely overlap are left alone. A merged
+// network is priority if either half was, keeping the lowest priority index. The result
+// is not sorted.
+func Aggregate(addrs NetAddrSlice) NetAddrSlice {
+	type key struct {
+		ip   string
+		ones int
+		bits int
+	}
+	keyOf := func(n *net.IPNet) key {
+		ones, bits := n.Mask.Size()
+		return key{string(n.IP.Mask(n.Mask)), ones, bits}
+	}
+
+	set := make(map[key]*NetAddr, len(addrs))
+	for _, addr := range addrs {
+		ip := addr.IPNet.IP.To4()
+		if _, bits := addr.IPNet.Mask.Size(); bits == 128 || ip == nil {
+			ip = addr.IPNet.IP.To16()
+		}
+		normalized := *addr
+		normalized.IPNet = &net.IPNet{IP: ip, Mask: addr.IPNet.Mask}
+		k := keyOf(normalized.IPNet)
+		if existing, ok := set[k]; ok {
+			set[k] = mergeAddr(existing, &normalized, existing.IPNet)
+			continue
+		}
+		set[k] = &normalized
+	}
+
+	// Walk the prefix lengths from the longest, so merges cascade upwards
+	for ones := 128; ones > 0; ones-- {
+		for k, addr := range set {
+			if k.ones != ones || set[k] != addr {
+				continue
+			}
+			parentMask := net.CIDRMask(ones-1, k.bits)
+			parent := &net.IPNet{IP: addr.IPNet.IP.Mask(parentMask), Mask: parentMask}
+
+			sibling := make(net.IP, len(addr.IPNet.IP))
+			copy(sibling, addr.IPNet.IP)
+			sibling[(ones-1)/8] ^= 0x80 >> ((ones - 1) % 8)
+			sk := key{string(sibling), ones, k.bits}
+			other, ok := set[sk]
+			if !ok {
+				continue
+			}
+			if compareIP(other.IPNet.IP, addr.IPNet.IP) {
+				addr, other = other, addr
+			}
+			delete(set, k)
+			delete(set, sk)
+			pk := keyOf(parent)
+			merged := mergeAddr(addr, other, parent)
+			if existing, ok := set[pk]; ok {
+				merged = mergeAddr(existing, merged, parent)
+			}
+			set[pk] = merged
+		}
+	}
+
+	result := make(NetAddrSlice, 0, len(set))
+	for _, addr := range set {
+		result = append(result, addr)
+	}
+	return result
+}
+
+// mergeAddr returns network n carrying the attributes of a and b.
+func mergeAddr(a, b *NetAddr, n *net.IPNet) *NetAddr {
+	merged := &NetAddr{
+		IPNet:      n,
+		FromLookup: a.FromLookup && b.FromLookup,
+		Source:     a.Source,
+	}
+	switch {
+	case a.IsPriority && b.IsPriority:
+		merged.IsPriority = true
+		merged.OriginalPriorityIndex = min(a.OriginalPriorityIndex, b.OriginalPriorityIndex)
+	case a.IsPriority:
+		merged.IsPriority, merged.OriginalPriorityIndex = true, a.OriginalPriorityIndex
+	case b.IsPriority:
+		merged.IsPriority, merged.OriginalPriorityIndex = true, b.OriginalPriorityIndex
+	}
+	if a.IPNet.String() != n.String() {
+		merged.Source = "aggregated from " + a.IPNet.String() + " and " + b.IPNet.String()
+	}
+	return merged
+}
@@ -0,0 +1,72 @@
+package cidr
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// parseAddrs parses CIDRs into a NetAddrSlice. A "!N" suffix marks a priority network of
+// index N.
+func parseAddrs(t *testing.T, cidrs ...string) NetAddrSlice {
+	t.Helper()
+	var s NetAddrSlice
+	for _, c := range cidrs {
+		addr := &NetAddr{}
+		text, index, ok := strings.Cut(c, "!")
+		if ok {
+			addr.IsPriority = true
+			fmt.Sscan(index, &addr.OriginalPriorityIndex)
+		}
+		var err error
+		if _, addr.IPNet, err = net.ParseCIDR(text); err != nil {
+			t.Fatal(err)
+		}
+		s = append(s, addr)
+	}
+	return s
+}
+
+// formatAddrs returns the sorted text of s, in the notation of parseAddrs.
+func formatAddrs(s NetAddrSlice) []string {
+	var out []string
+	for _, addr := range s {
+		text := addr.IPNet.String()
+		if addr.IsPriority {
+			text += fmt.Sprintf("!%d", addr.OriginalPriorityIndex)
+		}
+		out = append(out, text)
+	}
+	slices.Sort(out)
+	return out
+}
+
+func TestAggregate(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []string
+		want []string
+	}{
+		{"halves", []string{"203.0.113.0/25", "203.0.113.128/25"}, []string{"203.0.113.0/24"}},
+		{"two /32 to /31", []string{"192.0.2.0/32", "192.0.2.1/32"}, []string{"192.0.2.0/31"}},
+		{"iterative collapse", []string{"192.0.2.0/32", "192.0.2.1/32", "192.0.2.2/31"}, []string{"192.0.2.0/30"}},
+		{"consecutive hosts", []string{"192.0.2.0/32", "192.0.2.1/32", "192.0.2.2/32", "192.0.2.3/32", "192.0.2.4/32"}, []string{"192.0.2.0/30", "192.0.2.4/32"}},
+		{"adjacent but not siblings", []string{"192.0.2.1/32", "192.0.2.2/32"}, []string{"192.0.2.1/32", "192.0.2.2/32"}},
+		{"non-adjacent", []string{"192.0.2.0/25", "198.51.100.128/25"}, []string{"192.0.2.0/25", "198.51.100.128/25"}},
+		{"overlapping left alone", []string{"192.0.2.0/24", "192.0.2.0/25"}, []string{"192.0.2.0/24", "192.0.2.0/25"}},
+		{"IPv6 halves", []string{"2001:db8::/33", "2001:db8:8000::/33"}, []string{"2001:db8::/32"}},
+		{"mixed families", []string{"192.0.2.0/32", "192.0.2.1/32", "2001:db8::/128", "2001:db8::1/128"}, []string{"192.0.2.0/31", "2001:db8::/127"}},
+		{"duplicates", []string{"192.0.2.0/32", "192.0.2.0/32", "192.0.2.1/32"}, []string{"192.0.2.0/31"}},
+		{"priority kept", []string{"192.0.2.0/32", "192.0.2.1/32!3"}, []string{"192.0.2.0/31!3"}},
+		{"lowest priority index", []string{"192.0.2.0/32!5", "192.0.2.1/32!2"}, []string{"192.0.2.0/31!2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatAddrs(Aggregate(parseAddrs(t, tt.in...))); !slices.Equal(got, tt.want) {
+				t.Errorf("Aggregate(%v) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
@@ -13,8 +13,69 @@ type NetAddr struct {
 	// OriginalPriorityIndex is used to preserve the order of user-defined priority entries
 	// before numerical sorting.
 	OriginalPriorityIndex int
+	// FromLookup is set for host addresses taken from A or AAAA answers, as opposed to
+	// networks written as ip4:/ip6: or priority CIDRs.
+	FromLookup bool
+	// Source names the SPF record and mechanism the address was flattened from, when known.
+	Source string
+}
+
+// Family returns "ipv4" or "ipv6". IPv4-mapped IPv6 networks are reported as ipv4, like
+// they are written in the generated record.
+func (n *NetAddr) Family() string {
+	if n.IPNet.IP.To4() != nil {
+		return "ipv4"
+	}
+	return "ipv6"
 }
 
 // NetAddrSlice is a slice of NetAddr that implements the sort.Interface
 // for customized numerical sorting (IPv4 before IPv6).
-type NetAddrSlice []*NetAddr
\ No newline at end of file
+type NetAddrSlice []*NetAddr
+
+// Covering returns the first address of the slice containing ip, or nil when none does.
+func (s NetAddrSlice) Covering(ip net.IP) *NetAddr {
+	for _, addr := range s {
+		if addr.IPNet.Contains(ip) {
+			return addr
+		}
+	}
+	return nil
+}
+
+// CoveringNet returns the first address of the slice whose network contains all of n,
+// or nil when none does.
+func (s NetAddrSlice) CoveringNet(n *net.IPNet) *NetAddr {
+	nOnes, nBits := n.Mask.Size()
+	for _, addr := range s {
+		ones, bits := addr.IPNet.Mask.Size()
+		if bits == nBits && ones <= nOnes && addr.IPNet.Contains(n.IP) {
+			return addr
+		}
+	}
+	return nil
+}
+
+// Coalesce widens the host addresses taken from A/AAAA answers to the given prefix lengths
+// (0 leaves a family alone). Networks written explicitly are never widened. It returns the
+// widened networks with the addresses each one absorbed.
+func (s NetAddrSlice) Coalesce(v4Prefix, v6Prefix int) map[string][]string {
+	widened := make(map[string][]string)
+	for _, addr := range s {
+		if !addr.FromLookup {
+			continue
+		}
+		prefix, bits := v6Prefix, 128
+		if addr.IPNet.IP.To4() != nil {
+			prefix, bits = v4Prefix, 32
+		}
+		if ones, _ := addr.IPNet.Mask.Size(); prefix == 0 || ones <= prefix {
+			continue
+		}
+		mask := net.CIDRMask(prefix, bits)
+		network := &net.IPNet{IP: addr.IPNet.IP.Mask(mask), Mask: mask}
+		widened[network.String()] = append(widened[network.String()], addr.IPNet.String())
+		addr.IPNet = network
+	}
+	return widened
+}
@@ -0,0 +1,87 @@
+package cidr
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"testing"
+)
+
+func TestCoalesce(t *testing.T) {
+	tests := []struct {
+		name        string
+		lookups     []string // taken from A/AAAA answers
+		explicit    []string // written as ip4:/ip6:
+		v4Prefix    int
+		v6Prefix    int
+		want        []string // after deduplication
+		wantWidened map[string][]string
+	}{
+		{
+			"AAAA hosts into their /64s",
+			[]string{"2001:db8:1::10/128", "2001:db8:1::11/128", "2001:db8:1::12/128", "2001:db8:2::a/128", "2001:db8:2::b/128"}, nil,
+			0, 64,
+			[]string{"2001:db8:1::/64", "2001:db8:2::/64"},
+			map[string][]string{
+				"2001:db8:1::/64": {"2001:db8:1::10/128", "2001:db8:1::11/128", "2001:db8:1::12/128"},
+				"2001:db8:2::/64": {"2001:db8:2::a/128", "2001:db8:2::b/128"},
+			},
+		},
+		{
+			"explicit ip6 tokens never widened",
+			[]string{"2001:db8:1::10/128"}, []string{"2001:db8:1::20/128", "2001:db8:3::/56"},
+			0, 64,
+			[]string{"2001:db8:1::/64", "2001:db8:1::20/128", "2001:db8:3::/56"},
+			map[string][]string{"2001:db8:1::/64": {"2001:db8:1::10/128"}},
+		},
+		{
+			"IPv4 hosts, IPv6 left alone",
+			[]string{"192.0.2.1/32", "192.0.2.200/32", "198.51.100.7/32", "2001:db8:1::10/128"}, nil,
+			24, 0,
+			[]string{"192.0.2.0/24", "198.51.100.0/24", "2001:db8:1::10/128"},
+			map[string][]string{"192.0.2.0/24": {"192.0.2.1/32", "192.0.2.200/32"}, "198.51.100.0/24": {"198.51.100.7/32"}},
+		},
+		{
+			"already as wide",
+			[]string{"192.0.2.0/24", "2001:db8::/48"}, nil,
+			24, 64,
+			[]string{"192.0.2.0/24", "2001:db8::/48"},
+			map[string][]string{},
+		},
+		{
+			"disabled",
+			[]string{"192.0.2.1/32", "2001:db8:1::10/128"}, nil,
+			0, 0,
+			[]string{"192.0.2.1/32", "2001:db8:1::10/128"},
+			map[string][]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := parseAddrs(t, tt.lookups...)
+			for i, addr := range s {
+				addr.FromLookup = true
+				addr.Source = fmt.Sprintf("a in host%d.example.com", i)
+			}
+			s = append(s, parseAddrs(t, tt.explicit...)...)
+			sources := make([]string, len(s))
+			for i, addr := range s {
+				sources[i] = addr.Source
+			}
+
+			widened := s.Coalesce(tt.v4Prefix, tt.v6Prefix)
+			if !maps.EqualFunc(widened, tt.wantWidened, slices.Equal) {
+				t.Errorf("Coalesce() widened = %v, want %v", widened, tt.wantWidened)
+			}
+			if got := formatAddrs(DeduplicateAndSort(s)); !slices.Equal(got, tt.want) {
+				t.Errorf("after Coalesce() = %v, want %v", got, tt.want)
+			}
+			// Widened addresses keep the provenance of the answer they came from
+			for i, addr := range s {
+				if addr.Source != sources[i] {
+					t.Errorf("Source of %s = %q, want %q", addr.IPNet, addr.Source, sources[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+// Fichier: cidr/contain.go (suppression des réseaux inclus)
+
+package cidr
+
+import (
+	"fmt"
+	"sort"
+)
+
+// RemoveCovered drops every network fully contained in a broader network of the same
+// family. A covered priority network hands its priority on to the network covering it,
+// with the lowest priority index, so that the covering network keeps its place in the
+// first segment. The result is unsorted; addrs is not modified.
+func RemoveCovered(addrs NetAddrSlice) NetAddrSlice {
+	// Broadest networks first, so that a network is only checked against kept ones
+	byPrefix := append(NetAddrSlice(nil), addrs...)
+	sort.SliceStable(byPrefix, func(i, j int) bool {
+		a, _ := byPrefix[i].IPNet.Mask.Size()
+		b, _ := byPrefix[j].IPNet.Mask.Size()
+		return a < b
+	})
+
+	idx := &Index{v4: &indexNode{}, v6: &indexNode{}}
+	var kept NetAddrSlice
+	for _, addr := range byPrefix {
+		c := idx.CoveringNet(addr.IPNet)
+		if c == nil {
+			// Copy, as the priority of a kept network may change
+			n := *addr
+			idx.Insert(&n)
+			kept = append(kept, &n)
+			continue
+		}
+		if addr.IsPriority && (!c.IsPriority || addr.OriginalPriorityIndex < c.OriginalPriorityIndex) {
+			c.IsPriority, c.OriginalPriorityIndex = true, addr.OriginalPriorityIndex
+			c.Source = fmt.Sprintf("%s (priority from %s)", c.Source, addr.IPNet)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,34 @@
+package cidr
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestRemoveCovered(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []string
+		want []string
+	}{
+		{"nested IPv4", []string{"10.1.2.3/32", "10.0.0.0/8", "10.1.0.0/16"}, []string{"10.0.0.0/8"}},
+		{"disjoint IPv4", []string{"192.0.2.0/25", "192.0.2.128/25"}, []string{"192.0.2.0/25", "192.0.2.128/25"}},
+		{"nested IPv6", []string{"2001:db8:1::/48", "2001:db8::/32", "2001:db8:1::1/128"}, []string{"2001:db8::/32"}},
+		{"families apart", []string{"0.0.0.0/0", "2001:db8::/32"}, []string{"0.0.0.0/0", "2001:db8::/32"}},
+		{"priority transferred", []string{"192.0.2.0/24", "192.0.2.10/32!4"}, []string{"192.0.2.0/24!4"}},
+		{"lowest priority index", []string{"192.0.2.0/24!6", "192.0.2.10/32!4", "192.0.2.20/32!9"}, []string{"192.0.2.0/24!4"}},
+		{"priority of the cover kept", []string{"192.0.2.0/24!1", "192.0.2.10/32!4"}, []string{"192.0.2.0/24!1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := parseAddrs(t, tt.in...)
+			before := formatAddrs(in)
+			if got := formatAddrs(RemoveCovered(in)); !slices.Equal(got, tt.want) {
+				t.Errorf("RemoveCovered(%v) = %v, want %v", tt.in, got, tt.want)
+			}
+			if after := formatAddrs(in); !slices.Equal(after, before) {
+				t.Errorf("RemoveCovered modified its input: %v, was %v", after, before)
+			}
+		})
+	}
+}
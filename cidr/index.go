@@ -0,0 +1,99 @@
+// Fichier: cidr/index.go (arbre binaire de préfixes)
+
+package cidr
+
+import "net"
+
+// Index is a binary prefix trie answering containment and overlap queries in time
+// proportional to the address length, instead of scanning a whole NetAddrSlice. It keeps
+// the slice semantics: when several inserted networks match, the one inserted first wins.
+type Index struct {
+	v4, v6 *indexNode
+	n      int
+}
+
+type indexNode struct {
+	child [2]*indexNode
+	// addr is the first network inserted at this exact prefix, order its insertion rank.
+	addr  *NetAddr
+	order int
+}
+
+// NewIndex returns an index of the given networks, in slice order.
+func NewIndex(s NetAddrSlice) *Index {
+	idx := &Index{v4: &indexNode{}, v6: &indexNode{}}
+	for _, addr := range s {
+		idx.Insert(addr)
+	}
+	return idx
+}
+
+// key returns the root of n's family and its address bytes and prefix length. IPv4 and
+// IPv6 networks are kept apart, as CoveringNet does.
+func (idx *Index) key(n *net.IPNet) (*indexNode, []byte, int) {
+	ones, bits := n.Mask.Size()
+	if bits == 32 {
+		return idx.v4, n.IP.To4(), ones
+	}
+	return idx.v6, n.IP.To16(), ones
+}
+
+func bit(ip []byte, i int) int {
+	return int(ip[i/8]>>(7-i%8)) & 1
+}
+
+// Insert adds a network to the index.
+func (idx *Index) Insert(addr *NetAddr) {
+	node, ip, ones := idx.key(addr.IPNet)
+	for i := 0; i < ones; i++ {
+		b := bit(ip, i)
+		if node.child[b] == nil {
+			node.child[b] = &indexNode{}
+		}
+		node = node.child[b]
+	}
+	if node.addr == nil {
+		node.addr, node.order = addr, idx.n
+	}
+	idx.n++
+}
+
+// CoveringNet returns the first inserted network that contains all of n, or nil when none
+// does. It gives the same answer as NetAddrSlice.CoveringNet on the inserted slice.
+func (idx *Index) CoveringNet(n *net.IPNet) *NetAddr {
+	node, ip, ones := idx.key(n)
+	var found *indexNode
+	for i := 0; node != nil; i++ {
+		if node.addr != nil && (found == nil || node.order < found.order) {
+			found = node
+		}
+		if i == ones {
+			break
+		}
+		node = node.child[bit(ip, i)]
+	}
+	if found == nil {
+		return nil
+	}
+	return found.addr
+}
+
+// Covers reports whether an inserted network contains all of n.
+func (idx *Index) Covers(n *net.IPNet) bool {
+	return idx.CoveringNet(n) != nil
+}
+
+// Overlaps reports whether an inserted network shares at least one address with n: it
+// either contains n or lies within it.
+func (idx *Index) Overlaps(n *net.IPNet) bool {
+	node, ip, ones := idx.key(n)
+	for i := 0; i < ones; i++ {
+		if node.addr != nil {
+			return true
+		}
+		if node = node.child[bit(ip, i)]; node == nil {
+			return false
+		}
+	}
+	return node.addr != nil || node.child[0] != nil || node.child[1] != nil
+}
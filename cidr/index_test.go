@@ -0,0 +1,87 @@
+package cidr
+
+import (
+	"math/rand/v2"
+	"net"
+	"testing"
+)
+
+// randomNet returns a random network within a narrow range of either family, so that
+// random sets share enough prefixes to exercise containment.
+func randomNet(rng *rand.Rand) *net.IPNet {
+	if rng.IntN(4) == 0 {
+		ip := net.ParseIP("2001:db8::").To16()
+		ip[4], ip[5] = byte(rng.IntN(4)), byte(rng.IntN(256))
+		ones := 32 + rng.IntN(97)
+		return &net.IPNet{IP: ip.Mask(net.CIDRMask(ones, 128)), Mask: net.CIDRMask(ones, 128)}
+	}
+	ip := net.IPv4(10, byte(rng.IntN(4)), byte(rng.IntN(256)), byte(rng.IntN(256))).To4()
+	ones := 8 + rng.IntN(25)
+	return &net.IPNet{IP: ip.Mask(net.CIDRMask(ones, 32)), Mask: net.CIDRMask(ones, 32)}
+}
+
+func randomSlice(rng *rand.Rand, n int) NetAddrSlice {
+	s := make(NetAddrSlice, n)
+	for i := range s {
+		s[i] = &NetAddr{IPNet: randomNet(rng)}
+	}
+	return s
+}
+
+// overlaps is the naive overlap check the index replaces.
+func overlaps(s NetAddrSlice, n *net.IPNet) bool {
+	_, nBits := n.Mask.Size()
+	for _, addr := range s {
+		if _, bits := addr.IPNet.Mask.Size(); bits == nBits && (addr.IPNet.Contains(n.IP) || n.Contains(addr.IPNet.IP)) {
+			return true
+		}
+	}
+	return false
+}
+
+// TestIndexMatchesSlice checks the index against the slice scans on randomized sets.
+func TestIndexMatchesSlice(t *testing.T) {
+	tests := []struct {
+		name    string
+		seed    uint64
+		size    int
+		queries int
+	}{
+		{"empty", 1, 0, 100},
+		{"small", 2, 10, 1000},
+		{"medium", 3, 200, 2000},
+		{"large", 4, 2000, 2000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rng := rand.New(rand.NewPCG(tt.seed, 0))
+			s := randomSlice(rng, tt.size)
+			idx := NewIndex(s)
+			for range tt.queries {
+				n := randomNet(rng)
+				if got, want := idx.CoveringNet(n), s.CoveringNet(n); got != want {
+					t.Fatalf("CoveringNet(%s) = %v, want %v", n, got, want)
+				}
+				if got, want := idx.Covers(n), s.CoveringNet(n) != nil; got != want {
+					t.Fatalf("Covers(%s) = %v, want %v", n, got, want)
+				}
+				if got, want := idx.Overlaps(n), overlaps(s, n); got != want {
+					t.Fatalf("Overlaps(%s) = %v, want %v", n, got, want)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkIndex builds an index of 10k networks and queries it with 10k others.
+func BenchmarkIndex(b *testing.B) {
+	rng := rand.New(rand.NewPCG(5, 0))
+	s, queries := randomSlice(rng, 10000), randomSlice(rng, 10000)
+	for b.Loop() {
+		idx := NewIndex(s)
+		for _, q := range queries {
+			idx.CoveringNet(q.IPNet)
+			idx.Overlaps(q.IPNet)
+		}
+	}
+}
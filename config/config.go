@@ -2,45 +2,579 @@ package config
 
 import (
 	"fmt"
-	"os"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"project/spf-flattener/dns"
+	"project/spf-flattener/domainutil"
+	"project/spf-flattener/formatter"
+	"project/spf-flattener/providers"
 
 	"gopkg.in/yaml.v3"
 )
 
+// dateLayout is the format of every date found in the configuration.
+const dateLayout = "2006-01-02"
+
 // Config holds the application configuration loaded from a YAML file.
 type Config struct {
-	// ConcurrencyLimit for parallel DNS lookups.
+	// ConcurrencyLimit for parallel DNS lookups; shorthand setting every Concurrency pool.
 	ConcurrencyLimit int `yaml:"concurrencyLimit"`
+	// Concurrency sizes each worker pool separately.
+	Concurrency Concurrency `yaml:"concurrency"`
 	// MaxLookups is an optional limit for DNS lookups, typically 10 for SPF.
 	MaxLookups int `yaml:"maxLookups"`
 	// PriorityEntries contains a list of domains or CIDRs that should be prioritized.
-	PriorityEntries []string `yaml:"priorityEntries"`
+	PriorityEntries []PriorityEntry `yaml:"priorityEntries"`
 	// TargetDomain is the domain that we are targeting for the lookups.
 	TargetDomain string `yaml:"targetDomain"`
+	// Zone pins the DNS zone the generated records belong to (defaults to TargetDomain).
+	// TargetDomain and every generated include must fall within it, catching typos.
+	Zone string `yaml:"zone"`
+	// PublishedRecords lists the entry points the generated records are compared with
+	// (defaults to _spf.<targetDomain>), e.g. both the apex and _spf during a migration.
+	PublishedRecords []string `yaml:"publishedRecords"`
+	// PublishZone declares the zone the generated records are published into when
+	// _spf.<targetDomain> is delegated to a separate subzone via NS records.
+	PublishZone string `yaml:"publishZone"`
+	// Metadata documents who owns the configuration and when it must be reviewed.
+	Metadata Metadata `yaml:"metadata"`
+	// ExpiryWarningDays is the window, in days, in which upcoming expirations are reported.
+	ExpiryWarningDays int `yaml:"expiryWarningDays"`
+	// Strict turns findings such as expired priority entries into errors.
+	Strict bool `yaml:"strict"`
+	// Preflight lists sending IPs that must be authorized by the generated record.
+	Preflight []string `yaml:"preflight"`
+	// KeepMechanisms lists domain suffixes whose a: and mx: mechanisms are kept verbatim
+	// in the output instead of being resolved (e.g. hosts that renumber frequently).
+	KeepMechanisms []string `yaml:"keepMechanisms"`
+	// FlattenOnlySuffixes lists our own domain suffixes: only the includes under them are
+	// flattened, every other include is kept verbatim and reported as an external
+	// dependency. Empty (default) flattens everything.
+	FlattenOnlySuffixes []string `yaml:"flattenOnlySuffixes"`
+	// Nameserver is the recursive resolver queried, as host:port (the port defaults to
+	// 53), optionally prefixed by udp://, tcp:// or tls:// (port 853) for DNS over TLS.
+	// When empty, the nameservers of /etc/resolv.conf are used.
+	Nameserver string `yaml:"nameserver"`
+	// Nameservers lists several recursive resolvers, tried in order when one times out or
+	// answers SERVFAIL. Nameserver, when set, is tried first.
+	Nameservers []string `yaml:"nameservers"`
+	// ResolutionMode selects how SPF TXT records are fetched: "recursive" (default)
+	// or "authoritative" to query each zone's authoritative servers directly.
+	ResolutionMode string `yaml:"resolutionMode"`
+	// ResolverBackend selects how DNS queries are sent: "dns" (default) queries the
+	// nameservers directly, "system" goes through the platform's stub resolver, for
+	// environments that forbid raw port 53 traffic (see dns.SystemExchanger).
+	ResolverBackend string `yaml:"resolverBackend"`
+	// OnParseError selects what happens when an included record does not parse:
+	// "fail" (default), "skip" the include, or "keep" it verbatim in the output.
+	OnParseError string `yaml:"onParseError"`
+	// OnExists selects what happens with exists: mechanisms, which cannot be flattened:
+	// "error" aborts, "warn" (default) drops them with a warning, "passthrough" keeps
+	// them verbatim in the output.
+	OnExists string `yaml:"onExists"`
+	// MergeMultipleSPF merges the records of a name publishing several SPF records instead
+	// of failing like verifiers, which return permerror.
+	MergeMultipleSPF bool `yaml:"mergeMultipleSPF"`
+	// DropReservedRanges drops private, link-local and multicast addresses resolved from
+	// A/AAAA records instead of only warning about them.
+	DropReservedRanges bool `yaml:"dropReservedRanges"`
+	// OnMacro selects what happens with mechanisms using SPF macros (%{i}, %{d}...), which
+	// depend on the connecting client: "error" (default) aborts, "passthrough" keeps them
+	// verbatim in the output.
+	OnMacro string `yaml:"onMacro"`
+	// MaxRuntime aborts the run when it takes longer than this duration (0 means no limit).
+	MaxRuntime time.Duration `yaml:"maxRuntime"`
+	// Providers extends or overrides the built-in list of well-known include domains.
+	Providers []providers.Provider `yaml:"providers"`
+	// CoalesceIPv4To and CoalesceIPv6To widen host addresses resolved from A/AAAA records
+	// to these prefix lengths (e.g. 64) to save record space; 0 disables. Explicit
+	// ip4:/ip6: networks are never widened.
+	CoalesceIPv4To int `yaml:"coalesceIPv4To"`
+	CoalesceIPv6To int `yaml:"coalesceIPv6To"`
+	// AggregateCIDRs merges networks that are the two halves of a parent network into the
+	// parent before formatting, to save record space.
+	AggregateCIDRs bool `yaml:"aggregateCIDRs"`
+	// KeepCoveredCIDRs keeps networks contained in a broader network of the set, which are
+	// removed by default.
+	KeepCoveredCIDRs bool `yaml:"keepCoveredCIDRs"`
+	// Pins lists includes whose resolved networks must stay within an approved set.
+	Pins []Pin `yaml:"pins"`
+	// MechanismQualifier is set on every generated ip4/ip6 mechanism: "+" (the default,
+	// written without qualifier), or "?" and "~" to stage a cautious rollout. Passthrough
+	// mechanisms keep their own qualifiers.
+	MechanismQualifier string `yaml:"mechanismQualifier"`
+	// OutputFormat selects what is written to standard output: "text" (default), the
+	// zone lines, "zone", a zone file snippet with fully qualified names, "json", a
+	// single document (see pipeline.Report), or "terraform", HCL for TerraformProvider.
+	OutputFormat string `yaml:"outputFormat"`
+	// TerraformProvider selects the HCL of the terraform output: "generic" (default), a
+	// for_each-able map, or "route53" / "cloudflare" resources.
+	TerraformProvider string `yaml:"terraformProvider"`
+	// MaxTXTLength limits the length of every generated record value, for DNS providers
+	// whose interfaces accept less than the 255-byte string limit.
+	MaxTXTLength int `yaml:"maxTXTLength"`
+	// MaxMechanismsPerRecord limits the number of mechanisms of every generated record,
+	// for receivers that struggle with long records; 0 (default) means no limit.
+	MaxMechanismsPerRecord int `yaml:"maxMechanismsPerRecord"`
+	// OwnerRecord describes the _spf-owner discovery record marking the records as machine-managed.
+	OwnerRecord OwnerRecord `yaml:"ownerRecord"`
+	// Publish selects the DNS provider the -publish flag pushes the records to.
+	Publish Publish `yaml:"publish"`
+	// ReceiverRTT is the round-trip time assumed for each DNS query of a receiver when
+	// estimating the worst-case latency of evaluating the published record (default 80ms).
+	ReceiverRTT time.Duration `yaml:"receiverRTT"`
+}
+
+// Publish configures the provider API the generated records are pushed to.
+type Publish struct {
+	// Provider is "route53" or "cloudflare"; empty disables publishing.
+	Provider string `yaml:"provider"`
+	// ZoneID is the provider's identifier of the zone holding the records.
+	ZoneID string `yaml:"zoneId"`
+	// APIToken is the Cloudflare API token. Leave it empty to take it from the
+	// CLOUDFLARE_API_TOKEN environment variable rather than storing it in the file.
+	APIToken string `yaml:"apiToken"`
+}
+
+// redactedSecret replaces the secret values of a configuration that is written out.
+const redactedSecret = "<redacted>"
+
+// Redacted returns a copy of c with its secrets, the publish API token, masked, for
+// writing the configuration out of the process (capture bundles, logs).
+func (c *Config) Redacted() *Config {
+	r := *c
+	if r.Publish.APIToken != "" {
+		r.Publish.APIToken = redactedSecret
+	}
+	return &r
+}
+
+// Concurrency holds the size of each worker pool. Zero values take ConcurrencyLimit.
+type Concurrency struct {
+	// DNSQueries bounds the DNS queries in flight (A/AAAA fan-out of MX hosts included).
+	DNSQueries int `yaml:"dnsQueries"`
+	// IncludeBranches bounds the include records fetched at once.
+	IncludeBranches int `yaml:"includeBranches"`
+	// PublishOps bounds the provider API calls in flight while publishing.
+	PublishOps int `yaml:"publishOps"`
+}
+
+// Pin ties an include of the chain to a file of approved CIDRs, one per line ('#' starts
+// a comment). A run fails when the include resolves to a network outside the approved
+// ones, or when an approved CIDR is no longer resolved at all.
+type Pin struct {
+	Include string `yaml:"include"`
+	File    string `yaml:"file"`
+}
+
+// OwnerRecord holds the fields of the _spf-owner.<targetDomain> discovery record.
+type OwnerRecord struct {
+	Enabled bool   `yaml:"enabled"`
+	Config  string `yaml:"config"`
+	Contact string `yaml:"contact"`
+}
+
+// Value returns the TXT content of the discovery record.
+func (o OwnerRecord) Value() string {
+	parts := []string{"managed-by=spf-flattener"}
+	if o.Config != "" {
+		parts = append(parts, "config="+o.Config)
+	}
+	if o.Contact != "" {
+		parts = append(parts, "contact="+o.Contact)
+	}
+	return strings.Join(parts, "; ")
+}
+
+// Metadata holds free-form ownership information about the configuration.
+type Metadata struct {
+	Owner      string `yaml:"owner"`
+	Ticket     string `yaml:"ticket"`
+	ReviewDate string `yaml:"reviewDate"`
+
+	reviewAt time.Time
+}
+
+// ReviewAt returns the parsed review date, or the zero time when none is set.
+func (m Metadata) ReviewAt() time.Time { return m.reviewAt }
+
+// PriorityEntry is a domain or CIDR to prioritize. In YAML it is either a plain string
+// or a mapping carrying the entry with its annotations.
+type PriorityEntry struct {
+	Entry   string `yaml:"entry"`
+	Expires string `yaml:"expires,omitempty"`
+	Ticket  string `yaml:"ticket,omitempty"`
+	Comment string `yaml:"comment,omitempty"`
+	// RequireBothFamilies fails the entry when either its A or its AAAA lookup fails,
+	// instead of keeping the family that resolved.
+	RequireBothFamilies bool `yaml:"requireBothFamilies,omitempty"`
+	// ExpectFamilies lists the address families (ipv4, ipv6) a hostname entry should
+	// resolve to; a missing family is reported.
+	ExpectFamilies []string `yaml:"expectFamilies,omitempty"`
+	// AcknowledgeCovered silences the finding reported when the entry is already fully
+	// covered by the flattened chain.
+	AcknowledgeCovered bool `yaml:"acknowledgeCovered,omitempty"`
+
+	expiresAt time.Time
+}
+
+// UnmarshalYAML accepts both the plain string and the annotated mapping forms.
+func (p *PriorityEntry) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		return node.Decode(&p.Entry)
+	}
+	type plain PriorityEntry
+	return node.Decode((*plain)(p))
+}
+
+// MarshalYAML writes entries without annotations in the plain string form.
+func (p PriorityEntry) MarshalYAML() (any, error) {
+	annotated := p.Expires != "" || p.Ticket != "" || p.Comment != "" ||
+		p.RequireBothFamilies || len(p.ExpectFamilies) > 0 || p.AcknowledgeCovered
+	if !annotated {
+		return p.Entry, nil
+	}
+	type plain PriorityEntry
+	return plain(p), nil
 }
 
-// LoadConfig reads and unmarshals the configuration from the specified YAML file path.
+// ExpiresAt returns the parsed expiry date, or the zero time when the entry never expires.
+func (p PriorityEntry) ExpiresAt() time.Time { return p.expiresAt }
+
+// LoadConfig reads and unmarshals the configuration from the specified YAML file path,
+// layered on top of the configurations named by its extends directive.
 func LoadConfig(filePath string) (*Config, error) {
-	data, err := os.ReadFile(filePath)
+	node, err := loadLayers(filePath, nil)
 	if err != nil {
-		// Log the error if the file cannot be read (e.g., does not exist or permission denied)
-		return nil, fmt.Errorf("failed to read config file %s: %w", filePath, err)
+		return nil, err
 	}
 
 	var cfg Config
-	err = yaml.Unmarshal(data, &cfg)
-	if err != nil {
+	if err := node.Decode(&cfg); err != nil {
 		// Log the error if the YAML content is invalid
 		return nil, fmt.Errorf("failed to unmarshal config file %s: %w", filePath, err)
 	}
 
-	// Apply sensible defaults if values are missing or invalid
-	if cfg.MaxLookups == 0 {
-		cfg.MaxLookups = 10 // Default SPF lookup limit
+	if err := cfg.finalize(); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", filePath, err)
 	}
-	if cfg.ConcurrencyLimit == 0 {
-		cfg.ConcurrencyLimit = 4 // Default concurrency limit
+
+	return &cfg, nil
+}
+
+// Option configures a Config built programmatically with New.
+type Option func(*Config)
+
+// WithTargetDomain sets the domain that we are targeting for the lookups.
+func WithTargetDomain(domain string) Option {
+	return func(c *Config) { c.TargetDomain = domain }
+}
+
+// WithPriorityEntries sets the domains or CIDRs that should be prioritized.
+func WithPriorityEntries(entries ...string) Option {
+	return func(c *Config) {
+		c.PriorityEntries = nil
+		for _, e := range entries {
+			c.PriorityEntries = append(c.PriorityEntries, PriorityEntry{Entry: e})
+		}
+	}
+}
+
+// WithMaxLookups sets the DNS lookup limit.
+func WithMaxLookups(n int) Option {
+	return func(c *Config) { c.MaxLookups = n }
+}
+
+// WithConcurrencyLimit sets the number of parallel DNS lookups.
+func WithConcurrencyLimit(n int) Option {
+	return func(c *Config) { c.ConcurrencyLimit = n }
+}
+
+// WithStrict turns findings into errors.
+func WithStrict(strict bool) Option {
+	return func(c *Config) { c.Strict = strict }
+}
+
+// WithPreflight sets the sending IPs that must be authorized by the generated record.
+func WithPreflight(ips ...string) Option {
+	return func(c *Config) { c.Preflight = ips }
+}
+
+// WithResolverBackend selects the dns or system resolver backend.
+func WithResolverBackend(backend string) Option {
+	return func(c *Config) { c.ResolverBackend = backend }
+}
+
+// WithResolutionMode selects recursive or authoritative SPF TXT lookups.
+func WithResolutionMode(mode string) Option {
+	return func(c *Config) { c.ResolutionMode = mode }
+}
+
+// WithMaxRuntime sets the runtime budget of a run.
+func WithMaxRuntime(d time.Duration) Option {
+	return func(c *Config) { c.MaxRuntime = d }
+}
+
+// Upstreams returns the recursive resolvers to query in order: Nameserver, then
+// Nameservers. An empty list selects the system configuration.
+func (c *Config) Upstreams() []string {
+	var servers []string
+	if c.Nameserver != "" {
+		servers = append(servers, c.Nameserver)
 	}
+	return append(servers, c.Nameservers...)
+}
+
+// WithNameserver sets the recursive resolver queried (see Nameserver).
+func WithNameserver(addr string) Option {
+	return func(c *Config) { c.Nameserver = addr }
+}
 
+// OutputFormats are the accepted values of OutputFormat.
+var OutputFormats = []string{"text", "zone", "json", "terraform"}
+
+// WithMaxTXTLength sets the length limit of generated record values.
+func WithMaxTXTLength(n int) Option {
+	return func(c *Config) { c.MaxTXTLength = n }
+}
+
+// WithPublishZone sets the zone the generated records are published into.
+func WithPublishZone(zone string) Option {
+	return func(c *Config) { c.PublishZone = zone }
+}
+
+// New builds a validated configuration without a YAML file. The result is equivalent
+// to what LoadConfig returns for a file holding the same values.
+func New(opts ...Option) (*Config, error) {
+	var cfg Config
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if err := cfg.finalize(); err != nil {
+		return nil, err
+	}
 	return &cfg, nil
 }
+
+// ValidationError lists every problem found while validating a configuration.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid configuration: " + strings.Join(e.Problems, "; ")
+}
+
+// finalize applies defaults and validates the configuration. Both LoadConfig and New
+// go through it so file-based and programmatic configurations cannot diverge.
+func (c *Config) finalize() error {
+	// Apply sensible defaults if values are missing
+	if c.MaxLookups == 0 {
+		c.MaxLookups = 10 // Default SPF lookup limit
+	}
+	if c.ConcurrencyLimit == 0 {
+		c.ConcurrencyLimit = 4 // Default concurrency limit
+	}
+	if c.Concurrency.DNSQueries == 0 {
+		c.Concurrency.DNSQueries = c.ConcurrencyLimit
+	}
+	if c.Concurrency.IncludeBranches == 0 {
+		c.Concurrency.IncludeBranches = c.ConcurrencyLimit
+	}
+	if c.Concurrency.PublishOps == 0 {
+		c.Concurrency.PublishOps = c.ConcurrencyLimit
+	}
+	if c.ResolutionMode == "" {
+		c.ResolutionMode = "recursive"
+	}
+	if c.ResolverBackend == "" {
+		c.ResolverBackend = "dns"
+	}
+
+	if c.OnParseError == "" {
+		c.OnParseError = "fail"
+	}
+	if c.OnExists == "" {
+		c.OnExists = "warn"
+	}
+	if c.OnMacro == "" {
+		c.OnMacro = "error"
+	}
+	if c.OutputFormat == "" {
+		c.OutputFormat = "text"
+	}
+	if c.TerraformProvider == "" {
+		c.TerraformProvider = "generic"
+	}
+	if c.MaxTXTLength == 0 {
+		c.MaxTXTLength = formatter.DefaultMaxRecordLength
+	}
+	if c.ReceiverRTT == 0 {
+		c.ReceiverRTT = 80 * time.Millisecond
+	}
+	if c.ExpiryWarningDays == 0 {
+		c.ExpiryWarningDays = 30
+	}
+
+	var problems []string
+	if c.TargetDomain == "" {
+		problems = append(problems, "targetDomain is not defined")
+	} else if _, err := domainutil.RegistrableDomain(c.TargetDomain); err != nil {
+		problems = append(problems, fmt.Sprintf("targetDomain %q is not a registrable domain: %v", c.TargetDomain, err))
+	}
+	if zone := strings.ToLower(strings.TrimSuffix(c.Zone, ".")); zone != "" && c.TargetDomain != "" {
+		target := strings.ToLower(strings.TrimSuffix(c.TargetDomain, "."))
+		if target != zone && !strings.HasSuffix(target, "."+zone) {
+			problems = append(problems, fmt.Sprintf("targetDomain %q is outside the pinned zone %q", c.TargetDomain, c.Zone))
+		}
+		if _, err := domainutil.RegistrableDomain(zone); err != nil {
+			problems = append(problems, fmt.Sprintf("zone %q is not a registrable domain: %v", c.Zone, err))
+		}
+	}
+	if c.MaxLookups < 0 {
+		problems = append(problems, fmt.Sprintf("maxLookups must be positive (got %d)", c.MaxLookups))
+	}
+	if c.ConcurrencyLimit < 0 {
+		problems = append(problems, fmt.Sprintf("concurrencyLimit must be positive (got %d)", c.ConcurrencyLimit))
+	}
+	if c.Concurrency.DNSQueries < 0 || c.Concurrency.IncludeBranches < 0 || c.Concurrency.PublishOps < 0 {
+		problems = append(problems, fmt.Sprintf("concurrency pools must be positive (got dnsQueries %d, includeBranches %d, publishOps %d)",
+			c.Concurrency.DNSQueries, c.Concurrency.IncludeBranches, c.Concurrency.PublishOps))
+	}
+	for i := range c.PriorityEntries {
+		entry := &c.PriorityEntries[i]
+		if strings.TrimSpace(entry.Entry) == "" {
+			problems = append(problems, fmt.Sprintf("priorityEntries[%d] is empty", i))
+		}
+		if ip, _, err := net.ParseCIDR(entry.Entry); err == nil && ip.To4() != nil && strings.Contains(entry.Entry, ":") {
+			problems = append(problems, fmt.Sprintf("priorityEntries[%d] %q is an IPv4-mapped IPv6 network; write it as an IPv4 or a plain IPv6 CIDR", i, entry.Entry))
+		}
+		for _, family := range entry.ExpectFamilies {
+			if family != "ipv4" && family != "ipv6" {
+				problems = append(problems, fmt.Sprintf("priorityEntries[%d].expectFamilies: %q is not ipv4 or ipv6", i, family))
+			}
+		}
+		if entry.Expires != "" {
+			t, err := time.Parse(dateLayout, entry.Expires)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("priorityEntries[%d].expires %q is not a YYYY-MM-DD date", i, entry.Expires))
+			}
+			entry.expiresAt = t
+		}
+	}
+	if c.ResolutionMode != "recursive" && c.ResolutionMode != "authoritative" {
+		problems = append(problems, fmt.Sprintf("resolutionMode must be recursive or authoritative (got %q)", c.ResolutionMode))
+	}
+	switch c.Publish.Provider {
+	case "":
+	case "route53", "cloudflare":
+		if c.Publish.ZoneID == "" {
+			problems = append(problems, fmt.Sprintf("publish.zoneId is required by the %s provider", c.Publish.Provider))
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("publish.provider must be route53 or cloudflare (got %q)", c.Publish.Provider))
+	}
+	switch c.ResolverBackend {
+	case "dns":
+	case "system":
+		if c.ResolutionMode == "authoritative" {
+			problems = append(problems, "resolutionMode: authoritative needs resolverBackend: dns, the system resolver cannot query chosen servers")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("resolverBackend must be dns or system (got %q)", c.ResolverBackend))
+	}
+	switch c.OnParseError {
+	case "fail", "skip", "keep":
+	default:
+		problems = append(problems, fmt.Sprintf("onParseError must be fail, skip or keep (got %q)", c.OnParseError))
+	}
+	switch c.OnExists {
+	case "error", "warn", "passthrough":
+	default:
+		problems = append(problems, fmt.Sprintf("onExists must be error, warn or passthrough (got %q)", c.OnExists))
+	}
+	switch c.MechanismQualifier {
+	case "", "+", "?", "~":
+	default:
+		problems = append(problems, fmt.Sprintf("mechanismQualifier must be +, ? or ~ (got %q)", c.MechanismQualifier))
+	}
+	if !slices.Contains(OutputFormats, c.OutputFormat) {
+		problems = append(problems, fmt.Sprintf("outputFormat must be one of %s (got %q)", strings.Join(OutputFormats, ", "), c.OutputFormat))
+	}
+	if !slices.Contains(formatter.TerraformProviders, c.TerraformProvider) {
+		problems = append(problems, fmt.Sprintf("terraformProvider must be one of %s (got %q)", strings.Join(formatter.TerraformProviders, ", "), c.TerraformProvider))
+	}
+	switch c.OnMacro {
+	case "error", "passthrough":
+	default:
+		problems = append(problems, fmt.Sprintf("onMacro must be error or passthrough (got %q)", c.OnMacro))
+	}
+	if c.CoalesceIPv4To < 0 || c.CoalesceIPv4To > 32 {
+		problems = append(problems, fmt.Sprintf("coalesceIPv4To must be a prefix length between 0 and 32 (got %d)", c.CoalesceIPv4To))
+	}
+	if c.CoalesceIPv6To < 0 || c.CoalesceIPv6To > 128 {
+		problems = append(problems, fmt.Sprintf("coalesceIPv6To must be a prefix length between 0 and 128 (got %d)", c.CoalesceIPv6To))
+	}
+	if c.MaxTXTLength < 0 {
+		problems = append(problems, fmt.Sprintf("maxTXTLength must be positive (got %d)", c.MaxTXTLength))
+	}
+	if c.MaxMechanismsPerRecord < 0 {
+		problems = append(problems, fmt.Sprintf("maxMechanismsPerRecord must be positive (got %d)", c.MaxMechanismsPerRecord))
+	}
+	if c.MaxRuntime < 0 {
+		problems = append(problems, fmt.Sprintf("maxRuntime must be positive (got %s)", c.MaxRuntime))
+	}
+	if c.ReceiverRTT < 0 {
+		problems = append(problems, fmt.Sprintf("receiverRTT must be positive (got %s)", c.ReceiverRTT))
+	}
+	if c.Nameserver != "" {
+		if u, err := dns.ParseUpstream(c.Nameserver); err != nil {
+			problems = append(problems, fmt.Sprintf("nameserver %q: %v", c.Nameserver, err))
+		} else {
+			c.Nameserver = u.String()
+		}
+	}
+	for i, ns := range c.Nameservers {
+		if u, err := dns.ParseUpstream(ns); err != nil {
+			problems = append(problems, fmt.Sprintf("nameservers[%d] %q: %v", i, ns, err))
+		} else {
+			c.Nameservers[i] = u.String()
+		}
+	}
+	for i, pin := range c.Pins {
+		if pin.Include == "" || pin.File == "" {
+			problems = append(problems, fmt.Sprintf("pins[%d] needs both include and file", i))
+		}
+	}
+	for i, ip := range c.Preflight {
+		if net.ParseIP(ip) == nil {
+			problems = append(problems, fmt.Sprintf("preflight[%d] %q is not an IP address", i, ip))
+		}
+	}
+	if c.OwnerRecord.Enabled {
+		fields := []struct{ name, value string }{{"config", c.OwnerRecord.Config}, {"contact", c.OwnerRecord.Contact}}
+		for _, f := range fields {
+			if strings.ContainsAny(f.value, "\";\\") || strings.IndexFunc(f.value, func(r rune) bool { return r < 0x20 || r > 0x7e }) >= 0 {
+				problems = append(problems, fmt.Sprintf("ownerRecord.%s %q contains characters that need escaping", f.name, f.value))
+			}
+		}
+		if n := len(c.OwnerRecord.Value()); n > c.MaxTXTLength {
+			problems = append(problems, fmt.Sprintf("ownerRecord is %d bytes long, over the %d-byte maxTXTLength", n, c.MaxTXTLength))
+		}
+	}
+	if c.Metadata.ReviewDate != "" {
+		t, err := time.Parse(dateLayout, c.Metadata.ReviewDate)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("metadata.reviewDate %q is not a YYYY-MM-DD date", c.Metadata.ReviewDate))
+		}
+		c.Metadata.reviewAt = t
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewMatchesLoadConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		opts []Option
+	}{
+		{"defaults", "targetDomain: example.com\n", []Option{WithTargetDomain("example.com")}},
+		{
+			"every option",
+			`targetDomain: example.com
+nameserver: 192.0.2.53
+priorityEntries:
+  - 192.0.2.0/24
+  - mail.example.com
+maxLookups: 8
+concurrencyLimit: 2
+strict: true
+preflight: [192.0.2.25]
+resolutionMode: authoritative
+maxRuntime: 2m
+maxTXTLength: 200
+publishZone: _spf.example.com
+`,
+			[]Option{
+				WithTargetDomain("example.com"), WithNameserver("192.0.2.53"),
+				WithPriorityEntries("192.0.2.0/24", "mail.example.com"), WithMaxLookups(8),
+				WithConcurrencyLimit(2), WithStrict(true), WithPreflight("192.0.2.25"),
+				WithResolutionMode("authoritative"), WithMaxRuntime(2 * time.Minute),
+				WithMaxTXTLength(200), WithPublishZone("_spf.example.com"),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte(tt.yaml), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			loaded, err := LoadConfig(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			built, err := New(tt.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(loaded, built) {
+				t.Errorf("New() = %+v\nLoadConfig() = %+v", built, loaded)
+			}
+		})
+	}
+}
+
+func TestNewListsEveryProblem(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		want int
+	}{
+		{"valid", []Option{WithTargetDomain("example.com")}, 0},
+		{"one problem", []Option{WithTargetDomain("example.com"), WithResolverBackend("bogus")}, 1},
+		{
+			"several problems",
+			[]Option{WithTargetDomain("example.com"), WithResolverBackend("bogus"), WithResolutionMode("bogus"), WithMaxRuntime(-time.Second)},
+			3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(tt.opts...)
+			if tt.want == 0 {
+				if err != nil {
+					t.Fatalf("New() error = %v", err)
+				}
+				return
+			}
+			var verr *ValidationError
+			if !errors.As(err, &verr) {
+				t.Fatalf("New() error = %v, want *ValidationError", err)
+			}
+			if len(verr.Problems) != tt.want {
+				t.Errorf("New() problems = %q, want %d", verr.Problems, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigNameservers(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		want    []string
+		wantErr []string
+	}{
+		{"normalized", "nameservers: [192.0.2.53, '2001:db8::53', 'tls://9.9.9.9']\n",
+			[]string{"192.0.2.53:53", "[2001:db8::53]:53", "tls://9.9.9.9:853"}, nil},
+		{"malformed entries", "nameservers: [192.0.2.53, 'tls://9.9.9.9:8530000', 'https://dns.example']\n",
+			nil, []string{`nameservers[1] "tls://9.9.9.9:8530000"`, `nameservers[2] "https://dns.example"`}},
+		{"malformed nameserver", "nameserver: '[2001:db8::zz]'\n",
+			nil, []string{`nameserver "[2001:db8::zz]"`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte("targetDomain: example.com\n"+tt.yaml), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := LoadConfig(path)
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatalf("LoadConfig() error = %v", err)
+				}
+				if !reflect.DeepEqual(cfg.Nameservers, tt.want) {
+					t.Errorf("Nameservers = %q, want %q", cfg.Nameservers, tt.want)
+				}
+				return
+			}
+			var verr *ValidationError
+			if !errors.As(err, &verr) || len(verr.Problems) != len(tt.wantErr) {
+				t.Fatalf("LoadConfig() error = %v, want %d problems", err, len(tt.wantErr))
+			}
+			for i, want := range tt.wantErr {
+				if !strings.HasPrefix(verr.Problems[i], want) {
+					t.Errorf("problem %q, want it to start with %q", verr.Problems[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadConfigConcurrency(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want Concurrency
+	}{
+		{"default", "", Concurrency{DNSQueries: 4, IncludeBranches: 4, PublishOps: 4}},
+		{"shorthand sets every pool", "concurrencyLimit: 8\n", Concurrency{DNSQueries: 8, IncludeBranches: 8, PublishOps: 8}},
+		{
+			"pools set separately",
+			"concurrency:\n  dnsQueries: 16\n  includeBranches: 4\n  publishOps: 2\n",
+			Concurrency{DNSQueries: 16, IncludeBranches: 4, PublishOps: 2},
+		},
+		{
+			"unset pools take the shorthand",
+			"concurrencyLimit: 6\nconcurrency:\n  publishOps: 2\n",
+			Concurrency{DNSQueries: 6, IncludeBranches: 6, PublishOps: 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte("targetDomain: example.com\n"+tt.yaml), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := LoadConfig(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Concurrency != tt.want {
+				t.Errorf("concurrency = %+v, want %+v", cfg.Concurrency, tt.want)
+			}
+		})
+	}
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("targetDomain: example.com\nconcurrency:\n  publishOps: -1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(path); err == nil || !strings.Contains(err.Error(), "publishOps -1") {
+		t.Errorf("LoadConfig() error = %v, want the negative publishOps reported", err)
+	}
+}
@@ -0,0 +1,211 @@
+// Fichier: config/extends.go
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// extendsKey is the directive naming the base configuration a file is layered on.
+const extendsKey = "extends"
+
+// loadLayers reads source and, recursively, the configurations it extends, and returns
+// the merged mapping node. Each leaf value carries a line comment naming its source.
+//
+// Merge rules: mappings are merged key by key, while scalars and lists in the child
+// replace the base value entirely (a child priorityEntries list is not appended).
+func loadLayers(source string, chain []string) (*yaml.Node, error) {
+	for _, seen := range chain {
+		if seen == source {
+			return nil, fmt.Errorf("extends cycle: %s -> %s", strings.Join(chain, " -> "), source)
+		}
+	}
+	chain = append(chain, source)
+
+	data, err := readSource(source)
+	if err != nil {
+		return nil, err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal config file %s: %w", source, err)
+	}
+	node := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	if len(doc.Content) > 0 {
+		node = doc.Content[0]
+	}
+	if node.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("config file %s is not a YAML mapping", source)
+	}
+
+	var base string
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == extendsKey {
+			base = node.Content[i+1].Value
+			node.Content = append(node.Content[:i], node.Content[i+2:]...)
+			break
+		}
+	}
+	annotate(node, source)
+	if base == "" {
+		return node, nil
+	}
+
+	parent, err := loadLayers(resolveSource(source, base), chain)
+	if err != nil {
+		return nil, err
+	}
+	merge(parent, node)
+	return parent, nil
+}
+
+// readSource reads a local file, an http(s) URL, or standard input for "-".
+func readSource(source string) ([]byte, error) {
+	if source == Stdin {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config from standard input: %w", err)
+		}
+		return data, nil
+	}
+	if !isURL(source) {
+		data, err := os.ReadFile(source)
+		if errors.Is(err, fs.ErrNotExist) {
+			if abs, _ := filepath.Abs(source); abs != source {
+				return nil, fmt.Errorf("config file %s does not exist (looked for %s)", source, abs)
+			}
+			return nil, fmt.Errorf("config file %s does not exist", source)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file %s: %w", source, err)
+		}
+		return data, nil
+	}
+	resp, err := http.Get(source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch config %s: %w", source, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch config %s: %s", source, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// Stdin is the config source name that reads the configuration from standard input.
+// Relative extends paths of such a configuration are relative to the working directory.
+const Stdin = "-"
+
+func isURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// resolveSource makes a relative extends path relative to the file that names it.
+func resolveSource(from, base string) string {
+	if isURL(base) || filepath.IsAbs(base) || isURL(from) {
+		return base
+	}
+	return filepath.Join(filepath.Dir(from), base)
+}
+
+// annotate records source as the provenance of every leaf value below node.
+func annotate(node *yaml.Node, source string) {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		if value.Kind == yaml.MappingNode {
+			annotate(value, source)
+			continue
+		}
+		key.LineComment = "from " + source
+	}
+}
+
+// merge overlays child onto base in place.
+func merge(base, child *yaml.Node) {
+	for i := 0; i+1 < len(child.Content); i += 2 {
+		key, value := child.Content[i], child.Content[i+1]
+		j := indexOf(base, key.Value)
+		switch {
+		case j < 0:
+			base.Content = append(base.Content, key, value)
+		case value.Kind == yaml.MappingNode && base.Content[j+1].Kind == yaml.MappingNode:
+			merge(base.Content[j+1], value)
+		default:
+			base.Content[j], base.Content[j+1] = key, value
+		}
+	}
+}
+
+// indexOf returns the index of key in a mapping node's content, or -1.
+func indexOf(mapping *yaml.Node, key string) int {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// EffectiveConfig returns the merged configuration of filePath and the files it extends,
+// with a comment after each value naming the file that supplied it. Secrets are masked.
+func EffectiveConfig(filePath string) ([]byte, error) {
+	node, err := loadLayers(filePath, nil)
+	if err != nil {
+		return nil, err
+	}
+	redactNode(node, "publish", "apiToken")
+	return yaml.Marshal(node)
+}
+
+// redactNode masks the non-empty scalar at path in the mapping node.
+func redactNode(node *yaml.Node, path ...string) {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value != path[0] {
+			continue
+		}
+		value := node.Content[i+1]
+		switch {
+		case len(path) > 1 && value.Kind == yaml.MappingNode:
+			redactNode(value, path[1:]...)
+		case len(path) == 1 && value.Kind == yaml.ScalarNode && value.Value != "":
+			value.Value, value.Tag, value.Style = redactedSecret, "!!str", 0
+		}
+	}
+}
+
+// Sources returns the local files of filePath's extends chain, starting with filePath.
+// URLs are not included. The walk stops at the first unreadable or invalid file so it
+// can be used on configurations that are being edited.
+func Sources(filePath string) []string {
+	var files []string
+	for source := filePath; source != "" && source != Stdin && !isURL(source); {
+		for _, seen := range files {
+			if seen == source {
+				return files
+			}
+		}
+		files = append(files, source)
+
+		data, err := os.ReadFile(source)
+		if err != nil {
+			return files
+		}
+		var top struct {
+			Extends string `yaml:"extends"`
+		}
+		if yaml.Unmarshal(data, &top) != nil || top.Extends == "" {
+			return files
+		}
+		source = resolveSource(source, top.Extends)
+	}
+	return files
+}
@@ -0,0 +1,161 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestSecretsRedacted(t *testing.T) {
+	tests := []struct {
+		name, base, child string
+		wantMasked        bool
+	}{
+		{"token in the file", "", "targetDomain: example.com\npublish:\n  provider: cloudflare\n  zoneId: z1\n  apiToken: s3cr3t-token\n", true},
+		{"token in the base", "publish:\n  provider: cloudflare\n  zoneId: z1\n  apiToken: s3cr3t-token\n", "extends: base.yaml\ntargetDomain: example.com\n", true},
+		{"token from the environment", "", "targetDomain: example.com\npublish:\n  provider: cloudflare\n  zoneId: z1\n", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if tt.base != "" {
+				if err := os.WriteFile(filepath.Join(dir, "base.yaml"), []byte(tt.base), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			path := filepath.Join(dir, "config.yaml")
+			if err := os.WriteFile(path, []byte(tt.child), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			effective, err := EffectiveConfig(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := LoadConfig(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			marshalled, err := yaml.Marshal(cfg.Redacted())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for what, out := range map[string]string{"EffectiveConfig": string(effective), "Redacted": string(marshalled)} {
+				if strings.Contains(out, "s3cr3t-token") {
+					t.Errorf("%s leaks the token:\n%s", what, out)
+				}
+				if masked := strings.Contains(out, redactedSecret); masked != tt.wantMasked {
+					t.Errorf("%s masked = %v, want %v:\n%s", what, masked, tt.wantMasked, out)
+				}
+			}
+			if tt.wantMasked && cfg.Publish.APIToken != "s3cr3t-token" {
+				t.Errorf("Redacted() changed the configuration: token %q", cfg.Publish.APIToken)
+			}
+		})
+	}
+}
+
+func TestExtendsMerge(t *testing.T) {
+	tests := []struct {
+		name string
+		// files maps each file of the temporary directory to its content; the chain
+		// starts at config.yaml.
+		files   map[string]string
+		want    string
+		wantErr string
+	}{
+		{
+			"child scalar replaces the base",
+			map[string]string{"base.yaml": "targetDomain: base.example\nmaxLookups: 8\n", "config.yaml": "extends: base.yaml\ntargetDomain: example.com\n"},
+			"maxLookups: 8\ntargetDomain: example.com\n", "",
+		},
+		{
+			"mappings are merged key by key",
+			map[string]string{"base.yaml": "publish:\n  provider: cloudflare\n  zoneId: z1\n", "config.yaml": "extends: base.yaml\npublish:\n  zoneId: z2\n"},
+			"publish:\n    provider: cloudflare\n    zoneId: z2\n", "",
+		},
+		{
+			"lists replace the base list",
+			map[string]string{"base.yaml": "priorityEntries: [a.example, b.example]\n", "config.yaml": "extends: base.yaml\npriorityEntries: [c.example]\n"},
+			"priorityEntries:\n    - c.example\n", "",
+		},
+		{
+			"a scalar replaces a mapping",
+			map[string]string{"base.yaml": "publish:\n  provider: cloudflare\n", "config.yaml": "extends: base.yaml\npublish: null\n"},
+			"publish: null\n", "",
+		},
+		{
+			"three layers, the nearest wins",
+			map[string]string{
+				"org.yaml":    "maxLookups: 8\ntargetDomain: org.example\nconcurrency:\n  dns: 4\n",
+				"base.yaml":   "extends: org.yaml\ntargetDomain: base.example\nconcurrency:\n  publishOps: 2\n",
+				"config.yaml": "extends: base.yaml\nconcurrency:\n  dns: 16\n",
+			},
+			"concurrency:\n    dns: 16\n    publishOps: 2\nmaxLookups: 8\ntargetDomain: base.example\n", "",
+		},
+		{
+			"relative to the extending file",
+			map[string]string{"shared/base.yaml": "maxLookups: 8\n", "shared/team.yaml": "extends: base.yaml\n", "config.yaml": "extends: shared/team.yaml\n"},
+			"maxLookups: 8\n", "",
+		},
+		{
+			"empty child keeps the base",
+			map[string]string{"base.yaml": "maxLookups: 8\n", "config.yaml": "extends: base.yaml\n"},
+			"maxLookups: 8\n", "",
+		},
+		{
+			"cycle",
+			map[string]string{"base.yaml": "extends: config.yaml\n", "config.yaml": "extends: base.yaml\n"},
+			"", "extends cycle",
+		},
+		{
+			"missing base",
+			map[string]string{"config.yaml": "extends: nowhere.yaml\n"},
+			"", "does not exist",
+		},
+		{
+			"base is not a mapping",
+			map[string]string{"base.yaml": "- a\n- b\n", "config.yaml": "extends: base.yaml\n"},
+			"", "is not a YAML mapping",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, content := range tt.files {
+				path := filepath.Join(dir, name)
+				if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			node, err := loadLayers(filepath.Join(dir, "config.yaml"), nil)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadLayers() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Decode and re-encode to drop the provenance comments and sort the keys
+			var merged map[string]any
+			if err := node.Decode(&merged); err != nil {
+				t.Fatal(err)
+			}
+			got, err := yaml.Marshal(merged)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("merged =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
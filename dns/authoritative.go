@@ -0,0 +1,98 @@
+// Fichier: dns/authoritative.go (Résolution directe auprès des serveurs faisant autorité)
+
+package dns
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// resolveTXT fetches the TXT records of domain, from the zone's authoritative servers
+// when the resolver runs in authoritative mode, falling back to the recursive resolver.
+func (r *Resolver) resolveTXT(domain string) (*dns.Msg, error) {
+	if !r.Authoritative {
+		return r.resolveDNS(domain, dns.TypeTXT)
+	}
+
+	resp, err := r.resolveAuthoritative(domain, dns.TypeTXT)
+	if err == nil {
+		return resp, nil
+	}
+	log.Printf("Warning: Authoritative TXT lookup failed for %s, falling back to recursive resolver: %v", domain, err)
+	return r.resolveDNS(domain, dns.TypeTXT)
+}
+
+// resolveAuthoritative queries the authoritative servers of the zone containing domain
+// directly, with recursion disabled, so stale recursive caches are bypassed.
+func (r *Resolver) resolveAuthoritative(domain string, qtype uint16) (*dns.Msg, error) {
+	zone, servers, err := r.findZone(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for _, server := range servers {
+		resp, err := r.exchange(domain, qtype, server, false)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if !resp.Authoritative {
+			lastErr = fmt.Errorf("server %s is not authoritative for %s", server, zone)
+			continue
+		}
+		return resp, nil
+	}
+	return nil, fmt.Errorf("no authoritative server of %s answered for %s: %w", zone, domain, lastErr)
+}
+
+// findZone walks up from domain to the closest zone cut and returns the zone name
+// and the addresses of its authoritative servers. Discoveries are cached per name.
+func (r *Resolver) findZone(domain string) (string, []string, error) {
+	labels := dns.SplitDomainName(domain)
+	for i := range labels {
+		name := dns.Fqdn(strings.Join(labels[i:], "."))
+
+		r.mu.Lock()
+		servers, cached := r.zoneServers[name]
+		r.mu.Unlock()
+
+		if !cached {
+			servers = r.discoverServers(name)
+			r.mu.Lock()
+			r.zoneServers[name] = servers
+			r.mu.Unlock()
+		}
+		if len(servers) > 0 {
+			return name, servers, nil
+		}
+	}
+	return "", nil, fmt.Errorf("no zone cut found for %s", domain)
+}
+
+// discoverServers returns the addresses of the nameservers delegated at name, using the
+// recursive resolver for the NS set and the glue. It returns nil when name is not a zone cut.
+func (r *Resolver) discoverServers(name string) []string {
+	hosts, err := r.LookupDelegation(name)
+	if err != nil || len(hosts) == 0 {
+		return nil
+	}
+
+	var servers []string
+	for _, host := range hosts {
+		resp, err := r.resolveDNS(host, dns.TypeA)
+		if err != nil {
+			continue
+		}
+		for _, ans := range resp.Answer {
+			if a, ok := ans.(*dns.A); ok {
+				servers = append(servers, net.JoinHostPort(a.A.String(), "53"))
+			}
+		}
+	}
+	return servers
+}
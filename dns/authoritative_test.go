@@ -0,0 +1,155 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"project/spf-flattener/dns/dnstest"
+)
+
+// recursiveServer is the address of the recursive resolver of newTestResolver.
+const recursiveServer = "192.0.2.53:53"
+
+// hierarchy answers as the recursive resolver, from a cache holding stale records, and
+// as the authoritative servers of the zones behind it, setting the AA bit.
+type hierarchy struct {
+	recursive *dnstest.Zone
+	// servers holds the zone of each authoritative server, by address.
+	servers map[string]*dnstest.Zone
+	// down servers time out; lame servers answer without the AA bit.
+	down, lame map[string]bool
+
+	mu    sync.Mutex
+	asked []string
+}
+
+func (h *hierarchy) Exchange(m *dns.Msg, server string) (*dns.Msg, error) {
+	q := m.Question[0]
+	h.mu.Lock()
+	h.asked = append(h.asked, fmt.Sprintf("%s %s %s rd=%v", server, strings.TrimSuffix(q.Name, "."), dns.TypeToString[q.Qtype], m.RecursionDesired))
+	h.mu.Unlock()
+	if server == recursiveServer {
+		return h.recursive.Exchange(m, server)
+	}
+	zone, ok := h.servers[server]
+	if !ok || h.down[server] {
+		return nil, errors.New("i/o timeout")
+	}
+	resp, err := zone.Exchange(m, server)
+	if err == nil {
+		resp.Authoritative = !h.lame[server]
+	}
+	return resp, err
+}
+
+// authoritativeQueries returns the TXT queries sent to the authoritative servers.
+func (h *hierarchy) authoritativeQueries() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var out []string
+	for _, q := range h.asked {
+		if !strings.HasPrefix(q, recursiveServer) && strings.Contains(q, " TXT ") {
+			out = append(out, q)
+		}
+	}
+	return out
+}
+
+func TestResolveAuthoritative(t *testing.T) {
+	// The recursive resolver still caches the record the zone changed since
+	const recursive = `
+example.com. 300 IN NS ns1.example.com.
+example.com. 300 IN NS ns2.example.com.
+ns1.example.com. 300 IN A 198.51.100.1
+ns2.example.com. 300 IN A 198.51.100.2
+_spf.example.com. 300 IN TXT "v=spf1 ip4:192.0.2.0/24 -all"
+_spf.mail.example.com. 300 IN TXT "v=spf1 ip4:192.0.2.0/24 -all"
+`
+	const authoritative = `
+_spf.example.com. 300 IN TXT "v=spf1 ip4:203.0.113.0/24 -all"
+_spf.mail.example.com. 300 IN TXT "v=spf1 ip4:203.0.113.0/24 -all"
+`
+	const stale, fresh = "v=spf1 ip4:192.0.2.0/24 -all", "v=spf1 ip4:203.0.113.0/24 -all"
+	tests := []struct {
+		name          string
+		authoritative bool
+		domain        string
+		down, lame    []string
+		want          string
+		// wantAsked lists the authoritative servers queried, in order.
+		wantAsked []string
+		wantLog   string
+	}{
+		{"recursive mode", false, "_spf.example.com", nil, nil, stale, nil, ""},
+		{"fresh from the first server", true, "_spf.example.com", nil, nil, fresh, []string{"198.51.100.1:53"}, ""},
+		{"zone cut found above the name", true, "_spf.mail.example.com", nil, nil, fresh, []string{"198.51.100.1:53"}, ""},
+		{"first server down", true, "_spf.example.com", []string{"198.51.100.1:53"}, nil, fresh, []string{"198.51.100.1:53", "198.51.100.2:53"}, ""},
+		{"lame server skipped", true, "_spf.example.com", nil, []string{"198.51.100.1:53"}, fresh, []string{"198.51.100.1:53", "198.51.100.2:53"}, ""},
+		{
+			"every server failing falls back to the recursive resolver", true, "_spf.example.com",
+			[]string{"198.51.100.1:53"}, []string{"198.51.100.2:53"}, stale,
+			[]string{"198.51.100.1:53", "198.51.100.2:53"}, "is not authoritative for example.com.",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs strings.Builder
+			log.SetOutput(&logs)
+			t.Cleanup(func() { log.SetOutput(os.Stderr) })
+			h := &hierarchy{
+				recursive: dnstest.New(t, recursive),
+				servers: map[string]*dnstest.Zone{
+					"198.51.100.1:53": dnstest.New(t, authoritative),
+					"198.51.100.2:53": dnstest.New(t, authoritative),
+				},
+				down: make(map[string]bool),
+				lame: make(map[string]bool),
+			}
+			for _, s := range tt.down {
+				h.down[s] = true
+			}
+			for _, s := range tt.lame {
+				h.lame[s] = true
+			}
+			r := newTestResolver(h)
+			r.Authoritative = tt.authoritative
+
+			resp, err := r.resolveTXT(tt.domain)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, rr := range resp.Answer {
+				if txt, ok := rr.(*dns.TXT); ok {
+					got = append(got, strings.Join(txt.Txt, ""))
+				}
+			}
+			if !slices.Equal(got, []string{tt.want}) {
+				t.Errorf("TXT = %q, want %q", got, tt.want)
+			}
+
+			var asked []string
+			for _, q := range h.authoritativeQueries() {
+				server, rest, _ := strings.Cut(q, " ")
+				if !strings.HasSuffix(rest, "rd=false") {
+					t.Errorf("authoritative query %s asks for recursion", q)
+				}
+				asked = append(asked, server)
+			}
+			if !slices.Equal(asked, tt.wantAsked) {
+				t.Errorf("authoritative servers asked = %v, want %v", asked, tt.wantAsked)
+			}
+			if tt.wantLog != "" && !strings.Contains(logs.String(), tt.wantLog) {
+				t.Errorf("log does not mention %q:\n%s", tt.wantLog, logs.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+// Fichier: dns/boundary.go (frontière des dépendances externes)
+
+package dns
+
+import (
+	"log"
+	"strings"
+
+	"project/spf-flattener/spf"
+)
+
+// ExternalInclude is an include kept verbatim because its target is outside
+// FlattenOnlySuffixes.
+type ExternalInclude struct {
+	// Include is the target of the include mechanism, From the domain whose record has it.
+	Include string `json:"include"`
+	From    string `json:"from"`
+	// Depth is 1 for an include of the flattened domain's own record, 2 one level below...
+	Depth int `json:"depth"`
+	// Lookups estimates what verifiers pay for the include: the include itself plus the
+	// DNS-querying terms of the target's record, each nested include counted once.
+	Lookups int `json:"lookups"`
+}
+
+// ExternalBoundary lists the external includes met below domain while flattening, in
+// breadth-first order, each at its shallowest depth. The record of every external target
+// is fetched to estimate its lookup cost.
+func (r *Resolver) ExternalBoundary(domain string) []ExternalInclude {
+	if len(r.FlattenOnlySuffixes) == 0 {
+		return nil
+	}
+
+	var external []ExternalInclude
+	r.mu.Lock()
+	seen := map[string]bool{domain: true}
+	queue := []ExternalInclude{{Include: domain}}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		rec, ok := r.records[current.Include]
+		if !ok {
+			continue
+		}
+		terms, _ := rec.Effective()
+		for _, t := range terms {
+			if !(t.Name == "include" && !t.Modifier || t.Name == "redirect" && t.Modifier) {
+				continue
+			}
+			target := strings.ToLower(t.Value)
+			if seen[target] {
+				continue
+			}
+			seen[target] = true
+			next := ExternalInclude{Include: t.Value, From: current.Include, Depth: current.Depth + 1}
+			if t.Name == "include" && !matchSuffix(target, r.FlattenOnlySuffixes) {
+				external = append(external, next)
+				continue
+			}
+			queue = append(queue, next)
+		}
+	}
+	r.mu.Unlock()
+
+	for i, e := range external {
+		external[i].Lookups = 1
+		txt, _, err := r.fetchSPFStrings(e.Include)
+		var rec *spf.Record
+		if err == nil {
+			rec, err = r.Parsed.Parse(e.Include, txt)
+		}
+		if err == nil {
+			external[i].Lookups += rec.Lookups()
+		} else {
+			log.Printf("WARN: Cannot estimate the lookups of external include %s: %v", e.Include, err)
+		}
+	}
+	return external
+}
@@ -0,0 +1,66 @@
+package dns
+
+import (
+	"io"
+	"log"
+	"os"
+	"slices"
+	"testing"
+
+	"project/spf-flattener/dns/dnstest"
+)
+
+// TestExternalBoundary flattens a chain where internal includes nest external ones and
+// external includes nest internal ones, with flattenOnlySuffixes set to our two domains.
+func TestExternalBoundary(t *testing.T) {
+	const zone = `
+example.com. 300 IN TXT "v=spf1 ip4:192.0.2.0/25 include:_spf.example.com include:_spf.vendor.net -all"
+_spf.example.com. 300 IN TXT "v=spf1 ip4:192.0.2.128/25 include:mail.Example.ORG include:relay.vendor.net -all"
+mail.example.org. 300 IN TXT "v=spf1 ip4:198.51.100.0/24 include:relay.vendor.net -all"
+_spf.vendor.net. 300 IN TXT "v=spf1 include:back.example.com a mx -all"
+back.example.com. 300 IN TXT "v=spf1 ip4:203.0.113.128/25 -all"
+relay.vendor.net. 300 IN TXT "v=spf1 ip4:203.0.113.0/25 include:more.vendor.net -all"
+`
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	z := dnstest.New(t, zone)
+	r := newTestResolver(z)
+	r.FlattenOnlySuffixes = []string{"example.com", "example.org"}
+
+	nets, err := r.FlattenSPF("example.com", "example.com", false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, n := range nets {
+		got = append(got, n.IPNet.String())
+	}
+	slices.Sort(got)
+	// Only the internal records are flattened, down to the second level
+	if want := []string{"192.0.2.0/25", "192.0.2.128/25", "198.51.100.0/24"}; !slices.Equal(got, want) {
+		t.Errorf("FlattenSPF() = %v, want %v", got, want)
+	}
+	passthrough := r.Passthrough()
+	slices.Sort(passthrough)
+	if want := []string{"include:_spf.vendor.net", "include:relay.vendor.net"}; !slices.Equal(passthrough, want) {
+		t.Errorf("Passthrough() = %v, want %v", passthrough, want)
+	}
+
+	// relay.vendor.net is reached from two internal records, at depths 2 and 3
+	want := []ExternalInclude{
+		{Include: "_spf.vendor.net", From: "example.com", Depth: 1, Lookups: 4},
+		{Include: "relay.vendor.net", From: "_spf.example.com", Depth: 2, Lookups: 2},
+	}
+	if got := r.ExternalBoundary("example.com"); !slices.Equal(got, want) {
+		t.Errorf("ExternalBoundary() = %+v, want %+v", got, want)
+	}
+	// The internal include behind an external one is left to verifiers
+	if slices.Contains(z.Queries(), "back.example.com TXT") {
+		t.Errorf("queries = %v, want back.example.com, behind an external include, not fetched", z.Queries())
+	}
+
+	r.FlattenOnlySuffixes = nil
+	if got := r.ExternalBoundary("example.com"); got != nil {
+		t.Errorf("ExternalBoundary() without suffixes = %+v, want nil", got)
+	}
+}
@@ -0,0 +1,99 @@
+// Fichier: dns/breaker.go (Disjoncteur par serveur)
+
+package dns
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	breakerThreshold = 5                // Consecutive failures that open a server's breaker
+	breakerCooldown  = 30 * time.Second // How long an open breaker skips its server
+)
+
+// breaker stops querying a server after breakerThreshold consecutive retryable failures
+// (timeouts, SERVFAIL) instead of adding load during an outage. After breakerCooldown a
+// single probe query is let through: success closes the breaker, failure re-opens it.
+type breaker struct {
+	mu      sync.Mutex
+	servers map[string]*serverHealth
+	// skipped counts the queries refused by open breakers.
+	skipped int
+	// now returns the current time; nil means time.Now. Tests replace it.
+	now func() time.Time
+}
+
+type serverHealth struct {
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// allow reports whether a query may be sent to server.
+func (b *breaker) allow(server string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	h := b.servers[server]
+	if h == nil || h.failures < breakerThreshold {
+		return true
+	}
+	if b.clock().Before(h.openUntil) || h.probing {
+		b.skipped++
+		return false
+	}
+	h.probing = true
+	log.Printf("INFO: Circuit breaker for %s half-open, probing", server)
+	return true
+}
+
+// record updates server's health with the outcome of a query.
+func (b *breaker) record(server string, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.servers == nil {
+		b.servers = make(map[string]*serverHealth)
+	}
+	h := b.servers[server]
+	if h == nil {
+		h = &serverHealth{}
+		b.servers[server] = h
+	}
+	wasOpen := h.failures >= breakerThreshold
+	h.probing = false
+	if !failed {
+		if wasOpen {
+			log.Printf("INFO: Circuit breaker for %s closed, server answers again", server)
+		}
+		h.failures = 0
+		return
+	}
+	h.failures++
+	if h.failures >= breakerThreshold {
+		h.openUntil = b.clock().Add(breakerCooldown)
+		if !wasOpen {
+			log.Printf("WARN: Circuit breaker for %s opened after %d consecutive failures; skipping it for %s", server, h.failures, breakerCooldown)
+		}
+	}
+}
+
+// clock returns the current time, from b.now when set.
+func (b *breaker) clock() time.Time {
+	if b.now != nil {
+		return b.now()
+	}
+	return time.Now()
+}
+
+// stats returns the number of queries skipped and the servers whose breaker is open.
+func (b *breaker) stats() (skipped int, open []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for server, h := range b.servers {
+		if h.failures >= breakerThreshold {
+			open = append(open, server)
+		}
+	}
+	return b.skipped, open
+}
@@ -0,0 +1,84 @@
+package dns
+
+import (
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestBreakerCycle walks a server's breaker through opening, skipping, a failed probe,
+// a successful probe and closing, moving an injected clock past the cooldowns.
+func TestBreakerCycle(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	const server = "192.0.2.53:53"
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := &breaker{now: func() time.Time { return now }}
+
+	wantOpen := func(step string, want bool) {
+		t.Helper()
+		_, open := b.stats()
+		if got := len(open) == 1 && open[0] == server; got != want {
+			t.Errorf("%s: open = %v, want open %v", step, open, want)
+		}
+	}
+
+	// Failures below the threshold, interrupted by a success, do not open it
+	for range breakerThreshold - 1 {
+		b.record(server, true)
+	}
+	b.record(server, false)
+	for range breakerThreshold - 1 {
+		if !b.allow(server) {
+			t.Fatal("allow() = false below the threshold")
+		}
+		b.record(server, true)
+	}
+	wantOpen("below the threshold", false)
+
+	b.record(server, true)
+	wantOpen("threshold reached", true)
+	for range 3 {
+		if b.allow(server) {
+			t.Fatal("allow() = true while open")
+		}
+	}
+	// A successful query from another server leaves this breaker open
+	b.record("198.51.100.1:53", false)
+
+	now = now.Add(breakerCooldown - time.Second)
+	if b.allow(server) {
+		t.Fatal("allow() = true before the cooldown ends")
+	}
+
+	// Half-open: a single probe goes through, concurrent queries are still skipped
+	now = now.Add(time.Second)
+	if !b.allow(server) {
+		t.Fatal("allow() = false after the cooldown, want a probe")
+	}
+	if b.allow(server) {
+		t.Fatal("allow() = true while the probe is in flight")
+	}
+	b.record(server, true)
+	wantOpen("failed probe", true)
+	if b.allow(server) {
+		t.Fatal("allow() = true right after a failed probe")
+	}
+
+	now = now.Add(breakerCooldown)
+	if !b.allow(server) {
+		t.Fatal("allow() = false after the second cooldown, want a probe")
+	}
+	b.record(server, false)
+	wantOpen("successful probe", false)
+	if !b.allow(server) || !b.allow(server) {
+		t.Fatal("allow() = false once closed")
+	}
+
+	// Six queries were refused while the breaker was open
+	if skipped, _ := b.stats(); skipped != 6 {
+		t.Errorf("skipped = %d, want 6", skipped)
+	}
+}
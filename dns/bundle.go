@@ -0,0 +1,218 @@
+// Fichier: dns/bundle.go (capture et rejeu des réponses DNS)
+
+package dns
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// Exchanger sends one query to a server and returns its response. The resolver uses the
+// network unless Exchanger is set.
+type Exchanger interface {
+	Exchange(m *dns.Msg, server string) (*dns.Msg, error)
+}
+
+// network is the default Exchanger. server is an upstream spec (see ParseUpstream).
+type network struct{}
+
+func (network) Exchange(m *dns.Msg, server string) (*dns.Msg, error) {
+	u, err := ParseUpstream(server)
+	if err != nil {
+		return nil, err
+	}
+	resp, _, err := u.client().Exchange(m, u.Addr())
+	return resp, err
+}
+
+// exchangeKey identifies a query: the same question sent to another server during
+// failover may get a different outcome.
+type exchangeKey struct {
+	server, name string
+	qtype        uint16
+}
+
+// exchanged is the recorded outcome of a query: a response, or the error text.
+type exchanged struct {
+	resp *dns.Msg
+	err  string
+}
+
+// Recorder is an Exchanger that queries the network and keeps the first outcome of every
+// query, to be written as an answers file and replayed by a Replayer.
+type Recorder struct {
+	// Next sends the queries; nil sends them to the network.
+	Next Exchanger
+
+	mu      sync.Mutex
+	answers map[exchangeKey]exchanged
+}
+
+// NewRecorder returns an empty Recorder.
+func NewRecorder() *Recorder {
+	return &Recorder{answers: make(map[exchangeKey]exchanged)}
+}
+
+func (rec *Recorder) Exchange(m *dns.Msg, server string) (*dns.Msg, error) {
+	next := rec.Next
+	if next == nil {
+		next = network{}
+	}
+	resp, err := next.Exchange(m, server)
+	q := m.Question[0]
+	key := exchangeKey{server, strings.ToLower(q.Name), q.Qtype}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if _, ok := rec.answers[key]; !ok {
+		switch {
+		case err != nil:
+			rec.answers[key] = exchanged{err: err.Error()}
+		case resp == nil:
+			rec.answers[key] = exchanged{err: "empty response"}
+		default:
+			rec.answers[key] = exchanged{resp: resp.Copy()}
+		}
+	}
+	return resp, err
+}
+
+// WriteAnswers writes the recorded outcomes in the answers file format, sorted so that
+// captures of the same run compare equal. Each query starts with a header line
+//
+//	;; QUERY <server> <name> <type> <rcode>
+//	;; QUERY <server> <name> <type> ERROR <error text>
+//
+// followed by the answer and authority RRs in zone file syntax, the authority ones after
+// a ";; AUTHORITY" line.
+func (rec *Recorder) WriteAnswers(w io.Writer) error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	keys := make([]exchangeKey, 0, len(rec.answers))
+	for key := range rec.answers {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.name != b.name {
+			return a.name < b.name
+		}
+		if a.qtype != b.qtype {
+			return a.qtype < b.qtype
+		}
+		return a.server < b.server
+	})
+
+	bw := bufio.NewWriter(w)
+	for _, key := range keys {
+		x := rec.answers[key]
+		if x.resp == nil {
+			fmt.Fprintf(bw, ";; QUERY %s %s %s ERROR %s\n", key.server, key.name, dns.TypeToString[key.qtype], x.err)
+			continue
+		}
+		fmt.Fprintf(bw, ";; QUERY %s %s %s %s\n", key.server, key.name, dns.TypeToString[key.qtype], dns.RcodeToString[x.resp.Rcode])
+		for _, rr := range x.resp.Answer {
+			fmt.Fprintln(bw, rr)
+		}
+		if len(x.resp.Ns) > 0 {
+			fmt.Fprintln(bw, ";; AUTHORITY")
+			for _, rr := range x.resp.Ns {
+				fmt.Fprintln(bw, rr)
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// ErrNotCaptured reports a query a Replayer has no recorded outcome for.
+var ErrNotCaptured = errors.New("query not in the captured answers")
+
+// Replayer is an Exchanger answering from an answers file instead of the network.
+type Replayer struct {
+	answers map[exchangeKey]exchanged
+}
+
+// LoadAnswers reads an answers file written by Recorder.WriteAnswers.
+func LoadAnswers(path string) (*Replayer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rep := &Replayer{answers: make(map[exchangeKey]exchanged)}
+	var current *dns.Msg
+	authority := false
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if header, ok := strings.CutPrefix(text, ";; QUERY "); ok {
+			fields := strings.SplitN(header, " ", 5)
+			if len(fields) < 4 {
+				return nil, fmt.Errorf("%s:%d: malformed query header %q", path, line, text)
+			}
+			qtype, known := dns.StringToType[fields[2]]
+			if !known {
+				return nil, fmt.Errorf("%s:%d: unknown query type %q", path, line, fields[2])
+			}
+			key := exchangeKey{fields[0], fields[1], qtype}
+			if fields[3] == "ERROR" {
+				rep.answers[key] = exchanged{err: strings.Join(fields[4:], " ")}
+				current = nil
+				continue
+			}
+			rcode, known := dns.StringToRcode[fields[3]]
+			if !known {
+				return nil, fmt.Errorf("%s:%d: unknown rcode %q", path, line, fields[3])
+			}
+			current = new(dns.Msg)
+			current.SetQuestion(key.name, qtype)
+			current.Response, current.Rcode = true, rcode
+			rep.answers[key] = exchanged{resp: current}
+			authority = false
+			continue
+		}
+		if text == ";; AUTHORITY" {
+			authority = true
+			continue
+		}
+		if strings.TrimSpace(text) == "" || strings.HasPrefix(text, ";") {
+			continue
+		}
+		if current == nil {
+			return nil, fmt.Errorf("%s:%d: record outside of a query", path, line)
+		}
+		rr, err := dns.NewRR(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		if authority {
+			current.Ns = append(current.Ns, rr)
+		} else {
+			current.Answer = append(current.Answer, rr)
+		}
+	}
+	return rep, scanner.Err()
+}
+
+func (rep *Replayer) Exchange(m *dns.Msg, server string) (*dns.Msg, error) {
+	q := m.Question[0]
+	x, ok := rep.answers[exchangeKey{server, strings.ToLower(q.Name), q.Qtype}]
+	switch {
+	case !ok:
+		return nil, fmt.Errorf("%w: %s %s at %s", ErrNotCaptured, q.Name, dns.TypeToString[q.Qtype], server)
+	case x.resp == nil:
+		return nil, errors.New(x.err)
+	}
+	resp := x.resp.Copy()
+	resp.Id = m.Id
+	return resp, nil
+}
@@ -0,0 +1,103 @@
+package dns
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// perServer answers TXT queries with the name of the server and A queries with an
+// address, so that answers cached under the wrong key are told apart.
+type perServer struct{}
+
+func (perServer) Exchange(m *dns.Msg, server string) (*dns.Msg, error) {
+	resp := new(dns.Msg)
+	resp.SetReply(m)
+	q := m.Question[0]
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: 300}
+	switch q.Qtype {
+	case dns.TypeTXT:
+		resp.Answer = []dns.RR{&dns.TXT{Hdr: hdr, Txt: []string{"from " + server}}}
+	case dns.TypeA:
+		resp.Answer = []dns.RR{&dns.A{Hdr: hdr, A: []byte{192, 0, 2, 1}}}
+	}
+	return resp, nil
+}
+
+func TestReplayerKeys(t *testing.T) {
+	rec := NewRecorder()
+	rec.Next = perServer{}
+	for _, q := range []struct {
+		server, name string
+		qtype        uint16
+	}{
+		{"192.0.2.53:53", "example.com.", dns.TypeTXT},
+		{"192.0.2.53:53", "example.com.", dns.TypeA},
+		{"198.51.100.53:53", "example.com.", dns.TypeTXT},
+	} {
+		m := new(dns.Msg)
+		m.SetQuestion(q.name, q.qtype)
+		if _, err := rec.Exchange(m, q.server); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(t.TempDir(), "answers.zone")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rec.WriteAnswers(f); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	rep, err := LoadAnswers(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, server, qname string
+		qtype               uint16
+		want                string
+	}{
+		{"same question", "192.0.2.53:53", "example.com.", dns.TypeTXT, `"from 192.0.2.53:53"`},
+		{"name case", "192.0.2.53:53", "EXAMPLE.com.", dns.TypeTXT, `"from 192.0.2.53:53"`},
+		{"other server", "198.51.100.53:53", "example.com.", dns.TypeTXT, `"from 198.51.100.53:53"`},
+		{"other type", "192.0.2.53:53", "example.com.", dns.TypeA, "192.0.2.1"},
+		{"type not asked of that server", "198.51.100.53:53", "example.com.", dns.TypeA, ""},
+		{"server not queried", "203.0.113.53:53", "example.com.", dns.TypeTXT, ""},
+		{"name not queried", "192.0.2.53:53", "www.example.com.", dns.TypeTXT, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := new(dns.Msg)
+			m.SetQuestion(tt.qname, tt.qtype)
+			resp, err := rep.Exchange(m, tt.server)
+			if tt.want == "" {
+				if !errors.Is(err, ErrNotCaptured) {
+					t.Errorf("Exchange() = %v, %v, want ErrNotCaptured", resp, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(resp.Answer) != 1 {
+				t.Fatalf("Exchange() answers = %v, want one", resp.Answer)
+			}
+			var got string
+			switch rr := resp.Answer[0].(type) {
+			case *dns.TXT:
+				got = `"` + rr.Txt[0] + `"`
+			case *dns.A:
+				got = rr.A.String()
+			}
+			if got != tt.want {
+				t.Errorf("Exchange() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+// Fichier: dns/cost.go (coût d'évaluation côté récepteur)
+
+package dns
+
+import (
+	"log"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"project/spf-flattener/spf"
+)
+
+// ReceiverCost estimates what a receiving MTA pays to evaluate a published SPF record.
+type ReceiverCost struct {
+	// Queries counts the TXT queries of the records walked and one query per a, mx, ptr
+	// and exists term. The address queries following mx and ptr are not counted.
+	Queries int `json:"queries"`
+	// Bytes is the sum of the estimated wire sizes of the responses.
+	Bytes int `json:"bytes"`
+	// Unknown lists the include targets whose record could not be fetched; their own
+	// terms are not counted.
+	Unknown []string `json:"unknown,omitempty"`
+}
+
+// ReceiverCost walks the scheme published at entry the way a receiver evaluates it, in
+// the worst case where no mechanism matches before the end. records maps the names of
+// the generated records, which may not be published yet, to their values. Other include
+// targets use the records fetched while flattening, or are fetched now. An include
+// reached through several parents is counted every time, as in VerifierLookups.
+func (r *Resolver) ReceiverCost(entry string, records map[string]string) ReceiverCost {
+	var cost ReceiverCost
+	fetched := make(map[string]*spf.Record)
+	r.receiverCost(strings.ToLower(entry), records, fetched, make(map[string]bool), &cost)
+	return cost
+}
+
+// receiverCost adds the cost of the record at domain; path guards against cycles.
+func (r *Resolver) receiverCost(domain string, records map[string]string, fetched map[string]*spf.Record, path map[string]bool, cost *ReceiverCost) {
+	if path[domain] {
+		return
+	}
+	path[domain] = true
+	defer delete(path, domain)
+
+	cost.Queries++
+	rec, text := r.costRecord(domain, records, fetched)
+	if rec == nil {
+		cost.Bytes += responseSize(domain, dns.TypeTXT, nil)
+		cost.Unknown = append(cost.Unknown, domain)
+		return
+	}
+	cost.Bytes += responseSize(domain, dns.TypeTXT, &dns.TXT{Txt: splitTXT(text)})
+
+	terms, _ := rec.Effective()
+	for _, t := range terms {
+		target := strings.ToLower(t.Value)
+		if target == "" {
+			target = domain
+		}
+		switch {
+		case !t.Modifier && t.Name == "include", t.Modifier && t.Name == "redirect":
+			r.receiverCost(target, records, fetched, path, cost)
+		case !t.Modifier && (t.Name == "a" || t.Name == "mx" || t.Name == "ptr" || t.Name == "exists"):
+			cost.Queries++
+			cost.Bytes += responseSize(target, dns.TypeA, &dns.A{A: net.IPv4zero})
+		}
+	}
+}
+
+// costRecord returns the record at domain and its text: a generated record, a record
+// parsed while flattening, or one fetched now. A failed fetch is remembered as nil.
+func (r *Resolver) costRecord(domain string, records map[string]string, fetched map[string]*spf.Record) (*spf.Record, string) {
+	if value, ok := records[domain]; ok {
+		rec, err := spf.Parse(value)
+		if err != nil {
+			return nil, ""
+		}
+		return rec, value
+	}
+	rec, ok := r.Record(domain)
+	if !ok {
+		if rec, ok = fetched[domain]; !ok {
+			text, err := r.fetchSPF(domain)
+			if err == nil {
+				rec, err = r.Parsed.Parse(domain, text)
+			}
+			if err != nil {
+				log.Printf("WARN: Cannot estimate the receiver cost of %s: %v", domain, err)
+			}
+			fetched[domain] = rec
+		}
+	}
+	if rec == nil {
+		return nil, ""
+	}
+	text := "v=spf1"
+	for _, t := range rec.Terms {
+		text += " " + t.String()
+	}
+	return rec, text
+}
+
+// responseSize estimates the wire size of the response to a qtype query for name
+// carrying rr as its only answer, or no answer when rr is nil.
+func responseSize(name string, qtype uint16, rr dns.RR) int {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	if rr != nil {
+		*rr.Header() = dns.RR_Header{Name: dns.Fqdn(name), Rrtype: qtype, Class: dns.ClassINET}
+		m.Answer = []dns.RR{rr}
+	}
+	m.Compress = true
+	return m.Len()
+}
+
+// splitTXT splits a TXT value in the character-strings of at most 255 bytes it is
+// published as.
+func splitTXT(value string) []string {
+	var strs []string
+	for len(value) > 255 {
+		strs = append(strs, value[:255])
+		value = value[255:]
+	}
+	return append(strs, value)
+}
@@ -0,0 +1,99 @@
+// Fichier: dns/dnstest/zone.go (zone DNS en mémoire pour les tests)
+
+// Package dnstest answers the queries of a dns.Resolver from an in-memory zone, so that
+// tests run without network access.
+package dnstest
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// Zone is a dns.Exchanger answering from records in zone file syntax. A name without
+// records is NXDOMAIN, unless a wildcard *.<parent> record synthesizes an answer.
+type Zone struct {
+	mu      sync.Mutex
+	rrs     []dns.RR
+	rcodes  map[string]int
+	queries []string
+}
+
+// New parses zone, in zone file syntax with absolute names, into a Zone.
+func New(tb testing.TB, zone string) *Zone {
+	tb.Helper()
+	z := &Zone{rcodes: make(map[string]int)}
+	zp := dns.NewZoneParser(strings.NewReader(zone), ".", "")
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		z.rrs = append(z.rrs, rr)
+	}
+	if err := zp.Err(); err != nil {
+		tb.Fatalf("dnstest: %v", err)
+	}
+	return z
+}
+
+// Fail makes every query for name answer rcode, e.g. dns.RcodeServerFailure.
+func (z *Zone) Fail(name string, rcode int) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.rcodes[dns.CanonicalName(name)] = rcode
+}
+
+// Queries returns the questions received, as "name TYPE", in order.
+func (z *Zone) Queries() []string {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return append([]string(nil), z.queries...)
+}
+
+// Exchange answers m from the zone, whatever the server.
+func (z *Zone) Exchange(m *dns.Msg, server string) (*dns.Msg, error) {
+	q := m.Question[0]
+	name := dns.CanonicalName(q.Name)
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.queries = append(z.queries, strings.TrimSuffix(name, ".")+" "+dns.TypeToString[q.Qtype])
+
+	resp := new(dns.Msg)
+	resp.SetReply(m)
+	if rcode, ok := z.rcodes[name]; ok {
+		resp.Rcode = rcode
+		return resp, nil
+	}
+	rrs, found := z.lookup(name)
+	if !found {
+		// A wildcard answers for names below its parent that have no records
+		_, parent, _ := strings.Cut(name, ".")
+		if rrs, found = z.lookup("*." + parent); found {
+			for i, rr := range rrs {
+				rr = dns.Copy(rr)
+				rr.Header().Name = q.Name
+				rrs[i] = rr
+			}
+		}
+	}
+	if !found {
+		resp.Rcode = dns.RcodeNameError
+		return resp, nil
+	}
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == q.Qtype {
+			resp.Answer = append(resp.Answer, rr)
+		}
+	}
+	return resp, nil
+}
+
+// lookup returns the records owned by name and whether the name exists.
+func (z *Zone) lookup(name string) ([]dns.RR, bool) {
+	var rrs []dns.RR
+	for _, rr := range z.rrs {
+		if dns.CanonicalName(rr.Header().Name) == name {
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs, len(rrs) > 0
+}
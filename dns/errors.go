@@ -0,0 +1,61 @@
+// Fichier: dns/errors.go (Taxonomie des erreurs)
+
+package dns
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// Error kinds returned by the resolver. Callers branch on them with errors.Is, e.g.
+//
+//	if errors.Is(err, dns.ErrLookupLimit) { /* raise maxLookups or restructure the chain */ }
+//	if errors.Is(err, dns.ErrNXDomain) { /* the name does not exist: skip or fail */ }
+//
+// and on the error types with errors.As:
+//
+//	var lerr *dns.LookupError
+//	if errors.As(err, &lerr) && lerr.Retryable() { /* transient: retry later */ }
+//
+//	var perr *spf.ParseError
+//	if errors.As(err, &perr) { /* upstream record is malformed at perr.Offset */ }
+var (
+	// ErrLookupLimit is returned when flattening exceeds the lookup budget.
+	ErrLookupLimit = errors.New("SPF lookup limit reached")
+	// ErrNoSPFRecord is returned when a domain publishes no v=spf1 TXT record.
+	ErrNoSPFRecord = errors.New("no SPF record found")
+	// ErrMultipleSPF is returned when a domain publishes more than one SPF record.
+	ErrMultipleSPF = errors.New("multiple SPF records")
+	// ErrCycle is returned when an include chain loops back to a domain already visited.
+	ErrCycle = errors.New("include cycle detected")
+	// ErrNXDomain is wrapped by a LookupError when the queried name does not exist.
+	ErrNXDomain = errors.New("name does not exist (NXDOMAIN)")
+	// ErrCircuitOpen is wrapped by a LookupError when the server was skipped because it
+	// failed repeatedly (see the resolver's circuit breaker).
+	ErrCircuitOpen = errors.New("server skipped, circuit breaker open")
+)
+
+// LookupError describes a failed DNS query.
+type LookupError struct {
+	// Domain is the queried name.
+	Domain string
+	// Qtype is the queried record type.
+	Qtype uint16
+	// Rcode is the response code, or -1 when no response was received.
+	Rcode int
+	// Err is the underlying network error, ErrNXDomain, or a description of the rcode.
+	Err error
+}
+
+func (e *LookupError) Error() string {
+	return fmt.Sprintf("DNS query for %s (%s) failed: %v", e.Domain, dns.TypeToString[e.Qtype], e.Err)
+}
+
+func (e *LookupError) Unwrap() error { return e.Err }
+
+// Retryable reports whether the failure is transient (network error or SERVFAIL).
+func (e *LookupError) Retryable() bool {
+	return e.Rcode == -1 || e.Rcode == dns.RcodeServerFailure
+}
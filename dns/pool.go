@@ -0,0 +1,48 @@
+// Fichier: dns/pool.go
+
+package dns
+
+import "sync"
+
+// pool bounds the number of concurrent operations of one kind and records the peak
+// reached, so that users can tune its size.
+type pool struct {
+	slots chan struct{}
+
+	mu       sync.Mutex
+	inFlight int
+	peak     int
+}
+
+func newPool(size int) *pool {
+	if size <= 0 {
+		size = 1
+	}
+	return &pool{slots: make(chan struct{}, size)}
+}
+
+// acquire blocks until a slot is free.
+func (p *pool) acquire() {
+	p.slots <- struct{}{}
+	p.mu.Lock()
+	p.inFlight++
+	if p.inFlight > p.peak {
+		p.peak = p.inFlight
+	}
+	p.mu.Unlock()
+}
+
+// release frees the slot taken by acquire.
+func (p *pool) release() {
+	p.mu.Lock()
+	p.inFlight--
+	p.mu.Unlock()
+	<-p.slots
+}
+
+// stats returns the peak number of concurrent operations and the pool size.
+func (p *pool) stats() (peak, size int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.peak, cap(p.slots)
+}
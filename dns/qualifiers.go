@@ -0,0 +1,61 @@
+// Fichier: dns/qualifiers.go (mécanismes non "pass")
+
+package dns
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"project/spf-flattener/cidr"
+	"project/spf-flattener/spf"
+)
+
+// nonPassNet is an ip4/ip6 network that an upstream record softfails, fails or leaves
+// neutral. Flattening drops such mechanisms, so they are only kept for conflict reports.
+type nonPassNet struct {
+	ipNet  *net.IPNet
+	source string
+}
+
+// recordNonPass remembers the network of a non-pass ip4/ip6 mechanism of domain's record.
+func (r *Resolver) recordNonPass(domain string, term spf.Term) {
+	value := term.Value
+	if !strings.Contains(value, "/") {
+		if term.Name == "ip4" {
+			value += "/32"
+		} else {
+			value += "/128"
+		}
+	}
+	_, ipNet, err := net.ParseCIDR(value)
+	if err != nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nonPass = append(r.nonPass, nonPassNet{ipNet: ipNet, source: term.String() + " in " + domain})
+}
+
+// QualifierConflicts lists the flattened networks that overlap a network another record
+// of the chain qualifies with ~, - or ?. Flattening turns them all into pass, so the
+// intent of the non-pass mechanism is lost and a human should decide.
+func (r *Resolver) QualifierConflicts(nets cidr.NetAddrSlice) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var conflicts []string
+	for _, n := range nets {
+		for _, np := range r.nonPass {
+			if !n.IPNet.Contains(np.ipNet.IP) && !np.ipNet.Contains(n.IPNet.IP) {
+				continue
+			}
+			source := n.Source
+			if n.IsPriority {
+				source = fmt.Sprintf("priority entry #%d", n.OriginalPriorityIndex+1)
+			}
+			conflicts = append(conflicts, fmt.Sprintf("%s (%s) overlaps %s (%s)", n.IPNet, source, np.ipNet, np.source))
+		}
+	}
+	return conflicts
+}
@@ -0,0 +1,32 @@
+// Fichier: dns/resolvconf.go
+
+package dns
+
+import (
+	"log"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// resolvConf is the system resolver configuration read when no nameserver is configured.
+const resolvConf = "/etc/resolv.conf"
+
+// fallbackNameserver is used when the system configuration is missing or lists no server,
+// as on Windows.
+const fallbackNameserver = "1.1.1.1:53"
+
+// systemNameservers returns the nameservers listed in the resolv.conf file at path, as
+// host:port, or the public fallback when there are none.
+func systemNameservers(path string) []string {
+	conf, err := dns.ClientConfigFromFile(path)
+	if err != nil || len(conf.Servers) == 0 {
+		log.Printf("WARN: No nameserver found in %s (%v), using %s", path, err, fallbackNameserver)
+		return []string{fallbackNameserver}
+	}
+	servers := make([]string, len(conf.Servers))
+	for i, server := range conf.Servers {
+		servers[i] = net.JoinHostPort(server, conf.Port)
+	}
+	return servers
+}
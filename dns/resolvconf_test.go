@@ -0,0 +1,84 @@
+package dns
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestSystemNameservers(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string // "" leaves the file missing
+		want    []string
+	}{
+		{"several servers", "search example.com\nnameserver 192.0.2.53\nnameserver 198.51.100.53\nnameserver 2001:db8::53\n",
+			[]string{"192.0.2.53:53", "198.51.100.53:53", "[2001:db8::53]:53"}},
+		{"single server", "nameserver 192.0.2.53\noptions ndots:1\n", []string{"192.0.2.53:53"}},
+		{"no server", "search example.com\n", []string{fallbackNameserver}},
+		{"missing file", "", []string{fallbackNameserver}},
+	}
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "resolv.conf")
+			if tt.content != "" {
+				if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := systemNameservers(path); !slices.Equal(got, tt.want) {
+				t.Errorf("systemNameservers() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// failing answers SERVFAIL from the servers it lists and defers to perServer otherwise.
+type failing []string
+
+func (f failing) Exchange(m *dns.Msg, server string) (*dns.Msg, error) {
+	if slices.Contains(f, server) {
+		resp := new(dns.Msg)
+		resp.SetRcode(m, dns.RcodeServerFailure)
+		return resp, nil
+	}
+	return perServer{}.Exchange(m, server)
+}
+
+// TestSystemNameserversFailover checks that the servers of resolv.conf are tried in order.
+func TestSystemNameserversFailover(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "resolv.conf")
+	if err := os.WriteFile(path, []byte("nameserver 192.0.2.53\nnameserver 198.51.100.53\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	tests := []struct {
+		name    string
+		failing failing
+		want    string
+	}{
+		{"first answers", nil, "from 192.0.2.53:53"},
+		{"first fails", failing{"192.0.2.53:53"}, "from 198.51.100.53:53"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewResolver(systemNameservers(path), 4, 4, 10)
+			r.Exchanger = tt.failing
+			resp, err := r.resolveTXT("example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := resp.Answer[0].(*dns.TXT).Txt[0]; got != tt.want {
+				t.Errorf("answer %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
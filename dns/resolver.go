@@ -3,46 +3,146 @@
 package dns
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"project/spf-flattener/cidr"
+	"project/spf-flattener/providers"
+	"project/spf-flattener/spf"
 
 	"github.com/miekg/dns"
 )
 
-const maxDNSLookups = 10 // Standard SPF lookup limit
+const maxDNSLookups = 10 // Default lookup limit, the standard SPF one
+
+// MaxRFCLookups is the lookup limit verifiers enforce (RFC 7208 section 4.6.4).
+const MaxRFCLookups = 10
 const dnsTimeout = 5 * time.Second
+const maxExplanationLength = 255 // Longer explanations are likely truncated by receivers
 
 // FlattenedResult contains the result of the SPF flattening process.
 type FlattenedResult struct {
 	IPNets        cidr.NetAddrSlice
 	TotalLookups  int
 	InitialDomain string
-	SLD           string // Second Level Domain
+	SLD           string // Registrable domain, see domainutil.RegistrableDomain
 }
 
 // Resolver manages DNS lookups with concurrency and state.
 type Resolver struct {
 	client *dns.Client
-	// lookupTracker maps FQDNs that initiated a DNS lookup to prevent cycles and count lookups.
-	lookupTracker map[string]struct{}
+	// nameservers are the recursive resolvers queried in order, as host:port. preferred
+	// is the index of the last one that answered, tried first to avoid paying a
+	// timeout on every query; failures counts the failed queries per server.
+	nameservers []string
+	preferred   int
+	failures    map[string]int
+	// lookupTracker maps FQDNs that initiated a DNS lookup to their flattening, shared by
+	// every include reaching them, and counts the lookups issued. includes holds the
+	// include and redirect edges followed so far, to tell cycles from shared includes.
+	lookupTracker map[string]*flight
+	includes      map[string][]string
 	// Mutex to protect concurrent access to lookupTracker.
 	mu sync.Mutex
-	// Semaphore to limit concurrent goroutines for DNS lookups.
-	semaphore chan struct{}
+	// queries limits the DNS queries in flight.
+	queries *pool
+	// branches limits the include records being fetched at once, so that wide chains
+	// do not send bursts of TXT queries.
+	branches *pool
+	// discarded counts answer RRs dropped because they did not match the question.
+	discarded int
+	// inFlight counts the flattenings in progress per domain, addresses the networks
+	// collected by the completed mechanisms (see Snapshot).
+	inFlight  map[string]int
+	addresses int
+	// breaker skips the servers that keep failing.
+	breaker breaker
+	// maxLookups is the operational limit on SPF records fetched while flattening.
+	maxLookups int
+
+	// Exchanger, when set, sends the queries instead of the network (see Recorder and
+	// Replayer).
+	Exchanger Exchanger
+	// Context, when set, ends the lookups once it is done: the queries of a run aborted
+	// by its runtime budget fail instead of reaching the network.
+	Context context.Context
+	// Parsed caches the parsed SPF records of the run; it may be shared with other users.
+	Parsed *spf.Cache
+	// Providers, when set, annotates includes of well-known email providers.
+	Providers *providers.Registry
+	// Strict turns anomalies skipped in upstream records into errors.
+	Strict bool
+	// OnParseError selects what happens when an include target's record does not parse:
+	// "fail" (default), "skip" the include, or "keep" it verbatim as a passthrough token.
+	OnParseError string
+	// OnExists selects what happens with exists: mechanisms: "error", "warn" (default)
+	// or "passthrough" to keep them verbatim.
+	OnExists string
+	// OnMacro selects what happens with mechanisms using SPF macros: "error" (default)
+	// or "passthrough" to keep them verbatim.
+	OnMacro string
+	// MergeMultipleSPF merges several SPF records published at one name instead of
+	// failing, as verifiers do with a permerror.
+	MergeMultipleSPF bool
+	// DropReservedRanges drops the private, link-local and multicast addresses of A/AAAA
+	// answers instead of only reporting them.
+	DropReservedRanges bool
+	// Authoritative makes SPF TXT lookups bypass the recursive resolver's cache
+	// by querying the authoritative servers of each zone.
+	Authoritative bool
+
+	// KeepSuffixes lists domain suffixes whose a: and mx: mechanisms are not resolved
+	// but kept verbatim as passthrough tokens.
+	KeepSuffixes []string
+	// FlattenOnlySuffixes, when set, limits flattening to the includes whose target is
+	// under one of these domain suffixes; the other includes are kept verbatim as
+	// passthrough tokens (see ExternalBoundary).
+	FlattenOnlySuffixes []string
+	// passthrough holds the mechanisms kept verbatim.
+	passthrough map[string]struct{}
+
+	// nonPass holds the ip4/ip6 networks of non-pass mechanisms met while flattening.
+	nonPass []nonPassNet
+
+	// records keeps the parsed SPF record of every domain flattened so far.
+	records map[string]*spf.Record
+	// zoneServers caches the authoritative server addresses per candidate zone name.
+	// An empty entry means the name is not a zone cut.
+	zoneServers map[string][]string
 }
 
-// NewResolver creates a new Resolver instance.
-func NewResolver(concurrencyLimit int) *Resolver {
+// NewResolver creates a new Resolver instance querying the recursive resolvers nameservers
+// (host:port) with failover, or those of /etc/resolv.conf when there are none. dnsQueries bounds the DNS queries in flight and includeBranches the include
+// records fetched at once. maxLookups bounds the SPF records fetched while flattening;
+// zero selects the RFC limit of 10.
+func NewResolver(nameservers []string, dnsQueries, includeBranches, maxLookups int) *Resolver {
+	if maxLookups <= 0 {
+		maxLookups = maxDNSLookups
+	}
+	if len(nameservers) == 0 {
+		nameservers = systemNameservers(resolvConf)
+	}
 	return &Resolver{
 		client:        &dns.Client{Timeout: dnsTimeout},
-		lookupTracker: make(map[string]struct{}),
-		semaphore:     make(chan struct{}, concurrencyLimit),
+		nameservers:   nameservers,
+		failures:      make(map[string]int),
+		lookupTracker: make(map[string]*flight),
+		includes:      make(map[string][]string),
+		inFlight:      make(map[string]int),
+		maxLookups:    maxLookups,
+		Parsed:        spf.NewCache(),
+		queries:       newPool(dnsQueries),
+		branches:      newPool(includeBranches),
+		passthrough:   make(map[string]struct{}),
+		records:       make(map[string]*spf.Record),
+		zoneServers:   make(map[string][]string),
 	}
 }
 
@@ -53,144 +153,740 @@ func (r *Resolver) GetLookupCount() int {
 	return len(r.lookupTracker)
 }
 
+// PeakConcurrency returns the peak number of DNS queries and include fetches in flight,
+// with the size of their pools.
+func (r *Resolver) PeakConcurrency() (queries, queriesSize, branches, branchesSize int) {
+	queries, queriesSize = r.queries.stats()
+	branches, branchesSize = r.branches.stats()
+	return
+}
+
+// BreakerStats returns the number of queries skipped by open circuit breakers and the
+// servers whose breaker is still open.
+func (r *Resolver) BreakerStats() (skipped int, open []string) {
+	return r.breaker.stats()
+}
+
+// GetDiscardedCount safely returns the number of answer RRs discarded so far.
+func (r *Resolver) GetDiscardedCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.discarded
+}
+
+// Record returns the parsed SPF record fetched for domain during flattening.
+func (r *Resolver) Record(domain string) (*spf.Record, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rec, ok := r.records[domain]
+	return rec, ok
+}
+
+// VerifierLookups returns the number of DNS-querying mechanisms a verifier evaluates
+// for domain's unflattened chain. Unlike GetLookupCount, which counts the queries we
+// issued, an include reachable through several parents is counted every time it is
+// reached, since verifiers do not cache across branches.
+func (r *Resolver) VerifierLookups(domain string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.verifierLookups(domain, make(map[string]bool))
+}
+
+// Subtree returns domain and every domain reached from it through include and redirect
+// while flattening.
+func (r *Resolver) Subtree(domain string) map[string]bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	seen := make(map[string]bool)
+	queue := []string{domain}
+	for len(queue) > 0 {
+		d := queue[0]
+		queue = queue[1:]
+		if seen[d] {
+			continue
+		}
+		seen[d] = true
+		rec, ok := r.records[d]
+		if !ok {
+			continue
+		}
+		terms, _ := rec.Effective()
+		for _, t := range terms {
+			if t.Name == "include" && !t.Modifier || t.Name == "redirect" && t.Modifier {
+				queue = append(queue, t.Value)
+			}
+		}
+	}
+	return seen
+}
+
+// verifierLookups walks the parsed records depth-first; path guards against cycles.
+func (r *Resolver) verifierLookups(domain string, path map[string]bool) int {
+	rec, ok := r.records[domain]
+	if !ok || path[domain] {
+		return 0
+	}
+	path[domain] = true
+	defer delete(path, domain)
+
+	n := 0
+	effective, _ := rec.Effective()
+	for _, t := range effective {
+		switch {
+		case !t.Modifier && (t.Name == "include"):
+			n += 1 + r.verifierLookups(t.Value, path)
+		case t.Modifier && t.Name == "redirect":
+			n += 1 + r.verifierLookups(t.Value, path)
+		case !t.Modifier && (t.Name == "a" || t.Name == "mx" || t.Name == "ptr" || t.Name == "exists"):
+			n++
+		}
+	}
+	return n
+}
+
 // resolveDNS performs the actual MIEKG DNS query and handles SERVFAIL/Timeout (Fail-Fast).
+// The nameservers are tried in order starting with the last one that answered; the next
+// one is tried only when a server fails to answer or answers SERVFAIL.
 func (r *Resolver) resolveDNS(domain string, qtype uint16) (*dns.Msg, error) {
-	c := new(dns.Client)
+	if r.Context != nil {
+		if err := r.Context.Err(); err != nil {
+			return nil, err
+		}
+	}
+	r.mu.Lock()
+	start := r.preferred
+	r.mu.Unlock()
+
+	var tried []string
+	var err error
+	for i := range r.nameservers {
+		n := (start + i) % len(r.nameservers)
+		server := r.nameservers[n]
+		tried = append(tried, server)
+
+		var resp *dns.Msg
+		resp, err = r.exchange(domain, qtype, server, true)
+		var lerr *LookupError
+		if err == nil || !errors.As(err, &lerr) || !lerr.Retryable() {
+			r.mu.Lock()
+			r.preferred = n
+			r.mu.Unlock()
+			return resp, err
+		}
+		r.mu.Lock()
+		r.failures[server]++
+		r.mu.Unlock()
+	}
+	if len(tried) > 1 {
+		err = fmt.Errorf("%w (nameservers tried: %s)", err, strings.Join(tried, ", "))
+	}
+	return nil, err
+}
+
+// NameserverFailures returns the number of failed queries per nameserver, or nil when
+// every query was answered.
+func (r *Resolver) NameserverFailures() map[string]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.failures) == 0 {
+		return nil
+	}
+	failures := make(map[string]int, len(r.failures))
+	for server, n := range r.failures {
+		failures[server] = n
+	}
+	return failures
+}
+
+// Nameservers returns the recursive resolvers queried, in order.
+func (r *Resolver) Nameservers() []string {
+	return r.nameservers
+}
+
+// exchange sends a single query to server and returns the filtered response.
+func (r *Resolver) exchange(domain string, qtype uint16, server string, recursionDesired bool) (*dns.Msg, error) {
+	if !r.breaker.allow(server) {
+		return nil, &LookupError{Domain: domain, Qtype: qtype, Rcode: -1, Err: ErrCircuitOpen}
+	}
+
+	// Bound the number of queries in flight
+	r.queries.acquire()
+	defer r.queries.release()
+
 	m := new(dns.Msg)
 	m.SetQuestion(dns.Fqdn(domain), qtype)
-	m.RecursionDesired = true
+	m.RecursionDesired = recursionDesired
 
-	// Use a standard public resolver for simplicity (e.g., Google DNS)
-	// In a production environment, one might use /etc/resolv.conf settings.
-	resp, _, err := c.Exchange(m, "193.51.24.1:53")
+	exchanger := r.Exchanger
+	if exchanger == nil {
+		exchanger = network{}
+	}
+	resp, err := exchanger.Exchange(m, server)
+	r.breaker.record(server, err != nil || resp == nil || resp.Rcode == dns.RcodeServerFailure)
 
 	if err != nil {
-		return nil, fmt.Errorf("DNS query error for %s (%s): %w", domain, dns.TypeToString[qtype], err)
+		return nil, &LookupError{Domain: domain, Qtype: qtype, Rcode: -1, Err: err}
 	}
-	if resp == nil || resp.Rcode != dns.RcodeSuccess {
-		return nil, fmt.Errorf("DNS response failed for %s (%s). Rcode: %s", domain, dns.TypeToString[qtype], dns.RcodeToString[resp.Rcode])
+	if resp == nil {
+		return nil, &LookupError{Domain: domain, Qtype: qtype, Rcode: -1, Err: errors.New("empty response")}
+	}
+	switch resp.Rcode {
+	case dns.RcodeSuccess:
+	case dns.RcodeNameError:
+		return nil, &LookupError{Domain: domain, Qtype: qtype, Rcode: resp.Rcode, Err: ErrNXDomain}
+	default:
+		return nil, &LookupError{Domain: domain, Qtype: qtype, Rcode: resp.Rcode, Err: fmt.Errorf("Rcode: %s", dns.RcodeToString[resp.Rcode])}
 	}
 
+	resp.Answer = r.filterAnswer(domain, qtype, resp.Answer)
 	return resp, nil
 }
 
+// filterAnswer keeps only IN-class RRs owned by the question name or by a CNAME target
+// chained from it. Anything else was stuffed into the answer by a broken path.
+func (r *Resolver) filterAnswer(domain string, qtype uint16, answer []dns.RR) []dns.RR {
+	owners := map[string]struct{}{dns.CanonicalName(domain): {}}
+	for changed := true; changed; {
+		changed = false
+		for _, rr := range answer {
+			cname, ok := rr.(*dns.CNAME)
+			if !ok {
+				continue
+			}
+			_, fromChain := owners[dns.CanonicalName(cname.Hdr.Name)]
+			target := dns.CanonicalName(cname.Target)
+			if _, seen := owners[target]; fromChain && !seen {
+				owners[target] = struct{}{}
+				changed = true
+			}
+		}
+	}
+
+	kept := answer[:0]
+	dropped := 0
+	for _, rr := range answer {
+		_, owned := owners[dns.CanonicalName(rr.Header().Name)]
+		if owned && rr.Header().Class == dns.ClassINET {
+			kept = append(kept, rr)
+			continue
+		}
+		dropped++
+	}
+
+	if dropped > 0 {
+		r.mu.Lock()
+		r.discarded += dropped
+		r.mu.Unlock()
+		log.Printf("Warning: Discarded %d answer RRs not matching the question %s (%s); this indicates a broken resolver or middlebox on the path.",
+			dropped, domain, dns.TypeToString[qtype])
+	}
+	return kept
+}
+
+// LookupDelegation returns the nameservers of the zone cut at name, if any.
+// An empty result means name is not delegated and lives in its parent zone.
+func (r *Resolver) LookupDelegation(name string) ([]string, error) {
+	resp, err := r.resolveDNS(name, dns.TypeNS)
+	if err != nil {
+		return nil, err
+	}
+
+	var hosts []string
+	for _, ans := range resp.Answer {
+		if ns, ok := ans.(*dns.NS); ok && strings.EqualFold(ns.Hdr.Name, dns.Fqdn(name)) {
+			hosts = append(hosts, ns.Ns)
+		}
+	}
+	return hosts, nil
+}
+
 // ResolveAAndAAAA performs a simple A and AAAA lookup and returns the results as NetAddr.
+// For priority entries, a family that fails while the other succeeds is reported as
+// degraded and the successful family's addresses are returned; the entry fails only when
+// both families fail or the name does not exist.
 func (r *Resolver) ResolveAAndAAAA(domain string, isPriority bool, priorityIndex int) (cidr.NetAddrSlice, error) {
+	return r.resolveAddresses(domain, isPriority, false, priorityIndex)
+}
+
+// ResolveBothFamilies is ResolveAAndAAAA for priority entries that require both address
+// families: any failed lookup fails the entry.
+func (r *Resolver) ResolveBothFamilies(domain string, priorityIndex int) (cidr.NetAddrSlice, error) {
+	return r.resolveAddresses(domain, true, true, priorityIndex)
+}
+
+func (r *Resolver) resolveAddresses(domain string, isPriority, requireBoth bool, priorityIndex int) (cidr.NetAddrSlice, error) {
 	var results cidr.NetAddrSlice
 
 	// A and AAAA lookups do not count towards the SPF 10 lookup limit.
 
-	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
-		resp, err := r.resolveDNS(domain, qtype)
+	// Query both families concurrently, then merge in order (A before AAAA).
+	qtypes := []uint16{dns.TypeA, dns.TypeAAAA}
+	resps := make([]*dns.Msg, len(qtypes))
+	errs := make([]error, len(qtypes))
+	var wg sync.WaitGroup
+	for i, qtype := range qtypes {
+		wg.Go(func() {
+			resps[i], errs[i] = r.resolveDNS(domain, qtype)
+		})
+	}
+	wg.Wait()
+
+	if isPriority {
+		// Fail-fast for critical priority entries when nothing usable came back
+		failed := 0
+		for _, err := range errs {
+			if err == nil {
+				continue
+			}
+			failed++
+			if requireBoth || errors.Is(err, ErrNXDomain) {
+				return nil, err
+			}
+		}
+		if failed == len(errs) {
+			return nil, errors.Join(errs...)
+		}
+	}
+
+	for i, qtype := range qtypes {
+		resp, err := resps[i], errs[i]
 		if err != nil {
-			// Log and continue if simple A/AAAA fails, unless it's a priority fail-fast point.
-			log.Printf("Warning: Failed to resolve %s records for %s: %v", dns.TypeToString[qtype], domain, err)
+			// Log and continue if simple A/AAAA fails; priority entries keep the other family.
 			if isPriority {
-				return nil, err // Fail-fast for critical priority entries
+				log.Printf("WARN: Degraded priority entry %s: %s lookup failed, using the other address family only: %v", domain, dns.TypeToString[qtype], err)
+			} else {
+				log.Printf("Warning: Failed to resolve %s records for %s: %v", dns.TypeToString[qtype], domain, err)
 			}
 			continue
 		}
 
+		var ips []net.IP
 		for _, ans := range resp.Answer {
 			switch t := ans.(type) {
 			case *dns.A:
-				// Use /32 for A records
-				mask := net.CIDRMask(32, 32)
-				results = append(results, &cidr.NetAddr{
-					IPNet:                 &net.IPNet{IP: t.A, Mask: mask},
-					IsPriority:            isPriority,
-					OriginalPriorityIndex: priorityIndex,
-				})
+				ips = append(ips, t.A)
 			case *dns.AAAA:
-				// Use /128 for AAAA records
-				mask := net.CIDRMask(128, 128)
-				results = append(results, &cidr.NetAddr{
-					IPNet:                 &net.IPNet{IP: t.AAAA, Mask: mask},
-					IsPriority:            isPriority,
-					OriginalPriorityIndex: priorityIndex,
-				})
+				ips = append(ips, t.AAAA)
 			}
 		}
+		// Use /32 for A records, /128 for AAAA records
+		bits := 32
+		if qtype == dns.TypeAAAA {
+			bits = 128
+		}
+		for _, ip := range r.sanitize(domain, dns.TypeToString[qtype], ips) {
+			results = append(results, &cidr.NetAddr{
+				IPNet:                 &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)},
+				IsPriority:            isPriority,
+				OriginalPriorityIndex: priorityIndex,
+				FromLookup:            true,
+			})
+		}
 	}
 	return results, nil
 }
 
 // FlattenSPF recursively resolves the SPF record for a given domain, handling concurrency and limits.
 func (r *Resolver) FlattenSPF(domain string, initialDomain string, isPriority bool, priorityIndex int) (cidr.NetAddrSlice, error) {
-	// Fail-Fast: Check lookup limit
-	if r.GetLookupCount() >= maxDNSLookups {
-		return nil, fmt.Errorf("lookup limit of %d reached for domain %s (current count: %d)",
-			maxDNSLookups, domain, r.GetLookupCount())
+	return r.flatten("", domain, initialDomain, isPriority, priorityIndex)
+}
+
+// flight is the flattening of one domain. An include reaching a domain already flattened,
+// or being flattened, by another branch waits for it and shares its result, so that a
+// shared include contributes to every parent whichever branch got to it first.
+type flight struct {
+	done chan struct{}
+	nets cidr.NetAddrSlice
+	err  error
+}
+
+// result returns a copy of the networks of the flight, as parents annotate them.
+func (f *flight) result() (cidr.NetAddrSlice, error) {
+	nets := make(cidr.NetAddrSlice, len(f.nets))
+	for i, n := range f.nets {
+		c := *n
+		nets[i] = &c
 	}
+	return nets, f.err
+}
 
-	r.mu.Lock()
-	// Fail-Fast: Check for recursion/cycle
-	if _, ok := r.lookupTracker[domain]; ok {
-		r.mu.Unlock()
-		log.Printf("Warning: Detected recursion/cycle for domain %s, skipping.", domain)
+// flatten flattens domain, included or redirected to from parent ("" at the top).
+func (r *Resolver) flatten(parent, domain, initialDomain string, isPriority bool, priorityIndex int) (cidr.NetAddrSlice, error) {
+	// Fail-Fast: Check lookup limit and recursion/cycle, then track the lookup
+	f, owner, err := r.track(parent, domain)
+	if errors.Is(err, ErrCycle) {
+		log.Printf("Warning: %v, skipping.", err)
 		return nil, nil
+	} else if err != nil {
+		return nil, err
 	}
+	if !owner {
+		<-f.done
+		log.Printf("INFO: %s is included through several parents, its flattening is shared", domain)
+		return f.result()
+	}
+	f.nets, f.err = r.flattenRecord(domain, initialDomain, isPriority, priorityIndex)
+	close(f.done)
+	return f.nets, f.err
+}
 
-	// Track the lookup
-	r.lookupTracker[domain] = struct{}{}
-	r.mu.Unlock()
-
+// flattenRecord fetches the SPF record of domain and flattens its mechanisms.
+func (r *Resolver) flattenRecord(domain string, initialDomain string, isPriority bool, priorityIndex int) (cidr.NetAddrSlice, error) {
 	log.Printf("INFO: Starting SPF resolution for %s (Lookup #%d)", domain, r.GetLookupCount())
+	r.begin(domain)
+	collected := 0
+	defer func() { r.end(domain, collected) }()
 
-	// Resolve TXT record
-	resp, err := r.resolveDNS(domain, dns.TypeTXT)
+	spfRecord, lengths, err := r.fetchSPFStrings(domain)
+	if errors.Is(err, ErrNoSPFRecord) {
+		log.Printf("Warning: No valid SPF record found for %s. Skipping.", domain)
+		return nil, nil
+	}
 	if err != nil {
 		log.Printf("ERROR: Fail-fast: DNS TXT resolution failed for domain %s: %v", domain, err)
 		return nil, err
 	}
 
-	// Find SPF record
-	spfRecord := ""
-	for _, ans := range resp.Answer {
-		if t, ok := ans.(*dns.TXT); ok && len(t.Txt) > 0 && strings.HasPrefix(strings.ToLower(t.Txt[0]), "v=spf1") {
-			spfRecord = strings.Join(t.Txt, "")
-			break
+	record, err := r.Parsed.Parse(domain, spfRecord)
+	var perr *spf.ParseError
+	if errors.As(err, &perr) {
+		// Operators see the separate character-strings in their DNS console
+		perr.Locate(lengths)
+	}
+	if err != nil {
+		// An include target's broken record may be skipped or kept per policy; the
+		// target's own record always fails.
+		switch {
+		case domain == initialDomain || r.OnParseError == "" || r.OnParseError == "fail":
+			return nil, err
+		case r.OnParseError == "keep":
+			log.Printf("WARN: Unparseable SPF record of %s, include kept verbatim: %v", domain, err)
+			r.addPassthrough("include:" + domain)
+		default:
+			log.Printf("WARN: Unparseable SPF record of %s, include skipped: %v", domain, err)
 		}
+		return nil, nil
 	}
+	r.mu.Lock()
+	r.records[domain] = record
+	r.mu.Unlock()
 
-	if spfRecord == "" {
-		log.Printf("Warning: No valid SPF record found for %s. Skipping.", domain)
-		return nil, nil
+	// Resolve mechanisms concurrently. Each result lands in the slot of its position in
+	// the record and slots are merged in record order, so the output does not depend on
+	// goroutine scheduling.
+	effective, ignored := record.Effective()
+	if len(ignored) > 0 {
+		log.Printf("WARN: %d mechanisms after 'all' in the SPF record of %s are ignored by verifiers and not flattened: %s",
+			len(ignored), domain, joinTerms(ignored))
 	}
 
-	// Process mechanisms sequentially
-	mechanisms := strings.Fields(spfRecord)[1:] // Skip "v=spf1"
-	var allNets cidr.NetAddrSlice
+	var terms []spf.Term
+	redirect, hasAll := "", false
+	for _, term := range effective {
+		if term.Modifier {
+			switch term.Name {
+			case "exp":
+				r.reportExplanation(domain, term.Value)
+			case "redirect":
+				redirect = term.Value
+			}
+			continue
+		}
+		if term.Name == "all" {
+			hasAll = true
+		}
+		if !term.Pass() {
+			// Only mechanisms that authorize senders are flattened
+			if term.Name == "ip4" || term.Name == "ip6" {
+				r.recordNonPass(domain, term)
+			}
+			continue
+		}
 
-	for _, mechanism := range mechanisms {
-		if strings.HasPrefix(mechanism, "a") ||
-			strings.HasPrefix(mechanism, "mx") ||
-			strings.HasPrefix(mechanism, "ptr") ||
-			strings.HasPrefix(mechanism, "ip4") ||
-			strings.HasPrefix(mechanism, "ip6") ||
-			strings.HasPrefix(mechanism, "include") {
+		switch term.Name {
+		case "a", "mx", "ptr", "ip4", "ip6", "include":
+			terms = append(terms, term)
+		case "exists":
+			if err := r.handleExists(domain, term); err != nil {
+				return nil, err
+			}
+		}
+	}
 
-			nets, err := r.resolveMechanism(domain, mechanism, isPriority, priorityIndex, initialDomain)
-			if err != nil {
-				return nil, fmt.Errorf("error resolving mechanism %s in %s: %w", mechanism, domain, err)
+	ctx := evalContext{domain: domain, origin: initialDomain}
+	slots := make([]cidr.NetAddrSlice, len(terms))
+	errs := make([]error, len(terms))
+	var wg sync.WaitGroup
+	for i, term := range terms {
+		wg.Go(func() {
+			slots[i], errs[i] = r.resolveMechanism(ctx, term, isPriority, priorityIndex)
+		})
+	}
+	wg.Wait()
+
+	var allNets cidr.NetAddrSlice
+	for i, term := range terms {
+		if errs[i] != nil {
+			return nil, fmt.Errorf("error resolving mechanism %s in %s (record %q): %w", term, domain, snippet(spfRecord), errs[i])
+		}
+		for _, n := range slots[i] {
+			if n.Source == "" {
+				n.Source = term.String() + " in " + domain
 			}
-			allNets = append(allNets, nets...)
+		}
+		allNets = append(allNets, slots[i]...)
+		if term.Name != "include" {
+			collected += len(slots[i])
 		}
 	}
 
+	// redirect= replaces the record when no all mechanism matched (RFC 7208 section 6.1).
+	// The target is flattened like an include: one lookup, guarded against cycles.
+	switch {
+	case redirect != "" && hasAll:
+		log.Printf("INFO: redirect=%s in %s is ignored by verifiers since the record has an all mechanism", redirect, domain)
+	case redirect != "":
+		log.Printf("INFO: Following redirect=%s from %s", redirect, domain)
+		nets, err := r.flatten(domain, redirect, initialDomain, isPriority, priorityIndex)
+		if err != nil {
+			return nil, fmt.Errorf("error following redirect=%s in %s: %w", redirect, domain, err)
+		}
+		allNets = append(allNets, nets...)
+	}
+
 	return allNets, nil
 }
 
+// handleExists applies the OnExists policy to an exists: mechanism of domain's record. Its
+// result depends on the connecting client, so it cannot be turned into networks.
+func (r *Resolver) handleExists(domain string, term spf.Term) error {
+	switch r.OnExists {
+	case "error":
+		return fmt.Errorf("%s in the SPF record of %s cannot be flattened (onExists: error)", term, domain)
+	case "passthrough":
+		log.Printf("INFO: %s in %s kept verbatim; receivers evaluate it and it costs one lookup", term, domain)
+		r.addPassthrough(term.String())
+	default:
+		log.Printf("WARN: %s in %s cannot be flattened and is dropped; the generated record is narrower than the original", term, domain)
+	}
+	return nil
+}
+
+// joinTerms returns the text of terms separated by spaces.
+func joinTerms(terms []spf.Term) string {
+	parts := make([]string, len(terms))
+	for i, t := range terms {
+		parts[i] = t.String()
+	}
+	return strings.Join(parts, " ")
+}
+
+// track records a lookup of domain from parent. It returns the flight of domain, owned
+// by the caller when domain is met for the first time and counted as a lookup then. It
+// returns ErrLookupLimit when the budget is spent and ErrCycle if domain leads back to
+// parent. Both checks happen under the same lock as the update so concurrent branches
+// cannot overshoot the budget, nor wait on each other around a cycle.
+func (r *Resolver) track(parent, domain string) (*flight, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if f, ok := r.lookupTracker[domain]; ok {
+		if parent == "" || r.reaches(domain, parent) {
+			return nil, false, fmt.Errorf("%w: %s", ErrCycle, domain)
+		}
+		r.includes[parent] = append(r.includes[parent], domain)
+		return f, false, nil
+	}
+	if len(r.lookupTracker) >= r.maxLookups {
+		return nil, false, fmt.Errorf("%w: limit of %d reached for domain %s (current count: %d)",
+			ErrLookupLimit, r.maxLookups, domain, len(r.lookupTracker))
+	}
+	f := &flight{done: make(chan struct{})}
+	r.lookupTracker[domain] = f
+	if parent != "" {
+		r.includes[parent] = append(r.includes[parent], domain)
+	}
+	return f, true, nil
+}
+
+// reaches reports whether to is from itself or reachable from it through the include
+// edges followed so far. Callers hold r.mu.
+func (r *Resolver) reaches(from, to string) bool {
+	seen := make(map[string]bool)
+	queue := []string{from}
+	for len(queue) > 0 {
+		d := queue[0]
+		queue = queue[1:]
+		if d == to {
+			return true
+		}
+		if !seen[d] {
+			seen[d] = true
+			queue = append(queue, r.includes[d]...)
+		}
+	}
+	return false
+}
+
+// fetchSPF returns the SPF record published at domain, or ErrNoSPFRecord.
+func (r *Resolver) fetchSPF(domain string) (string, error) {
+	record, _, err := r.fetchSPFStrings(domain)
+	return record, err
+}
+
+// fetchSPFStrings is fetchSPF also returning the lengths of the character-strings the
+// record was joined from, to locate parse errors.
+func (r *Resolver) fetchSPFStrings(domain string) (string, []int, error) {
+	// The branch slot is only held for the fetch: holding it while the record's own
+	// includes are resolved could exhaust the pool and deadlock deep chains.
+	r.branches.acquire()
+	resp, err := r.resolveTXT(domain)
+	r.branches.release()
+	if err != nil {
+		return "", nil, err
+	}
+
+	var records []string
+	var lengths []int
+	for _, ans := range resp.Answer {
+		if t, ok := ans.(*dns.TXT); ok && len(t.Txt) > 0 && spf.IsSPF(t.Txt[0]) {
+			record := strings.Join(t.Txt, "")
+			if first, ok := spf.SplitConcatenated(record); ok {
+				if r.Strict {
+					return "", nil, fmt.Errorf("multiple SPF strings concatenated in one TXT RR at %s: %q", domain, record)
+				}
+				log.Printf("Warning: Multiple SPF strings concatenated in one TXT RR at %s, using only the first: %q", domain, first)
+				record = first
+			}
+			if records = append(records, record); len(records) == 1 {
+				for _, str := range t.Txt {
+					lengths = append(lengths, len(str))
+				}
+			}
+		}
+	}
+
+	switch {
+	case len(records) == 0:
+		return "", nil, fmt.Errorf("%w at %s", ErrNoSPFRecord, domain)
+	case len(records) == 1:
+		return records[0], lengths, nil
+	case !r.MergeMultipleSPF:
+		return "", nil, fmt.Errorf("%w at %s (permerror per RFC 7208 section 4.5): %q", ErrMultipleSPF, domain, records)
+	}
+	log.Printf("WARN: %d SPF records at %s merged (mergeMultipleSPF); verifiers return permerror: %q", len(records), domain, records)
+	return mergeSPF(records), nil, nil
+}
+
+// mergeSPF merges several SPF records into one. Evaluation stops at an all mechanism, so
+// the all mechanisms are dropped and the first one found, in the sorted order that keeps
+// runs stable, ends the merged record.
+func mergeSPF(records []string) string {
+	// Answer order is not stable: merge in a fixed order so runs agree
+	sort.Strings(records)
+	terms := []string{"v=spf1"}
+	var all string
+	for _, record := range records {
+		for _, term := range strings.Fields(record)[1:] {
+			if strings.EqualFold(strings.TrimLeft(term, "+-~?"), "all") {
+				if all == "" {
+					all = term
+				}
+				continue
+			}
+			terms = append(terms, term)
+		}
+	}
+	if all != "" {
+		terms = append(terms, all)
+	}
+	return strings.Join(terms, " ")
+}
+
+// FetchSPF returns the SPF record published at domain, without flattening it nor counting
+// a lookup.
+func (r *Resolver) FetchSPF(domain string) (string, error) {
+	return r.fetchSPF(domain)
+}
+
+// reportExplanation fetches the TXT record targeted by an exp= modifier and logs its content.
+// Receivers only fetch it on failure, so this lookup is not tracked against the SPF budget.
+func (r *Resolver) reportExplanation(domain, target string) {
+	if strings.Contains(target, "%{") {
+		log.Printf("INFO: exp= modifier in %s uses macros (%s); explanation is expanded by receivers and not fetched.", domain, target)
+		return
+	}
+
+	resp, err := r.resolveDNS(target, dns.TypeTXT)
+	if err != nil {
+		log.Printf("Warning: exp= modifier in %s points at %s, which could not be resolved (not counted as a lookup): %v", domain, target, err)
+		return
+	}
+
+	explanation := ""
+	for _, ans := range resp.Answer {
+		if t, ok := ans.(*dns.TXT); ok {
+			explanation = strings.Join(t.Txt, "")
+			break
+		}
+	}
+
+	switch {
+	case strings.TrimSpace(explanation) == "":
+		log.Printf("Warning: exp= modifier in %s points at %s, which has no explanation text.", domain, target)
+	case len(explanation) > maxExplanationLength:
+		log.Printf("Warning: Explanation at %s is %d bytes long (over %d): %q", target, len(explanation), maxExplanationLength, explanation)
+	default:
+		log.Printf("INFO: Explanation at %s (not counted as a lookup): %q", target, explanation)
+	}
+}
+
+// evalContext is the evaluation context of a record (RFC 7208 section 4.8). domain is the
+// <domain> that a, mx and ptr without a domain-spec refer to: the name whose record is
+// evaluated. An include (or redirect) target becomes the new domain; a CNAME followed while
+// fetching the TXT record does not. origin is the domain the chain started from.
+type evalContext struct {
+	domain string
+	origin string
+}
+
+// target returns the domain a mechanism queries: its domain-spec, or the current domain.
+func (c evalContext) target(mechanism spf.Term) string {
+	if mechanism.Value != "" {
+		// Example: a:other.com, mx:mail.other.com
+		return mechanism.Value
+	}
+	return c.domain
+}
+
 // resolveMechanism handles the logic for different SPF mechanisms.
-func (r *Resolver) resolveMechanism(baseDomain, mechanism string, isPriority bool, priorityIndex int, initialDomain string) (cidr.NetAddrSlice, error) {
-	// IP4/IP6: Direct CIDR inclusion (no DNS lookup)
-	if strings.HasPrefix(mechanism, "ip4:") || strings.HasPrefix(mechanism, "ip6:") {
-		cidrText := mechanism[4:]
+func (r *Resolver) resolveMechanism(ctx evalContext, mechanism spf.Term, isPriority bool, priorityIndex int) (cidr.NetAddrSlice, error) {
+	// Macros expand per connecting client: the domain-spec is not a literal name
+	if strings.Contains(mechanism.Value, "%{") {
+		if r.OnMacro == "passthrough" {
+			log.Printf("INFO: %s in %s uses SPF macros and is kept verbatim", mechanism, ctx.domain)
+			r.addPassthrough(mechanism.String())
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%s in the SPF record of %s uses SPF macros, which depend on the connecting client and cannot be flattened (set onMacro: passthrough to keep it verbatim)", mechanism, ctx.domain)
+	}
+
+	switch mechanism.Name {
+	case "ip4", "ip6":
+		// IP4/IP6: Direct CIDR inclusion (no DNS lookup)
+		cidrText := mechanism.Value
+
+		if reason := nonGlobalLiteral(cidrText); reason != "" {
+			if r.Strict {
+				return nil, fmt.Errorf("non-global address in %s: %s", mechanism, reason)
+			}
+			log.Printf("Warning: Non-global address in upstream SPF of %s, skipped: %s (%s)", ctx.domain, mechanism, reason)
+			return nil, nil
+		}
 
 		// Try plain IP first (no mask)
 		if ip := net.ParseIP(cidrText); ip != nil {
 			// Validate family matches mechanism
-			if strings.HasPrefix(mechanism, "ip4:") {
+			if mechanism.Name == "ip4" {
 				if ip = ip.To4(); ip == nil {
 					return nil, fmt.Errorf("expected IPv4 address for %s", mechanism)
 				}
@@ -217,37 +913,41 @@ func (r *Resolver) resolveMechanism(baseDomain, mechanism string, isPriority boo
 		return cidr.NetAddrSlice{
 			&cidr.NetAddr{IPNet: ipNet, IsPriority: isPriority, OriginalPriorityIndex: priorityIndex},
 		}, nil
-	}
 
-	// INCLUDE: Recursive call (uses 1 DNS lookup)
-	if strings.HasPrefix(mechanism, "include:") {
-		includedDomain := mechanism[8:]
-		if includedDomain == baseDomain {
+	case "include":
+		// INCLUDE: Recursive call (uses 1 DNS lookup)
+		includedDomain := mechanism.Value
+		if strings.EqualFold(includedDomain, ctx.domain) {
 			log.Printf("Warning: Skipping self-referential include: %s", includedDomain)
 			return nil, nil
 		}
+		r.annotateProvider(includedDomain)
+		if len(r.FlattenOnlySuffixes) > 0 && !matchSuffix(includedDomain, r.FlattenOnlySuffixes) {
+			r.addPassthrough(mechanism.String())
+			return nil, nil
+		}
 		// Recursive call: The result will be added to the final list
-		return r.FlattenSPF(includedDomain, initialDomain, isPriority, priorityIndex)
+		return r.flatten(ctx.domain, includedDomain, ctx.origin, isPriority, priorityIndex)
 	}
 
 	// A, MX, PTR: Need DNS resolution
-	targetDomain := baseDomain // Default to baseDomain for a, mx, ptr without parameters
-	if strings.Contains(mechanism, ":") {
-		// Example: a:other.com, mx:mail.other.com
-		parts := strings.SplitN(mechanism, ":", 2)
-		targetDomain = parts[1]
+	targetDomain := ctx.target(mechanism)
+
+	if (mechanism.Name == "a" || mechanism.Name == "mx") && mechanism.Value != "" && r.keep(mechanism.Value) {
+		r.addPassthrough(mechanism.String())
+		return nil, nil
 	}
 
-	switch {
-	case strings.HasPrefix(mechanism, "a"):
+	switch mechanism.Name {
+	case "a":
 		// A mechanism: Resolve A/AAAA records for the target domain
 		return r.ResolveAAndAAAA(targetDomain, isPriority, priorityIndex)
 
-	case strings.HasPrefix(mechanism, "mx"):
+	case "mx":
 		// MX mechanism: Resolve MX records, then A/AAAA for each MX host
 		return r.resolveMX(targetDomain, isPriority, priorityIndex)
 
-	case strings.HasPrefix(mechanism, "ptr"):
+	case "ptr":
 		// PTR mechanism: PTR is generally discouraged. Resolve it if required.
 		// (Implementation of PTR resolution is complex and often skipped in real flatteners,
 		// but we respect the requirement)
@@ -255,11 +955,100 @@ func (r *Resolver) resolveMechanism(baseDomain, mechanism string, isPriority boo
 		return r.resolvePTR(targetDomain, isPriority, priorityIndex)
 
 	default:
-		// Unknown mechanism (like exists, redirect, or simple 'a' without domain)
+		// Unknown mechanism (like exists or all)
 		return nil, nil
 	}
 }
 
+// nonGlobalLiteral reports why an ip4/ip6 value can never match a sender on the internet,
+// or returns "" when it is publishable. Malformed values are left to the CIDR parser.
+func nonGlobalLiteral(value string) string {
+	addr, _, hasPrefix := strings.Cut(value, "/")
+	if strings.Contains(addr, "%") {
+		return "zone identifier"
+	}
+	ip := net.ParseIP(addr)
+	switch {
+	case ip == nil:
+		return ""
+	case ip.IsUnspecified() && !hasPrefix:
+		return "unspecified address"
+	case ip.IsLoopback():
+		return "loopback address"
+	case ip.IsLinkLocalUnicast():
+		return "link-local address"
+	case ip.IsMulticast():
+		return "multicast address"
+	}
+	return ""
+}
+
+// snippet shortens a record for inclusion in error messages.
+func snippet(record string) string {
+	const maxLen = 120
+	if len(record) <= maxLen {
+		return record
+	}
+	return record[:maxLen] + "..."
+}
+
+// keep reports whether domain matches one of the passthrough suffixes.
+func (r *Resolver) keep(domain string) bool {
+	return matchSuffix(domain, r.KeepSuffixes)
+}
+
+// matchSuffix reports whether domain is one of the suffixes or a subdomain of one.
+func matchSuffix(domain string, suffixes []string) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	for _, suffix := range suffixes {
+		suffix = strings.ToLower(strings.TrimSuffix(suffix, "."))
+		if domain == suffix || strings.HasSuffix(domain, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// addPassthrough records a mechanism to be copied verbatim into the output.
+func (r *Resolver) addPassthrough(token string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.passthrough[token]; ok {
+		return
+	}
+	log.Printf("INFO: Keeping %s as a passthrough mechanism (not flattened)", token)
+	r.passthrough[token] = struct{}{}
+}
+
+// Passthrough returns the mechanisms kept verbatim, sorted so that the output does not
+// depend on the order in which concurrent branches discovered them.
+func (r *Resolver) Passthrough() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tokens := make([]string, 0, len(r.passthrough))
+	for t := range r.passthrough {
+		tokens = append(tokens, t)
+	}
+	sort.Strings(tokens)
+	return tokens
+}
+
+// annotateProvider logs the provider behind a well-known include domain and warns when
+// that provider advises against flattening its record.
+func (r *Resolver) annotateProvider(domain string) {
+	if r.Providers == nil {
+		return
+	}
+	p, ok := r.Providers.Match(domain)
+	if !ok {
+		return
+	}
+	log.Printf("INFO: include:%s belongs to %s", domain, p.Name)
+	if p.AvoidFlattening {
+		log.Printf("Warning: Flattening include:%s although %s advises against it: %s", domain, p.Name, p.Guidance)
+	}
+}
+
 // resolveMX performs resolution for the 'mx' mechanism.
 func (r *Resolver) resolveMX(domain string, isPriority bool, priorityIndex int) (cidr.NetAddrSlice, error) {
 	resp, err := r.resolveDNS(domain, dns.TypeMX)
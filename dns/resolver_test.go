@@ -0,0 +1,733 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"project/spf-flattener/cidr"
+	"project/spf-flattener/dns/dnstest"
+	"project/spf-flattener/spf"
+)
+
+func TestMergeSPF(t *testing.T) {
+	tests := []struct {
+		name    string
+		records []string
+		want    string
+	}{
+		{
+			"all of every record dropped",
+			[]string{"v=spf1 ip4:198.51.100.0/25 -all", "v=spf1 ip4:198.51.100.128/25 ip6:2001:db8::/32 -all"},
+			"v=spf1 ip4:198.51.100.0/25 ip4:198.51.100.128/25 ip6:2001:db8::/32 -all",
+		},
+		{
+			"answer order",
+			[]string{"v=spf1 include:b.example ~all", "v=spf1 include:a.example -all"},
+			"v=spf1 include:a.example include:b.example -all",
+		},
+		{
+			"without all",
+			[]string{"v=spf1 ip4:192.0.2.1", "v=spf1 ip4:192.0.2.2 redirect=c.example"},
+			"v=spf1 ip4:192.0.2.1 ip4:192.0.2.2 redirect=c.example",
+		},
+		{
+			"uppercase",
+			[]string{"v=spf1 ip4:192.0.2.1 -ALL", "v=spf1 ip4:192.0.2.2 All"},
+			"v=spf1 ip4:192.0.2.1 ip4:192.0.2.2 -ALL",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mergeSPF(tt.records); got != tt.want {
+				t.Errorf("mergeSPF(%q) = %q, want %q", tt.records, got, tt.want)
+			}
+		})
+	}
+}
+
+// delayed answers from a zone after a delay, failing the query types of rcodes.
+type delayed struct {
+	zone   *dnstest.Zone
+	delay  time.Duration
+	rcodes map[uint16]int
+}
+
+func (d delayed) Exchange(m *dns.Msg, server string) (*dns.Msg, error) {
+	time.Sleep(d.delay)
+	if rcode, ok := d.rcodes[m.Question[0].Qtype]; ok {
+		resp := new(dns.Msg)
+		resp.SetRcode(m, rcode)
+		return resp, nil
+	}
+	return d.zone.Exchange(m, server)
+}
+
+// newTestResolver returns a resolver sending its queries to e.
+func newTestResolver(e Exchanger) *Resolver {
+	r := NewResolver([]string{"192.0.2.53:53"}, 4, 4, 10)
+	r.Exchanger = e
+	return r
+}
+
+func TestResolveAAndAAAA(t *testing.T) {
+	const zone = `
+mail.example.com. 300 IN A 192.0.2.1
+mail.example.com. 300 IN A 192.0.2.2
+mail.example.com. 300 IN AAAA 2001:db8::1
+`
+	const delay = 100 * time.Millisecond
+	tests := []struct {
+		name        string
+		host        string
+		priority    bool
+		requireBoth bool
+		rcodes      map[uint16]int
+		want        []string
+		wantErr     bool
+	}{
+		{"both families, A first", "mail.example.com", false, false, nil, []string{"192.0.2.1/32", "192.0.2.2/32", "2001:db8::1/128"}, false},
+		{"priority, AAAA failing", "mail.example.com", true, false, map[uint16]int{dns.TypeAAAA: dns.RcodeServerFailure}, []string{"192.0.2.1/32", "192.0.2.2/32"}, false},
+		{"priority requiring both, AAAA failing", "mail.example.com", true, true, map[uint16]int{dns.TypeAAAA: dns.RcodeServerFailure}, nil, true},
+		{"priority, both failing", "mail.example.com", true, false, map[uint16]int{dns.TypeA: dns.RcodeServerFailure, dns.TypeAAAA: dns.RcodeServerFailure}, nil, true},
+		{"priority, no such name", "nx.example.com", true, false, nil, nil, true},
+		{"not priority, both failing", "mail.example.com", false, false, map[uint16]int{dns.TypeA: dns.RcodeServerFailure, dns.TypeAAAA: dns.RcodeServerFailure}, nil, false},
+	}
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestResolver(delayed{dnstest.New(t, zone), delay, tt.rcodes})
+			start := time.Now()
+			var nets cidr.NetAddrSlice
+			var err error
+			if tt.requireBoth {
+				nets, err = r.ResolveBothFamilies(tt.host, 0)
+			} else {
+				nets, err = r.ResolveAAndAAAA(tt.host, tt.priority, 0)
+			}
+			// Both queries are in flight together: one delay, not two
+			if elapsed := time.Since(start); elapsed >= 2*delay {
+				t.Errorf("took %s, want the A and AAAA queries sent concurrently (%s each)", elapsed, delay)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			var got []string
+			for _, n := range nets {
+				got = append(got, n.IPNet.String())
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// poisoned answers from a zone with extra RRs stuffed into every answer section.
+type poisoned struct {
+	zone  *dnstest.Zone
+	extra []string
+}
+
+func (p poisoned) Exchange(m *dns.Msg, server string) (*dns.Msg, error) {
+	resp, err := p.zone.Exchange(m, server)
+	if err != nil {
+		return nil, err
+	}
+	for _, text := range p.extra {
+		rr, err := dns.NewRR(text)
+		if err != nil {
+			return nil, err
+		}
+		resp.Answer = append(resp.Answer, rr)
+	}
+	return resp, nil
+}
+
+func TestFilterAnswer(t *testing.T) {
+	const zone = `
+mail.example.com. 300 IN A 192.0.2.1
+alias.example.com. 300 IN TXT "no address of its own"
+`
+	tests := []struct {
+		name          string
+		host          string
+		extra         []string
+		want          []string
+		wantDiscarded int
+	}{
+		{"clean", "mail.example.com", nil, []string{"192.0.2.1/32"}, 0},
+		{"other name", "mail.example.com", []string{"evil.example.net. 300 IN A 198.51.100.66"}, []string{"192.0.2.1/32"}, 1},
+		{"other class", "mail.example.com", []string{"mail.example.com. 300 CH A 198.51.100.66"}, []string{"192.0.2.1/32"}, 1},
+		{"owner case ignored", "mail.example.com", []string{"MAIL.Example.COM. 300 IN A 192.0.2.2"}, []string{"192.0.2.1/32", "192.0.2.2/32"}, 0},
+		{"CNAME target kept", "alias.example.com", []string{"alias.example.com. 300 IN CNAME mail.example.com.", "mail.example.com. 300 IN A 192.0.2.1"}, []string{"192.0.2.1/32"}, 0},
+	}
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The poison goes into the AAAA answers too, where nothing else is owned
+			z := dnstest.New(t, zone)
+			r := newTestResolver(poisoned{z, tt.extra})
+			nets, err := r.ResolveAAndAAAA(tt.host, false, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, n := range nets {
+				got = append(got, n.IPNet.String())
+			}
+			slices.Sort(got)
+			got = slices.Compact(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			// Each poisoned RR is discarded once from the A and once from the AAAA answer
+			if got := r.GetDiscardedCount(); got != 2*tt.wantDiscarded {
+				t.Errorf("GetDiscardedCount() = %d, want %d", got, 2*tt.wantDiscarded)
+			}
+		})
+	}
+}
+
+func TestErrorTaxonomy(t *testing.T) {
+	const zone = `
+example.com. 300 IN TXT "v=spf1 include:a.example.com include:b.example.com -all"
+a.example.com. 300 IN TXT "v=spf1 ip4:192.0.2.0/24 -all"
+b.example.com. 300 IN TXT "v=spf1 ip4:198.51.100.0/24 -all"
+nospf.example.com. 300 IN TXT "google-site-verification=abc"
+twice.example.com. 300 IN TXT "v=spf1 ip4:192.0.2.1 -all"
+twice.example.com. 300 IN TXT "v=spf1 ip4:192.0.2.2 -all"
+broken.example.com. 300 IN TXT "v=spf1 ip4:192.0.2.1 ~redirect=x.example.com -all"
+down.example.com. 300 IN TXT "v=spf1 -all"
+`
+	tests := []struct {
+		name       string
+		domain     string
+		maxLookups int
+		flatten    bool
+		// check asserts the error has the expected kind
+		check func(error) bool
+	}{
+		{"lookup limit", "example.com", 2, true, func(err error) bool { return errors.Is(err, ErrLookupLimit) }},
+		{"no SPF record", "nospf.example.com", 10, false, func(err error) bool { return errors.Is(err, ErrNoSPFRecord) }},
+		{"multiple SPF records", "twice.example.com", 10, false, func(err error) bool { return errors.Is(err, ErrMultipleSPF) }},
+		{"NXDOMAIN", "nx.example.com", 10, false, func(err error) bool {
+			var lerr *LookupError
+			return errors.Is(err, ErrNXDomain) && errors.As(err, &lerr) && !lerr.Retryable()
+		}},
+		{"SERVFAIL", "down.example.com", 10, false, func(err error) bool {
+			var lerr *LookupError
+			return errors.As(err, &lerr) && lerr.Rcode == dns.RcodeServerFailure && lerr.Retryable()
+		}},
+		{"parse error", "broken.example.com", 10, true, func(err error) bool {
+			var perr *spf.ParseError
+			return errors.As(err, &perr) && perr.Domain == "broken.example.com" && perr.Mechanism == "~redirect=x.example.com" && perr.Offset == 21
+		}},
+	}
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			z := dnstest.New(t, zone)
+			z.Fail("down.example.com", dns.RcodeServerFailure)
+			r := NewResolver([]string{"192.0.2.53:53"}, 4, 4, tt.maxLookups)
+			r.Exchanger = z
+			var err error
+			if tt.flatten {
+				_, err = r.FlattenSPF(tt.domain, tt.domain, false, 0)
+			} else {
+				_, err = r.FetchSPF(tt.domain)
+			}
+			if err == nil || !tt.check(err) {
+				t.Errorf("error = %#v (%v), not of the expected kind", err, err)
+			}
+		})
+	}
+}
+
+func TestTrackCycle(t *testing.T) {
+	// a includes b and c, which both include d; d includes a back
+	steps := []struct {
+		parent, domain string
+		wantOwner      bool
+		wantErr        error
+	}{
+		{"", "a", true, nil},
+		{"a", "b", true, nil},
+		{"a", "c", true, nil},
+		{"b", "d", true, nil},
+		{"c", "d", false, nil},
+		{"d", "a", false, ErrCycle},
+		{"b", "b", false, ErrCycle},
+		{"", "a", false, ErrCycle},
+	}
+	r := NewResolver([]string{"192.0.2.53:53"}, 4, 4, 10)
+	for _, step := range steps {
+		_, owner, err := r.track(step.parent, step.domain)
+		if !errors.Is(err, step.wantErr) || owner != step.wantOwner {
+			t.Errorf("track(%q, %q) = owner %v, error %v, want owner %v, error %v",
+				step.parent, step.domain, owner, err, step.wantOwner, step.wantErr)
+		}
+	}
+	if got := r.GetLookupCount(); got != 4 {
+		t.Errorf("GetLookupCount() = %d, want 4", got)
+	}
+}
+
+// flatten returns the CIDRs FlattenSPF collects for domain from zone.
+func flatten(t *testing.T, zone, domain string, maxLookups int) ([]string, error) {
+	t.Helper()
+	r := NewResolver([]string{"192.0.2.53:53"}, 4, 4, maxLookups)
+	r.Exchanger = dnstest.New(t, zone)
+	nets, err := r.FlattenSPF(domain, domain, false, 0)
+	var got []string
+	for _, n := range nets {
+		got = append(got, n.IPNet.String())
+	}
+	return got, err
+}
+
+func TestFlattenRedirect(t *testing.T) {
+	const zone = `
+example.com. 300 IN TXT "v=spf1 redirect=_spf.example.net"
+_spf.example.net. 300 IN TXT "v=spf1 ip4:192.0.2.0/24 ip6:2001:db8::/32 -all"
+chain.example.com. 300 IN TXT "v=spf1 ip4:198.51.100.1 redirect=r1.example.net"
+r1.example.net. 300 IN TXT "v=spf1 ip4:198.51.100.2 redirect=r2.example.net"
+r2.example.net. 300 IN TXT "v=spf1 ip4:198.51.100.3 redirect=r3.example.net"
+r3.example.net. 300 IN TXT "v=spf1 ip4:198.51.100.4 -all"
+withall.example.com. 300 IN TXT "v=spf1 ip4:198.51.100.1 redirect=_spf.example.net ~all"
+loop.example.com. 300 IN TXT "v=spf1 ip4:198.51.100.1 redirect=loop2.example.com"
+loop2.example.com. 300 IN TXT "v=spf1 ip4:198.51.100.2 redirect=loop.example.com"
+`
+	tests := []struct {
+		name       string
+		domain     string
+		maxLookups int
+		want       []string
+		wantErr    error
+	}{
+		{"redirect only", "example.com", 10, []string{"192.0.2.0/24", "2001:db8::/32"}, nil},
+		{"chained redirects", "chain.example.com", 10, []string{"198.51.100.1/32", "198.51.100.2/32", "198.51.100.3/32", "198.51.100.4/32"}, nil},
+		{"chain at the lookup limit", "chain.example.com", 4, []string{"198.51.100.1/32", "198.51.100.2/32", "198.51.100.3/32", "198.51.100.4/32"}, nil},
+		{"chain over the lookup limit", "chain.example.com", 3, nil, ErrLookupLimit},
+		{"ignored next to all", "withall.example.com", 10, []string{"198.51.100.1/32"}, nil},
+		{"redirect loop", "loop.example.com", 10, []string{"198.51.100.1/32", "198.51.100.2/32"}, nil},
+	}
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := flatten(t, zone, tt.domain, tt.maxLookups)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("FlattenSPF() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("FlattenSPF() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFlattenExists(t *testing.T) {
+	const zone = `example.com. 300 IN TXT "v=spf1 ip4:192.0.2.0/24 exists:relay.example.net -all"` + "\n"
+	tests := []struct {
+		policy          string
+		wantErr         bool
+		wantPassthrough []string
+		wantLog         string
+	}{
+		{"error", true, nil, ""},
+		{"warn", false, nil, "WARN: exists:relay.example.net in example.com cannot be flattened"},
+		{"", false, nil, "WARN: exists:relay.example.net in example.com cannot be flattened"},
+		{"passthrough", false, []string{"exists:relay.example.net"}, "kept verbatim"},
+	}
+	for _, tt := range tests {
+		t.Run("onExists "+tt.policy, func(t *testing.T) {
+			var logs strings.Builder
+			log.SetOutput(&logs)
+			t.Cleanup(func() { log.SetOutput(os.Stderr) })
+			r := newTestResolver(dnstest.New(t, zone))
+			r.OnExists = tt.policy
+			nets, err := r.FlattenSPF("example.com", "example.com", false, 0)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("FlattenSPF() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if !strings.Contains(err.Error(), "exists:relay.example.net") || !strings.Contains(err.Error(), "example.com") {
+					t.Errorf("error %q does not name the mechanism and the domain", err)
+				}
+				return
+			}
+			if len(nets) != 1 || nets[0].IPNet.String() != "192.0.2.0/24" {
+				t.Errorf("FlattenSPF() = %v, want the ip4 network only", nets)
+			}
+			if got := r.Passthrough(); !slices.Equal(got, tt.wantPassthrough) {
+				t.Errorf("Passthrough() = %v, want %v", got, tt.wantPassthrough)
+			}
+			if !strings.Contains(logs.String(), tt.wantLog) {
+				t.Errorf("log does not contain %q:\n%s", tt.wantLog, logs.String())
+			}
+		})
+	}
+}
+
+func TestFetchSPFRecordCount(t *testing.T) {
+	const zone = `
+none.example.com. 300 IN TXT "google-site-verification=abc"
+one.example.com. 300 IN TXT "google-site-verification=abc"
+one.example.com. 300 IN TXT "v=spf1 ip4:192.0.2.0/24 -all"
+two.example.com. 300 IN TXT "v=spf1 ip4:198.51.100.0/24 -all"
+two.example.com. 300 IN TXT "v=spf1 ip4:192.0.2.0/24 ~all"
+`
+	tests := []struct {
+		name    string
+		domain  string
+		merge   bool
+		want    string
+		wantErr error
+	}{
+		{"zero", "none.example.com", false, "", ErrNoSPFRecord},
+		{"one", "one.example.com", false, "v=spf1 ip4:192.0.2.0/24 -all", nil},
+		{"two", "two.example.com", false, "", ErrMultipleSPF},
+		{"two merged", "two.example.com", true, "v=spf1 ip4:192.0.2.0/24 ip4:198.51.100.0/24 ~all", nil},
+		{"one with merging", "one.example.com", true, "v=spf1 ip4:192.0.2.0/24 -all", nil},
+	}
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestResolver(dnstest.New(t, zone))
+			r.MergeMultipleSPF = tt.merge
+			got, err := r.FetchSPF(tt.domain)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("FetchSPF() error = %v, want %v", err, tt.wantErr)
+			}
+			if errors.Is(err, ErrMultipleSPF) {
+				// The error names the domain and lists every record
+				for _, part := range []string{tt.domain, "ip4:198.51.100.0/24 -all", "ip4:192.0.2.0/24 ~all"} {
+					if !strings.Contains(err.Error(), part) {
+						t.Errorf("error %q does not contain %q", err, part)
+					}
+				}
+			}
+			if got != tt.want {
+				t.Errorf("FetchSPF() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// jittered answers from a zone after a random delay, shuffling the order in which
+// parallel branches complete.
+type jittered struct {
+	zone *dnstest.Zone
+}
+
+func (j jittered) Exchange(m *dns.Msg, server string) (*dns.Msg, error) {
+	time.Sleep(rand.N(time.Millisecond))
+	return j.zone.Exchange(m, server)
+}
+
+// TestFlattenDiamond flattens a chain whose branches share an include, with the branches
+// completing in random order: the shared include contributes to both parents and the
+// result, in order and with its provenance, is the same on every run.
+func TestFlattenDiamond(t *testing.T) {
+	const zone = `
+example.com. 300 IN TXT "v=spf1 include:a.example.net include:b.example.net ip4:203.0.113.0/24 -all"
+a.example.net. 300 IN TXT "v=spf1 ip4:192.0.2.0/25 include:shared.example.net -all"
+b.example.net. 300 IN TXT "v=spf1 include:shared.example.net ip4:198.51.100.0/24 -all"
+shared.example.net. 300 IN TXT "v=spf1 ip4:192.0.2.128/25 include:leaf.example.net -all"
+leaf.example.net. 300 IN TXT "v=spf1 ip6:2001:db8::/32 -all"
+`
+	want := []string{
+		"192.0.2.0/25 ip4:192.0.2.0/25 in a.example.net",
+		"192.0.2.128/25 ip4:192.0.2.128/25 in shared.example.net",
+		"2001:db8::/32 ip6:2001:db8::/32 in leaf.example.net",
+		"192.0.2.128/25 ip4:192.0.2.128/25 in shared.example.net",
+		"2001:db8::/32 ip6:2001:db8::/32 in leaf.example.net",
+		"198.51.100.0/24 ip4:198.51.100.0/24 in b.example.net",
+		"203.0.113.0/24 ip4:203.0.113.0/24 in example.com",
+	}
+	var logs strings.Builder
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	defer runtime.GOMAXPROCS(max(4, runtime.GOMAXPROCS(0)))
+	for i := range 50 {
+		r := newTestResolver(jittered{dnstest.New(t, zone)})
+		nets, err := r.FlattenSPF("example.com", "example.com", false, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, n := range nets {
+			got = append(got, n.IPNet.String()+" "+n.Source)
+		}
+		if !slices.Equal(got, want) {
+			t.Fatalf("run %d: FlattenSPF() = %q, want %q", i, got, want)
+		}
+		// Each record is fetched once, however many parents include it
+		if got := r.GetLookupCount(); got != 5 {
+			t.Fatalf("run %d: GetLookupCount() = %d, want 5", i, got)
+		}
+	}
+	if strings.Contains(logs.String(), "cycle") {
+		t.Errorf("a shared include was reported as a cycle:\n%s", logs.String())
+	}
+}
+
+// TestFlattenConcatenated flattens a record published as one TXT RR holding two complete
+// SPF records as separate character-strings.
+func TestFlattenConcatenated(t *testing.T) {
+	const zone = `
+example.com. 300 IN TXT "v=spf1 ip4:192.0.2.0/24 ~all" "v=spf1 ip4:198.51.100.0/24 -all"
+`
+	tests := []struct {
+		strict  bool
+		want    []string
+		wantErr string
+	}{
+		{false, []string{"192.0.2.0/24"}, ""},
+		{true, nil, "multiple SPF strings concatenated in one TXT RR at example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("strict %v", tt.strict), func(t *testing.T) {
+			var logs strings.Builder
+			log.SetOutput(&logs)
+			t.Cleanup(func() { log.SetOutput(os.Stderr) })
+			r := newTestResolver(dnstest.New(t, zone))
+			r.Strict = tt.strict
+			nets, err := r.FlattenSPF("example.com", "example.com", false, 0)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("FlattenSPF() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, n := range nets {
+				got = append(got, n.IPNet.String())
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("FlattenSPF() = %v, want %v", got, tt.want)
+			}
+			if !strings.Contains(logs.String(), `using only the first: "v=spf1 ip4:192.0.2.0/24 ~all"`) {
+				t.Errorf("log does not report the concatenated record:\n%s", logs.String())
+			}
+		})
+	}
+}
+
+// TestResolveAAndAAAACombinations resolves a host under every combination of A and AAAA
+// outcomes, as a plain lookup, a priority entry and a priority entry requiring both.
+func TestResolveAAndAAAACombinations(t *testing.T) {
+	const zone = `
+mail.example.com. 300 IN A 192.0.2.1
+mail.example.com. 300 IN AAAA 2001:db8::1
+`
+	const (
+		ok       = -1
+		servfail = dns.RcodeServerFailure
+		nxdomain = dns.RcodeNameError
+	)
+	v4, v6, both := []string{"192.0.2.1/32"}, []string{"2001:db8::1/128"}, []string{"192.0.2.1/32", "2001:db8::1/128"}
+	// fails stands for an error; plain lookups never fail, they log and go on.
+	var fails []string
+	tests := []struct {
+		a, aaaa int
+		// plain, priority and requireBoth are the addresses expected in each mode.
+		plain, priority, requireBoth []string
+		wantDegraded                 bool
+	}{
+		{ok, ok, both, both, both, false},
+		{ok, servfail, v4, v4, fails, true},
+		{ok, nxdomain, v4, fails, fails, false},
+		{servfail, ok, v6, v6, fails, true},
+		{servfail, servfail, nil, fails, fails, false},
+		{servfail, nxdomain, nil, fails, fails, false},
+		{nxdomain, ok, v6, fails, fails, false},
+		{nxdomain, servfail, nil, fails, fails, false},
+		{nxdomain, nxdomain, nil, fails, fails, false},
+	}
+	name := func(rcode int) string {
+		if rcode == ok {
+			return "ok"
+		}
+		return dns.RcodeToString[rcode]
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("A %s, AAAA %s", name(tt.a), name(tt.aaaa)), func(t *testing.T) {
+			rcodes := make(map[uint16]int)
+			if tt.a != ok {
+				rcodes[dns.TypeA] = tt.a
+			}
+			if tt.aaaa != ok {
+				rcodes[dns.TypeAAAA] = tt.aaaa
+			}
+			modes := []struct {
+				mode    string
+				want    []string
+				resolve func(r *Resolver) (cidr.NetAddrSlice, error)
+			}{
+				{"plain", tt.plain, func(r *Resolver) (cidr.NetAddrSlice, error) { return r.ResolveAAndAAAA("mail.example.com", false, 0) }},
+				{"priority", tt.priority, func(r *Resolver) (cidr.NetAddrSlice, error) { return r.ResolveAAndAAAA("mail.example.com", true, 0) }},
+				{"requireBoth", tt.requireBoth, func(r *Resolver) (cidr.NetAddrSlice, error) { return r.ResolveBothFamilies("mail.example.com", 0) }},
+			}
+			for _, m := range modes {
+				var logs strings.Builder
+				log.SetOutput(&logs)
+				t.Cleanup(func() { log.SetOutput(os.Stderr) })
+				r := newTestResolver(delayed{dnstest.New(t, zone), 0, rcodes})
+				nets, err := m.resolve(r)
+				wantErr := m.want == nil && m.mode != "plain"
+				if (err != nil) != wantErr {
+					t.Errorf("%s: error = %v, want error %v", m.mode, err, wantErr)
+					continue
+				}
+				var got []string
+				for _, n := range nets {
+					got = append(got, n.IPNet.String())
+				}
+				if !slices.Equal(got, m.want) {
+					t.Errorf("%s: got %v, want %v", m.mode, got, m.want)
+				}
+				degraded := strings.Contains(logs.String(), "Degraded priority entry mail.example.com")
+				if want := m.mode == "priority" && tt.wantDegraded; degraded != want {
+					t.Errorf("%s: degraded finding = %v, want %v:\n%s", m.mode, degraded, want, logs.String())
+				}
+			}
+		})
+	}
+}
+
+// chasing answers like a recursive resolver following CNAMEs: a name owning a CNAME is
+// answered with the CNAME and the records of its target.
+type chasing struct {
+	zone *dnstest.Zone
+	// cnames maps an alias to its target, both fully qualified.
+	cnames map[string]string
+}
+
+func (c chasing) Exchange(m *dns.Msg, server string) (*dns.Msg, error) {
+	target, ok := c.cnames[m.Question[0].Name]
+	if !ok {
+		return c.zone.Exchange(m, server)
+	}
+	q := m.Copy()
+	q.Question[0].Name = target
+	resp, err := c.zone.Exchange(q, server)
+	if err != nil {
+		return nil, err
+	}
+	resp.SetReply(m)
+	cname := &dns.CNAME{Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 300}, Target: target}
+	resp.Answer = append([]dns.RR{cname}, resp.Answer...)
+	return resp, nil
+}
+
+// recording records the questions it passes on, as "name TYPE".
+type recording struct {
+	next  Exchanger
+	mu    sync.Mutex
+	asked []string
+}
+
+func (r *recording) Exchange(m *dns.Msg, server string) (*dns.Msg, error) {
+	q := m.Question[0]
+	r.mu.Lock()
+	r.asked = append(r.asked, strings.TrimSuffix(q.Name, ".")+" "+dns.TypeToString[q.Qtype])
+	r.mu.Unlock()
+	return r.next.Exchange(m, server)
+}
+
+// TestFlattenEvalContext pins the domain that a and mx without a domain-spec refer to
+// (RFC 7208 section 4.8): the redirect or include target, but the queried name, not the
+// CNAME target, when the TXT record is reached through a CNAME.
+func TestFlattenEvalContext(t *testing.T) {
+	const zone = `
+redirect.example.com. 300 IN TXT "v=spf1 redirect=_spf.example.net"
+redirect.example.com. 300 IN A 192.0.2.1
+redirect.example.com. 300 IN MX 10 mx.example.com.
+_spf.example.net. 300 IN TXT "v=spf1 a mx -all"
+_spf.example.net. 300 IN A 198.51.100.1
+_spf.example.net. 300 IN MX 10 mx.example.net.
+mx.example.com. 300 IN A 192.0.2.25
+mx.example.net. 300 IN A 198.51.100.25
+include.example.com. 300 IN TXT "v=spf1 a include:vendor.example.org -all"
+include.example.com. 300 IN A 192.0.2.2
+vendor.example.org. 300 IN TXT "v=spf1 mx -all"
+vendor.example.org. 300 IN MX 10 mx.vendor.example.org.
+mx.vendor.example.org. 300 IN A 203.0.113.25
+target.example.net. 300 IN TXT "v=spf1 a -all"
+target.example.net. 300 IN A 198.51.100.60
+`
+	tests := []struct {
+		name, domain string
+		want         []string
+		// wantQueried and notQueried are address queries that must, or must not, be sent.
+		wantQueried, notQueried []string
+	}{
+		{
+			"redirect and bare a/mx", "redirect.example.com", []string{"198.51.100.1/32", "198.51.100.25/32"},
+			[]string{"_spf.example.net A", "_spf.example.net MX"}, []string{"redirect.example.com A", "redirect.example.com MX"},
+		},
+		{
+			"include and bare mx", "include.example.com", []string{"192.0.2.2/32", "203.0.113.25/32"},
+			[]string{"include.example.com A", "vendor.example.org MX"}, []string{"include.example.com MX"},
+		},
+		{
+			// The A query for the alias is answered through the CNAME too
+			"CNAME'd TXT and bare a", "alias.example.com", []string{"198.51.100.60/32"},
+			[]string{"alias.example.com TXT", "alias.example.com A"}, []string{"target.example.net A"},
+		},
+	}
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &recording{next: chasing{dnstest.New(t, zone), map[string]string{"alias.example.com.": "target.example.net."}}}
+			r := newTestResolver(rec)
+			nets, err := r.FlattenSPF(tt.domain, tt.domain, false, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, n := range nets {
+				got = append(got, n.IPNet.String())
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("FlattenSPF() = %v, want %v", got, tt.want)
+			}
+			for _, q := range tt.wantQueried {
+				if !slices.Contains(rec.asked, q) {
+					t.Errorf("queries = %v, want %s", rec.asked, q)
+				}
+			}
+			for _, q := range tt.notQueried {
+				if slices.Contains(rec.asked, q) {
+					t.Errorf("queries = %v, want no %s", rec.asked, q)
+				}
+			}
+		})
+	}
+}
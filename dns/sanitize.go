@@ -0,0 +1,68 @@
+// Fichier: dns/sanitize.go (nettoyage des réponses A/AAAA)
+
+package dns
+
+import (
+	"log"
+	"net"
+)
+
+// bogus returns why an address can never be a legitimate sender: the placeholders some
+// load balancers answer with (unspecified, broadcast) and loopback.
+func bogus(ip net.IP) string {
+	switch {
+	case ip.IsUnspecified():
+		return "unspecified"
+	case ip.IsLoopback():
+		return "loopback"
+	case ip.Equal(net.IPv4bcast):
+		return "broadcast"
+	}
+	return ""
+}
+
+// reserved returns the reserved range an address belongs to, if any: private,
+// link-local and multicast addresses are not reachable senders on the internet.
+func reserved(ip net.IP) string {
+	switch {
+	case ip.IsPrivate():
+		return "private"
+	case ip.IsLinkLocalUnicast():
+		return "link-local"
+	case ip.IsMulticast():
+		return "multicast"
+	}
+	return ""
+}
+
+// sanitize filters the addresses of one A or AAAA answer for host: exact duplicates are
+// dropped and counted, bogus addresses are rejected, and addresses in reserved ranges are
+// reported and dropped when DropReservedRanges is set.
+func (r *Resolver) sanitize(host, qtype string, ips []net.IP) []net.IP {
+	seen := make(map[string]bool, len(ips))
+	var out []net.IP
+	duplicates := 0
+	for _, ip := range ips {
+		if seen[ip.String()] {
+			duplicates++
+			continue
+		}
+		seen[ip.String()] = true
+		if kind := bogus(ip); kind != "" {
+			log.Printf("WARN: %s answered a %s %s address (%s), rejected", host, kind, qtype, ip)
+			continue
+		}
+		if kind := reserved(ip); kind != "" {
+			if r.DropReservedRanges {
+				log.Printf("WARN: %s answered a %s %s address (%s), dropped", host, kind, qtype, ip)
+				continue
+			}
+			log.Printf("WARN: %s answered a %s %s address (%s), kept (see dropReservedRanges)", host, kind, qtype, ip)
+		}
+		out = append(out, ip)
+	}
+	if duplicates > 0 {
+		log.Printf("INFO: %s answered %d duplicate %s address(es), ignored", host, duplicates, qtype)
+	}
+	return out
+}
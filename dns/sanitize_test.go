@@ -0,0 +1,73 @@
+package dns
+
+import (
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"project/spf-flattener/dns/dnstest"
+)
+
+func TestSanitize(t *testing.T) {
+	tests := []struct {
+		name, answers string
+		dropReserved  bool
+		want          []string
+		// wantLog lists substrings of the findings logged.
+		wantLog []string
+	}{
+		{"clean", "A 192.0.2.1\nAAAA 2001:db8::1", false, []string{"192.0.2.1/32", "2001:db8::1/128"}, nil},
+		{"duplicates", "A 192.0.2.1\nA 192.0.2.1\nA 192.0.2.1\nAAAA 2001:db8::1\nAAAA 2001:db8::1", false, []string{"192.0.2.1/32", "2001:db8::1/128"},
+			[]string{"answered 2 duplicate A address(es)", "answered 1 duplicate AAAA address(es)"}},
+		{"unspecified", "A 0.0.0.0\nAAAA ::\nA 192.0.2.1", false, []string{"192.0.2.1/32"},
+			[]string{"unspecified A address (0.0.0.0), rejected", "unspecified AAAA address (::), rejected"}},
+		{"loopback", "A 127.0.0.1\nAAAA ::1\nA 192.0.2.1", false, []string{"192.0.2.1/32"},
+			[]string{"loopback A address (127.0.0.1), rejected", "loopback AAAA address (::1), rejected"}},
+		{"broadcast", "A 255.255.255.255\nA 192.0.2.1", false, []string{"192.0.2.1/32"}, []string{"broadcast A address (255.255.255.255), rejected"}},
+		// Bogus addresses are rejected whatever the reserved range policy
+		{"bogus with dropReservedRanges", "A 0.0.0.0\nA 192.0.2.1", true, []string{"192.0.2.1/32"}, []string{"rejected"}},
+		{"private kept", "A 10.0.0.1\nAAAA fd00::1", false, []string{"10.0.0.1/32", "fd00::1/128"},
+			[]string{"private A address (10.0.0.1), kept (see dropReservedRanges)", "private AAAA address (fd00::1), kept"}},
+		{"private dropped", "A 10.0.0.1\nA 192.0.2.1", true, []string{"192.0.2.1/32"}, []string{"private A address (10.0.0.1), dropped"}},
+		{"link-local dropped", "A 169.254.1.1\nAAAA fe80::1\nA 192.0.2.1", true, []string{"192.0.2.1/32"},
+			[]string{"link-local A address (169.254.1.1), dropped", "link-local AAAA address (fe80::1), dropped"}},
+		{"multicast dropped", "A 224.0.0.1\nAAAA ff02::1\nA 192.0.2.1", true, []string{"192.0.2.1/32"},
+			[]string{"multicast A address (224.0.0.1), dropped", "multicast AAAA address (ff02::1), dropped"}},
+		{"only bogus", "A 0.0.0.0\nA 127.0.0.1", false, nil, []string{"rejected"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs strings.Builder
+			log.SetOutput(&logs)
+			t.Cleanup(func() { log.SetOutput(os.Stderr) })
+			var zone strings.Builder
+			for _, answer := range strings.Split(tt.answers, "\n") {
+				zone.WriteString("lb.example.com. 300 IN " + answer + "\n")
+			}
+			r := newTestResolver(dnstest.New(t, zone.String()))
+			r.DropReservedRanges = tt.dropReserved
+			nets, err := r.ResolveAAndAAAA("lb.example.com", false, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, n := range nets {
+				got = append(got, n.IPNet.String())
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("ResolveAAndAAAA() = %v, want %v", got, tt.want)
+			}
+			for _, want := range tt.wantLog {
+				if !strings.Contains(logs.String(), "lb.example.com answered") || !strings.Contains(logs.String(), want) {
+					t.Errorf("log does not name the host with %q:\n%s", want, logs.String())
+				}
+			}
+			if tt.wantLog == nil && logs.Len() > 0 {
+				t.Errorf("unexpected findings:\n%s", logs.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+// Fichier: dns/snapshot.go
+
+package dns
+
+import "sort"
+
+// Snapshot is a read-only view of a resolver's progress, safe to take while flattening
+// runs in other goroutines.
+type Snapshot struct {
+	// Lookups is the number of SPF records fetched so far, MaxLookups the budget.
+	Lookups    int
+	MaxLookups int
+	// InFlight lists the domains whose record is being flattened, sorted.
+	InFlight []string
+	// Addresses counts the networks collected so far, before deduplication.
+	Addresses int
+	// Discarded counts the answer RRs dropped because they did not match the question.
+	Discarded int
+}
+
+// Snapshot copies the resolver's progress under its lock; it does not wait for any
+// query or branch to complete.
+func (r *Resolver) Snapshot() Snapshot {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := Snapshot{
+		Lookups:    len(r.lookupTracker),
+		MaxLookups: r.maxLookups,
+		InFlight:   make([]string, 0, len(r.inFlight)),
+		Addresses:  r.addresses,
+		Discarded:  r.discarded,
+	}
+	for domain := range r.inFlight {
+		s.InFlight = append(s.InFlight, domain)
+	}
+	sort.Strings(s.InFlight)
+	return s
+}
+
+// begin and end mark domain's record as being flattened.
+func (r *Resolver) begin(domain string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.inFlight[domain]++
+}
+
+func (r *Resolver) end(domain string, addresses int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.inFlight[domain]--; r.inFlight[domain] <= 0 {
+		delete(r.inFlight, domain)
+	}
+	r.addresses += addresses
+}
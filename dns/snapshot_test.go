@@ -0,0 +1,82 @@
+package dns
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"project/spf-flattener/dns/dnstest"
+)
+
+// TestSnapshotConcurrent takes snapshots from several goroutines while a wide chain is
+// flattened: every snapshot is consistent and the counters never go backwards. Run it
+// with -race to check the locking.
+func TestSnapshotConcurrent(t *testing.T) {
+	var zone strings.Builder
+	zone.WriteString(`example.com. 300 IN TXT "v=spf1`)
+	for i := range 8 {
+		fmt.Fprintf(&zone, " include:b%d.example.net", i)
+	}
+	zone.WriteString(" -all\"\n")
+	for i := range 8 {
+		fmt.Fprintf(&zone, "b%d.example.net. 300 IN TXT \"v=spf1 ip4:192.0.2.%d include:leaf.example.net -all\"\n", i, i)
+	}
+	zone.WriteString("leaf.example.net. 300 IN TXT \"v=spf1 ip4:198.51.100.0/24 ip6:2001:db8::/32 -all\"\n")
+
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	r := NewResolver([]string{"192.0.2.53:53"}, 4, 4, 20)
+	r.Exchanger = jittered{dnstest.New(t, zone.String())}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var last Snapshot
+			for {
+				s := r.Snapshot()
+				switch {
+				case s.MaxLookups != 20:
+					t.Errorf("MaxLookups = %d, want 20", s.MaxLookups)
+				case s.Lookups < last.Lookups || s.Addresses < last.Addresses:
+					t.Errorf("snapshot went backwards: %+v after %+v", s, last)
+				case s.Lookups > s.MaxLookups:
+					t.Errorf("Lookups = %d over the budget", s.Lookups)
+				case !slices.IsSorted(s.InFlight):
+					t.Errorf("InFlight = %v, not sorted", s.InFlight)
+				}
+				last = s
+				select {
+				case <-done:
+					return
+				default:
+				}
+			}
+		}()
+	}
+	nets, err := r.FlattenSPF("example.com", "example.com", false, 0)
+	close(done)
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := r.Snapshot()
+	if len(s.InFlight) != 0 {
+		t.Errorf("InFlight = %v after flattening, want none", s.InFlight)
+	}
+	if s.Lookups != r.GetLookupCount() || s.Lookups != 10 {
+		t.Errorf("Lookups = %d, GetLookupCount() = %d, want 10", s.Lookups, r.GetLookupCount())
+	}
+	// Each record's own networks are counted once, however many parents include it
+	if s.Addresses != 10 || len(nets) != 24 {
+		t.Errorf("Addresses = %d for %d networks, want 10 for 24", s.Addresses, len(nets))
+	}
+}
@@ -0,0 +1,101 @@
+// Fichier: dns/system.go (résolution par le résolveur du système)
+
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// SystemExchanger is an Exchanger answering through a net.Resolver, for environments that
+// only allow DNS through the platform's stub resolver. The server of each query is
+// ignored. The stdlib results carry less than DNS messages:
+//   - no TTLs: the RRs of the answers have a TTL of 0;
+//   - no rcode detail: a name without records of the type and a name that does not
+//     exist both come back as an empty NOERROR answer;
+//   - only A, AAAA, TXT, MX and NS queries are supported, so the authoritative
+//     resolution mode is not available.
+type SystemExchanger struct {
+	// Resolver answers the queries; nil uses net.DefaultResolver.
+	Resolver *net.Resolver
+	// notFound counts the queries whose not-found answer lost its rcode detail.
+	notFound atomic.Int64
+}
+
+// NotFound returns the number of queries answered "not found", which the system resolver
+// does not tell apart from a name that does not exist.
+func (s *SystemExchanger) NotFound() int {
+	return int(s.notFound.Load())
+}
+
+func (s *SystemExchanger) Exchange(m *dns.Msg, server string) (*dns.Msg, error) {
+	res := s.Resolver
+	if res == nil {
+		res = net.DefaultResolver
+	}
+	q := m.Question[0]
+	resp := new(dns.Msg)
+	resp.SetReply(m)
+	hdr := func(rrtype uint16) dns.RR_Header {
+		return dns.RR_Header{Name: q.Name, Rrtype: rrtype, Class: dns.ClassINET}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+	defer cancel()
+	var err error
+	switch q.Qtype {
+	case dns.TypeA, dns.TypeAAAA:
+		network, rrtype := "ip4", dns.TypeA
+		if q.Qtype == dns.TypeAAAA {
+			network, rrtype = "ip6", dns.TypeAAAA
+		}
+		var ips []net.IP
+		if ips, err = res.LookupIP(ctx, network, q.Name); err == nil {
+			for _, ip := range ips {
+				if rrtype == dns.TypeA {
+					resp.Answer = append(resp.Answer, &dns.A{Hdr: hdr(rrtype), A: ip.To4()})
+				} else {
+					resp.Answer = append(resp.Answer, &dns.AAAA{Hdr: hdr(rrtype), AAAA: ip})
+				}
+			}
+		}
+	case dns.TypeTXT:
+		var txts []string
+		if txts, err = res.LookupTXT(ctx, q.Name); err == nil {
+			for _, txt := range txts {
+				resp.Answer = append(resp.Answer, &dns.TXT{Hdr: hdr(dns.TypeTXT), Txt: []string{txt}})
+			}
+		}
+	case dns.TypeMX:
+		var mxs []*net.MX
+		if mxs, err = res.LookupMX(ctx, q.Name); err == nil {
+			for _, mx := range mxs {
+				resp.Answer = append(resp.Answer, &dns.MX{Hdr: hdr(dns.TypeMX), Preference: mx.Pref, Mx: dns.Fqdn(mx.Host)})
+			}
+		}
+	case dns.TypeNS:
+		var nss []*net.NS
+		if nss, err = res.LookupNS(ctx, q.Name); err == nil {
+			for _, ns := range nss {
+				resp.Answer = append(resp.Answer, &dns.NS{Hdr: hdr(dns.TypeNS), Ns: dns.Fqdn(ns.Host)})
+			}
+		}
+	default:
+		return nil, fmt.Errorf("%s queries are not supported by the system resolver backend", dns.TypeToString[q.Qtype])
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		s.notFound.Add(1)
+		return resp, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
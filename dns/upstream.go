@@ -0,0 +1,106 @@
+// Fichier: dns/upstream.go (syntaxe des serveurs DNS)
+
+package dns
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// UpstreamSyntax lists the accepted nameserver forms, for error messages.
+const UpstreamSyntax = "host, host:port, IPv6 address, [IPv6]:port, or udp://, tcp://, tls:// followed by one of these"
+
+// defaultPorts are the ports used when a nameserver spec has none, per scheme.
+var defaultPorts = map[string]int{"udp": 53, "tcp": 53, "tls": 853}
+
+// Upstream is a parsed nameserver spec.
+type Upstream struct {
+	// Scheme is the transport: "udp" (default), "tcp", or "tls" for DNS over TLS.
+	Scheme string
+	// Host is an IP address or a host name, without brackets.
+	Host string
+	Port int
+}
+
+// ParseUpstream parses a nameserver spec (see UpstreamSyntax). The port defaults to 53,
+// or 853 for tls://.
+func ParseUpstream(spec string) (Upstream, error) {
+	u := Upstream{Scheme: "udp"}
+	rest := spec
+	if scheme, after, ok := strings.Cut(spec, "://"); ok {
+		if scheme == "https" {
+			return u, fmt.Errorf("DNS over HTTPS is not supported, use tls:// for DNS over TLS")
+		}
+		if _, known := defaultPorts[scheme]; !known {
+			return u, fmt.Errorf("unknown scheme %q (accepted: %s)", scheme, UpstreamSyntax)
+		}
+		u.Scheme, rest = scheme, after
+	}
+	if strings.ContainsAny(rest, "/?#@") {
+		return u, fmt.Errorf("unexpected path or user info in %q (accepted: %s)", spec, UpstreamSyntax)
+	}
+
+	host, port := rest, ""
+	switch {
+	case net.ParseIP(rest) != nil:
+		// A bare address, including IPv6 without brackets
+	case strings.HasPrefix(rest, "[") && strings.HasSuffix(rest, "]"):
+		host = rest[1 : len(rest)-1]
+	default:
+		var err error
+		if host, port, err = net.SplitHostPort(rest); err != nil {
+			if strings.Contains(rest, ":") {
+				return u, fmt.Errorf("invalid address %q (accepted: %s)", rest, UpstreamSyntax)
+			}
+			host, port = rest, ""
+		}
+	}
+
+	u.Host, u.Port = host, defaultPorts[u.Scheme]
+	if port != "" {
+		n, err := strconv.Atoi(port)
+		if err != nil || n < 1 || n > 65535 {
+			return u, fmt.Errorf("invalid port %q, must be 1 to 65535", port)
+		}
+		u.Port = n
+	}
+	if ip := net.ParseIP(host); ip == nil {
+		if strings.Contains(host, ":") {
+			return u, fmt.Errorf("invalid IPv6 address %q", host)
+		}
+		if _, ok := dns.IsDomainName(host); !ok || host == "" || strings.ContainsAny(host, " []") {
+			return u, fmt.Errorf("invalid host %q", host)
+		}
+	}
+	return u, nil
+}
+
+// Addr returns the address to connect to, as host:port.
+func (u Upstream) Addr() string {
+	return net.JoinHostPort(u.Host, strconv.Itoa(u.Port))
+}
+
+// String returns the canonical spec: host:port for udp, scheme://host:port otherwise.
+// ParseUpstream accepts it back.
+func (u Upstream) String() string {
+	if u.Scheme == "udp" {
+		return u.Addr()
+	}
+	return u.Scheme + "://" + u.Addr()
+}
+
+// client returns a DNS client for the transport of u.
+func (u Upstream) client() *dns.Client {
+	switch u.Scheme {
+	case "tcp":
+		return &dns.Client{Net: "tcp"}
+	case "tls":
+		return &dns.Client{Net: "tcp-tls", TLSConfig: &tls.Config{ServerName: u.Host}}
+	}
+	return new(dns.Client)
+}
@@ -0,0 +1,60 @@
+package dns
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseUpstream(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    Upstream
+		wantErr string
+	}{
+		{"192.0.2.53", Upstream{"udp", "192.0.2.53", 53}, ""},
+		{"192.0.2.53:5353", Upstream{"udp", "192.0.2.53", 5353}, ""},
+		{"dns.example.com", Upstream{"udp", "dns.example.com", 53}, ""},
+		{"dns.example.com:53", Upstream{"udp", "dns.example.com", 53}, ""},
+		{"2001:db8::53", Upstream{"udp", "2001:db8::53", 53}, ""},
+		{"[2001:db8::53]", Upstream{"udp", "2001:db8::53", 53}, ""},
+		{"[2001:db8::53]:5353", Upstream{"udp", "2001:db8::53", 5353}, ""},
+		{"udp://192.0.2.53", Upstream{"udp", "192.0.2.53", 53}, ""},
+		{"tcp://192.0.2.53", Upstream{"tcp", "192.0.2.53", 53}, ""},
+		{"tls://9.9.9.9", Upstream{"tls", "9.9.9.9", 853}, ""},
+		{"tls://dns.example.com:8853", Upstream{"tls", "dns.example.com", 8853}, ""},
+		{"tls://[2001:db8::53]", Upstream{"tls", "2001:db8::53", 853}, ""},
+		{"tls://9.9.9.9:8530000", Upstream{}, "invalid port"},
+		{"192.0.2.53:0", Upstream{}, "invalid port"},
+		{"192.0.2.53:dns", Upstream{}, "invalid port"},
+		{"https://dns.example/dns-query", Upstream{}, "not supported"},
+		{"https://dns.example", Upstream{}, "not supported"},
+		{"quic://192.0.2.53", Upstream{}, "unknown scheme"},
+		{"tls://192.0.2.53/path", Upstream{}, "unexpected path"},
+		{"user@192.0.2.53", Upstream{}, "unexpected path or user info"},
+		{"2001:db8::53::1", Upstream{}, "invalid address"},
+		{"[2001:db8::zz]:53", Upstream{}, "invalid IPv6 address"},
+		{"bad host:53", Upstream{}, "invalid host"},
+		{"", Upstream{}, "invalid host"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := ParseUpstream(tt.spec)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ParseUpstream(%q) error = %v, want %q", tt.spec, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseUpstream(%q) error = %v", tt.spec, err)
+			}
+			if got != tt.want {
+				t.Errorf("ParseUpstream(%q) = %+v, want %+v", tt.spec, got, tt.want)
+			}
+			// The canonical spec parses back to the same upstream
+			if again, err := ParseUpstream(got.String()); err != nil || again != got {
+				t.Errorf("ParseUpstream(%q) = %+v, %v, want %+v", got.String(), again, err, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+// Fichier: dns/wildcard.go
+
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// LookupTXT returns the TXT strings published at name, each record's strings joined.
+// A name that does not exist returns an error wrapping ErrNXDomain.
+func (r *Resolver) LookupTXT(name string) ([]string, error) {
+	resp, err := r.resolveDNS(name, dns.TypeTXT)
+	if err != nil {
+		return nil, err
+	}
+	var txts []string
+	for _, ans := range resp.Answer {
+		if t, ok := ans.(*dns.TXT); ok {
+			txts = append(txts, strings.Join(t.Txt, ""))
+		}
+	}
+	sort.Strings(txts)
+	return txts, nil
+}
+
+// WildcardTXT queries a random label under parent to fingerprint a wildcard. It returns the
+// TXT strings a wildcard synthesizes for any name under parent, or nil when there is none.
+func (r *Resolver) WildcardTXT(parent string) ([]string, error) {
+	probe := fmt.Sprintf("_wildcard-probe-%08x.%s", rand.Uint32(), parent)
+	txts, err := r.LookupTXT(probe)
+	if errors.Is(err, ErrNXDomain) {
+		return nil, nil
+	}
+	return txts, err
+}
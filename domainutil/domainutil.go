@@ -0,0 +1,16 @@
+// Fichier: domainutil/domainutil.go
+
+package domainutil
+
+import (
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// RegistrableDomain returns the registrable domain (public suffix plus one label) of name,
+// e.g. example.co.uk for mail.example.co.uk. It fails when name is itself a public suffix.
+func RegistrableDomain(name string) (string, error) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	return publicsuffix.EffectiveTLDPlusOne(name)
+}
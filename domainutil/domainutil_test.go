@@ -0,0 +1,38 @@
+package domainutil
+
+import "testing"
+
+func TestRegistrableDomain(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{"example.com", "example.com", false},
+		{"mail.example.com", "example.com", false},
+		{"a.b.c.example.com.", "example.com", false},
+		{"Mail.Example.COM", "example.com", false},
+		{"example.co.uk", "example.co.uk", false},
+		{"mail.example.co.uk", "example.co.uk", false},
+		{"_spf.mail.example.co.uk", "example.co.uk", false},
+		{"example.com.au", "example.com.au", false},
+		{"spf1.example.com.au", "example.com.au", false},
+		// Public suffixes have no registrable domain
+		{"com", "", true},
+		{"co.uk", "", true},
+		{"com.au", "", true},
+		{"co.uk.", "", true},
+		{"", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := RegistrableDomain(tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RegistrableDomain(%q) error = %v, want error %v", tt.name, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("RegistrableDomain(%q) = %q, want %q", tt.name, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,22 @@
+// Fichier: formatter/hash.go (empreintes des enregistrements)
+
+package formatter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// RecordHash returns a short, version-stable fingerprint of a TXT record value, so that a
+// monitor can compare a published record with the generated one without parsing it.
+//
+// Canonicalization, which must not change: the character-strings of the record are
+// concatenated (the caller passes the joined value), runs of whitespace are collapsed to
+// a single space, leading and trailing whitespace is removed and the result is
+// lowercased. The fingerprint is the first 12 hex digits of its SHA-256.
+func RecordHash(value string) string {
+	canonical := strings.ToLower(strings.Join(strings.Fields(value), " "))
+	sum := sha256.Sum256([]byte(canonical))
+	return hex.EncodeToString(sum[:])[:12]
+}
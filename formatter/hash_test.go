@@ -0,0 +1,26 @@
+package formatter
+
+import "testing"
+
+// TestRecordHash pins the fingerprints: monitors compare them across tool versions, so a
+// change here breaks every deployed monitor.
+func TestRecordHash(t *testing.T) {
+	tests := []struct {
+		name, value, want string
+	}{
+		{"chained segment", "v=spf1 ip4:192.0.2.0/24 include:spf1.example.com", "74ee80beb73f"},
+		{"last segment", "v=spf1 ip4:198.51.100.0/24 ip6:2001:db8::/32 ~all", "c4a8fda302b7"},
+		{"deny all", "v=spf1 -all", "f90139dd9ab3"},
+		{"empty", "", "e3b0c44298fc"},
+		// Canonicalization: whitespace collapsed and trimmed, lowercased
+		{"extra whitespace", "  v=spf1 \t-all\n", "f90139dd9ab3"},
+		{"uppercase", "V=SPF1 -ALL", "f90139dd9ab3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := RecordHash(tt.value); got != tt.want {
+				t.Errorf("RecordHash(%q) = %s, want %s", tt.value, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+// Fichier: formatter/names.go
+
+package formatter
+
+import (
+	"fmt"
+	"strings"
+
+	"project/spf-flattener/domainutil"
+)
+
+const maxNameLength = 253 // Presentation length of a domain name without the trailing dot
+const maxLabelLength = 63
+
+// RecordName returns the fully qualified owner name of the segment at index i:
+// _spf.<sld> for the entry point, then spf1.<sld>, spf2.<sld>...
+func RecordName(i int, sld string) string {
+	if i == 0 {
+		return "_spf." + sld
+	}
+	return fmt.Sprintf("spf%d.%s", i, sld)
+}
+
+// ValidateName checks a generated domain name against the DNS name and label length limits.
+func ValidateName(name string) error {
+	name = strings.TrimSuffix(name, ".")
+	if len(name) > maxNameLength {
+		return fmt.Errorf("generated name %s is %d bytes long, over the %d-byte limit", name, len(name), maxNameLength)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if len(label) > maxLabelLength {
+			return fmt.Errorf("generated name %s has a %d-byte label %q, over the %d-byte limit", name, len(label), label, maxLabelLength)
+		}
+	}
+	return nil
+}
+
+// CheckIncludes verifies that every include token of the segments, except the passthrough
+// tokens copied from upstream records, targets a name within zone: a suffix match plus the
+// same registrable domain. It guards against a typo sending receivers to someone else's
+// domain.
+func CheckIncludes(segments, passthrough []string, zone string) error {
+	zone = strings.ToLower(strings.TrimSuffix(zone, "."))
+	zoneDomain, err := domainutil.RegistrableDomain(zone)
+	if err != nil {
+		return fmt.Errorf("zone %s: %w", zone, err)
+	}
+	external := make(map[string]bool, len(passthrough))
+	for _, token := range passthrough {
+		external[token] = true
+	}
+
+	for _, segment := range segments {
+		for _, token := range strings.Fields(segment) {
+			if !strings.HasPrefix(token, "include:") || external[token] {
+				continue
+			}
+			target := strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(token, "include:"), "."))
+			if target != zone && !strings.HasSuffix(target, "."+zone) {
+				return fmt.Errorf("generated %s is outside the zone %s", token, zone)
+			}
+			if d, err := domainutil.RegistrableDomain(target); err != nil || d != zoneDomain {
+				return fmt.Errorf("generated %s does not belong to the registrable domain %s", token, zoneDomain)
+			}
+		}
+	}
+	return nil
+}
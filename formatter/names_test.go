@@ -0,0 +1,145 @@
+package formatter
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"project/spf-flattener/cidr"
+)
+
+// mustNet parses a CIDR into a NetAddr.
+func mustNet(t *testing.T, c string) *cidr.NetAddr {
+	t.Helper()
+	_, n, err := net.ParseCIDR(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &cidr.NetAddr{IPNet: n}
+}
+
+// longName returns a domain name of n bytes ending in .example, made of labels of at
+// most 63 bytes.
+func longName(n int) string {
+	name := "example"
+	for len(name) < n {
+		label := min(63, n-len(name)-1)
+		if label < 1 {
+			// A single byte left cannot hold a label and its dot: widen the last label
+			return "a" + name
+		}
+		name = strings.Repeat("a", label) + "." + name
+	}
+	return name
+}
+
+func TestValidateName(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantErr bool
+	}{
+		{"253 bytes", longName(253), false},
+		{"253 bytes with the root dot", longName(253) + ".", false},
+		{"254 bytes", longName(254), true},
+		{"63-byte label", strings.Repeat("a", 63) + ".example", false},
+		{"64-byte label", strings.Repeat("a", 64) + ".example", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateName(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ValidateName(%d bytes) error = %v, want error %v", len(tt.input), err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFormatSegmentsNameLimits(t *testing.T) {
+	results := cidr.NetAddrSlice{mustNet(t, "192.0.2.0/24"), mustNet(t, "192.0.4.0/24")}
+	tests := []struct {
+		name      string
+		sld       string
+		maxLength int
+		wantErr   string
+	}{
+		// "v=spf1 ip4:192.0.2.0/24 include:spf1.<sld> " takes 38+len(sld) bytes: 217 fills 255
+		{"include token at 255 bytes", longName(217), 255, ""},
+		{"include token at 256 bytes", longName(218), 255, "leaves no room"},
+		// One segment: only _spf.<sld> is generated
+		{"owner name at 253 bytes", longName(248), 1000, ""},
+		{"owner name at 254 bytes", longName(249), 1000, "over the 253-byte limit"},
+		// Two segments, the second CIDR not fitting: spf1.<sld> is generated too
+		{"chained name at 253 bytes", longName(248), 290, ""},
+		{"chained name at 254 bytes", longName(249), 291, "over the 253-byte limit"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			segments, err := FormatSegments(results, nil, tt.sld, tt.maxLength, 0, "")
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("FormatSegments() error = %v", err)
+				}
+				for _, s := range segments {
+					if len(s) > tt.maxLength {
+						t.Errorf("segment of %d bytes over the %d-byte limit: %s", len(s), tt.maxLength, s)
+					}
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("FormatSegments() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckIncludes(t *testing.T) {
+	// Two /24 per segment at most: three segments chained by generated includes
+	results := cidr.NetAddrSlice{mustNet(t, "192.0.2.0/24"), mustNet(t, "198.51.100.0/24"), mustNet(t, "203.0.113.0/24")}
+	tests := []struct {
+		name        string
+		domain      string
+		passthrough []string
+		zone        string
+		wantErr     string
+	}{
+		{"within the zone", "example.com", nil, "example.com", ""},
+		{"subdomain of the zone", "mail.example.com", nil, "example.com", ""},
+		{"zone with a trailing dot and capitals", "example.co.uk", nil, "Example.CO.UK.", ""},
+		{"typo'd domain", "examp1e.com", nil, "example.com", "generated include:spf1.examp1e.com is outside the zone example.com"},
+		{"typo'd zone suffix", "example.co", nil, "example.com", "outside the zone example.com"},
+		{"lookalike parent", "example.com.evil.example.net", nil, "example.com", "outside the zone example.com"},
+		{"zone is a public suffix", "example.co.uk", nil, "co.uk", "zone co.uk"},
+		// Passthrough includes come from upstream records and may point anywhere
+		{"external keepInclude", "example.com", []string{"include:_spf.google.com"}, "example.com", ""},
+		{"external keepInclude of a lookalike domain", "example.com", []string{"include:spf.examp1e.com"}, "example.com", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			segments, err := FormatSegments(results, tt.passthrough, tt.domain, 60+len(tt.domain), 0, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(segments) < 2 {
+				t.Fatalf("segments = %q, want a chain", segments)
+			}
+			err = CheckIncludes(segments, tt.passthrough, tt.zone)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("CheckIncludes() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("CheckIncludes() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	// An external include is only exempt when it was copied from upstream
+	segments := []string{"v=spf1 ip4:192.0.2.0/24 include:_spf.google.com -all"}
+	if err := CheckIncludes(segments, nil, "example.com"); err == nil || !strings.Contains(err.Error(), "include:_spf.google.com is outside the zone") {
+		t.Errorf("CheckIncludes() of a generated external include: error = %v", err)
+	}
+}
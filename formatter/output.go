@@ -9,11 +9,19 @@ import (
 	"project/spf-flattener/cidr"
 )
 
-const maxTXTLength = 255
+const maxTXTLength = 255 // DNS character-string limit
 const finalDirective = "~all"
 
-// FormatSegments generates the multiple TXT records.
-func FormatSegments(results cidr.NetAddrSlice, sld string) []string {
+// DefaultMaxRecordLength is the default limit on the length of a generated record value.
+const DefaultMaxRecordLength = maxTXTLength
+
+// FormatSegments generates the multiple TXT records, none longer than maxLength bytes
+// nor holding more than maxMechanisms mechanisms (0 means no limit), chaining include
+// and ~all counted. Passthrough mechanisms are copied verbatim into the first segment, ahead of the flattened
+// CIDRs. The generated ip4/ip6 tokens carry qualifier ("" or "+" for the default pass).
+// It fails when a generated owner name or include token would exceed DNS limits.
+func FormatSegments(results cidr.NetAddrSlice, passthrough []string, sld string, maxLength, maxMechanisms int, qualifier string) ([]string, error) {
+	qualifier = strings.TrimPrefix(qualifier, "+")
 	var segments []string
 	var currentSegment []string
 
@@ -21,20 +29,41 @@ func FormatSegments(results cidr.NetAddrSlice, sld string) []string {
 	currentLength := len("v=spf1 ")
 	currentSegment = append(currentSegment, "v=spf1")
 
+	for _, token := range passthrough {
+		currentSegment = append(currentSegment, token)
+		currentLength += len(token) + 1
+	}
+	// The first segment must still fit one CIDR and the chaining include
+	if maxMechanisms > 0 && len(passthrough)+2 > maxMechanisms {
+		return nil, fmt.Errorf("%d passthrough mechanisms leave no room in the first record within the %d-mechanism limit",
+			len(passthrough), maxMechanisms)
+	}
+	if include := "include:" + RecordName(1, sld); currentLength+len(include)+1 > maxLength {
+		return nil, fmt.Errorf("%d passthrough mechanisms take %d bytes and leave no room for %s in the first record within the %d-byte limit",
+			len(passthrough), currentLength, include, maxLength)
+	}
+
 	for _, addr := range results {
 		// The full SPF entry: 'ip4:X.Y.Z.W/M' or 'ip6:...'
 		prefix := "ip4:"
 		if addr.IPNet.IP.To4() == nil {
 			prefix = "ip6:"
 		}
-		cidrStr := prefix + addr.IPNet.String()
+		cidrStr := qualifier + prefix + addr.IPNet.String()
 
 		// Check if adding this CIDR would exceed limit (including space for include and ~all)
 		nextIndex := len(segments) + 1
 		includeStr := fmt.Sprintf("include:spf%d.%s", nextIndex, sld)
 		reservedSpace := len(includeStr) + 1 // +2 for spaces
 
-		if currentLength+len(cidrStr)+1+reservedSpace > maxTXTLength {
+		if len("v=spf1 ")+len(cidrStr)+1+reservedSpace > maxLength {
+			return nil, fmt.Errorf("token %s is %d bytes long and leaves no room for %s within the %d-byte limit",
+				includeStr, len(includeStr), cidrStr, maxLength)
+		}
+
+		// currentSegment holds v=spf1, which is not a mechanism, in place of the include
+		full := maxMechanisms > 0 && len(currentSegment) >= maxMechanisms
+		if full || currentLength+len(cidrStr)+1+reservedSpace > maxLength {
 			// Finalize current segment with include only (no ~all)
 			currentSegment = append(currentSegment, includeStr)
 			segments = append(segments, strings.Join(currentSegment, " "))
@@ -53,5 +82,17 @@ func FormatSegments(results cidr.NetAddrSlice, sld string) []string {
 	currentSegment = append(currentSegment, finalDirective)
 	segments = append(segments, strings.Join(currentSegment, " "))
 
-	return segments
+	// Every owner name is also the target of the previous segment's include token
+	for i := range segments {
+		if err := ValidateName(RecordName(i, sld)); err != nil {
+			return nil, err
+		}
+	}
+
+	return segments, nil
+}
+
+// Mechanisms returns the number of mechanisms and modifiers of a generated record.
+func Mechanisms(record string) int {
+	return len(strings.Fields(record)) - 1
 }
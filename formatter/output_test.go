@@ -0,0 +1,125 @@
+package formatter
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"project/spf-flattener/cidr"
+)
+
+func TestFormatSegmentsPassthrough(t *testing.T) {
+	results := cidr.NetAddrSlice{mustNet(t, "192.0.2.0/24"), mustNet(t, "198.51.100.0/24")}
+	// "a:relayNN.partner.example " is 26 bytes
+	relays := func(n int) []string {
+		var tokens []string
+		for i := range n {
+			tokens = append(tokens, fmt.Sprintf("a:relay%02d.partner.example", i))
+		}
+		return tokens
+	}
+	tests := []struct {
+		name          string
+		passthrough   []string
+		maxLength     int
+		maxMechanisms int
+		wantErr       string
+	}{
+		{"none", nil, 255, 0, ""},
+		{"verbatim in the first segment", []string{"a:relay1.partner.example", "mx:partner.example"}, 255, 0, ""},
+		// 7 + 8×26 + "include:spf1.example.com " (25) = 240 bytes
+		{"fitting with the include", relays(8), 240, 0, ""},
+		{"one byte short for the include", relays(8), 239, 0, "leave no room for include:spf1.example.com"},
+		{"over the byte limit", relays(12), 255, 0, "leave no room"},
+		{"over the mechanism limit", relays(4), 255, 5, "passthrough mechanisms leave no room"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			segments, err := FormatSegments(results, tt.passthrough, "example.com", tt.maxLength, tt.maxMechanisms, "")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("FormatSegments() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("FormatSegments() error = %v", err)
+			}
+			prefix := strings.Join(append([]string{"v=spf1"}, tt.passthrough...), " ") + " "
+			if !strings.HasPrefix(segments[0], prefix) {
+				t.Errorf("first segment %q does not start with the passthrough tokens", segments[0])
+			}
+			for _, s := range segments {
+				if len(s) > tt.maxLength {
+					t.Errorf("segment of %d bytes over the %d-byte limit: %s", len(s), tt.maxLength, s)
+				}
+			}
+		})
+	}
+}
+
+// TestFormatSegmentsLimits checks the split when the byte limit and the mechanism limit
+// disagree on where to cut: every record holds as many CIDRs as both limits allow.
+func TestFormatSegmentsLimits(t *testing.T) {
+	// Short ip4 tokens, then long ip6 tokens: the mechanism limit cuts the first records
+	// and the byte limit the later ones
+	var results cidr.NetAddrSlice
+	for i := range 12 {
+		results = append(results, mustNet(t, fmt.Sprintf("192.0.2.%d/32", 2*i)))
+	}
+	for i := range 12 {
+		results = append(results, mustNet(t, fmt.Sprintf("2001:db8:%x::/48", 0x1000+i)))
+	}
+	tests := []struct {
+		name          string
+		maxLength     int
+		maxMechanisms int
+		// cuts says which limit ended each record but the last
+		cuts []string
+	}{
+		{"bytes only", 120, 0, []string{"bytes", "bytes", "bytes", "bytes", "bytes", "bytes"}},
+		{"mechanisms only", 255, 6, []string{"mechanisms", "mechanisms", "mechanisms", "mechanisms"}},
+		{"mechanisms, then bytes", 120, 5, []string{"mechanisms", "mechanisms", "mechanisms", "bytes", "bytes", "bytes"}},
+		{"bytes win", 120, 20, []string{"bytes", "bytes", "bytes", "bytes", "bytes", "bytes"}},
+		{"mechanisms win", 255, 3, []string{"mechanisms", "mechanisms", "mechanisms", "mechanisms", "mechanisms", "mechanisms", "mechanisms", "mechanisms", "mechanisms", "mechanisms", "mechanisms"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			segments, err := FormatSegments(results, nil, "example.com", tt.maxLength, tt.maxMechanisms, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var cuts []string
+			var cidrs []string
+			for i, s := range segments {
+				if len(s) > tt.maxLength {
+					t.Errorf("record of %d bytes over the %d-byte limit: %s", len(s), tt.maxLength, s)
+				}
+				if tt.maxMechanisms > 0 && Mechanisms(s) > tt.maxMechanisms {
+					t.Errorf("record of %d mechanisms over the limit of %d: %s", Mechanisms(s), tt.maxMechanisms, s)
+				}
+				fields := strings.Fields(s)
+				cidrs = append(cidrs, fields[1:len(fields)-1]...)
+				if i == len(segments)-1 {
+					continue
+				}
+				// The first CIDR of the next record did not fit under one of the limits
+				next := strings.Fields(segments[i+1])[1]
+				switch {
+				case tt.maxMechanisms > 0 && Mechanisms(s) == tt.maxMechanisms:
+					cuts = append(cuts, "mechanisms")
+				case len(s)+len(next)+1 > tt.maxLength:
+					cuts = append(cuts, "bytes")
+				default:
+					t.Errorf("record %d cut with room left for %s: %s", i, next, s)
+				}
+			}
+			if got, want := strings.Join(cuts, " "), strings.Join(tt.cuts, " "); got != want {
+				t.Errorf("cuts = %s, want %s", got, want)
+			}
+			if len(cidrs) != len(results) {
+				t.Errorf("records hold %d CIDRs, want %d", len(cidrs), len(results))
+			}
+		})
+	}
+}
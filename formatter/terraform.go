@@ -0,0 +1,86 @@
+// Fichier: formatter/terraform.go (sortie Terraform)
+
+package formatter
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TXTRecord is a generated TXT record with its fully qualified owner name.
+type TXTRecord struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// TerraformProviders are the accepted flavors of FormatTerraform.
+var TerraformProviders = []string{"generic", "route53", "cloudflare"}
+
+// FormatTerraform renders the records as Terraform HCL for flavor:
+//   - "route53": aws_route53_record resources, values over 255 bytes split with \"\" as
+//     the AWS provider expects;
+//   - "cloudflare": cloudflare_record resources, Cloudflare splitting long values itself;
+//   - "generic": a spf_records local, a map from owner name to ttl and value that
+//     for_each can iterate over.
+//
+// The resources take the zone from a zone_id variable, declared in the output.
+func FormatTerraform(records []TXTRecord, ttl int, flavor string) (string, error) {
+	for _, r := range records {
+		if _, err := QuoteTXT(r.Value); err != nil {
+			return "", fmt.Errorf("cannot encode record %s: %w", r.Name, err)
+		}
+	}
+
+	var b strings.Builder
+	switch flavor {
+	case "route53", "cloudflare":
+		resource, field := "aws_route53_record", "records"
+		if flavor == "cloudflare" {
+			resource, field = "cloudflare_record", "content"
+		}
+		fmt.Fprintf(&b, "variable \"zone_id\" {\n  type = string\n}\n")
+		for _, r := range records {
+			value := hclString(r.Value)
+			if flavor == "route53" {
+				var chunks []string
+				for v := r.Value; v != ""; v = v[min(len(v), maxTXTLength):] {
+					chunks = append(chunks, v[:min(len(v), maxTXTLength)])
+				}
+				value = "[" + hclString(strings.Join(chunks, `""`)) + "]"
+			}
+			fmt.Fprintf(&b, "\nresource %q %q {\n", resource, terraformLabel(r.Name))
+			fmt.Fprintf(&b, "  zone_id = var.zone_id\n")
+			fmt.Fprintf(&b, "  name    = %s\n", hclString(r.Name))
+			fmt.Fprintf(&b, "  type    = \"TXT\"\n")
+			fmt.Fprintf(&b, "  ttl     = %d\n", ttl)
+			fmt.Fprintf(&b, "  %-7s = %s\n", field, value)
+			fmt.Fprintf(&b, "}\n")
+		}
+	case "generic":
+		fmt.Fprintf(&b, "locals {\n  spf_records = {\n")
+		for _, r := range records {
+			fmt.Fprintf(&b, "    %s = { ttl = %d, value = %s }\n", hclString(r.Name), ttl, hclString(r.Value))
+		}
+		fmt.Fprintf(&b, "  }\n}\n")
+	default:
+		return "", fmt.Errorf("unknown Terraform provider %q (accepted: %s)", flavor, strings.Join(TerraformProviders, ", "))
+	}
+	return b.String(), nil
+}
+
+// terraformLabel returns the resource label of an owner name: its first label without
+// the leading underscore, "spf" for _spf and "spf_owner" for _spf-owner.
+func terraformLabel(name string) string {
+	label, _, _ := strings.Cut(name, ".")
+	return strings.ReplaceAll(strings.TrimPrefix(label, "_"), "-", "_")
+}
+
+// hclString quotes s as an HCL string literal, escaping the template sequences ${ and %{
+// that SPF macros may contain.
+func hclString(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	s = strings.ReplaceAll(s, "${", "$${")
+	s = strings.ReplaceAll(s, "%{", "%%{")
+	return `"` + s + `"`
+}
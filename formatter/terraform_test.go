@@ -0,0 +1,64 @@
+package formatter
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files of testdata")
+
+// terraformRecords covers a chained record, a value over 255 bytes and SPF macros, which
+// collide with HCL template sequences.
+var terraformRecords = []TXTRecord{
+	{Name: "_spf.example.com", Value: "v=spf1 ip4:192.0.2.0/24 exists:%{i}.spf.example.net include:spf1.example.com"},
+	{Name: "spf1.example.com", Value: "v=spf1 " + strings.Repeat("ip4:198.51.100.1 ", 16) + "~all"},
+	{Name: "_spf-owner.example.com", Value: `v=spf1 exp=${x} "quoted\" -all`},
+}
+
+// TestFormatTerraformGolden locks the HCL of every flavor in testdata/terraform/<flavor>.tf.
+func TestFormatTerraformGolden(t *testing.T) {
+	for _, flavor := range TerraformProviders {
+		t.Run(flavor, func(t *testing.T) {
+			got, err := FormatTerraform(terraformRecords, DefaultTTL, flavor)
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join("testdata", "terraform", flavor+".tf")
+			if *update {
+				if err := os.WriteFile(path, []byte(got), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("%v (run go test -update to create it)", err)
+			}
+			if !bytes.Equal([]byte(got), want) {
+				t.Errorf("%s differs (go test -update to accept):\n%s", path, got)
+			}
+		})
+	}
+}
+
+func TestFormatTerraformErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		records []TXTRecord
+		flavor  string
+	}{
+		{"unknown flavor", terraformRecords, "bind"},
+		{"non-printable value", []TXTRecord{{Name: "_spf.example.com", Value: "v=spf1 \x7f -all"}}, "generic"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := FormatTerraform(tt.records, DefaultTTL, tt.flavor); err == nil {
+				t.Error("FormatTerraform() succeeded, want an error")
+			}
+		})
+	}
+}
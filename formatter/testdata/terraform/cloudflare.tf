@@ -0,0 +1,27 @@
+variable "zone_id" {
+  type = string
+}
+
+resource "cloudflare_record" "spf" {
+  zone_id = var.zone_id
+  name    = "_spf.example.com"
+  type    = "TXT"
+  ttl     = 600
+  content = "v=spf1 ip4:192.0.2.0/24 exists:%%{i}.spf.example.net include:spf1.example.com"
+}
+
+resource "cloudflare_record" "spf1" {
+  zone_id = var.zone_id
+  name    = "spf1.example.com"
+  type    = "TXT"
+  ttl     = 600
+  content = "v=spf1 ip4:198.51.100.1 ip4:198.51.100.1 ip4:198.51.100.1 ip4:198.51.100.1 ip4:198.51.100.1 ip4:198.51.100.1 ip4:198.51.100.1 ip4:198.51.100.1 ip4:198.51.100.1 ip4:198.51.100.1 ip4:198.51.100.1 ip4:198.51.100.1 ip4:198.51.100.1 ip4:198.51.100.1 ip4:198.51.100.1 ip4:198.51.100.1 ~all"
+}
+
+resource "cloudflare_record" "spf_owner" {
+  zone_id = var.zone_id
+  name    = "_spf-owner.example.com"
+  type    = "TXT"
+  ttl     = 600
+  content = "v=spf1 exp=$${x} \"quoted\\\" -all"
+}
@@ -0,0 +1,7 @@
+locals {
+  spf_records = {
+    "_spf.example.com" = { ttl = 600, value = "v=spf1 ip4:192.0.2.0/24 exists:%%{i}.spf.example.net include:spf1.example.com" }
+    "spf1.example.com" = { ttl = 600, value = "v=spf1 ip4:198.51.100.1 ip4:198.51.100.1 ip4:198.51.100.1 ip4:198.51.100.1 ip4:198.51.100.1 ip4:198.51.100.1 ip4:198.51.100.1 ip4:198.51.100.1 ip4:198.51.100.1 ip4:198.51.100.1 ip4:198.51.100.1 ip4:198.51.100.1 ip4:198.51.100.1 ip4:198.51.100.1 ip4:198.51.100.1 ip4:198.51.100.1 ~all" }
+    "_spf-owner.example.com" = { ttl = 600, value = "v=spf1 exp=$${x} \"quoted\\\" -all" }
+  }
+}
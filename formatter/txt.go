@@ -0,0 +1,79 @@
+// Fichier: formatter/txt.go
+
+package formatter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// QuoteTXT encodes a TXT value in zone-file presentation format: one or more quoted
+// character-strings of at most 255 bytes, with quotes and backslashes escaped. Every
+// output path must use it so console, zone files and providers agree on the encoding.
+// Bytes outside printable ASCII are rejected rather than silently escaped.
+func QuoteTXT(value string) (string, error) {
+	for i := 0; i < len(value); i++ {
+		if c := value[i]; c < 0x20 || c > 0x7e {
+			return "", fmt.Errorf("TXT value contains non-printable byte 0x%02x at offset %d: %q", c, i, value)
+		}
+	}
+
+	var chunks []string
+	for len(value) > maxTXTLength {
+		chunks = append(chunks, quoteString(value[:maxTXTLength]))
+		value = value[maxTXTLength:]
+	}
+	chunks = append(chunks, quoteString(value))
+	return strings.Join(chunks, " "), nil
+}
+
+// quoteString escapes a single character-string and wraps it in quotes.
+func quoteString(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + s + `"`
+}
+
+// UnquoteTXT decodes a TXT value in presentation format, as QuoteTXT and the provider
+// APIs write it, and joins its character-strings. Decimal escapes (\DDD) are decoded.
+func UnquoteTXT(s string) (string, error) {
+	var b strings.Builder
+	rest := strings.TrimSpace(s)
+	for rest != "" {
+		if rest[0] != '"' {
+			return "", fmt.Errorf("TXT value %s: expected a quoted character-string", s)
+		}
+		i := 1
+		for ; i < len(rest) && rest[i] != '"'; i++ {
+			if rest[i] != '\\' {
+				b.WriteByte(rest[i])
+				continue
+			}
+			if i+3 < len(rest) && isDigits(rest[i+1:i+4]) {
+				n, _ := strconv.Atoi(rest[i+1 : i+4])
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+			if i+1 < len(rest) {
+				i++
+				b.WriteByte(rest[i])
+			}
+		}
+		if i >= len(rest) {
+			return "", fmt.Errorf("TXT value %s: unterminated character-string", s)
+		}
+		rest = strings.TrimSpace(rest[i+1:])
+	}
+	return b.String(), nil
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
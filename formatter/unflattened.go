@@ -0,0 +1,56 @@
+// Fichier: formatter/unflattened.go
+
+package formatter
+
+import (
+	"fmt"
+	"strings"
+
+	"project/spf-flattener/spf"
+)
+
+// maxRFCLookups is the lookup limit verifiers enforce (RFC 7208 section 4.6.4).
+const maxRFCLookups = 10
+
+// FormatUnflattened rebuilds a normalized unflattened record from the source record's
+// top-level terms, ending with the same all-directive as the flattened segments. A
+// redirect= is only followed without an all mechanism (RFC 7208 section 6.1): when the
+// source relies on one, the record ends with it instead, and when the source has an all
+// the dead redirect is left out. lookups is the number of lookups a verifier evaluates
+// for the whole chain of the source (see dns.Resolver.VerifierLookups).
+// It returns the record and the problems that make it non-compliant on its own.
+func FormatUnflattened(rec *spf.Record, lookups int) (string, []string) {
+	terms, _ := rec.Effective()
+	hasAll, redirect := false, ""
+	for _, t := range terms {
+		switch {
+		case t.Name == "all" && !t.Modifier:
+			hasAll = true
+		case t.Name == "redirect" && t.Modifier:
+			redirect = t.String()
+		}
+	}
+
+	parts := []string{"v=spf1"}
+	for _, t := range terms {
+		if t.Name == "all" && !t.Modifier || t.Name == "redirect" && t.Modifier {
+			continue
+		}
+		parts = append(parts, t.String())
+	}
+	if redirect != "" && !hasAll {
+		parts = append(parts, redirect)
+	} else {
+		parts = append(parts, finalDirective)
+	}
+	record := strings.Join(parts, " ")
+
+	var problems []string
+	if len(record) > maxTXTLength {
+		problems = append(problems, fmt.Sprintf("record is %d bytes, over the %d-byte string limit", len(record), maxTXTLength))
+	}
+	if lookups > maxRFCLookups {
+		problems = append(problems, fmt.Sprintf("record needs %d lookups, over the RFC limit of %d", lookups, maxRFCLookups))
+	}
+	return record, problems
+}
@@ -0,0 +1,44 @@
+package formatter
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"project/spf-flattener/spf"
+)
+
+func TestFormatUnflattened(t *testing.T) {
+	tests := []struct {
+		name    string
+		source  string
+		lookups int
+		want    string
+		// wantProblems are substrings of the expected problems, in order
+		wantProblems []string
+	}{
+		{"all replaced", "v=spf1 ip4:192.0.2.0/24 include:_spf.example.net -all", 1, "v=spf1 ip4:192.0.2.0/24 include:_spf.example.net ~all", nil},
+		{"redirect kept without all", "v=spf1 ip4:192.0.2.0/24 redirect=_spf.example.net", 1, "v=spf1 ip4:192.0.2.0/24 redirect=_spf.example.net", nil},
+		{"dead redirect dropped", "v=spf1 ip4:192.0.2.0/24 redirect=_spf.example.net -all", 0, "v=spf1 ip4:192.0.2.0/24 ~all", nil},
+		{"canonical form", "V=SPF1 IP4:192.0.2.0/24 INCLUDE:_spf.example.net ?ALL", 1, "v=spf1 ip4:192.0.2.0/24 include:_spf.example.net ~all", nil},
+		// Two top-level includes whose own records bring the chain past the limit
+		{"nested lookups", "v=spf1 include:a.example.net include:b.example.net -all", 11, "v=spf1 include:a.example.net include:b.example.net ~all", []string{"needs 11 lookups"}},
+		{"at the lookup limit", "v=spf1 include:a.example.net -all", 10, "v=spf1 include:a.example.net ~all", nil},
+		{"too long", "v=spf1 " + strings.Repeat("ip4:192.0.2.1 ", 20) + "-all", 0, "v=spf1 " + strings.Repeat("ip4:192.0.2.1 ", 20) + "~all", []string{"over the 255-byte string limit"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, err := spf.Parse(tt.source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, problems := FormatUnflattened(rec, tt.lookups)
+			if got != tt.want {
+				t.Errorf("FormatUnflattened() = %q, want %q", got, tt.want)
+			}
+			if len(problems) != len(tt.wantProblems) || !slices.EqualFunc(problems, tt.wantProblems, strings.Contains) {
+				t.Errorf("problems = %q, want %q", problems, tt.wantProblems)
+			}
+		})
+	}
+}
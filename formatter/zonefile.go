@@ -0,0 +1,30 @@
+// Fichier: formatter/zonefile.go (extrait de fichier de zone BIND)
+
+package formatter
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultTTL is the TTL of the generated records.
+const DefaultTTL = 600
+
+// FormatZoneFile returns the records of the segments as an RFC 1035 zone file snippet
+// ready to paste into the zone of domain: an $ORIGIN line, then one TXT record per
+// segment with its fully qualified owner name, values longer than 255 bytes split into
+// several quoted character-strings.
+func FormatZoneFile(segments []string, domain string, ttl int) (string, error) {
+	origin := strings.TrimSuffix(domain, ".") + "."
+	var b strings.Builder
+	fmt.Fprintf(&b, "$ORIGIN %s\n", origin)
+	for i, segment := range segments {
+		name := RecordName(i, origin)
+		value, err := QuoteTXT(segment)
+		if err != nil {
+			return "", fmt.Errorf("cannot encode record %s: %w", name, err)
+		}
+		fmt.Fprintf(&b, "%s %d IN TXT %s\n", name, ttl, value)
+	}
+	return b.String(), nil
+}
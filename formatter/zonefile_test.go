@@ -0,0 +1,80 @@
+package formatter
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// TestFormatZoneFileParses feeds the snippet to the miekg/dns zone parser and checks that
+// every record comes back with its owner name, TTL and value.
+func TestFormatZoneFileParses(t *testing.T) {
+	long := "v=spf1 " + strings.Repeat("ip4:192.0.2.1 ", 40) + "~all"
+	tests := []struct {
+		name     string
+		segments []string
+		domain   string
+	}{
+		{"single record", []string{"v=spf1 ip4:192.0.2.0/24 ~all"}, "example.com"},
+		{"chain", []string{"v=spf1 ip4:192.0.2.0/24 include:spf1.example.com", "v=spf1 ip6:2001:db8::/32 ~all"}, "example.com"},
+		{"fully qualified domain", []string{"v=spf1 -all"}, "example.com."},
+		{"255-byte value", []string{"v=spf1 " + strings.Repeat("a", 248)}, "example.com"},
+		{"256-byte value", []string{"v=spf1 " + strings.Repeat("a", 249)}, "example.com"},
+		{"long value", []string{long}, "example.com"},
+		{"quotes and backslashes", []string{`v=spf1 exists:%{i}.x.example.com exp="a\b" -all`}, "example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			snippet, err := FormatZoneFile(tt.segments, tt.domain, DefaultTTL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			zp := dns.NewZoneParser(strings.NewReader(snippet), "", "")
+			var i int
+			for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+				if i >= len(tt.segments) {
+					t.Fatalf("extra record %s", rr)
+				}
+				txt, isTXT := rr.(*dns.TXT)
+				if !isTXT {
+					t.Fatalf("record %s is not a TXT record", rr)
+				}
+				if want := RecordName(i, strings.TrimSuffix(tt.domain, ".")) + "."; txt.Hdr.Name != want {
+					t.Errorf("owner %s, want %s", txt.Hdr.Name, want)
+				}
+				if txt.Hdr.Ttl != DefaultTTL {
+					t.Errorf("TTL %d, want %d", txt.Hdr.Ttl, DefaultTTL)
+				}
+				// miekg/dns keeps the character-strings escaped
+				var got string
+				for _, s := range txt.Txt {
+					s, err := UnquoteTXT(`"` + s + `"`)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if len(s) > 255 {
+						t.Errorf("character-string of %d bytes", len(s))
+					}
+					got += s
+				}
+				if got != tt.segments[i] {
+					t.Errorf("value %q, want %q", got, tt.segments[i])
+				}
+				i++
+			}
+			if err := zp.Err(); err != nil {
+				t.Fatalf("zone parser: %v\n%s", err, snippet)
+			}
+			if i != len(tt.segments) {
+				t.Errorf("parsed %d records, want %d:\n%s", i, len(tt.segments), snippet)
+			}
+		})
+	}
+}
+
+func TestFormatZoneFileRejectsNonPrintable(t *testing.T) {
+	if _, err := FormatZoneFile([]string{"v=spf1 \x00 -all"}, "example.com", DefaultTTL); err == nil {
+		t.Error("FormatZoneFile() accepted a non-printable byte")
+	}
+}
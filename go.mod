@@ -4,12 +4,12 @@ go 1.25.1
 
 require (
 	github.com/miekg/dns v1.1.68
+	golang.org/x/net v0.46.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	golang.org/x/mod v0.24.0 // indirect
-	golang.org/x/net v0.46.0 // indirect
 	golang.org/x/sync v0.14.0 // indirect
 	golang.org/x/sys v0.37.0 // indirect
 	golang.org/x/tools v0.33.0 // indirect
@@ -1,286 +1,230 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
-	"net"
+	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 
-	"project/spf-flattener/cidr"
 	"project/spf-flattener/config"
-	"project/spf-flattener/dns"
-	"project/spf-flattener/formatter"
+	"project/spf-flattener/pipeline"
+	"project/spf-flattener/publish"
 )
 
-const configFile = "spf-flattener-config.yaml"
+// defaultConfigFile is the configuration file read when -config is not given.
+const defaultConfigFile = "spf-flattener-config.yaml"
+
+// options holds the command line flags.
+type options struct {
+	// config is the configuration file, "-" for standard input.
+	config string
+	// domain, when set, flattens that domain ad hoc: no priority entries, no comparison.
+	domain string
+	// noConfig skips the configuration file and uses defaults (requires domain).
+	noConfig bool
+	// printEffectiveConfig dumps the merged configuration with its provenance and exits.
+	printEffectiveConfig bool
+	// watch re-runs the flattener whenever the configuration files change.
+	watch bool
+	// vcsFriendly writes the records sorted, one mechanism per line, for version control.
+	vcsFriendly bool
+	// suggestConfig prints priorityEntries without the entries covered by the chain and exits.
+	suggestConfig bool
+	// updatePin rewrites the pin file of this include from the current resolution.
+	updatePin string
+	// output overrides the outputFormat of the configuration.
+	output string
+	// publish pushes the generated records to the configured provider after the run.
+	publish bool
+	// dryRun prints the changes publish would make without calling the provider.
+	dryRun bool
+	// force publishes even when the published records already match.
+	force bool
+	// captureBundle saves what is needed to replay the run into this directory.
+	captureBundle string
+	// replayBundle re-runs a captured run from this directory, without network access.
+	replayBundle string
+}
 
-func main() {
-	// 1. Load Configuration
-	cfg, err := config.LoadConfig(configFile)
-	if err != nil {
-		log.Fatalf("ERROR: Failed to load configuration from %s: %v", configFile, err)
-	}
-	log.Printf("INFO: Configuration loaded successfully. Concurrency limit: %d", cfg.ConcurrencyLimit)
+// parseFlags parses the command line arguments (without the program name).
+func parseFlags(args []string) (options, error) {
+	var opts options
+	fs := flag.NewFlagSet("spf-flattener", flag.ContinueOnError)
+	fs.StringVar(&opts.config, "config", defaultConfigFile, "configuration file, - to read it from standard input")
+	fs.StringVar(&opts.domain, "domain", "", "flatten this domain ad hoc (skips priority entries and comparison)")
+	fs.BoolVar(&opts.noConfig, "no-config", false, "do not read the configuration file, use defaults (requires -domain)")
+	fs.BoolVar(&opts.printEffectiveConfig, "print-effective-config", false, "print the configuration merged with the files it extends, then exit")
+	fs.BoolVar(&opts.watch, "watch", false, "re-run whenever the configuration file or a file it extends changes")
+	fs.BoolVar(&opts.vcsFriendly, "vcs-friendly", false, "write the records sorted by name, one mechanism per line, for minimal diffs under version control")
+	fs.BoolVar(&opts.suggestConfig, "suggest-config", false, "print priorityEntries without the entries already covered by the flattened chain, then exit")
+	fs.StringVar(&opts.updatePin, "update-pin", "", "rewrite the pin file of this include from the current resolution, after review of the deviations")
+	fs.StringVar(&opts.output, "output", "", "what to write to standard output: "+strings.Join(config.OutputFormats, " or ")+" (overrides outputFormat)")
+	fs.BoolVar(&opts.publish, "publish", false, "push the generated records to the provider of the publish configuration")
+	fs.BoolVar(&opts.dryRun, "dry-run", false, "with -publish, print the changes instead of calling the provider")
+	fs.BoolVar(&opts.force, "force", false, "with -publish, publish even when the published records already match")
+	fs.StringVar(&opts.captureBundle, "capture-bundle", "", "save the configuration, DNS answers and output of the run into this directory, for -replay-bundle")
+	fs.StringVar(&opts.replayBundle, "replay-bundle", "", "re-run a run captured with -capture-bundle from this directory, without network access")
+	if err := fs.Parse(args); err != nil {
+		return opts, err
+	}
+	if opts.noConfig && opts.domain == "" {
+		return opts, fmt.Errorf("-no-config requires -domain")
+	}
+	if opts.output != "" && !slices.Contains(config.OutputFormats, opts.output) {
+		return opts, fmt.Errorf("-output must be one of %s (got %q)", strings.Join(config.OutputFormats, ", "), opts.output)
+	}
+	if opts.publish && (opts.domain != "" || opts.replayBundle != "") {
+		return opts, fmt.Errorf("-publish cannot be combined with -domain or -replay-bundle")
+	}
+	// Watch mode only checks: a config save must never push records
+	if opts.publish && opts.watch {
+		return opts, fmt.Errorf("-publish cannot be combined with -watch")
+	}
+	if (opts.dryRun || opts.force) && !opts.publish {
+		return opts, fmt.Errorf("-dry-run and -force require -publish")
+	}
+	if opts.captureBundle != "" && opts.replayBundle != "" {
+		return opts, fmt.Errorf("-capture-bundle and -replay-bundle cannot be combined")
+	}
+	if opts.watch && (opts.captureBundle != "" || opts.replayBundle != "") {
+		return opts, fmt.Errorf("-watch cannot be combined with -capture-bundle or -replay-bundle")
+	}
+	if opts.watch && opts.config == "-" {
+		return opts, fmt.Errorf("-watch cannot watch a configuration read from standard input")
+	}
+	return opts, nil
+}
 
-	// Vérifier que targetDomain est défini
-	if cfg.TargetDomain == "" {
-		log.Fatalf("ERROR: targetDomain not defined in configuration file")
+// loadConfig returns the configuration for this run, from the file or from defaults.
+func loadConfig(opts options) (*config.Config, error) {
+	if opts.replayBundle != "" {
+		return config.LoadConfig(filepath.Join(opts.replayBundle, bundleConfig))
 	}
+	if opts.noConfig {
+		return config.New(config.WithTargetDomain(opts.domain))
+	}
+	return config.LoadConfig(opts.config)
+}
 
-	// Utiliser le targetDomain de la configuration
-	targetDomain := "spf-unflat." + cfg.TargetDomain
-
-	// --- Core Processing ---
-
-	// 3. Initialize Resolver with Concurrency Control
-	resolver := dns.NewResolver(cfg.ConcurrencyLimit)
+// exitIncomplete is the exit status of a run whose comparison with the published records
+// was not made because a record of our own chain failed to resolve. Failed runs exit with
+// 1 and invalid flags with 2.
+const exitIncomplete = 3
 
-	// 4. Resolve Priority Entries (synchronously to preserve configuration order)
-	var priorityIPNets cidr.NetAddrSlice
+// exitMaxRuntime is the exit status of a run aborted by its maxRuntime budget.
+const exitMaxRuntime = 4
 
-	for i, entry := range cfg.PriorityEntries {
-		resolved, err := resolvePriorityEntry(resolver, entry, i)
+func main() {
+	if ok, err := runVerb(os.Args[1:]); ok {
 		if err != nil {
-			// Fail-fast on priority resolution failure
-			log.Fatalf("FAIL-FAST: Failed to resolve priority entry '%s': %v", entry, err)
+			log.Fatalf("ERROR: %v", err)
 		}
-		priorityIPNets = append(priorityIPNets, resolved...)
-	}
-	log.Printf("INFO: Found %d unique network addresses from priority entries.", len(priorityIPNets))
-
-	// 5. Recursive SPF Flattening for Target Domain
-	// Note: The FlattenSPF implementation will handle recursion and lookups count.
-	nonPriorityIPNets, err := resolver.FlattenSPF(targetDomain, targetDomain, false, -1)
-	if err != nil {
-		// Fail-fast on main SPF resolution failure
-		log.Fatalf("FAIL-FAST: Failed to flatten SPF for %s: %v", targetDomain, err)
+		return
 	}
-	log.Printf("INFO: Found %d network addresses from the main SPF chain.", len(nonPriorityIPNets))
 
-	// 6. Combine, Deduplicate, and Sort All Addresses
-	allIPNets := append(priorityIPNets, nonPriorityIPNets...)
-	finalIPNets := cidr.DeduplicateAndSort(allIPNets)
-
-	// Check current TXT spf record and compare with finalIPNets
-	entryName := "_spf." + cfg.TargetDomain
-	currentCIDRs, err := fetchSPFAndResolveIncludes(entryName, cfg.MaxLookups)
+	opts, err := parseFlags(os.Args[1:])
 	if err != nil {
-		log.Printf("WARN: Failed to fetch current SPF (and includes) at %s: %v", entryName, err)
-	} else {
-		compareAndReportCIDRs(finalIPNets, currentCIDRs, entryName)
-	}
-
-	// 7. Format Output (Multi-TXT Segmentation)
-	segments := formatter.FormatSegments(finalIPNets, cfg.TargetDomain)
-
-	// --- Output Results ---
-
-	log.Println("=======================================================")
-	log.Println("             SPF FLATTENING RESULTS")
-	log.Println("=======================================================")
-	log.Printf("Initial Domain: %s\n", targetDomain)
-	log.Printf("Total DNS Lookups Used (Recursive Includes): %d / %d\n",
-		resolver.GetLookupCount(), cfg.MaxLookups)
-	log.Printf("Total Unique CIDRs Generated: %d\n", len(finalIPNets))
-	log.Println("-------------------------------------------------------")
-
-	// Print the generated TXT records
-	for i, segment := range segments {
-		recordName := "_spf"
-		if i > 0 {
-			recordName = fmt.Sprintf("spf%d", i) // spf1, spf2, ... (since the first segment is index 0)
-		}
-
-		// The entry point record is _spf.domain.com
-		fullRecordName := fmt.Sprintf("%s", recordName)
-
-		fmt.Printf("%s 600 IN TXT \"%s\"\n", fullRecordName, segment)
-
+		log.Printf("ERROR: %v", err)
+		os.Exit(2)
 	}
 
-}
-
-// resolvePriorityEntry resolves a single priority entry (CIDR or domain) into NetAddr slice.
-func resolvePriorityEntry(r *dns.Resolver, entry string, index int) (cidr.NetAddrSlice, error) {
-	// Check if it's already a CIDR
-	if _, ipNet, err := net.ParseCIDR(entry); err == nil {
-		return cidr.NetAddrSlice{&cidr.NetAddr{
-			IPNet:                 ipNet,
-			IsPriority:            true,
-			OriginalPriorityIndex: index,
-		}}, nil
+	if opts.watch {
+		watch(opts.config, withoutWatch(os.Args[1:]))
+		return
 	}
 
-	// Assume it's a domain and perform DNS resolution (A/AAAA)
-	// NOTE: MX/PTR mechanisms are typically not processed for simple priority domains,
-	// only for domains found in the SPF chain. If the requirement was to process MX/PTR
-	// here too, we would call a specific resolver function.
-
-	// A simple A/AAAA lookup for a priority domain
-	return r.ResolveAAndAAAA(entry, true, index)
-}
-
-// fetchSPFAndResolveIncludes looks up the given name and recursively follows include: mechanisms,
-// collecting all ip4/ip6 CIDRs found. It uses a simple BFS with a visited set and limits the number
-// of lookups by maxLookups to avoid loops.
-func fetchSPFAndResolveIncludes(name string, maxLookups int) ([]string, error) {
-	var cidrs []string
-	visited := make(map[string]struct{})
-	queue := []string{name}
-	lookups := 0
-
-	for len(queue) > 0 {
-		if lookups >= maxLookups {
-			return cidrs, fmt.Errorf("max lookups (%d) reached while resolving SPF includes", maxLookups)
-		}
-		d := queue[0]
-		queue = queue[1:]
-
-		// avoid duplicate lookups
-		if _, ok := visited[d]; ok {
-			continue
-		}
-		visited[d] = struct{}{}
-		lookups++
-
-		txts, err := net.LookupTXT(d)
+	if opts.printEffectiveConfig {
+		out, err := config.EffectiveConfig(opts.config)
 		if err != nil {
-			// continue processing other includes; report at end if nothing found
-			log.Printf("WARN: LookupTXT failed for %s: %v", d, err)
-			continue
-		}
-
-		foundSPF := false
-		for _, txt := range txts {
-			t := strings.TrimSpace(txt)
-			if strings.HasPrefix(strings.ToLower(t), "v=spf1") {
-				foundSPF = true
-				c, includes := parseSPFToCIDRsAndIncludes(t)
-				cidrs = append(cidrs, c...)
-				// enqueue includes
-				for _, inc := range includes {
-					// Per RFC include target is a domain; enqueue as-is
-					if _, seen := visited[inc]; !seen {
-						queue = append(queue, inc)
-					}
-				}
-				// do not break: in case multiple TXT records contain fragments, parse them all
-			}
-		}
-		if !foundSPF {
-			// No SPF at this name; continue
-			continue
+			log.Fatalf("ERROR: %v", err)
 		}
+		fmt.Print(string(out))
+		return
 	}
 
-	if len(cidrs) == 0 {
-		return nil, fmt.Errorf("no v=spf1 TXT records (or cidrs) found under %s and its includes", name)
-	}
-
-	// Normalize and dedupe CIDRs
-	normalized := make(map[string]struct{})
-	var out []string
-	for _, s := range cidrs {
-		normalized[s] = struct{}{}
-	}
-	for k := range normalized {
-		out = append(out, k)
+	// 1. Load Configuration
+	cfg, err := loadConfig(opts)
+	if err != nil {
+		log.Fatalf("ERROR: Failed to load configuration from %s: %v", opts.config, err)
 	}
-	return out, nil
-}
 
-// parseSPFToCIDRsAndIncludes extracts ip4/ip6 CIDRs and include: targets from a single spf string.
-// It normalizes bare IPs to CIDRs (/32 or /128).
-func parseSPFToCIDRsAndIncludes(spf string) (cidrs []string, includes []string) {
-	toks := strings.Fields(spf)
-	if len(toks) == 0 {
-		return
+	if opts.output != "" {
+		cfg.OutputFormat = opts.output
 	}
-	for _, tok := range toks[1:] { // skip "v=spf1"
-		if tok == "" {
-			continue
-		}
-		// strip leading qualifier + - ~ ?
-		if strings.ContainsAny(tok[:1], "+-~?") && len(tok) > 1 {
-			tok = tok[1:]
-		}
 
-		if strings.HasPrefix(tok, "include:") {
-			inc := strings.TrimPrefix(tok, "include:")
-			// include may have a trailing qualifier (unlikely) but trim spaces
-			inc = strings.TrimSpace(inc)
-			if inc != "" {
-				includes = append(includes, inc)
-			}
-			continue
+	// 2. Run the pipeline: resolve, flatten, compare, format and print
+	p, err := pipeline.New(cfg, opts.domain)
+	if err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+	log.Printf("INFO: Configuration loaded successfully. Nameservers: %s. Concurrency: %d DNS queries, %d include fetches, %d publish calls",
+		strings.Join(p.Nameservers(), ", "), cfg.Concurrency.DNSQueries, cfg.Concurrency.IncludeBranches, cfg.Concurrency.PublishOps)
+	p.SuggestConfig = opts.suggestConfig
+	p.VCSFriendly = opts.vcsFriendly
+	p.UpdatePin = opts.updatePin
+	var captured *capture
+	var replayed *bytes.Buffer
+	switch {
+	case opts.captureBundle != "":
+		captured = startCapture(p)
+	case opts.replayBundle != "":
+		if replayed, err = startReplay(p, opts.replayBundle); err != nil {
+			log.Fatalf("ERROR: %v", err)
 		}
-
-		if strings.HasPrefix(tok, "ip4:") || strings.HasPrefix(tok, "ip6:") {
-			addr := tok[4:]
-			// try CIDR
-			if _, ipnet, err := net.ParseCIDR(addr); err == nil {
-				cidrs = append(cidrs, ipnet.String())
-				continue
-			}
-			// try plain IP
-			if ip := net.ParseIP(addr); ip != nil {
-				if strings.HasPrefix(tok, "ip4:") {
-					mask := net.CIDRMask(32, 32)
-					ipnet := &net.IPNet{IP: ip, Mask: mask}
-					cidrs = append(cidrs, ipnet.String())
-				} else {
-					mask := net.CIDRMask(128, 128)
-					ipnet := &net.IPNet{IP: ip, Mask: mask}
-					cidrs = append(cidrs, ipnet.String())
-				}
-			}
+	}
+	err = p.Run(context.Background())
+	fmt.Fprintln(os.Stderr, p.Summary())
+	if captured != nil {
+		if err := captured.writeBundle(opts.captureBundle, cfg, p.Nameservers(), p.Summary()); err != nil {
+			log.Printf("ERROR: Failed to write the capture bundle: %v", err)
 		}
 	}
-	return
-}
-
-// compareAndReportCIDRs compares the generated list (final) with the current published CIDRs and logs differences.
-func compareAndReportCIDRs(final cidr.NetAddrSlice, current []string, recordName string) {
-	finalSet := make(map[string]struct{}, len(final))
-	for _, n := range final {
-		finalSet[n.IPNet.String()] = struct{}{}
+	if replayed != nil && err == nil {
+		checkReplay(opts.replayBundle, replayed)
 	}
-
-	currentSet := make(map[string]struct{}, len(current))
-	for _, c := range current {
-		currentSet[c] = struct{}{}
+	var budget *pipeline.BudgetError
+	if errors.As(err, &budget) {
+		log.Print(err)
+		os.Exit(exitMaxRuntime)
 	}
-
-	var missing []string // in final but not in current (should be added)
-	for f := range finalSet {
-		if _, ok := currentSet[f]; !ok {
-			missing = append(missing, f)
-		}
+	if err != nil {
+		log.Fatal(err)
 	}
-
-	var extra []string // in current but not in final (should be removed)
-	for c := range currentSet {
-		if _, ok := finalSet[c]; !ok {
-			extra = append(extra, c)
+	if opts.publish {
+		if err := publishRecords(cfg, p, opts); err != nil {
+			log.Fatalf("ERROR: %v", err)
 		}
 	}
-
-	if len(missing) == 0 && len(extra) == 0 {
-		log.Printf("OK: Published SPF at %s matches generated CIDRs (%d entries).", recordName, len(final))
-		return
+	if p.Summary().Status == pipeline.StatusIncomplete {
+		os.Exit(exitIncomplete)
 	}
+}
 
-	log.Printf("DIFFERENCE: Published SPF at %s does not match generated CIDRs.", recordName)
-	if len(missing) > 0 {
-		log.Printf("  Missing in DNS (present in generated final list):")
-		for _, m := range missing {
-			log.Printf("    + %s", m)
-		}
+// publishRecords pushes the records of the run to the configured provider, deleting the
+// records of a previous, longer chain. It does nothing when every generated record is
+// already live and nothing is stale, unless forced. An incomplete run is never published:
+// the chain it would replace or delete could not be read.
+func publishRecords(cfg *config.Config, p *pipeline.Pipeline, opts options) error {
+	if p.Summary().Status == pipeline.StatusIncomplete {
+		return fmt.Errorf("refusing to publish: records of the published chain failed to resolve, run again once they answer")
 	}
-	if len(extra) > 0 {
-		log.Printf("  Extra in DNS (not present in generated final list):")
-		for _, e := range extra {
-			log.Printf("    - %s", e)
-		}
+	publisher, err := publish.New(cfg.Publish, cfg.Concurrency.PublishOps)
+	if err != nil {
+		return err
+	}
+	if err := p.CheckPublishZone(); err != nil {
+		return fmt.Errorf("refusing to publish: %w", err)
+	}
+	stale := p.StaleRecords()
+	if len(p.Unpublished()) == 0 && len(stale) == 0 && !opts.force {
+		log.Printf("INFO: The published records already match, nothing to publish (use -force to publish anyway)")
+		return nil
 	}
+	return publisher.Publish(os.Stdout, p.Records(), stale, opts.dryRun)
 }
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"project/spf-flattener/config"
+	"project/spf-flattener/dns/dnstest"
+	"project/spf-flattener/pipeline"
+)
+
+func TestParseFlagsCombinations(t *testing.T) {
+	tests := []struct {
+		args    []string
+		wantErr string
+	}{
+		{[]string{"-publish"}, ""},
+		{[]string{"-publish", "-dry-run"}, ""},
+		{[]string{"-watch"}, ""},
+		{[]string{"-watch", "-publish"}, "-publish cannot be combined with -watch"},
+		{[]string{"-publish", "-watch", "-dry-run"}, "-publish cannot be combined with -watch"},
+		{[]string{"-publish", "-domain", "example.org"}, "-publish cannot be combined with -domain"},
+		{[]string{"-dry-run"}, "-dry-run and -force require -publish"},
+		{[]string{"-no-config"}, "-no-config requires -domain"},
+		{[]string{"-output", "xml"}, "-output must be one of"},
+		{[]string{"-capture-bundle", "a", "-replay-bundle", "b"}, "cannot be combined"},
+		{[]string{"-watch", "-config", "-"}, "standard input"},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
+			_, err := parseFlags(tt.args)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("parseFlags() error = %v, want none", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("parseFlags() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPublishRecordsRefusesIncomplete(t *testing.T) {
+	zone := dnstest.New(t, `
+spf-unflat.example.com. 300 IN TXT "v=spf1 ip4:192.0.2.0/24 -all"
+_spf.example.com. 300 IN TXT "v=spf1 ip4:192.0.2.0/24 include:spf1.example.com -all"
+`)
+	zone.Fail("spf1.example.com", dns.RcodeServerFailure)
+	cfg, err := config.New(config.WithTargetDomain("example.com"), config.WithNameserver("127.0.0.1:53"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := pipeline.New(cfg, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Out = io.Discard
+	p.SetExchanger(zone)
+	if err := p.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if status := p.Summary().Status; status != pipeline.StatusIncomplete {
+		t.Fatalf("status = %s, want %s", status, pipeline.StatusIncomplete)
+	}
+
+	err = publishRecords(cfg, p, options{publish: true, force: true, dryRun: true})
+	if err == nil || !strings.Contains(err.Error(), "refusing to publish") {
+		t.Errorf("publishRecords() error = %v, want a refusal", err)
+	}
+}
@@ -0,0 +1,101 @@
+// Fichier: pipeline/analyze.go (verbe analyze)
+
+package pipeline
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strconv"
+)
+
+// Stats summarizes the CIDRs of a Resolved document.
+type Stats struct {
+	IPv4, IPv6    int
+	Priority      int
+	IPv4Addresses uint64
+	IPv6Subnets   *big.Int // /64 networks, a longer prefix counting as one
+	Unsourced     int
+}
+
+// Stats counts the CIDRs of the document per family and the IPv4 addresses and IPv6 /64
+// networks they authorize.
+// Overlapping CIDRs are counted once each, as the document is already deduplicated.
+func (doc Resolved) Stats() Stats {
+	s := Stats{IPv6Subnets: new(big.Int)}
+	for _, c := range doc.CIDRs {
+		_, ipNet, err := net.ParseCIDR(c.CIDR)
+		if err != nil {
+			continue
+		}
+		ones, bits := ipNet.Mask.Size()
+		if bits == 32 {
+			s.IPv4++
+			s.IPv4Addresses += 1 << (bits - ones)
+		} else {
+			s.IPv6++
+			s.IPv6Subnets.Add(s.IPv6Subnets, new(big.Int).Lsh(big.NewInt(1), uint(max(64-ones, 0))))
+		}
+		if c.Priority {
+			s.Priority++
+		}
+		if c.Source == "" {
+			s.Unsourced++
+		}
+	}
+	return s
+}
+
+// WriteMarkdown renders the document as a markdown report.
+func (doc Resolved) WriteMarkdown(w io.Writer) {
+	s := doc.Stats()
+	fmt.Fprintf(w, "# SPF flattening of %s\n\n", doc.Domain)
+	fmt.Fprintf(w, "- %d CIDRs: %d IPv4 (%d addresses), %d IPv6 (%s /64 networks)\n", len(doc.CIDRs), s.IPv4, s.IPv4Addresses, s.IPv6, s.IPv6Subnets)
+	fmt.Fprintf(w, "- %d from priority entries, %d without provenance\n", s.Priority, s.Unsourced)
+	for _, token := range doc.Passthrough {
+		fmt.Fprintf(w, "- passthrough `%s`\n", token)
+	}
+	fmt.Fprintln(w, "\n| CIDR | Family | Priority | Source |\n|---|---|---|---|")
+	for _, c := range doc.CIDRs {
+		priority := ""
+		if c.Priority {
+			priority = strconv.Itoa(c.PriorityIndex)
+		}
+		fmt.Fprintf(w, "| %s | %s | %s | %s |\n", c.CIDR, c.Family, priority, c.Source)
+	}
+}
+
+// WriteCSV renders the CIDRs of the document as CSV, with a header line.
+func (doc Resolved) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"cidr", "family", "priority", "priorityIndex", "source"})
+	for _, c := range doc.CIDRs {
+		cw.Write([]string{c.CIDR, c.Family, strconv.FormatBool(c.Priority), strconv.Itoa(c.PriorityIndex), c.Source})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteDiff prints the CIDRs and passthrough mechanisms added and removed between two
+// documents.
+func WriteDiff(w io.Writer, old, new Resolved) {
+	cidrs := func(doc Resolved) []string {
+		var out []string
+		for _, c := range doc.CIDRs {
+			out = append(out, c.CIDR)
+		}
+		return out
+	}
+	added, removed := difference(cidrs(new), cidrs(old)), difference(cidrs(old), cidrs(new))
+	added = append(added, difference(new.Passthrough, old.Passthrough)...)
+	removed = append(removed, difference(old.Passthrough, new.Passthrough)...)
+	for _, c := range added {
+		fmt.Fprintf(w, "+ %s\n", c)
+	}
+	for _, c := range removed {
+		fmt.Fprintf(w, "- %s\n", c)
+	}
+	fmt.Fprintf(w, "%d added, %d removed\n", len(added), len(removed))
+}
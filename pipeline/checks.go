@@ -0,0 +1,197 @@
+// Fichier: pipeline/checks.go
+
+package pipeline
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"time"
+
+	"project/spf-flattener/cidr"
+	"project/spf-flattener/config"
+	"project/spf-flattener/dns"
+)
+
+// checkExpirations reports expired and soon-to-expire priority entries as well as an overdue
+// configuration review. It returns the number of expired entries.
+func checkExpirations(cfg *config.Config, now time.Time) int {
+	window := time.Duration(cfg.ExpiryWarningDays) * 24 * time.Hour
+	expired := 0
+
+	for _, entry := range cfg.PriorityEntries {
+		expiresAt := entry.ExpiresAt()
+		if expiresAt.IsZero() {
+			continue
+		}
+		ticket := ""
+		if entry.Ticket != "" {
+			ticket = ", ticket " + entry.Ticket
+		}
+		switch {
+		case !now.Before(expiresAt):
+			expired++
+			log.Printf("WARN: Priority entry %s expired %s%s", entry.Entry, entry.Expires, ticket)
+		case expiresAt.Sub(now) <= window:
+			log.Printf("INFO: Priority entry %s expires %s%s", entry.Entry, entry.Expires, ticket)
+		}
+	}
+
+	if reviewAt := cfg.Metadata.ReviewAt(); !reviewAt.IsZero() && !now.Before(reviewAt) {
+		log.Printf("WARN: Configuration review was due %s (owner: %s, ticket: %s)",
+			cfg.Metadata.ReviewDate, cfg.Metadata.Owner, cfg.Metadata.Ticket)
+	}
+	return expired
+}
+
+// findCoveredPriorities reports the priority entries whose addresses all fall within
+// CIDRs of the flattened chain and returns their indexes. Acknowledged entries are
+// returned without being reported.
+func findCoveredPriorities(entries []config.PriorityEntry, priority, chain cidr.NetAddrSlice) map[int]bool {
+	byEntry := make(map[int]cidr.NetAddrSlice)
+	for _, n := range priority {
+		byEntry[n.OriginalPriorityIndex] = append(byEntry[n.OriginalPriorityIndex], n)
+	}
+
+	index := cidr.NewIndex(chain)
+	covered := make(map[int]bool)
+	for i, entry := range entries {
+		nets := byEntry[i]
+		if len(nets) == 0 {
+			continue
+		}
+		var by []string
+		for _, n := range nets {
+			c := index.CoveringNet(n.IPNet)
+			if c == nil {
+				by = nil
+				break
+			}
+			by = append(by, fmt.Sprintf("%s by %s (%s)", n.IPNet, c.IPNet, c.Source))
+		}
+		if by == nil {
+			continue
+		}
+		covered[i] = true
+		if entry.AcknowledgeCovered {
+			continue
+		}
+		log.Printf("INFO: Priority entry '%s' (priorityEntries[%d]) is already covered by the flattened chain and could be removed:", entry.Entry, i)
+		for _, b := range by {
+			log.Printf("    %s", b)
+		}
+	}
+	return covered
+}
+
+// compareAndReportCIDRs compares the generated list (final) with the current published CIDRs and logs differences.
+// It returns the sorted CIDRs missing from and extra in the published records.
+func compareAndReportCIDRs(final cidr.NetAddrSlice, current []string, recordName string) (missing, extra []string) {
+	finalSet := make(map[string]struct{}, len(final))
+	for _, n := range final {
+		finalSet[n.IPNet.String()] = struct{}{}
+	}
+
+	currentSet := make(map[string]struct{}, len(current))
+	for _, c := range current {
+		currentSet[c] = struct{}{}
+	}
+
+	// missing: in final but not in current (should be added)
+	for f := range finalSet {
+		if _, ok := currentSet[f]; !ok {
+			missing = append(missing, f)
+		}
+	}
+
+	// extra: in current but not in final (should be removed)
+	for c := range currentSet {
+		if _, ok := finalSet[c]; !ok {
+			extra = append(extra, c)
+		}
+	}
+
+	sort.Strings(missing)
+	sort.Strings(extra)
+
+	if len(missing) == 0 && len(extra) == 0 {
+		log.Printf("OK: Published SPF at %s matches generated CIDRs (%d entries).", recordName, len(final))
+		return nil, nil
+	}
+
+	log.Printf("DIFFERENCE: Published SPF at %s does not match generated CIDRs.", recordName)
+	if len(missing) > 0 {
+		log.Printf("  Missing in DNS (present in generated final list):")
+		for _, m := range missing {
+			log.Printf("    + %s", m)
+		}
+	}
+	if len(extra) > 0 {
+		log.Printf("  Extra in DNS (not present in generated final list):")
+		for _, e := range extra {
+			log.Printf("    - %s", e)
+		}
+	}
+	return missing, extra
+}
+
+// reportStageDrift reports published ip4/ip6 mechanisms whose qualifier differs from the
+// configured one. This is a rollout stage difference, not a content difference: the
+// CIDRs are compared regardless of their qualifier.
+func reportStageDrift(published Published, qualifier string) {
+	if qualifier == "" {
+		qualifier = "+"
+	}
+	for _, q := range []string{"+", "?", "~", "-"} {
+		if n := published.Qualifiers[q]; n > 0 && q != qualifier {
+			log.Printf("INFO: Stage drift at %s: %d published ip4/ip6 mechanisms use qualifier %s, configured %s; publish the generated records to move to the new stage.",
+				published.Name, n, q, qualifier)
+		}
+	}
+}
+
+// compareOwnerRecord checks the published discovery record against the expected content,
+// so that tampering with the ownership marker is detected.
+func compareOwnerRecord(r *dns.Resolver, name, expected string) {
+	txts, err := r.LookupTXT(name)
+	if err != nil {
+		log.Printf("INFO: Discovery record %s is not published yet: %v", name, err)
+		return
+	}
+	for _, txt := range txts {
+		if txt == expected {
+			log.Printf("OK: Discovery record %s matches.", name)
+			return
+		}
+	}
+	log.Printf("DIFFERENCE: Discovery record %s does not match: published %q, expected %q", name, txts, expected)
+}
+
+// runPreflight checks that every preflight IP is covered by the generated set. For each
+// uncovered IP it reports the published CIDR that used to cover it, if any, and returns
+// the number of uncovered IPs.
+func runPreflight(ips []string, final cidr.NetAddrSlice, published []string) int {
+	var previous cidr.NetAddrSlice
+	for _, c := range published {
+		if _, ipNet, err := net.ParseCIDR(c); err == nil {
+			previous = append(previous, &cidr.NetAddr{IPNet: ipNet})
+		}
+	}
+
+	uncovered := 0
+	for _, s := range ips {
+		ip := net.ParseIP(s)
+		if addr := final.Covering(ip); addr != nil {
+			log.Printf("INFO: Preflight IP %s is authorized by %s", s, addr.IPNet)
+			continue
+		}
+		uncovered++
+		if prev := previous.Covering(ip); prev != nil {
+			log.Printf("ERROR: Preflight IP %s is no longer authorized (previously covered by published ip:%s)", s, prev.IPNet)
+		} else {
+			log.Printf("ERROR: Preflight IP %s is not authorized by the generated record", s)
+		}
+	}
+	return uncovered
+}
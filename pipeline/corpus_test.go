@@ -0,0 +1,272 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	miekg "github.com/miekg/dns"
+
+	"project/spf-flattener/config"
+	"project/spf-flattener/dns"
+	"project/spf-flattener/dns/dnstest"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files of testdata/corpus")
+
+// timingMs matches the durations of the timings of a JSON report.
+var timingMs = regexp.MustCompile(`"ms": [0-9]+`)
+
+// zeroTimings zeroes the durations of a JSON report, which vary from run to run.
+func zeroTimings(report []byte) []byte {
+	return timingMs.ReplaceAll(report, []byte(`"ms": 0`))
+}
+
+// A corpus entry is a directory of testdata/corpus holding an anonymized SPF chain:
+//
+//	config.yaml   the configuration of the run (outputFormat is forced to json)
+//	zone          the DNS records the run sees, in zone file syntax
+//
+// and the goldens of the run: report.json and records.txt (one "name value" line per
+// generated record), or error.txt when the run fails.
+const corpusDir = "testdata/corpus"
+
+func TestCorpus(t *testing.T) {
+	entries, err := os.ReadDir(corpusDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		t.Run(entry.Name(), func(t *testing.T) {
+			dir := filepath.Join(corpusDir, entry.Name())
+			got := runCorpusEntry(t, dir)
+			for name, data := range got {
+				checkGolden(t, filepath.Join(dir, name), data)
+			}
+			// A golden the run no longer produces, e.g. error.txt of a fixed failure, is stale
+			for _, name := range []string{"report.json", "records.txt", "error.txt"} {
+				if _, ok := got[name]; ok {
+					continue
+				}
+				path := filepath.Join(dir, name)
+				if _, err := os.Stat(path); err == nil {
+					if *update {
+						os.Remove(path)
+						continue
+					}
+					t.Errorf("%s exists but the run did not produce it (run go test -update)", path)
+				}
+			}
+		})
+	}
+}
+
+// runCorpusEntry runs the pipeline over the corpus entry in dir and returns the goldens
+// it produces, by file name.
+func runCorpusEntry(t *testing.T, dir string) map[string][]byte {
+	t.Helper()
+	return runCorpusBackend(t, dir, "")
+}
+
+// runCorpusBackend is runCorpusEntry with the given resolverBackend; the system backend
+// reaches the zone through a net.Resolver.
+func runCorpusBackend(t *testing.T, dir, backend string) map[string][]byte {
+	t.Helper()
+	captureLog(t)
+	zone, err := os.ReadFile(filepath.Join(dir, "zone"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.LoadConfig(filepath.Join(dir, "config.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.OutputFormat = "json"
+	if backend != "" {
+		cfg.ResolverBackend = backend
+	}
+	p, err := New(cfg, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	p.Out = &out
+	if backend == "system" {
+		p.SetExchanger(&dns.SystemExchanger{Resolver: zoneResolver(dnstest.New(t, string(zone)))})
+	} else {
+		p.SetExchanger(dnstest.New(t, string(zone)))
+	}
+
+	if err := p.Run(context.Background()); err != nil {
+		return map[string][]byte{"error.txt": []byte(err.Error() + "\n")}
+	}
+	var records bytes.Buffer
+	for _, rec := range p.Records() {
+		fmt.Fprintf(&records, "%s %s\n", rec.Name, rec.Value)
+	}
+	return map[string][]byte{"report.json": zeroTimings(out.Bytes()), "records.txt": records.Bytes()}
+}
+
+// TestCorpusBackends runs the corpus through the raw DNS backend and the system backend:
+// both produce the same records, or fail the same way.
+func TestCorpusBackends(t *testing.T) {
+	entries, err := os.ReadDir(corpusDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		t.Run(entry.Name(), func(t *testing.T) {
+			dir := filepath.Join(corpusDir, entry.Name())
+			raw, system := runCorpusBackend(t, dir, ""), runCorpusBackend(t, dir, "system")
+			for _, name := range []string{"records.txt", "error.txt"} {
+				if !bytes.Equal(raw[name], system[name]) {
+					t.Errorf("%s differs between the backends (-dns +system):\n%s", name, lineDiff(string(raw[name]), string(system[name])))
+				}
+			}
+		})
+	}
+}
+
+// zoneResolver returns a net.Resolver answering from zone, as a recursive resolver would,
+// over an in-memory connection.
+func zoneResolver(zone *dnstest.Zone) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return &zoneConn{zone: zone}, nil
+		},
+	}
+}
+
+// zoneConn is a DNS-over-TCP connection to zone: each query written is answered with a
+// length-prefixed response read back.
+type zoneConn struct {
+	net.Conn // nil: only the methods below are used
+	zone     *dnstest.Zone
+	resp     bytes.Buffer
+}
+
+func (c *zoneConn) Write(b []byte) (int, error) {
+	var m miekg.Msg
+	if len(b) < 2 {
+		return 0, io.ErrShortWrite
+	}
+	if err := m.Unpack(b[2:]); err != nil {
+		return 0, err
+	}
+	resp, err := c.zone.Exchange(&m, "")
+	if err != nil {
+		return 0, err
+	}
+	resp.RecursionAvailable = true
+	packed, err := resp.Pack()
+	if err != nil {
+		return 0, err
+	}
+	c.resp.Write([]byte{byte(len(packed) >> 8), byte(len(packed))})
+	c.resp.Write(packed)
+	return len(b), nil
+}
+
+func (c *zoneConn) Read(b []byte) (int, error)       { return c.resp.Read(b) }
+func (c *zoneConn) Close() error                     { return nil }
+func (c *zoneConn) SetDeadline(time.Time) error      { return nil }
+func (c *zoneConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *zoneConn) SetWriteDeadline(time.Time) error { return nil }
+func (c *zoneConn) LocalAddr() net.Addr              { return &net.TCPAddr{} }
+func (c *zoneConn) RemoteAddr() net.Addr             { return &net.TCPAddr{} }
+
+// checkGolden compares got with the golden file at path, or rewrites it with -update.
+func checkGolden(t *testing.T, path string, got []byte) {
+	t.Helper()
+	if *update {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Errorf("%v (run go test -update to create it)", err)
+		return
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs from the run (-golden +run, go test -update to accept):\n%s", path, lineDiff(string(want), string(got)))
+	}
+}
+
+// lineDiff returns the lines removed from want ("-") and added in got ("+"), with the
+// unchanged lines around them, from a longest common subsequence of the lines.
+func lineDiff(want, got string) string {
+	a := strings.Split(strings.TrimSuffix(want, "\n"), "\n")
+	b := strings.Split(strings.TrimSuffix(got, "\n"), "\n")
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	type line struct {
+		op   byte
+		text string
+	}
+	var lines []line
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			lines = append(lines, line{' ', a[i]})
+			i, j = i+1, j+1
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, line{'-', a[i]})
+			i++
+		default:
+			lines = append(lines, line{'+', b[j]})
+			j++
+		}
+	}
+
+	// Keep two lines of context around the changes
+	const contextLines = 2
+	var diff strings.Builder
+	last := -1
+	for k, l := range lines {
+		near := false
+		for d := max(0, k-contextLines); d <= min(len(lines)-1, k+contextLines); d++ {
+			near = near || lines[d].op != ' '
+		}
+		if !near {
+			continue
+		}
+		if last >= 0 && k > last+1 {
+			diff.WriteString("  ...\n")
+		}
+		fmt.Fprintf(&diff, "%c %s\n", l.op, l.text)
+		last = k
+	}
+	return diff.String()
+}
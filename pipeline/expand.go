@@ -0,0 +1,95 @@
+// Fichier: pipeline/expand.go (verbe expand)
+
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"project/spf-flattener/spf"
+)
+
+// Expand prints the SPF record of domain as a normalized one-liner, with explicit
+// qualifiers and mechanisms in their original order, followed by its mechanism counts and
+// lookup estimate. Nothing is resolved unless deep is set, in which case the include and
+// redirect tree is printed with the record text of every node.
+func (p *Pipeline) Expand(w io.Writer, domain string, deep bool) error {
+	text, err := p.resolver.FetchSPF(domain)
+	if err != nil {
+		return err
+	}
+	record, err := spf.Parse(text)
+	if err != nil {
+		return fmt.Errorf("SPF record of %s: %w", domain, err)
+	}
+
+	fmt.Fprintln(w, normalized(record))
+	counts := make(map[string]int)
+	for _, t := range record.Terms {
+		counts[t.Name]++
+	}
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = fmt.Sprintf("%s=%d", name, counts[name])
+	}
+	fmt.Fprintf(w, "terms: %s\n", strings.Join(parts, " "))
+	fmt.Fprintf(w, "lookups: %d at top level\n", record.Lookups())
+
+	if deep {
+		fmt.Fprintln(w)
+		p.expandTree(w, domain, record, 0, map[string]bool{domain: true})
+	}
+	return nil
+}
+
+// expandTree prints domain's record and, indented below it, the records of its include
+// and redirect targets. path guards against cycles.
+func (p *Pipeline) expandTree(w io.Writer, domain string, record *spf.Record, depth int, path map[string]bool) {
+	indent := strings.Repeat("  ", depth)
+	fmt.Fprintf(w, "%s%s: %s\n", indent, domain, normalized(record))
+
+	terms, _ := record.Effective()
+	for _, t := range terms {
+		if !(t.Name == "include" && !t.Modifier || t.Name == "redirect" && t.Modifier) {
+			continue
+		}
+		target := t.Value
+		switch {
+		case path[target]:
+			fmt.Fprintf(w, "%s  %s: cycle\n", indent, target)
+			continue
+		case strings.Contains(target, "%{"):
+			fmt.Fprintf(w, "%s  %s: macro, expanded by verifiers\n", indent, target)
+			continue
+		}
+		text, err := p.resolver.FetchSPF(target)
+		if err != nil {
+			fmt.Fprintf(w, "%s  %s: %v\n", indent, target, err)
+			continue
+		}
+		child, err := spf.Parse(text)
+		if err != nil {
+			fmt.Fprintf(w, "%s  %s: %v\n", indent, target, err)
+			continue
+		}
+		path[target] = true
+		p.expandTree(w, target, child, depth+1, path)
+		delete(path, target)
+	}
+}
+
+// normalized returns the record on one line with explicit qualifiers.
+func normalized(record *spf.Record) string {
+	parts := []string{"v=spf1"}
+	for _, t := range record.Terms {
+		parts = append(parts, t.Explicit())
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,91 @@
+package pipeline
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"project/spf-flattener/dns/dnstest"
+)
+
+func TestExpand(t *testing.T) {
+	const zone = `
+example.com. 300 IN TXT "v=spf1 ip4:192.0.2.0/24 mx ?a:%{d}.example.com include:_spf.example.net ~include:loop.example.org exists:%{i}.rbl.example.com -all"
+_spf.example.net. 300 IN TXT "v=spf1 ip6:2001:db8::/32 include:%{d}.example.net redirect=tail.example.net"
+tail.example.net. 300 IN TXT "v=spf1 include:missing.example.net -all"
+loop.example.org. 300 IN TXT "v=spf1 include:example.com ~all"
+`
+	const shallow = `v=spf1 +ip4:192.0.2.0/24 +mx ?a:%{d}.example.com +include:_spf.example.net ~include:loop.example.org +exists:%{i}.rbl.example.com -all
+terms: a=1 all=1 exists=1 include=2 ip4=1 mx=1
+lookups: 5 at top level
+`
+	tests := []struct {
+		name string
+		deep bool
+		want string
+		// wantQueries is the number of TXT queries sent.
+		wantQueries int
+	}{
+		{"shallow", false, shallow, 1},
+		{"deep", true, shallow + `
+example.com: v=spf1 +ip4:192.0.2.0/24 +mx ?a:%{d}.example.com +include:_spf.example.net ~include:loop.example.org +exists:%{i}.rbl.example.com -all
+  _spf.example.net: v=spf1 +ip6:2001:db8::/32 +include:%{d}.example.net redirect=tail.example.net
+    %{d}.example.net: macro, expanded by verifiers
+    tail.example.net: v=spf1 +include:missing.example.net -all
+      missing.example.net: DNS query for missing.example.net (TXT) failed: name does not exist (NXDOMAIN)
+  loop.example.org: v=spf1 +include:example.com ~all
+    example.com: cycle
+`, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			captureLog(t)
+			z := dnstest.New(t, zone)
+			p := newPipeline(t, "example.com")
+			p.SetExchanger(z)
+			var buf bytes.Buffer
+			if err := p.Expand(&buf, "example.com", tt.deep); err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != tt.want {
+				t.Errorf("Expand() =\n%s\nwant\n%s", buf.String(), tt.want)
+			}
+			txt := 0
+			for _, q := range z.Queries() {
+				if strings.Contains(q, "TXT") {
+					txt++
+				}
+			}
+			if txt != tt.wantQueries {
+				t.Errorf("queries = %q, want %d TXT queries", z.Queries(), tt.wantQueries)
+			}
+		})
+	}
+}
+
+func TestExpandErrors(t *testing.T) {
+	const zone = `
+example.com. 300 IN TXT "v=spf1 ip4:192.0.2.0/33 -all"
+`
+	tests := []struct {
+		domain, wantErr string
+	}{
+		{"example.com", "SPF record of example.com"},
+		{"missing.example.com", "missing.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.domain, func(t *testing.T) {
+			captureLog(t)
+			p := newPipeline(t, "example.com")
+			p.SetExchanger(dnstest.New(t, zone))
+			var buf bytes.Buffer
+			err := p.Expand(&buf, tt.domain, true)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Expand(%s) error = %v, want %q", tt.domain, err, tt.wantErr)
+			}
+			if buf.Len() > 0 {
+				t.Errorf("Expand(%s) printed %q on error", tt.domain, buf.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+// Fichier: pipeline/pins.go (CIDR approuvés par include)
+
+package pipeline
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"project/spf-flattener/cidr"
+	"project/spf-flattener/config"
+)
+
+// pinnedNets returns the networks flattened from pin's include and the records it reaches.
+func (p *Pipeline) pinnedNets(pin config.Pin, nets cidr.NetAddrSlice) cidr.NetAddrSlice {
+	domains := p.resolver.Subtree(pin.Include)
+	var pinned cidr.NetAddrSlice
+	for _, n := range nets {
+		if i := strings.LastIndex(n.Source, " in "); i >= 0 && domains[n.Source[i+len(" in "):]] {
+			pinned = append(pinned, n)
+		}
+	}
+	return cidr.DeduplicateAndSort(pinned)
+}
+
+// CheckPins compares the networks of every pinned include with its approved CIDRs by
+// containment, so renumbering within approved space is accepted. Any deviation fails the
+// run until the pin file is reviewed and updated.
+func (p *Pipeline) CheckPins(nets cidr.NetAddrSlice) error {
+	deviations := 0
+	for _, pin := range p.cfg.Pins {
+		approved, err := readPin(pin.File)
+		if err != nil {
+			return fmt.Errorf("ERROR: Cannot read pin of %s: %w", pin.Include, err)
+		}
+		approvedIndex := cidr.NewIndex(approved)
+		resolved := p.pinnedNets(pin, nets)
+		resolvedIndex := cidr.NewIndex(resolved)
+
+		for _, n := range resolved {
+			if !approvedIndex.Covers(n.IPNet) {
+				log.Printf("ERROR: Pinned include %s added %s (%s), outside the approved CIDRs of %s", pin.Include, n.IPNet, n.Source, pin.File)
+				deviations++
+			}
+		}
+		for _, a := range approved {
+			if !resolvedIndex.Overlaps(a.IPNet) {
+				log.Printf("ERROR: Pinned include %s no longer resolves to approved %s (%s)", pin.Include, a.IPNet, pin.File)
+				deviations++
+			}
+		}
+	}
+	if deviations > 0 {
+		return fmt.Errorf("PIN: %d deviations from pinned CIDRs; review them and run with -update-pin <include>", deviations)
+	}
+	return nil
+}
+
+// writePin rewrites the pin file of include with its currently resolved networks.
+func (p *Pipeline) writePin(include string, nets cidr.NetAddrSlice) error {
+	for _, pin := range p.cfg.Pins {
+		if !strings.EqualFold(pin.Include, include) {
+			continue
+		}
+		resolved := p.pinnedNets(pin, nets)
+		var b strings.Builder
+		fmt.Fprintf(&b, "# Approved CIDRs of %s, updated %s\n", pin.Include, time.Now().Format(time.DateOnly))
+		for _, n := range resolved {
+			fmt.Fprintln(&b, n.IPNet)
+		}
+		if err := os.WriteFile(pin.File, []byte(b.String()), 0o644); err != nil {
+			return err
+		}
+		log.Printf("INFO: Pin of %s updated with %d CIDRs in %s", pin.Include, len(resolved), pin.File)
+		return nil
+	}
+	return fmt.Errorf("no pin configured for include %s", include)
+}
+
+// readPin parses a pin file.
+func readPin(path string) (cidr.NetAddrSlice, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var approved cidr.NetAddrSlice
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		if text = strings.TrimSpace(text); text == "" {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		approved = append(approved, &cidr.NetAddr{IPNet: ipNet})
+	}
+	return approved, scanner.Err()
+}
@@ -0,0 +1,128 @@
+package pipeline
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"project/spf-flattener/config"
+	"project/spf-flattener/dns/dnstest"
+)
+
+// pinZone reaches the pinned pay.example.net and its nested include.
+const pinZone = `
+spf-unflat.example.com. 300 IN TXT "v=spf1 ip4:192.0.2.0/24 include:pay.example.net -all"
+pay.example.net. 300 IN TXT "v=spf1 ip4:198.51.100.0/25 include:_spf2.pay.example.net -all"
+_spf2.pay.example.net. 300 IN TXT "v=spf1 ip6:2001:db8:1::/48 -all"
+_spf.example.com. 300 IN TXT "v=spf1 ip4:192.0.2.0/24 ip4:198.51.100.0/25 ip6:2001:db8:1::/48 -all"
+`
+
+func TestCheckPins(t *testing.T) {
+	tests := []struct {
+		name string
+		pin  string // content of the pin file, none when empty
+		// wantErr and wantLog are substrings of the error and log; the run succeeds
+		// when wantErr is empty.
+		wantErr, wantLog []string
+	}{
+		{"exact", "198.51.100.0/25\n2001:db8:1::/48\n", nil, nil},
+		{"renumbered within approved space", "# Payment processor\n198.51.100.0/24\n2001:db8::/32 # whole block\n", nil, nil},
+		{
+			"addition", "198.51.100.0/25\n",
+			[]string{"PIN: 1 deviations"},
+			[]string{"pay.example.net added 2001:db8:1::/48 (ip6:2001:db8:1::/48 in _spf2.pay.example.net)"},
+		},
+		{
+			"removal", "198.51.100.0/25\n2001:db8:1::/48\n203.0.113.0/24\n",
+			[]string{"PIN: 1 deviations"},
+			[]string{"no longer resolves to approved 203.0.113.0/24"},
+		},
+		{
+			"renumbered outside approved space", "198.51.100.128/25\n2001:db8:1::/48\n",
+			[]string{"PIN: 2 deviations", "-update-pin"},
+			[]string{"added 198.51.100.0/25", "no longer resolves to approved 198.51.100.128/25"},
+		},
+		{"missing file", "", []string{"Cannot read pin of pay.example.net"}, nil},
+		{"malformed file", "198.51.100.0/25\nnot-a-cidr\n", []string{"pay.txt:2"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLog(t)
+			file := filepath.Join(t.TempDir(), "pay.txt")
+			if tt.pin != "" {
+				if err := os.WriteFile(file, []byte(tt.pin), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			p := newPipeline(t, "")
+			p.cfg.Pins = []config.Pin{{Include: "pay.example.net", File: file}}
+			p.Out = io.Discard
+			p.SetExchanger(dnstest.New(t, pinZone))
+
+			err := p.Run(context.Background())
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatalf("Run() error = %v\n%s", err, logs)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("Run() succeeded, want a pin deviation")
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Run() error = %v, want it to contain %q", err, want)
+				}
+			}
+			for _, want := range tt.wantLog {
+				if !strings.Contains(logs.String(), want) {
+					t.Errorf("log does not mention %q:\n%s", want, logs)
+				}
+			}
+		})
+	}
+}
+
+func TestUpdatePin(t *testing.T) {
+	captureLog(t)
+	file := filepath.Join(t.TempDir(), "pay.txt")
+	// The reviewed pin no longer matches the resolution
+	if err := os.WriteFile(file, []byte("203.0.113.0/24\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	run := func(update string) error {
+		p := newPipeline(t, "")
+		p.cfg.Pins = []config.Pin{{Include: "pay.example.net", File: file}}
+		p.UpdatePin = update
+		p.Out = io.Discard
+		p.SetExchanger(dnstest.New(t, pinZone))
+		return p.Run(context.Background())
+	}
+
+	if err := run("unknown.example.net"); err == nil || !strings.Contains(err.Error(), "no pin configured for include unknown.example.net") {
+		t.Errorf("Run() with an unpinned include: error = %v", err)
+	}
+	if err := run("Pay.Example.NET"); err != nil {
+		t.Fatalf("Run() with -update-pin: %v", err)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if !strings.HasPrefix(lines[0], "# Approved CIDRs of pay.example.net, updated ") {
+		t.Errorf("header = %q", lines[0])
+	}
+	// Only the networks reached through the pinned include, not the rest of the chain
+	if want := []string{"198.51.100.0/25", "2001:db8:1::/48"}; !slices.Equal(lines[1:], want) {
+		t.Errorf("pin file CIDRs = %q, want %q", lines[1:], want)
+	}
+	// The rewritten pin passes on the next run
+	if err := run(""); err != nil {
+		t.Errorf("Run() after -update-pin: %v", err)
+	}
+}
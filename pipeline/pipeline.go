@@ -0,0 +1,856 @@
+// Fichier: pipeline/pipeline.go
+
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"project/spf-flattener/cidr"
+	"project/spf-flattener/config"
+	"project/spf-flattener/dns"
+	"project/spf-flattener/formatter"
+	"project/spf-flattener/providers"
+	"project/spf-flattener/spf"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Pipeline runs the stages of a flattening run for one configuration. Each stage takes
+// and returns explicit data so it can be exercised on its own; Run wires them together.
+type Pipeline struct {
+	// Out receives the generated records (standard output by default).
+	Out io.Writer
+	// VCSFriendly writes the records sorted, one mechanism per line (see WriteRecordsVCS).
+	VCSFriendly bool
+	// SuggestConfig stops the run after the analysis and prints the suggested priorityEntries.
+	SuggestConfig bool
+	// UpdatePin, when set, rewrites the pin file of that include from the current
+	// resolution before the pins are checked.
+	UpdatePin string
+	// Offline skips the published-record fetch and comparison, for runs that must only
+	// depend on the upstream records.
+	Offline bool
+
+	cfg      *config.Config
+	resolver *dns.Resolver
+	// targetDomain is the domain whose SPF chain is flattened.
+	targetDomain string
+	// adHoc runs flatten the given domain only: nothing is compared or published.
+	adHoc bool
+	// covered holds the indexes of the priority entries already covered by the chain.
+	covered map[int]bool
+	// summary accumulates the outcome of the run as the stages complete.
+	summary Summary
+	// diffs holds the comparison with every published entry point, for the JSON report.
+	diffs []PublishedDiff
+	// external holds the includes kept outside flattenOnlySuffixes, for the JSON report.
+	external []dns.ExternalInclude
+	// cost is the receiver cost of the generated records, for the JSON report.
+	cost dns.ReceiverCost
+	// segments are the record values generated by the last Run.
+	segments []string
+}
+
+// Published is the result of the FetchPublished stage for one entry point.
+type Published struct {
+	// Name is the entry point of the published records (e.g. _spf.<targetDomain>).
+	Name string
+	// CIDRs are the normalized CIDRs found under Name and its includes.
+	CIDRs []string
+	// Err is set when the published records could not be fetched.
+	Err error
+	// Qualifiers counts the published ip4/ip6 mechanisms per qualifier ("+" for none).
+	Qualifiers map[string]int
+	// Incomplete lists the chained records of our own chain that failed to resolve; CIDRs
+	// then lack their content and cannot be compared.
+	Incomplete []string
+}
+
+// New prepares a run for cfg. A non-empty adHocDomain flattens that domain instead of
+// spf-unflat.<targetDomain>, without priority entries nor comparison.
+func New(cfg *config.Config, adHocDomain string) (*Pipeline, error) {
+	resolver := dns.NewResolver(cfg.Upstreams(), cfg.Concurrency.DNSQueries, cfg.Concurrency.IncludeBranches, cfg.MaxLookups)
+	registry, err := providers.NewRegistry(cfg.Providers)
+	if err != nil {
+		return nil, err
+	}
+	resolver.Providers = registry
+	resolver.Strict = cfg.Strict
+	resolver.Authoritative = cfg.ResolutionMode == "authoritative"
+	resolver.KeepSuffixes = cfg.KeepMechanisms
+	resolver.FlattenOnlySuffixes = cfg.FlattenOnlySuffixes
+	if cfg.ResolverBackend == "system" {
+		log.Printf("WARN: Using the system resolver backend: answers carry no TTL and no rcode detail (a missing name reads as an empty answer), the configured nameservers are not used")
+		resolver.Exchanger = &dns.SystemExchanger{}
+	}
+	resolver.OnParseError = cfg.OnParseError
+	resolver.OnExists = cfg.OnExists
+	resolver.OnMacro = cfg.OnMacro
+	resolver.MergeMultipleSPF = cfg.MergeMultipleSPF
+	resolver.DropReservedRanges = cfg.DropReservedRanges
+
+	p := &Pipeline{Out: os.Stdout, cfg: cfg, resolver: resolver, targetDomain: "spf-unflat." + cfg.TargetDomain}
+	if adHocDomain != "" {
+		p.adHoc = true
+		p.targetDomain = adHocDomain
+	}
+	return p, nil
+}
+
+// Run executes every stage in order under ctx, stopping at the first failure, or with a
+// *BudgetError when the run exceeds maxRuntime. Summary returns the outcome afterwards.
+func (p *Pipeline) Run(ctx context.Context) (err error) {
+	timer := newPhaseTimer(ctx, p.cfg.MaxRuntime)
+	p.resolver.Context = timer.ctx
+	defer p.endRun(ctx, timer)
+	p.summary = Summary{Status: StatusUnverified, MaxLookups: p.cfg.MaxLookups}
+	defer func() {
+		p.summary.Duration = time.Since(timer.start)
+		if err != nil {
+			p.summary.Status = StatusError
+		}
+	}()
+
+	finalIPNets, err := p.resolve(timer)
+	if err != nil {
+		return err
+	}
+	if p.SuggestConfig {
+		return p.printSuggestedConfig(p.covered)
+	}
+
+	// Check current TXT spf records and compare with finalIPNets
+	var published []Published
+	err = timer.run("published-record fetch", func() error {
+		published = p.FetchPublished()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = timer.run("comparison", func() error {
+		return p.Compare(finalIPNets, published)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Format Output (Multi-TXT Segmentation)
+	var segments []string
+	err = timer.run("formatting", func() error {
+		var err error
+		segments, err = p.Format(finalIPNets)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return p.Output(finalIPNets, segments, timer)
+}
+
+// endRun stops the clock of a run started under ctx. The lookups of an abandoned phase
+// end with the run context; otherwise the lookups that follow the run, such as those of
+// publishing, go back to ctx.
+func (p *Pipeline) endRun(ctx context.Context, timer *phaseTimer) {
+	timer.stop()
+	if !timer.abandoned {
+		p.resolver.Context = ctx
+	}
+}
+
+// SetExchanger sends the DNS queries of the resolver through e (see dns.Recorder and
+// dns.Replayer).
+func (p *Pipeline) SetExchanger(e dns.Exchanger) {
+	p.resolver.Exchanger = e
+}
+
+// Records returns the records generated by the last Run with their owner names.
+func (p *Pipeline) Records() []formatter.TXTRecord {
+	return p.records(p.segments)
+}
+
+// StaleRecords returns the chained records published past the end of the chain generated
+// by the last Run, left over from a previous, longer chain. Answers synthesized by a
+// wildcard are not records that can be deleted.
+func (p *Pipeline) StaleRecords() []formatter.TXTRecord {
+	var stale []formatter.TXTRecord
+	wildcard := wildcardTXT(p.resolver, p.cfg.TargetDomain)
+	first := max(len(p.segments), 1)
+	for i := first; i < first+chainProbeMargin; i++ {
+		name := formatter.RecordName(i, p.cfg.TargetDomain)
+		txts, err := p.resolver.LookupTXT(name)
+		if err != nil || !hasSPF(txts) || wildcard != nil && slices.Equal(txts, wildcard) {
+			return stale
+		}
+		for _, txt := range txts {
+			if spf.IsSPF(strings.TrimSpace(txt)) {
+				stale = append(stale, formatter.TXTRecord{Name: name, Value: txt})
+			}
+		}
+	}
+	return stale
+}
+
+// Unpublished returns the records generated by the last Run that are not live yet: the
+// name does not publish the value, or publishes other SPF records besides it. Qualifier
+// changes, a new segmentation and the owner record are caught even when the authorized
+// networks are unchanged.
+func (p *Pipeline) Unpublished() []formatter.TXTRecord {
+	var unpublished []formatter.TXTRecord
+	for _, rec := range p.Records() {
+		txts, err := p.resolver.LookupTXT(rec.Name)
+		if err != nil || !slices.Contains(txts, rec.Value) {
+			unpublished = append(unpublished, rec)
+			continue
+		}
+		for _, txt := range txts {
+			if txt != rec.Value && spf.IsSPF(strings.TrimSpace(txt)) {
+				unpublished = append(unpublished, rec)
+				break
+			}
+		}
+	}
+	return unpublished
+}
+
+// CheckPublishZone verifies that the records generated by the last Run can be published
+// where the configuration says: every name falls within publishZone, when it is set, and
+// no name is delegated to a zone other than publishZone.
+func (p *Pipeline) CheckPublishZone() error {
+	zone := strings.ToLower(strings.TrimSuffix(p.cfg.PublishZone, "."))
+	for _, rec := range p.Records() {
+		name := strings.ToLower(rec.Name)
+		if zone != "" && name != zone && !strings.HasSuffix(name, "."+zone) {
+			return fmt.Errorf("%s is outside publishZone %s", rec.Name, p.cfg.PublishZone)
+		}
+		if err := checkDelegation(p.resolver, rec.Name, p.cfg.PublishZone); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Summary returns the outcome of the last Run.
+func (p *Pipeline) Summary() Summary {
+	return p.summary
+}
+
+// Nameservers returns the recursive resolvers the run queries.
+func (p *Pipeline) Nameservers() []string {
+	return p.resolver.Nameservers()
+}
+
+// Snapshot returns the progress of the run so far. It may be called from another
+// goroutine while Run is resolving.
+func (p *Pipeline) Snapshot() dns.Snapshot {
+	return p.resolver.Snapshot()
+}
+
+// resolve runs the stages that produce the final, deduplicated and sorted CIDRs.
+func (p *Pipeline) resolve(timer *phaseTimer) (cidr.NetAddrSlice, error) {
+	cfg := p.cfg
+
+	// Audit configuration expirations
+	if err := p.Audit(time.Now()); err != nil {
+		return nil, err
+	}
+
+	// Ad hoc run: flatten the given domain itself, nothing is compared or published
+	if p.adHoc {
+		log.Printf("INFO: Ad hoc run for %s: priority entries, comparison and preflight are skipped", p.targetDomain)
+		cfg.TargetDomain = p.targetDomain
+		cfg.PriorityEntries = nil
+	}
+
+	if cfg.MaxLookups > dns.MaxRFCLookups {
+		log.Printf("WARN: maxLookups %d is over the RFC limit of %d: verifiers still stop after %d lookups", cfg.MaxLookups, dns.MaxRFCLookups, dns.MaxRFCLookups)
+	}
+
+	// Resolve Priority Entries (synchronously to preserve configuration order)
+	var priorityIPNets cidr.NetAddrSlice
+	err := timer.run("priority resolution", func() error {
+		var err error
+		priorityIPNets, err = p.ResolvePriorities()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Recursive SPF Flattening for Target Domain
+	var nonPriorityIPNets cidr.NetAddrSlice
+	err = timer.run("main chain flatten", func() error {
+		var err error
+		nonPriorityIPNets, err = p.FlattenChain()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Pinned includes must stay within their approved CIDRs
+	if p.UpdatePin != "" {
+		if err := p.writePin(p.UpdatePin, nonPriorityIPNets); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.CheckPins(nonPriorityIPNets); err != nil {
+		return nil, err
+	}
+
+	// Combine, Deduplicate, and Sort All Addresses
+	allIPNets := append(priorityIPNets, nonPriorityIPNets...)
+	p.coalesce(allIPNets)
+	finalIPNets := cidr.DeduplicateAndSort(allIPNets)
+	if !cfg.KeepCoveredCIDRs {
+		before := len(finalIPNets)
+		finalIPNets = cidr.DeduplicateAndSort(cidr.RemoveCovered(finalIPNets))
+		if removed := before - len(finalIPNets); removed > 0 {
+			log.Printf("INFO: Removed %d networks covered by a broader one", removed)
+		}
+	}
+	if cfg.AggregateCIDRs {
+		before := len(finalIPNets)
+		finalIPNets = cidr.DeduplicateAndSort(cidr.Aggregate(finalIPNets))
+		log.Printf("INFO: Aggregated adjacent networks: %d -> %d entries", before, len(finalIPNets))
+	}
+
+	if err := p.CheckQualifiers(allIPNets); err != nil {
+		return nil, err
+	}
+
+	// Advisory: priority entries the chain already provides only inflate the first segment
+	p.covered = findCoveredPriorities(cfg.PriorityEntries, priorityIPNets, nonPriorityIPNets)
+	return finalIPNets, nil
+}
+
+// Audit reports expired and soon-to-expire configuration entries. Expired priority
+// entries are an error in strict mode.
+func (p *Pipeline) Audit(now time.Time) error {
+	if expired := checkExpirations(p.cfg, now); expired > 0 && p.cfg.Strict {
+		return fmt.Errorf("STRICT: %d expired priority entries in configuration", expired)
+	}
+	return nil
+}
+
+// ResolvePriorities resolves the priority entries in configuration order.
+// Any failure is an error since priority entries are critical.
+func (p *Pipeline) ResolvePriorities() (cidr.NetAddrSlice, error) {
+	var priorityIPNets cidr.NetAddrSlice
+
+	for i, entry := range p.cfg.PriorityEntries {
+		resolved, err := resolvePriorityEntry(p.resolver, entry, i)
+		if errors.Is(err, dns.ErrNXDomain) {
+			return nil, fmt.Errorf("FAIL-FAST: Priority entry '%s' does not exist: %w", entry.Entry, err)
+		}
+		if err != nil {
+			// Fail-fast on priority resolution failure
+			return nil, fmt.Errorf("FAIL-FAST: Failed to resolve priority entry '%s': %w", entry.Entry, err)
+		}
+		checkFamilies(entry, resolved)
+		priorityIPNets = append(priorityIPNets, resolved...)
+	}
+	log.Printf("INFO: Found %d unique network addresses from priority entries.", len(priorityIPNets))
+	return priorityIPNets, nil
+}
+
+// FlattenChain flattens the SPF chain of the target domain.
+// Note: The FlattenSPF implementation will handle recursion and lookups count.
+func (p *Pipeline) FlattenChain() (cidr.NetAddrSlice, error) {
+	targetDomain := p.targetDomain
+	nonPriorityIPNets, err := p.resolver.FlattenSPF(targetDomain, targetDomain, false, -1)
+	if err != nil {
+		// Fail-fast on main SPF resolution failure, with a hint depending on the cause
+		var lerr *dns.LookupError
+		var perr *spf.ParseError
+		switch {
+		case errors.Is(err, dns.ErrLookupLimit):
+			return nil, fmt.Errorf("FAIL-FAST: SPF chain of %s exceeds the lookup budget: %w", targetDomain, err)
+		case errors.As(err, &perr):
+			return nil, fmt.Errorf("FAIL-FAST: Malformed upstream SPF record (domain %s, offset %d): %w", perr.Domain, perr.Offset, err)
+		case errors.As(err, &lerr) && lerr.Retryable():
+			return nil, fmt.Errorf("FAIL-FAST: Transient DNS failure while flattening %s, retry later: %w", targetDomain, err)
+		default:
+			return nil, fmt.Errorf("FAIL-FAST: Failed to flatten SPF for %s: %w", targetDomain, err)
+		}
+	}
+	log.Printf("INFO: Found %d network addresses from the main SPF chain.", len(nonPriorityIPNets))
+	return nonPriorityIPNets, nil
+}
+
+// coalesce widens resolved host addresses as configured and reports every widening,
+// since the record then authorizes more than what was resolved.
+func (p *Pipeline) coalesce(nets cidr.NetAddrSlice) {
+	if p.cfg.CoalesceIPv4To == 0 && p.cfg.CoalesceIPv6To == 0 {
+		return
+	}
+	before := len(cidr.DeduplicateAndSort(nets))
+	widened := nets.Coalesce(p.cfg.CoalesceIPv4To, p.cfg.CoalesceIPv6To)
+
+	networks := make([]string, 0, len(widened))
+	for network := range widened {
+		networks = append(networks, network)
+	}
+	sort.Strings(networks)
+	for _, network := range networks {
+		log.Printf("WARN: Coalesced %s into %s, authorizing more than resolved", strings.Join(widened[network], ", "), network)
+	}
+	log.Printf("INFO: Coalescing resolved addresses saved %d entries", before-len(cidr.DeduplicateAndSort(nets)))
+}
+
+// CheckQualifiers reports flattened networks that another record of the chain softfails,
+// fails or leaves neutral. The conflicts are errors in strict mode.
+func (p *Pipeline) CheckQualifiers(nets cidr.NetAddrSlice) error {
+	conflicts := p.resolver.QualifierConflicts(nets)
+	for _, c := range conflicts {
+		log.Printf("WARN: Qualifier conflict, flattening authorizes %s", c)
+	}
+	if len(conflicts) > 0 && p.cfg.Strict {
+		return fmt.Errorf("STRICT: %d flattened networks conflict with non-pass mechanisms of the chain", len(conflicts))
+	}
+	return nil
+}
+
+// FetchPublished reads the currently published records at every configured entry point.
+// Ad hoc runs fetch nothing.
+func (p *Pipeline) FetchPublished() []Published {
+	if p.adHoc || p.Offline {
+		return nil
+	}
+	names := p.cfg.PublishedRecords
+	if len(names) == 0 {
+		names = []string{"_spf." + p.cfg.TargetDomain}
+	}
+
+	var all []Published
+	var live []string
+	for _, name := range names {
+		published := Published{Name: name}
+		if err := checkDelegation(p.resolver, published.Name, p.cfg.PublishZone); err != nil {
+			log.Printf("WARN: %v", err)
+		}
+		published.Qualifiers = make(map[string]int)
+		published.CIDRs, published.Incomplete, published.Err = fetchSPFAndResolveIncludes(p.resolver, published.Name, strings.ToLower(p.cfg.TargetDomain), p.cfg.MaxLookups, p.cfg.MaxTXTLength, p.cfg.Strict, published.Qualifiers)
+		all = append(all, published)
+		if !errors.Is(published.Err, errNotPublished) {
+			live = append(live, strings.ToLower(name))
+		}
+	}
+	if len(live) > 0 {
+		checkChain(p.resolver, live, strings.ToLower(p.cfg.TargetDomain))
+	}
+	return all
+}
+
+// Compare reports the differences between the generated records and each published entry
+// point, then, with several entry points, between the generated records and the union of
+// what they authorize. It fails when a preflight IP would no longer be authorized, which
+// is checked in every mode. Ad hoc and offline runs compare nothing else.
+func (p *Pipeline) Compare(final cidr.NetAddrSlice, all []Published) error {
+	// Without published records, preflight IPs are still checked against the generated set
+	if p.adHoc || p.Offline {
+		return preflight(p.cfg.Preflight, final, nil)
+	}
+	var union []string
+	var names []string
+	seen := make(map[string]bool)
+	bootstrap, failed, incomplete, drift := 0, 0, 0, false
+	for _, published := range all {
+		switch {
+		case len(published.Incomplete) > 0 && published.Err == nil:
+			// The collected CIDRs lack whole segments: a diff would only list false positives
+			log.Printf("WARN: Published records at %s are incomplete, not comparable: %s failed to resolve",
+				published.Name, strings.Join(published.Incomplete, ", "))
+			p.diffs = append(p.diffs, PublishedDiff{Name: published.Name, Incomplete: published.Incomplete})
+			incomplete++
+		case errors.Is(published.Err, errNotPublished) && len(final) > 0:
+			log.Printf("INFO: Not yet published: %s has no SPF record. Publish all the generated records below to bootstrap it.", published.Name)
+			bootstrap++
+		case published.Err != nil:
+			log.Printf("WARN: Failed to fetch current SPF (and includes) at %s: %v", published.Name, published.Err)
+			p.diffs = append(p.diffs, PublishedDiff{Name: published.Name, Error: published.Err.Error()})
+			failed++
+		default:
+			reportStageDrift(published, p.cfg.MechanismQualifier)
+			missing, extra := compareAndReportCIDRs(final, published.CIDRs, published.Name)
+			p.diffs = append(p.diffs, PublishedDiff{Name: published.Name, Missing: missing, Extra: extra})
+			p.summary.Missing, p.summary.Extra = len(missing), len(extra)
+			if p.summary.Missing+p.summary.Extra > 0 {
+				drift = true
+			}
+		}
+		names = append(names, published.Name)
+		for _, c := range published.CIDRs {
+			if !seen[c] {
+				seen[c] = true
+				union = append(union, c)
+			}
+		}
+	}
+	p.summary.Published = len(union)
+	if len(all) > 1 && incomplete == 0 {
+		missing, extra := compareAndReportCIDRs(final, union, "the union of "+strings.Join(names, ", "))
+		p.summary.Missing, p.summary.Extra = len(missing), len(extra)
+	}
+	switch {
+	case drift:
+		p.summary.Status = StatusDrift
+	case incomplete > 0:
+		p.summary.Status = StatusIncomplete
+	case bootstrap == len(all) && len(all) > 0:
+		p.summary.Status = StatusBootstrap
+		p.summary.Missing = len(final)
+	case failed == 0 && bootstrap == 0:
+		p.summary.Status = StatusOK
+	}
+	if p.cfg.OwnerRecord.Enabled {
+		compareOwnerRecord(p.resolver, "_spf-owner."+p.cfg.TargetDomain, p.cfg.OwnerRecord.Value())
+	}
+
+	// Preflight: critical sending IPs must remain authorized before anything is output
+	return preflight(p.cfg.Preflight, final, union)
+}
+
+// preflight fails when a preflight IP is not authorized by final; published is the
+// previously published set, used to name what used to cover it.
+func preflight(ips []string, final cidr.NetAddrSlice, published []string) error {
+	if uncovered := runPreflight(ips, final, published); uncovered > 0 {
+		return fmt.Errorf("PREFLIGHT: %d critical sending IPs would not be authorized by the generated record", uncovered)
+	}
+	return nil
+}
+
+// Format splits the final CIDRs into the chained TXT record values.
+func (p *Pipeline) Format(final cidr.NetAddrSlice) ([]string, error) {
+	passthrough := p.resolver.Passthrough()
+	segments, err := formatter.FormatSegments(final, passthrough, p.cfg.TargetDomain, p.cfg.MaxTXTLength, p.cfg.MaxMechanismsPerRecord, p.cfg.MechanismQualifier)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: Cannot generate publishable records: %w", err)
+	}
+
+	zone := p.cfg.Zone
+	if zone == "" || p.adHoc {
+		zone = p.cfg.TargetDomain
+	}
+	if err := formatter.CheckIncludes(segments, passthrough, zone); err != nil {
+		return nil, fmt.Errorf("ERROR: Cannot generate publishable records: %w", err)
+	}
+	for _, token := range passthrough {
+		if strings.HasPrefix(token, "include:") {
+			log.Printf("INFO: External include kept verbatim, not checked against zone %s: %s", zone, token)
+		}
+	}
+	if !p.adHoc {
+		names := make([]string, len(segments))
+		for i := range segments {
+			names[i] = formatter.RecordName(i, p.cfg.TargetDomain)
+		}
+		checkWildcards(p.resolver, names)
+	}
+	return segments, nil
+}
+
+// Output logs the run summary and writes the generated records to p.Out.
+func (p *Pipeline) Output(final cidr.NetAddrSlice, segments []string, timer *phaseTimer) error {
+	cfg, resolver, targetDomain := p.cfg, p.resolver, p.targetDomain
+	p.summary.Generated = len(final)
+	p.summary.Lookups = resolver.GetLookupCount()
+	p.summary.Segments = len(segments)
+	p.segments = segments
+
+	log.Println("=======================================================")
+	log.Println("             SPF FLATTENING RESULTS")
+	log.Println("=======================================================")
+	log.Printf("Initial Domain: %s\n", targetDomain)
+	log.Printf("Total DNS Lookups Used (Recursive Includes): %d / %d\n",
+		resolver.GetLookupCount(), cfg.MaxLookups)
+	verifierLookups := resolver.VerifierLookups(targetDomain)
+	log.Printf("Verifier Lookups for Unflattened Chain: %d / %d\n", verifierLookups, dns.MaxRFCLookups)
+	if verifierLookups > dns.MaxRFCLookups {
+		log.Printf("WARN: Unflattened chain needs %d verifier lookups, over the RFC limit of %d\n", verifierLookups, dns.MaxRFCLookups)
+	}
+	log.Printf("Total Unique CIDRs Generated: %d\n", len(final))
+	log.Printf("  %s\n", familyBreakdown(final))
+	if passthrough := resolver.Passthrough(); len(passthrough) > 0 {
+		// Receivers pay one lookup per chained segment and per passthrough mechanism
+		receiverLookups := len(segments) - 1 + len(passthrough)
+		log.Printf("Passthrough Mechanisms: %s\n", strings.Join(passthrough, " "))
+		log.Printf("Receiver Lookups for Published Record: %d / %d\n", receiverLookups, cfg.MaxLookups)
+		if receiverLookups > cfg.MaxLookups {
+			log.Printf("WARN: Published record needs %d lookups, over the limit of %d\n", receiverLookups, cfg.MaxLookups)
+		}
+		// Verifiers enforce the RFC limit whatever maxLookups allows
+		if receiverLookups > dns.MaxRFCLookups && receiverLookups <= cfg.MaxLookups {
+			log.Printf("WARN: Published record needs %d lookups, over the RFC limit of %d enforced by verifiers\n", receiverLookups, dns.MaxRFCLookups)
+		}
+	}
+	p.cost = resolver.ReceiverCost(formatter.RecordName(0, cfg.TargetDomain), recordValues(p.records(segments)))
+	p.summary.ReceiverQueries, p.summary.ReceiverBytes = p.cost.Queries, p.cost.Bytes
+	log.Printf("Receiver Cost: receivers perform %d queries, ~%.1f KB, est. %s worst case (%s per query)\n",
+		p.cost.Queries, float64(p.cost.Bytes)/1024, time.Duration(p.cost.Queries)*cfg.ReceiverRTT, cfg.ReceiverRTT)
+	if len(p.cost.Unknown) > 0 {
+		log.Printf("WARN: Receiver cost excludes the records of %s, which could not be fetched\n", strings.Join(p.cost.Unknown, ", "))
+	}
+	p.external = resolver.ExternalBoundary(targetDomain)
+	if len(p.external) > 0 {
+		log.Printf("External Dependency Boundary (kept verbatim, outside flattenOnlySuffixes):\n")
+		for _, e := range p.external {
+			log.Printf("  include:%s from %s (depth %d, ~%d lookups)\n", e.Include, e.From, e.Depth, e.Lookups)
+		}
+	}
+	queries, queriesSize, branches, branchesSize := resolver.PeakConcurrency()
+	log.Printf("Peak Concurrency: %d / %d DNS queries, %d / %d include fetches\n", queries, queriesSize, branches, branchesSize)
+	if failures := resolver.NameserverFailures(); len(failures) > 0 {
+		var parts []string
+		for _, server := range resolver.Nameservers() {
+			parts = append(parts, fmt.Sprintf("%s %d", server, failures[server]))
+		}
+		log.Printf("WARN: Nameserver Failures: %s\n", strings.Join(parts, ", "))
+	}
+	if skipped, open := resolver.BreakerStats(); skipped > 0 || len(open) > 0 {
+		sort.Strings(open)
+		log.Printf("WARN: Queries Skipped by Circuit Breakers: %d (open: %s)\n", skipped, strings.Join(open, ", "))
+	}
+	if system, ok := resolver.Exchanger.(*dns.SystemExchanger); ok && system.NotFound() > 0 {
+		log.Printf("WARN: System Resolver Backend: %d not-found answers read as empty, NXDOMAIN not told apart\n", system.NotFound())
+	}
+	if discarded := resolver.GetDiscardedCount(); discarded > 0 {
+		log.Printf("WARN: Answer RRs Discarded (not matching question): %d\n", discarded)
+	}
+	log.Println("Record Hashes (spf-flattener hash):")
+	for i, segment := range segments {
+		mechanisms := fmt.Sprint(formatter.Mechanisms(segment))
+		if cfg.MaxMechanismsPerRecord > 0 {
+			mechanisms += fmt.Sprintf(" / %d", cfg.MaxMechanismsPerRecord)
+		}
+		log.Printf("  %-24s %s (%s mechanisms)\n", formatter.RecordName(i, cfg.TargetDomain), formatter.RecordHash(segment), mechanisms)
+	}
+	if timer != nil {
+		elapsed, records, hits := resolver.Parsed.Stats()
+		timer.add(fmt.Sprintf("spf parsing (%d records, %d reused)", records, hits), elapsed)
+		timer.report()
+	}
+	log.Println("-------------------------------------------------------")
+
+	if cfg.OutputFormat == "json" {
+		reportUnflattened(resolver, targetDomain)
+		return p.writeReport(final, segments, timer)
+	}
+	if cfg.OutputFormat == "terraform" {
+		reportUnflattened(resolver, targetDomain)
+		hcl, err := formatter.FormatTerraform(p.records(segments), formatter.DefaultTTL, cfg.TerraformProvider)
+		if err != nil {
+			return fmt.Errorf("ERROR: %w", err)
+		}
+		_, err = io.WriteString(p.Out, hcl)
+		return err
+	}
+
+	// Print the generated TXT records
+	write := WriteRecords
+	switch {
+	case cfg.OutputFormat == "zone" && p.VCSFriendly:
+		write = func(w io.Writer, segments []string) error { return WriteZoneVCS(w, cfg.TargetDomain, segments) }
+	case cfg.OutputFormat == "zone":
+		write = func(w io.Writer, segments []string) error {
+			zone, err := formatter.FormatZoneFile(segments, cfg.TargetDomain, formatter.DefaultTTL)
+			if err != nil {
+				return fmt.Errorf("ERROR: %w", err)
+			}
+			_, err = io.WriteString(w, zone)
+			return err
+		}
+	case p.VCSFriendly:
+		write = func(w io.Writer, segments []string) error { return WriteRecordsVCS(w, cfg.TargetDomain, segments) }
+	}
+	if err := write(p.Out, segments); err != nil {
+		return err
+	}
+
+	if cfg.OwnerRecord.Enabled && !p.adHoc {
+		value, err := formatter.QuoteTXT(cfg.OwnerRecord.Value())
+		if err != nil {
+			return fmt.Errorf("ERROR: Cannot encode record _spf-owner: %w", err)
+		}
+		name := "_spf-owner"
+		if cfg.OutputFormat == "zone" {
+			name += "." + strings.TrimSuffix(cfg.TargetDomain, ".") + "."
+		}
+		fmt.Fprintf(p.Out, "%s %d IN TXT %s\n", name, formatter.DefaultTTL, value)
+	}
+
+	reportUnflattened(resolver, targetDomain)
+	return nil
+}
+
+// printSuggestedConfig writes the priorityEntries list without the covered entries.
+// Acknowledged entries are kept.
+func (p *Pipeline) printSuggestedConfig(covered map[int]bool) error {
+	var kept struct {
+		PriorityEntries []config.PriorityEntry `yaml:"priorityEntries"`
+	}
+	for i, entry := range p.cfg.PriorityEntries {
+		if covered[i] && !entry.AcknowledgeCovered {
+			continue
+		}
+		kept.PriorityEntries = append(kept.PriorityEntries, entry)
+	}
+	out, err := yaml.Marshal(kept)
+	if err != nil {
+		return fmt.Errorf("ERROR: %w", err)
+	}
+	_, err = p.Out.Write(out)
+	return err
+}
+
+// resolvePriorityEntry resolves a single priority entry (CIDR or domain) into NetAddr slice.
+func resolvePriorityEntry(r *dns.Resolver, entry config.PriorityEntry, index int) (cidr.NetAddrSlice, error) {
+	// Check if it's already a CIDR
+	if _, ipNet, err := net.ParseCIDR(entry.Entry); err == nil {
+		return cidr.NetAddrSlice{&cidr.NetAddr{
+			IPNet:                 ipNet,
+			IsPriority:            true,
+			OriginalPriorityIndex: index,
+		}}, nil
+	}
+
+	// Assume it's a domain and perform DNS resolution (A/AAAA)
+	// NOTE: MX/PTR mechanisms are typically not processed for simple priority domains,
+	// only for domains found in the SPF chain. If the requirement was to process MX/PTR
+	// here too, we would call a specific resolver function.
+
+	// A simple A/AAAA lookup for a priority domain
+	if entry.RequireBothFamilies {
+		return r.ResolveBothFamilies(entry.Entry, index)
+	}
+	return r.ResolveAAndAAAA(entry.Entry, true, index)
+}
+
+// reportUnflattened logs a normalized unflattened equivalent of the source record, kept as a
+// known-good fallback should flattening ever be abandoned.
+func reportUnflattened(r *dns.Resolver, sourceDomain string) {
+	rec, ok := r.Record(sourceDomain)
+	if !ok {
+		return
+	}
+	record, problems := formatter.FormatUnflattened(rec, r.VerifierLookups(sourceDomain))
+
+	log.Println("-------------------------------------------------------")
+	log.Println("Unflattened Equivalent (reference only, do not publish alongside):")
+	log.Println(record)
+	for _, p := range problems {
+		log.Printf("WARN: Unflattened record is not compliant: %s", p)
+	}
+}
+
+// WriteRecords writes the generated TXT records, one zone-file line per segment.
+func WriteRecords(w io.Writer, segments []string) error {
+	for i, segment := range segments {
+		recordName := "_spf"
+		if i > 0 {
+			recordName = fmt.Sprintf("spf%d", i) // spf1, spf2, ... (since the first segment is index 0)
+		}
+
+		value, err := formatter.QuoteTXT(segment)
+		if err != nil {
+			return fmt.Errorf("ERROR: Cannot encode record %s: %w", recordName, err)
+		}
+		fmt.Fprintf(w, "%s 600 IN TXT %s\n", recordName, value)
+	}
+	return nil
+}
+
+// checkFamilies warns when a priority entry resolved to none of the addresses of a family
+// listed in its expectFamilies.
+func checkFamilies(entry config.PriorityEntry, resolved cidr.NetAddrSlice) {
+	for _, family := range entry.ExpectFamilies {
+		found := false
+		for _, n := range resolved {
+			if n.Family() == family {
+				found = true
+				break
+			}
+		}
+		if !found {
+			log.Printf("WARN: Priority entry '%s' resolved to no %s address, expected %s", entry.Entry, family, strings.Join(entry.ExpectFamilies, " and "))
+		}
+	}
+}
+
+// familyBreakdown counts the CIDRs per family within the priority and non-priority
+// sections. Records keep their evaluation order; only the summary is grouped.
+func familyBreakdown(nets cidr.NetAddrSlice) string {
+	counts := make(map[string]int)
+	for _, n := range nets {
+		section := "chain"
+		if n.IsPriority {
+			section = "priority"
+		}
+		counts[section+" "+n.Family()]++
+	}
+	return fmt.Sprintf("priority: %d ipv4, %d ipv6 / chain: %d ipv4, %d ipv6",
+		counts["priority ipv4"], counts["priority ipv6"], counts["chain ipv4"], counts["chain ipv6"])
+}
+
+// WriteRecordsVCS writes the records in a layout meant for version control: a fixed
+// header without timestamps, records sorted by owner name, and one mechanism per line
+// inside a parenthesized TXT. Each mechanism becomes its own character-string starting
+// with a space, which verifiers join back into the record (RFC 7208 section 3.3).
+func WriteRecordsVCS(w io.Writer, domain string, segments []string) error {
+	return writeVCS(w, domain, segments, false)
+}
+
+// WriteZoneVCS writes the records in the WriteRecordsVCS layout as a zone file snippet:
+// an $ORIGIN line, then fully qualified owner names as FormatZoneFile writes them.
+func WriteZoneVCS(w io.Writer, domain string, segments []string) error {
+	return writeVCS(w, domain, segments, true)
+}
+
+func writeVCS(w io.Writer, domain string, segments []string, zone bool) error {
+	origin := strings.TrimSuffix(domain, ".") + "."
+	names := make([]string, len(segments))
+	byName := make(map[string]string, len(segments))
+	for i, segment := range segments {
+		names[i] = "_spf"
+		if i > 0 {
+			names[i] = fmt.Sprintf("spf%d", i)
+		}
+		if zone {
+			names[i] = formatter.RecordName(i, origin)
+		}
+		byName[names[i]] = segment
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(w, "; SPF records of %s generated by spf-flattener, do not edit by hand.\n", domain)
+	if zone {
+		fmt.Fprintf(w, "$ORIGIN %s\n", origin)
+	}
+	for _, name := range names {
+		fmt.Fprintf(w, "%s 600 IN TXT (\n", name)
+		for i, term := range strings.Fields(byName[name]) {
+			if i > 0 {
+				term = " " + term
+			}
+			value, err := formatter.QuoteTXT(term)
+			if err != nil {
+				return fmt.Errorf("ERROR: Cannot encode record %s: %w", name, err)
+			}
+			fmt.Fprintf(w, "\t%s\n", value)
+		}
+		fmt.Fprintln(w, "\t)")
+	}
+	return nil
+}
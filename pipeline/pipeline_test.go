@@ -0,0 +1,651 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"math/rand/v2"
+	"net"
+	"os"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"project/spf-flattener/cidr"
+	"project/spf-flattener/config"
+	"project/spf-flattener/dns/dnstest"
+	"project/spf-flattener/formatter"
+)
+
+// nets parses CIDRs into a NetAddrSlice.
+func nets(t *testing.T, cidrs ...string) cidr.NetAddrSlice {
+	t.Helper()
+	var s cidr.NetAddrSlice
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s = append(s, &cidr.NetAddr{IPNet: n})
+	}
+	return s
+}
+
+// newPipeline returns a pipeline for example.com, ad hoc when adHoc is set.
+func newPipeline(t *testing.T, adHoc string, opts ...config.Option) *Pipeline {
+	t.Helper()
+	opts = append([]config.Option{config.WithTargetDomain("example.com"), config.WithNameserver("127.0.0.1:53")}, opts...)
+	cfg, err := config.New(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := New(cfg, adHoc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestComparePreflightEveryMode(t *testing.T) {
+	final := nets(t, "192.0.2.0/24")
+	tests := []struct {
+		name      string
+		adHoc     string
+		offline   bool
+		preflight []string
+		wantErr   bool
+	}{
+		{"offline covered", "", true, []string{"192.0.2.25"}, false},
+		{"offline uncovered", "", true, []string{"192.0.2.25", "198.51.100.7"}, true},
+		{"ad hoc covered", "other.example", false, []string{"192.0.2.25"}, false},
+		{"ad hoc uncovered", "other.example", false, []string{"198.51.100.7"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newPipeline(t, tt.adHoc, config.WithPreflight(tt.preflight...))
+			p.Offline = tt.offline
+			err := p.Compare(final, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Compare() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil && !strings.HasPrefix(err.Error(), "PREFLIGHT:") {
+				t.Errorf("Compare() error = %v, want a PREFLIGHT error", err)
+			}
+		})
+	}
+}
+
+// chainZone is a published chain of two records under example.com.
+const chainZone = `
+_spf.example.com. 300 IN TXT "v=spf1 ip4:192.0.2.0/24 include:spf1.example.com -all"
+spf1.example.com. 300 IN TXT "v=spf1 ip4:198.51.100.0/24 -all"
+`
+
+func TestFetchPublishedUsesResolver(t *testing.T) {
+	zone := dnstest.New(t, chainZone)
+	p := newPipeline(t, "")
+	p.SetExchanger(zone)
+
+	published := p.FetchPublished()
+	if len(published) != 1 || published[0].Err != nil {
+		t.Fatalf("FetchPublished() = %+v, want one entry point without error", published)
+	}
+	got := append([]string(nil), published[0].CIDRs...)
+	sort.Strings(got)
+	if want := []string{"192.0.2.0/24", "198.51.100.0/24"}; !slices.Equal(got, want) {
+		t.Errorf("FetchPublished() CIDRs = %v, want %v", got, want)
+	}
+	if queries := zone.Queries(); !slices.Contains(queries, "spf1.example.com TXT") {
+		t.Errorf("queries = %v, want the chained record fetched through the resolver", queries)
+	}
+}
+
+func TestStaleRecords(t *testing.T) {
+	const wildcard = `*.example.com. 300 IN TXT "v=spf1 -all"` + "\n"
+	const leftover = `
+spf1.example.com. 300 IN TXT "v=spf1 ip4:198.51.100.0/24 -all"
+spf2.example.com. 300 IN TXT "v=spf1 ip4:203.0.113.0/24 -all"
+`
+	var endless strings.Builder
+	for i := 1; i <= 20; i++ {
+		fmt.Fprintf(&endless, "spf%d.example.com. 300 IN TXT \"v=spf1 ip4:192.0.2.%d -all\"\n", i, i)
+	}
+	tests := []struct {
+		name string
+		zone string
+		want []string
+	}{
+		{"leftover records", leftover, []string{"spf1.example.com", "spf2.example.com"}},
+		{"leftover records under an SPF wildcard", wildcard + leftover, []string{"spf1.example.com", "spf2.example.com"}},
+		{"wildcard only", wildcard, nil},
+		{"bounded probe", endless.String(), []string{"spf1.example.com", "spf2.example.com", "spf3.example.com", "spf4.example.com", "spf5.example.com"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newPipeline(t, "")
+			p.SetExchanger(dnstest.New(t, tt.zone))
+			p.segments = []string{"v=spf1 ip4:192.0.2.0/24 -all"}
+
+			var got []string
+			for _, rec := range p.StaleRecords() {
+				got = append(got, rec.Name)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("StaleRecords() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnpublished(t *testing.T) {
+	segments := []string{"v=spf1 ip4:192.0.2.0/24 include:spf1.example.com -all", "v=spf1 ip4:198.51.100.0/24 -all"}
+	const owner = `_spf-owner.example.com. 300 IN TXT "managed-by=spf-flattener"` + "\n"
+	tests := []struct {
+		name  string
+		zone  string
+		owner bool
+		want  []string
+	}{
+		{"live", chainZone, false, nil},
+		{"live with owner record", chainZone + owner, true, nil},
+		{"owner record missing", chainZone, true, []string{"_spf-owner.example.com"}},
+		{"qualifier changed", `
+_spf.example.com. 300 IN TXT "v=spf1 ip4:192.0.2.0/24 include:spf1.example.com ~all"
+spf1.example.com. 300 IN TXT "v=spf1 ip4:198.51.100.0/24 -all"
+`, false, []string{"_spf.example.com"}},
+		{"resegmented", `
+_spf.example.com. 300 IN TXT "v=spf1 ip4:192.0.2.0/24 ip4:198.51.100.0/24 -all"
+`, false, []string{"_spf.example.com", "spf1.example.com"}},
+		{"second SPF record", chainZone + `spf1.example.com. 300 IN TXT "v=spf1 -all"` + "\n", false, []string{"spf1.example.com"}},
+		{"other TXT records", chainZone + `spf1.example.com. 300 IN TXT "site-verification=abc"` + "\n", false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newPipeline(t, "")
+			p.SetExchanger(dnstest.New(t, tt.zone))
+			p.segments = segments
+			p.cfg.OwnerRecord.Enabled = tt.owner
+
+			var got []string
+			for _, rec := range p.Unpublished() {
+				got = append(got, rec.Name)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Unpublished() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckPublishZone(t *testing.T) {
+	const delegated = `_spf.example.com. 300 IN NS ns1.example.net.` + "\n"
+	tests := []struct {
+		name        string
+		zone        string
+		publishZone string
+		segments    int
+		wantErr     string
+	}{
+		{"parent zone", chainZone, "", 2, ""},
+		{"declared parent zone", chainZone, "example.com.", 2, ""},
+		{"undeclared delegation", delegated, "", 1, "must be published in the delegated zone"},
+		{"declared delegation", delegated, "_spf.example.com", 1, ""},
+		{"chain outside the delegated zone", delegated, "_spf.example.com", 2, "spf1.example.com is outside publishZone"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newPipeline(t, "", config.WithPublishZone(tt.publishZone))
+			p.SetExchanger(dnstest.New(t, tt.zone))
+			p.segments = []string{"v=spf1 ip4:192.0.2.0/24 include:spf1.example.com -all", "v=spf1 ip4:198.51.100.0/24 -all"}[:tt.segments]
+
+			err := p.CheckPublishZone()
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("CheckPublishZone() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// jitterZone answers from a zone after a random delay, shuffling the order in which
+// parallel branches complete.
+type jitterZone struct {
+	*dnstest.Zone
+}
+
+func (z jitterZone) Exchange(m *dns.Msg, server string) (*dns.Msg, error) {
+	time.Sleep(rand.N(time.Millisecond))
+	return z.Zone.Exchange(m, server)
+}
+
+// TestRunDeterministic runs the same chain repeatedly with parallel branches completing
+// in random order: the JSON report must not change. Run it with -race too.
+func TestRunDeterministic(t *testing.T) {
+	// The branches overlap so provenance ties depend on the merge order
+	const zone = `
+spf-unflat.example.com. 300 IN TXT "v=spf1 include:a.example.net include:b.example.net ip4:192.0.2.0/24 include:c.example.net mx -all"
+a.example.net. 300 IN TXT "v=spf1 ip4:192.0.2.0/25 ip4:198.51.100.0/24 include:d.example.net ~all"
+b.example.net. 300 IN TXT "v=spf1 ip4:198.51.100.0/24 ip6:2001:db8::/48 a:mail.example.net ~all"
+c.example.net. 300 IN TXT "v=spf1 ip4:203.0.113.0/24 ip4:192.0.2.128/25 include:d.example.net -all"
+d.example.net. 300 IN TXT "v=spf1 ip4:203.0.113.64/26 ip6:2001:db8::/32 -all"
+mail.example.net. 300 IN A 203.0.113.10
+example.com. 300 IN MX 10 mx.example.com.
+mx.example.com. 300 IN A 198.51.100.25
+mx.example.com. 300 IN AAAA 2001:db8:1::25
+`
+	defer runtime.GOMAXPROCS(max(4, runtime.GOMAXPROCS(0)))
+	captureLog(t)
+	var first []byte
+	for i := range 50 {
+		p := newPipeline(t, "", config.WithConcurrencyLimit(8))
+		p.cfg.OutputFormat = "json"
+		p.Offline = true
+		var out bytes.Buffer
+		p.Out = &out
+		p.SetExchanger(jitterZone{dnstest.New(t, zone)})
+		if err := p.Run(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		got := zeroTimings(out.Bytes())
+		if i == 0 {
+			first = got
+			continue
+		}
+		if !bytes.Equal(got, first) {
+			t.Fatalf("run %d differs from the first run (-first +run):\n%s", i, lineDiff(string(first), string(got)))
+		}
+	}
+}
+
+func TestComparePublishedRedirect(t *testing.T) {
+	final := nets(t, "192.0.2.0/24", "198.51.100.0/24")
+	tests := []struct {
+		name        string
+		zone        string
+		wantMissing int
+	}{
+		{"include then redirect", `
+_spf.example.com. 300 IN TXT "v=spf1 ip4:192.0.2.0/24 include:spf1.example.com -all"
+spf1.example.com. 300 IN TXT "v=spf1 redirect=spf2.example.com"
+spf2.example.com. 300 IN TXT "v=spf1 ip4:198.51.100.0/24 -all"
+`, 0},
+		{"redirect ignored next to all", `
+_spf.example.com. 300 IN TXT "v=spf1 ip4:192.0.2.0/24 include:spf1.example.com -all"
+spf1.example.com. 300 IN TXT "v=spf1 redirect=spf2.example.com ~all"
+spf2.example.com. 300 IN TXT "v=spf1 ip4:198.51.100.0/24 -all"
+`, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			captureLog(t)
+			p := newPipeline(t, "")
+			p.SetExchanger(dnstest.New(t, tt.zone))
+			if err := p.Compare(final, p.FetchPublished()); err != nil {
+				t.Fatal(err)
+			}
+			if s := p.Summary(); s.Missing != tt.wantMissing || s.Extra != 0 {
+				t.Errorf("Compare() = %d missing, %d extra, want %d and 0", s.Missing, s.Extra, tt.wantMissing)
+			}
+		})
+	}
+}
+
+func TestRunIncomplete(t *testing.T) {
+	const zone = `
+spf-unflat.example.com. 300 IN TXT "v=spf1 ip4:192.0.2.0/24 ip4:198.51.100.0/24 include:vendor.example.net -all"
+vendor.example.net. 300 IN TXT "v=spf1 ip4:203.0.113.0/24 -all"
+_spf.example.com. 300 IN TXT "v=spf1 ip4:192.0.2.0/24 include:spf1.example.com -all"
+spf1.example.com. 300 IN TXT "v=spf1 ip4:198.51.100.0/24 ip4:203.0.113.0/24 -all"
+`
+	tests := []struct {
+		name           string
+		fail           string
+		wantStatus     string
+		wantIncomplete []string
+	}{
+		{"every segment resolves", "", StatusOK, nil},
+		{"chained segment SERVFAIL", "spf1.example.com", StatusIncomplete, []string{"spf1.example.com"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			captureLog(t)
+			z := dnstest.New(t, zone)
+			if tt.fail != "" {
+				z.Fail(tt.fail, dns.RcodeServerFailure)
+			}
+			p := newPipeline(t, "")
+			p.Out = io.Discard
+			p.SetExchanger(z)
+			if err := p.Run(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			s := p.Summary()
+			if s.Status != tt.wantStatus {
+				t.Errorf("status = %s, want %s", s.Status, tt.wantStatus)
+			}
+			// An incomplete comparison reports no false positives
+			if s.Missing != 0 || s.Extra != 0 {
+				t.Errorf("summary = %d missing, %d extra, want none", s.Missing, s.Extra)
+			}
+			if len(p.diffs) != 1 || !slices.Equal(p.diffs[0].Incomplete, tt.wantIncomplete) {
+				t.Errorf("diffs = %+v, want one with Incomplete %v", p.diffs, tt.wantIncomplete)
+			}
+			if tt.wantIncomplete != nil && (p.diffs[0].Missing != nil || p.diffs[0].Extra != nil) {
+				t.Errorf("incomplete diff lists CIDRs: %+v", p.diffs[0])
+			}
+		})
+	}
+}
+
+// TestVerifierLookups flattens a diamond: the shared include is fetched once but a
+// verifier evaluates it under each parent, taking the chain over the RFC limit.
+func TestVerifierLookups(t *testing.T) {
+	const zone = `
+spf-unflat.example.com. 300 IN TXT "v=spf1 include:a.example.net include:b.example.net -all"
+a.example.net. 300 IN TXT "v=spf1 ip4:192.0.2.0/25 include:shared.example.net -all"
+b.example.net. 300 IN TXT "v=spf1 ip4:192.0.2.128/25 include:shared.example.net -all"
+shared.example.net. 300 IN TXT "v=spf1 include:l1.example.net include:l2.example.net include:l3.example.net include:l4.example.net -all"
+l1.example.net. 300 IN TXT "v=spf1 ip4:198.51.100.1 -all"
+l2.example.net. 300 IN TXT "v=spf1 ip4:198.51.100.2 -all"
+l3.example.net. 300 IN TXT "v=spf1 ip4:198.51.100.3 -all"
+l4.example.net. 300 IN TXT "v=spf1 ip4:198.51.100.4 -all"
+`
+	logs := captureLog(t)
+	p := newPipeline(t, "")
+	p.cfg.OutputFormat = "json"
+	p.Offline = true
+	var out bytes.Buffer
+	p.Out = &out
+	p.SetExchanger(dnstest.New(t, zone))
+	if err := p.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var report Report
+	if err := json.Unmarshal(out.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	// Fetched: the source, a, b, shared and its four leaves. Evaluated: a, b, and shared
+	// with its four leaves under each of them.
+	if report.Lookups != 8 || report.VerifierLookups != 12 {
+		t.Errorf("report lookups = %d, verifierLookups = %d, want 8 and 12", report.Lookups, report.VerifierLookups)
+	}
+	if !strings.Contains(logs.String(), "WARN: Unflattened chain needs 12 verifier lookups, over the RFC limit of 10") {
+		t.Errorf("no RFC-limit warning for the verifier lookups:\n%s", logs.String())
+	}
+	if strings.Contains(logs.String(), "cycle") {
+		t.Errorf("the shared include was reported as a cycle:\n%s", logs.String())
+	}
+}
+
+// parseZone reads a zone file snippet back with the miekg/dns zone parser and returns
+// the owner names in file order and the joined TXT value of each.
+func parseZone(t *testing.T, snippet string) ([]string, map[string]string) {
+	t.Helper()
+	var names []string
+	values := make(map[string]string)
+	zp := dns.NewZoneParser(strings.NewReader(snippet), "", "")
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		txt, isTXT := rr.(*dns.TXT)
+		if !isTXT {
+			t.Fatalf("record %s is not a TXT record", rr)
+		}
+		// miekg/dns keeps the character-strings escaped
+		var value string
+		for _, s := range txt.Txt {
+			s, err := formatter.UnquoteTXT(`"` + s + `"`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			value += s
+		}
+		names = append(names, txt.Hdr.Name)
+		values[txt.Hdr.Name] = value
+	}
+	if err := zp.Err(); err != nil {
+		t.Fatalf("zone parser: %v\n%s", err, snippet)
+	}
+	return names, values
+}
+
+// TestRunZoneVCS checks that -vcs-friendly applies to zone output: the records come back
+// from the zone parser identical to the plain zone output, sorted by owner name.
+func TestRunZoneVCS(t *testing.T) {
+	// One address per record under the length limit, so spf10 sorts before spf2
+	var ips []string
+	for i := range 12 {
+		ips = append(ips, fmt.Sprintf("ip4:192.0.2.%d", 2*i+1))
+	}
+	zone := `spf-unflat.example.com. 300 IN TXT "v=spf1 ` + strings.Join(ips, " ") + ` -all"`
+	captureLog(t)
+	run := func(vcs bool) string {
+		p := newPipeline(t, "", config.WithMaxTXTLength(60))
+		p.cfg.OutputFormat = "zone"
+		p.Offline = true
+		p.VCSFriendly = vcs
+		var out bytes.Buffer
+		p.Out = &out
+		p.SetExchanger(dnstest.New(t, zone))
+		if err := p.Run(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		return out.String()
+	}
+	plain, vcs := run(false), run(true)
+	if !strings.Contains(vcs, "IN TXT (\n") {
+		t.Fatalf("zone output is not in the VCS-friendly layout:\n%s", vcs)
+	}
+	_, want := parseZone(t, plain)
+	names, got := parseZone(t, vcs)
+	if len(want) != 12 {
+		t.Fatalf("plain zone output has %d records, want 12:\n%s", len(want), plain)
+	}
+	if !maps.Equal(got, want) {
+		t.Errorf("VCS-friendly zone records differ:\n%s\nwant:\n%s", vcs, plain)
+	}
+	if !slices.IsSorted(names) {
+		t.Errorf("owner names not sorted: %v", names)
+	}
+}
+
+func TestReadResolvedSchemaVersion(t *testing.T) {
+	report, err := os.ReadFile("testdata/corpus/simple-provider/report.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		doc     string
+		wantErr bool
+	}{
+		{"current version", `{"schemaVersion": 1, "domain": "example.com", "cidrs": [{"cidr": "192.0.2.0/24", "family": "ipv4"}]}`, false},
+		{"written before versioning", `{"domain": "example.com", "cidrs": [{"cidr": "192.0.2.0/24", "family": "ipv4"}]}`, false},
+		{"JSON report", string(report), false},
+		{"newer version", `{"schemaVersion": 2, "domain": "example.com", "cidrs": []}`, true},
+		{"negative version", `{"schemaVersion": -1, "domain": "example.com", "cidrs": []}`, true},
+		{"not JSON", `domain: example.com`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := ReadResolved(strings.NewReader(tt.doc))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadResolved() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && (doc.Domain == "" || len(doc.CIDRs) == 0) {
+				t.Errorf("ReadResolved() = %+v, want the domain and CIDRs", doc)
+			}
+		})
+	}
+}
+
+// TestRunMaxLookups flattens linear chains against the configured lookup budget: the
+// budget is enforced whatever its value, and going over the RFC limit always warns.
+func TestRunMaxLookups(t *testing.T) {
+	// chain returns a zone where spf-unflat.example.com starts a chain of n records.
+	chain := func(n int) string {
+		var b strings.Builder
+		for i := range n {
+			name := fmt.Sprintf("c%d.example.net", i)
+			if i == 0 {
+				name = "spf-unflat.example.com"
+			}
+			next := ""
+			if i < n-1 {
+				next = fmt.Sprintf(" include:c%d.example.net", i+1)
+			}
+			fmt.Fprintf(&b, "%s. 300 IN TXT \"v=spf1 ip4:192.0.2.%d%s -all\"\n", name, i, next)
+		}
+		return b.String()
+	}
+	tests := []struct {
+		limit, records int
+		wantErr        bool
+		wantRFCWarning bool
+	}{
+		{5, 5, false, false},
+		{5, 6, true, false},
+		{10, 10, false, false},
+		{10, 11, true, false},
+		{20, 11, false, true},
+		{20, 20, false, true},
+		{20, 21, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("limit %d, %d records", tt.limit, tt.records), func(t *testing.T) {
+			logs := captureLog(t)
+			p := newPipeline(t, "", config.WithMaxLookups(tt.limit))
+			p.Out = io.Discard
+			p.SetExchanger(dnstest.New(t, chain(tt.records)))
+			err := p.Run(context.Background())
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "exceeds the lookup budget") {
+					t.Errorf("Run() error = %v, want the lookup budget exceeded", err)
+				}
+			} else if err != nil {
+				t.Fatalf("Run() error = %v", err)
+			} else if s := p.Summary(); s.Lookups != tt.records || s.MaxLookups != tt.limit {
+				t.Errorf("lookups = %d/%d, want %d/%d", s.Lookups, s.MaxLookups, tt.records, tt.limit)
+			}
+			warned := strings.Contains(logs.String(), fmt.Sprintf("maxLookups %d is over the RFC limit of 10", tt.limit))
+			if warned != tt.wantRFCWarning {
+				t.Errorf("RFC limit warning = %v, want %v:\n%s", warned, tt.wantRFCWarning, logs)
+			}
+		})
+	}
+}
+
+// TestFormatMaxTXTLength lowers maxTXTLength step by step: each step needs more segments,
+// none longer than the limit, and a published record over the limit is reported.
+func TestFormatMaxTXTLength(t *testing.T) {
+	var cidrs []string
+	for i := range 60 {
+		cidrs = append(cidrs, fmt.Sprintf("192.0.2.%d/32", i))
+	}
+	final := nets(t, cidrs...)
+	previous := 0
+	for _, limit := range []int{450, 255, 200, 120} {
+		t.Run(fmt.Sprint(limit), func(t *testing.T) {
+			captureLog(t)
+			p := newPipeline(t, "", config.WithMaxTXTLength(limit))
+			p.SetExchanger(dnstest.New(t, ""))
+			segments, err := p.Format(final)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(segments) <= previous {
+				t.Errorf("%d segments at limit %d, want more than the %d of the higher limit", len(segments), limit, previous)
+			}
+			previous = len(segments)
+			for i, s := range segments {
+				if len(s) > limit {
+					t.Errorf("segment %d is %d bytes, over the limit of %d: %q", i, len(s), limit, s)
+				}
+			}
+		})
+	}
+
+	// Published records are held to the same limit, whoever created them
+	zone := `spf-unflat.example.com. 300 IN TXT "v=spf1 ip4:192.0.2.0/24 -all"` + "\n" +
+		`_spf.example.com. 300 IN TXT "v=spf1 ip4:192.0.2.0/24 ` + strings.Repeat("ip4:198.51.100.1 ", 12) + `-all"` + "\n"
+	logs := captureLog(t)
+	p := newPipeline(t, "", config.WithMaxTXTLength(200))
+	p.Out = io.Discard
+	p.SetExchanger(dnstest.New(t, zone))
+	if err := p.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logs.String(), "Published record at _spf.example.com exceeds configured provider limit") {
+		t.Errorf("log does not report the published record over the limit:\n%s", logs)
+	}
+}
+
+// TestRunCoalesce flattens AAAA and A hosts with coalescing: the run reports the entries
+// saved and each widening with the addresses it absorbed, and explicit tokens stay as is.
+func TestRunCoalesce(t *testing.T) {
+	const zone = `
+spf-unflat.example.com. 300 IN TXT "v=spf1 a:hosts.example.net ip6:2001:db8:1::99 -all"
+hosts.example.net. 300 IN AAAA 2001:db8:1::10
+hosts.example.net. 300 IN AAAA 2001:db8:1::11
+hosts.example.net. 300 IN AAAA 2001:db8:1::12
+hosts.example.net. 300 IN AAAA 2001:db8:2::a
+hosts.example.net. 300 IN A 192.0.2.1
+hosts.example.net. 300 IN A 192.0.2.2
+`
+	tests := []struct {
+		name     string
+		v4, v6   int
+		want     []string
+		wantLogs []string
+	}{
+		{"off", 0, 0, []string{"192.0.2.1/32", "192.0.2.2/32", "2001:db8:1::10/128", "2001:db8:1::11/128", "2001:db8:1::12/128", "2001:db8:1::99/128", "2001:db8:2::a/128"}, nil},
+		{
+			// The explicit ip6: host inside the widened /64 is now covered by it
+			"IPv6 to /64", 0, 64, []string{"192.0.2.1/32", "192.0.2.2/32", "2001:db8:1::/64", "2001:db8:2::/64"},
+			[]string{
+				"WARN: Coalesced 2001:db8:1::10/128, 2001:db8:1::11/128, 2001:db8:1::12/128 into 2001:db8:1::/64, authorizing more than resolved",
+				"WARN: Coalesced 2001:db8:2::a/128 into 2001:db8:2::/64",
+				"INFO: Coalescing resolved addresses saved 2 entries",
+			},
+		},
+		{
+			"both families", 24, 64, []string{"192.0.2.0/24", "2001:db8:1::/64", "2001:db8:2::/64"},
+			[]string{"WARN: Coalesced 192.0.2.1/32, 192.0.2.2/32 into 192.0.2.0/24", "INFO: Coalescing resolved addresses saved 3 entries"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLog(t)
+			p := newPipeline(t, "")
+			p.cfg.CoalesceIPv4To, p.cfg.CoalesceIPv6To = tt.v4, tt.v6
+			p.SetExchanger(dnstest.New(t, zone))
+			doc, err := p.Resolve(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, c := range doc.CIDRs {
+				got = append(got, c.CIDR)
+				if c.Source == "" {
+					t.Errorf("%s has no provenance", c.CIDR)
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("CIDRs = %v, want %v", got, tt.want)
+			}
+			for _, want := range tt.wantLogs {
+				if !strings.Contains(logs.String(), want) {
+					t.Errorf("log does not contain %q:\n%s", want, logs)
+				}
+			}
+			if tt.wantLogs == nil && strings.Contains(logs.String(), "Coalesc") {
+				t.Errorf("coalescing reported while disabled:\n%s", logs)
+			}
+		})
+	}
+}
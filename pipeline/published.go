@@ -0,0 +1,365 @@
+// Fichier: pipeline/published.go
+
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"strings"
+
+	"project/spf-flattener/dns"
+	"project/spf-flattener/formatter"
+	"project/spf-flattener/spf"
+)
+
+// checkDelegation detects an NS delegation at name and returns an error when the
+// configuration does not declare the delegated subzone as the publish target.
+func checkDelegation(r *dns.Resolver, name, publishZone string) error {
+	nsHosts, err := r.LookupDelegation(name)
+	if err != nil {
+		log.Printf("WARN: Failed to check delegation of %s: %v", name, err)
+		return nil
+	}
+	if len(nsHosts) == 0 {
+		return nil
+	}
+
+	log.Printf("INFO: %s is delegated to a separate zone served by %s", name, strings.Join(nsHosts, ", "))
+	if !strings.EqualFold(strings.TrimSuffix(publishZone, "."), name) {
+		return fmt.Errorf("records under %s must be published in the delegated zone, not in the parent zone %s; "+
+			"set publishZone: %s in the configuration", name, strings.TrimPrefix(name, "_spf."), name)
+	}
+	return nil
+}
+
+// checkWildcards warns when a wildcard TXT record answers for the planned record names: a
+// verifier following the chain mid-rollout would receive the wildcard's text instead of
+// our record. A name whose answer matches the wildcard fingerprint is synthesized; a name
+// with its own record already exists and will be replaced.
+func checkWildcards(r *dns.Resolver, names []string) {
+	fingerprints := make(map[string][]string)
+	for _, name := range names {
+		parent := name[strings.Index(name, ".")+1:]
+		wildcard, probed := fingerprints[parent]
+		if !probed {
+			wildcard = wildcardTXT(r, parent)
+			fingerprints[parent] = wildcard
+		}
+		if len(wildcard) == 0 {
+			continue
+		}
+
+		txts, err := r.LookupTXT(name)
+		switch {
+		case err != nil:
+			log.Printf("WARN: Failed to look up planned record %s: %v", name, err)
+		case slices.Equal(txts, wildcard):
+			log.Printf("WARN: %s is shadowed by the wildcard *.%s (%q) until it is published; "+
+				"a verifier following the chain mid-rollout would receive the wildcard's text.", name, parent, wildcard)
+		default:
+			log.Printf("WARN: *.%s is a wildcard TXT record and %s already has its own TXT record %q; "+
+				"publish the whole chain at once.", parent, name, txts)
+		}
+	}
+}
+
+// fetchSPFAndResolveIncludes looks up the given name and recursively follows include: mechanisms and redirect=,
+// collecting all ip4/ip6 CIDRs found. It uses a simple BFS with a visited set and limits the number
+// of lookups by maxLookups to avoid loops. Records longer than maxLength are reported.
+// In strict mode malformed records are errors. The qualifiers of the ip4/ip6 mechanisms
+// are counted into qualifiers. The chained records under sld (spfN.<sld>) that failed to
+// resolve, other than by not existing, are returned as incomplete: the CIDRs collected
+// then lack a part of our own chain.
+func fetchSPFAndResolveIncludes(r *dns.Resolver, name, sld string, maxLookups, maxLength int, strict bool, qualifiers map[string]int) (cidrs, incomplete []string, err error) {
+	visited := make(map[string]struct{})
+	queue := []string{name}
+	lookups := 0
+
+	for len(queue) > 0 {
+		if lookups >= maxLookups {
+			return cidrs, incomplete, fmt.Errorf("max lookups (%d) reached while resolving SPF includes", maxLookups)
+		}
+		d := queue[0]
+		queue = queue[1:]
+
+		// avoid duplicate lookups
+		if _, ok := visited[d]; ok {
+			continue
+		}
+		visited[d] = struct{}{}
+		lookups++
+
+		txts, err := r.LookupTXT(d)
+		if d == name && (errors.Is(err, dns.ErrNXDomain) || err == nil && !hasSPF(txts)) {
+			return nil, nil, fmt.Errorf("%w: no SPF record at %s", errNotPublished, name)
+		}
+		if err != nil {
+			// continue processing other includes; report at end if nothing found
+			log.Printf("WARN: LookupTXT failed for %s: %v", d, err)
+			// A missing chained record is a chain break, reported by checkChain
+			if _, ok := chainIndex(strings.ToLower(d), sld); ok && !errors.Is(err, dns.ErrNXDomain) {
+				incomplete = append(incomplete, d)
+			}
+			continue
+		}
+
+		foundSPF := false
+		for _, txt := range txts {
+			t := strings.TrimSpace(txt)
+			if spf.IsSPF(t) {
+				if first, ok := spf.SplitConcatenated(t); ok {
+					if strict {
+						return cidrs, incomplete, fmt.Errorf("multiple SPF strings concatenated in one TXT RR at %s: %q", d, t)
+					}
+					log.Printf("WARN: Multiple SPF strings concatenated in one TXT RR at %s, using only the first: %q", d, first)
+					t = first
+				}
+				foundSPF = true
+				if len(t) > maxLength {
+					log.Printf("WARN: Published record at %s exceeds configured provider limit: %d bytes, maxTXTLength is %d", d, len(t), maxLength)
+				}
+				c, includes := parseSPFToCIDRsAndIncludes(r.Parsed, d, t, qualifiers)
+				cidrs = append(cidrs, c...)
+				// enqueue includes
+				for _, inc := range includes {
+					// Per RFC include target is a domain; enqueue as-is
+					if _, seen := visited[inc]; !seen {
+						queue = append(queue, inc)
+					}
+				}
+				// do not break: in case multiple TXT records contain fragments, parse them all
+			}
+		}
+		if !foundSPF {
+			// No SPF at this name; continue
+			continue
+		}
+	}
+
+	if len(cidrs) == 0 {
+		return nil, incomplete, fmt.Errorf("no v=spf1 TXT records (or cidrs) found under %s and its includes", name)
+	}
+
+	// Normalize and dedupe CIDRs
+	normalized := make(map[string]struct{})
+	var out []string
+	for _, s := range cidrs {
+		normalized[s] = struct{}{}
+	}
+	for k := range normalized {
+		out = append(out, k)
+	}
+	return out, incomplete, nil
+}
+
+// chainIndex returns N when name is the chained record spfN.<sld>.
+func chainIndex(name, sld string) (int, bool) {
+	var i int
+	_, err := fmt.Sscanf(name, "spf%d."+sld, &i)
+	return i, err == nil && i > 0 && formatter.RecordName(i, sld) == name
+}
+
+// chainProbeMargin is the number of chained names probed past the last one expected, to
+// find records left over from a longer chain. The probe stops earlier at the first name
+// without an SPF record, and never follows a wildcard that answers for every name.
+const chainProbeMargin = 5
+
+// wildcardTXT returns the TXT strings a wildcard synthesizes for the names under parent,
+// or nil when there is none.
+func wildcardTXT(r *dns.Resolver, parent string) []string {
+	wildcard, err := r.WildcardTXT(parent)
+	if err != nil {
+		log.Printf("WARN: Failed to probe for a wildcard under %s: %v", parent, err)
+	}
+	return wildcard
+}
+
+// checkChain verifies the structure of the live chain: every chained record included from
+// the entry points must be published, and every published spfN.<sld> record must be
+// reachable from one of them. Both are chain breaks: verifiers permerror on a missing
+// include and silently lose the coverage of an orphaned record. An answer synthesized by
+// a wildcard under sld is not a published record.
+func checkChain(r *dns.Resolver, entries []string, sld string) {
+	wildcard := wildcardTXT(r, sld)
+	published := make(map[string]bool)
+	failed := make(map[string]error)
+	synthesized := make(map[string]bool)
+	lookup := func(name string) []string {
+		txts, err := r.LookupTXT(name)
+		if err != nil && !errors.Is(err, dns.ErrNXDomain) {
+			failed[name] = err
+		}
+		if err == nil && wildcard != nil && slices.Equal(txts, wildcard) {
+			synthesized[name] = true
+			return nil
+		}
+		if err != nil || !hasSPF(txts) {
+			return nil
+		}
+		published[name] = true
+		return txts
+	}
+
+	// Follow the includes from the entry points, staying within the chain
+	reachable := make(map[string]bool)
+	highest := 0
+	queue := append([]string(nil), entries...)
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		if reachable[name] {
+			continue
+		}
+		reachable[name] = true
+		txts := lookup(name)
+		if txts == nil {
+			if i, ok := chainIndex(name, sld); ok {
+				switch err := failed[name]; {
+				case err != nil:
+					log.Printf("WARN: Published record health: %s is included but could not be checked: %v", name, err)
+				case synthesized[name]:
+					log.Printf("ERROR: Published record health: chain break: %s is included but only the wildcard *.%s answers it", name, sld)
+				default:
+					log.Printf("ERROR: Published record health: chain break: %s is included but has no SPF record", name)
+				}
+				highest = max(highest, i)
+			}
+			continue
+		}
+		for _, txt := range txts {
+			for _, token := range strings.Fields(txt) {
+				target, ok := strings.CutPrefix(strings.TrimPrefix(token, "+"), "include:")
+				if !ok {
+					if target, ok = strings.CutPrefix(token, "redirect="); !ok {
+						continue
+					}
+				}
+				target = strings.ToLower(strings.TrimSuffix(target, "."))
+				if i, ok := chainIndex(target, sld); ok {
+					highest = max(highest, i)
+					queue = append(queue, target)
+				}
+			}
+		}
+	}
+
+	// Probe the chained names past the highest referenced one to find orphans
+	for i := 1; i <= highest+chainProbeMargin; i++ {
+		name := formatter.RecordName(i, sld)
+		if !reachable[name] && lookup(name) != nil {
+			log.Printf("ERROR: Published record health: chain break: %s is published but not reachable from %s", name, strings.Join(entries, ", "))
+		}
+		if i >= highest && !published[name] {
+			return
+		}
+	}
+}
+
+// errNotPublished reports that the entry point of the published records does not exist
+// yet, as on the first deployment for a domain.
+var errNotPublished = errors.New("not yet published")
+
+// hasSPF reports whether one of the TXT strings is an SPF record.
+func hasSPF(txts []string) bool {
+	for _, txt := range txts {
+		if spf.IsSPF(strings.TrimSpace(txt)) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSPFToCIDRsAndIncludes extracts ip4/ip6 CIDRs and include: targets from a single spf string.
+// Only pass-qualified terms are returned, the others authorize nothing; qualifiers still
+// counts every ip4/ip6 term. The redirect= target, when verifiers follow it, is returned
+// among the includes.
+// CIDRs are normalized like the generated ones (family check, host bits masked, canonical text);
+// duplicates and family mismatches are reported as record health problems.
+func parseSPFToCIDRsAndIncludes(cache *spf.Cache, domain, spfText string, qualifiers map[string]int) (cidrs []string, includes []string) {
+	record, err := cache.Parse(domain, spfText)
+	if err != nil {
+		log.Printf("WARN: Published record health (%s): parse-error: %v", domain, err)
+		return
+	}
+	effective, ignored := record.Effective()
+	for _, term := range ignored {
+		log.Printf("WARN: Published record health (%s): %s after 'all' is ignored by verifiers", domain, term)
+	}
+	seen := make(map[string]string)
+	redirect, hasAll := "", false
+	for _, term := range effective {
+		if term.Modifier {
+			if term.Name == "redirect" {
+				redirect = term.Value
+			}
+			continue
+		}
+		if term.Name == "all" {
+			hasAll = true
+		}
+
+		if term.Name == "include" {
+			if !term.Pass() {
+				log.Printf("WARN: Published record health (%s): %s does not authorize its senders, not compared", domain, term)
+				continue
+			}
+			if term.Value != "" {
+				includes = append(includes, term.Value)
+			}
+			continue
+		}
+
+		if term.Name == "ip4" || term.Name == "ip6" {
+			if qualifiers != nil {
+				q := "+"
+				if term.Qualifier != 0 {
+					q = string(term.Qualifier)
+				}
+				qualifiers[q]++
+			}
+			// Only pass-qualified networks are authorized: -ip4 and ~ip4 exclude theirs
+			if !term.Pass() {
+				continue
+			}
+			c, err := normalizeCIDR(term.Name, term.Value)
+			if err != nil {
+				log.Printf("WARN: Published record health (%s): %s ignored by verifiers: %v", domain, term, err)
+				continue
+			}
+			if first, dup := seen[c]; dup {
+				log.Printf("WARN: Published record health (%s): %s duplicates %s", domain, term, first)
+				continue
+			}
+			seen[c] = term.String()
+			cidrs = append(cidrs, c)
+		}
+	}
+	// A redirect target is followed like an include when no all mechanism is present
+	if redirect != "" && !hasAll {
+		includes = append(includes, redirect)
+	}
+	return
+}
+
+// normalizeCIDR returns the canonical CIDR text of an ip4/ip6 mechanism value, checking
+// that the address family matches the mechanism. Bare IPs become /32 or /128.
+func normalizeCIDR(mechanism, value string) (string, error) {
+	if !strings.Contains(value, "/") {
+		if mechanism == "ip4" {
+			value += "/32"
+		} else {
+			value += "/128"
+		}
+	}
+	ip, ipnet, err := net.ParseCIDR(value)
+	if err != nil {
+		return "", err
+	}
+	if isV4 := ip.To4() != nil; isV4 != (mechanism == "ip4") {
+		return "", fmt.Errorf("address family does not match %s", mechanism)
+	}
+	return ipnet.String(), nil
+}
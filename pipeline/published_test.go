@@ -0,0 +1,308 @@
+package pipeline
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"project/spf-flattener/config"
+	"project/spf-flattener/dns/dnstest"
+	"project/spf-flattener/spf"
+)
+
+// captureLog redirects the log output to a buffer for the duration of the test.
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &buf
+}
+
+func TestCheckChain(t *testing.T) {
+	const wildcard = `*.example.com. 300 IN TXT "v=spf1 -all"` + "\n"
+	tests := []struct {
+		name  string
+		zone  string
+		want  []string
+		clean bool
+	}{
+		{
+			name:  "healthy chain under an SPF wildcard",
+			zone:  wildcard + chainZone,
+			clean: true,
+		},
+		{
+			name: "include answered only by the wildcard",
+			zone: wildcard + `
+_spf.example.com. 300 IN TXT "v=spf1 include:spf1.example.com include:spf2.example.com -all"
+spf1.example.com. 300 IN TXT "v=spf1 ip4:198.51.100.0/24 -all"
+`,
+			want: []string{"spf2.example.com is included but only the wildcard *.example.com answers it"},
+		},
+		{
+			name: "orphan",
+			zone: chainZone + `spf2.example.com. 300 IN TXT "v=spf1 ip4:203.0.113.0/24 -all"` + "\n",
+			want: []string{"spf2.example.com is published but not reachable"},
+		},
+		{
+			name:  "healthy chain",
+			zone:  chainZone,
+			clean: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLog(t)
+			p := newPipeline(t, "")
+			p.SetExchanger(dnstest.New(t, tt.zone))
+
+			done := make(chan struct{})
+			go func() {
+				checkChain(p.resolver, []string{"_spf.example.com"}, "example.com")
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("checkChain did not return")
+			}
+
+			out := logs.String()
+			for _, w := range tt.want {
+				if !strings.Contains(out, w) {
+					t.Errorf("log does not report %q:\n%s", w, out)
+				}
+			}
+			if tt.clean && strings.Contains(out, "chain break") {
+				t.Errorf("unexpected chain break:\n%s", out)
+			}
+		})
+	}
+}
+
+func TestParseSPFToCIDRsAndIncludesCase(t *testing.T) {
+	tests := []struct {
+		name, record, lower string
+	}{
+		{"uppercase", "V=SPF1 IP4:203.0.113.0/24 IP6:2001:DB8::/32 INCLUDE:relay.example.com -ALL", "v=spf1 ip4:203.0.113.0/24 ip6:2001:db8::/32 include:relay.example.com -all"},
+		{"mixed case", "v=Spf1 Ip4:192.0.2.1 ~IP4:198.51.100.0/24 Include:a.example.com Redirect=b.example.com", "v=spf1 ip4:192.0.2.1 ~ip4:198.51.100.0/24 include:a.example.com redirect=b.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			captureLog(t)
+			cache := spf.NewCache()
+			gotQ, wantQ := map[string]int{}, map[string]int{}
+			gotCIDRs, gotIncludes := parseSPFToCIDRsAndIncludes(cache, "example.com", tt.record, gotQ)
+			wantCIDRs, wantIncludes := parseSPFToCIDRsAndIncludes(cache, "example.com", tt.lower, wantQ)
+			if len(wantCIDRs) == 0 || len(wantIncludes) == 0 {
+				t.Fatalf("lowercase record %q gave no CIDRs or includes", tt.lower)
+			}
+			if !slices.Equal(gotCIDRs, wantCIDRs) || !slices.Equal(gotIncludes, wantIncludes) {
+				t.Errorf("got %v %v, want %v %v", gotCIDRs, gotIncludes, wantCIDRs, wantIncludes)
+			}
+			if !maps.Equal(gotQ, wantQ) {
+				t.Errorf("qualifiers = %v, want %v", gotQ, wantQ)
+			}
+		})
+	}
+}
+
+// TestParseSPFToCIDRsAndIncludesMessy runs published records as found in the wild:
+// mixed qualifiers, duplicates, terms after all and stray whitespace. Only the
+// pass-qualified networks and includes authorize senders.
+func TestParseSPFToCIDRsAndIncludesMessy(t *testing.T) {
+	tests := []struct {
+		name         string
+		record       string
+		wantCIDRs    []string
+		wantIncludes []string
+		wantQ        map[string]int
+		wantLog      []string
+	}{
+		{
+			"excluded networks",
+			"v=spf1 -ip4:192.0.2.66 ip4:192.0.2.0/24 ~ip4:198.51.100.0/24 ?ip6:2001:db8::/32 +ip6:2001:db8:1::/48 -all",
+			[]string{"192.0.2.0/24", "2001:db8:1::/48"},
+			nil,
+			map[string]int{"-": 1, "+": 2, "~": 1, "?": 1},
+			nil,
+		},
+		{
+			"excluded include",
+			"v=spf1 -include:blocked.example.net ~include:soft.example.net include:relay.example.net +include:plus.example.net ~all",
+			nil,
+			[]string{"relay.example.net", "plus.example.net"},
+			map[string]int{},
+			[]string{"-include:blocked.example.net does not authorize", "~include:soft.example.net does not authorize"},
+		},
+		{
+			"whitespace and duplicates",
+			"v=spf1   ip4:192.0.2.1\tip4:192.0.2.1/32  IP4:192.0.2.1   ~all  ",
+			[]string{"192.0.2.1/32"},
+			nil,
+			map[string]int{"+": 3},
+			[]string{"ip4:192.0.2.1/32 duplicates ip4:192.0.2.1", "ip4:192.0.2.1 duplicates ip4:192.0.2.1"},
+		},
+		{
+			"host bits and terms after all",
+			"v=spf1 ip4:192.0.2.77/24 -all ip4:203.0.113.0/24 include:late.example.net",
+			[]string{"192.0.2.0/24"},
+			nil,
+			map[string]int{"+": 1},
+			[]string{"ip4:203.0.113.0/24 after 'all' is ignored", "include:late.example.net after 'all' is ignored"},
+		},
+		{
+			"redirect followed without all",
+			"v=spf1 ~ip4:192.0.2.0/24 redirect=_spf.example.net",
+			nil,
+			[]string{"_spf.example.net"},
+			map[string]int{"~": 1},
+			nil,
+		},
+		{
+			"redirect ignored with all",
+			"v=spf1 ip4:192.0.2.0/24 redirect=_spf.example.net ?all",
+			[]string{"192.0.2.0/24"},
+			nil,
+			map[string]int{"+": 1},
+			nil,
+		},
+		{
+			"unparseable",
+			"v=spf1 ip4:192.0.2.0/24 ip4:192.0.2.256 -all",
+			nil,
+			nil,
+			map[string]int{},
+			[]string{"parse-error: invalid ip4 address"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLog(t)
+			q := map[string]int{}
+			cidrs, includes := parseSPFToCIDRsAndIncludes(spf.NewCache(), "example.com", tt.record, q)
+			if !slices.Equal(cidrs, tt.wantCIDRs) || !slices.Equal(includes, tt.wantIncludes) {
+				t.Errorf("got %v %v, want %v %v", cidrs, includes, tt.wantCIDRs, tt.wantIncludes)
+			}
+			if !maps.Equal(q, tt.wantQ) {
+				t.Errorf("qualifiers = %v, want %v", q, tt.wantQ)
+			}
+			for _, want := range tt.wantLog {
+				if !strings.Contains(logs.String(), want) {
+					t.Errorf("log does not mention %q:\n%s", want, logs.String())
+				}
+			}
+		})
+	}
+}
+
+// TestFetchPublishedConcatenated fetches a published record whose TXT RR holds two SPF
+// records as separate character-strings.
+func TestFetchPublishedConcatenated(t *testing.T) {
+	const zone = `
+_spf.example.com. 300 IN TXT "v=spf1 ip4:192.0.2.0/24 ~all" "v=spf1 ip4:198.51.100.0/24 -all"
+`
+	for _, strict := range []bool{false, true} {
+		t.Run(fmt.Sprintf("strict %v", strict), func(t *testing.T) {
+			logs := captureLog(t)
+			p := newPipeline(t, "", config.WithStrict(strict))
+			p.SetExchanger(dnstest.New(t, zone))
+			published := p.FetchPublished()
+			if len(published) != 1 {
+				t.Fatalf("FetchPublished() = %+v, want one entry point", published)
+			}
+			if strict {
+				if err := published[0].Err; err == nil || !strings.Contains(err.Error(), "multiple SPF strings concatenated in one TXT RR at _spf.example.com") {
+					t.Errorf("FetchPublished() error = %v, want the concatenation reported", err)
+				}
+				return
+			}
+			if want := []string{"192.0.2.0/24"}; published[0].Err != nil || !slices.Equal(published[0].CIDRs, want) {
+				t.Errorf("FetchPublished() = %+v, want only the CIDRs %v of the first record", published[0], want)
+			}
+			if !strings.Contains(logs.String(), "WARN: Multiple SPF strings concatenated in one TXT RR at _spf.example.com") {
+				t.Errorf("log does not report the concatenated record:\n%s", logs)
+			}
+		})
+	}
+}
+
+func TestCheckWildcards(t *testing.T) {
+	planned := []string{"_spf.example.com", "spf1.example.com", "spf2.example.com"}
+	tests := []struct {
+		name     string
+		zone     string
+		fail     string // name answering SERVFAIL
+		want     []string
+		wantNone bool
+	}{
+		{name: "no wildcard", zone: chainZone, wantNone: true},
+		{
+			name: "wildcard shadowing the unpublished names",
+			zone: `*.example.com. 300 IN TXT "google-site-verification=abc"` + "\n",
+			want: []string{
+				`_spf.example.com is shadowed by the wildcard *.example.com (["google-site-verification=abc"])`,
+				"spf1.example.com is shadowed by the wildcard *.example.com",
+				"spf2.example.com is shadowed by the wildcard *.example.com",
+			},
+		},
+		{
+			name: "wildcard next to published names",
+			zone: `*.example.com. 300 IN TXT "v=spf1 -all"` + "\n" + chainZone,
+			want: []string{
+				`*.example.com is a wildcard TXT record and _spf.example.com already has its own TXT record`,
+				`*.example.com is a wildcard TXT record and spf1.example.com already has its own TXT record`,
+				"spf2.example.com is shadowed by the wildcard *.example.com",
+			},
+		},
+		{name: "wildcard without TXT", zone: `*.example.com. 300 IN A 192.0.2.1` + "\n", wantNone: true},
+		{name: "wildcard under another parent", zone: `*.mail.example.com. 300 IN TXT "v=spf1 -all"` + "\n", wantNone: true},
+		{
+			name: "planned name failing",
+			zone: `*.example.com. 300 IN TXT "v=spf1 -all"` + "\n",
+			fail: "spf1.example.com",
+			want: []string{"Failed to look up planned record spf1.example.com"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLog(t)
+			z := dnstest.New(t, tt.zone)
+			if tt.fail != "" {
+				z.Fail(tt.fail, dns.RcodeServerFailure)
+			}
+			p := newPipeline(t, "")
+			p.SetExchanger(z)
+			checkWildcards(p.resolver, planned)
+
+			out := logs.String()
+			for _, w := range tt.want {
+				if !strings.Contains(out, w) {
+					t.Errorf("log does not report %q:\n%s", w, out)
+				}
+			}
+			if tt.wantNone && out != "" {
+				t.Errorf("unexpected findings:\n%s", out)
+			}
+			// The parent is probed once, with a label nobody publishes
+			probes := 0
+			for _, q := range z.Queries() {
+				if strings.HasPrefix(q, "_wildcard-probe-") && strings.HasSuffix(q, ".example.com TXT") {
+					probes++
+				}
+			}
+			if probes != 1 {
+				t.Errorf("queries = %v, want one wildcard probe", z.Queries())
+			}
+		})
+	}
+}
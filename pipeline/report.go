@@ -0,0 +1,127 @@
+// Fichier: pipeline/report.go (sortie JSON)
+
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"project/spf-flattener/cidr"
+	"project/spf-flattener/dns"
+	"project/spf-flattener/formatter"
+)
+
+// Report is the JSON document written instead of the zone lines with outputFormat: json.
+type Report struct {
+	// SchemaVersion is the SchemaVersion of the writer.
+	SchemaVersion int `json:"schemaVersion"`
+	// Domain is the domain the generated record names are built under.
+	Domain string `json:"domain"`
+	// Status is the outcome of the comparison with the published records (see Summary).
+	Status string `json:"status"`
+	// Lookups counts the SPF records we fetched, once each; VerifierLookups the lookups a
+	// verifier performs on the unflattened chain, counting an include every time it is
+	// reached, which is what the RFC limit applies to.
+	Lookups         int `json:"lookups"`
+	VerifierLookups int `json:"verifierLookups"`
+	MaxLookups      int `json:"maxLookups"`
+	// CIDRs are the final CIDRs, in output order.
+	CIDRs []ResolvedCIDR `json:"cidrs"`
+	// Passthrough holds the mechanisms kept verbatim.
+	Passthrough []string `json:"passthrough,omitempty"`
+	// Records are the generated TXT records, in chain order.
+	Records []ReportRecord `json:"records"`
+	// Published holds the comparison with every published entry point.
+	Published []PublishedDiff `json:"published,omitempty"`
+	// External lists the includes kept verbatim outside flattenOnlySuffixes.
+	External []dns.ExternalInclude `json:"external,omitempty"`
+	// ReceiverCost estimates what receivers pay to evaluate the generated records.
+	ReceiverCost dns.ReceiverCost `json:"receiverCost"`
+	// Timings is the timing breakdown of the run, the total last.
+	Timings []PhaseTiming `json:"timings,omitempty"`
+}
+
+// PhaseTiming is the duration of a phase of the run, in milliseconds.
+type PhaseTiming struct {
+	Name         string `json:"name"`
+	Milliseconds int64  `json:"ms"`
+}
+
+// ReportRecord is a generated TXT record with its fingerprint (see formatter.RecordHash)
+// and, for the records of the chain, its number of mechanisms.
+type ReportRecord struct {
+	formatter.TXTRecord
+	Hash       string `json:"hash"`
+	Mechanisms int    `json:"mechanisms,omitempty"`
+}
+
+// PublishedDiff compares the generated CIDRs with those published under an entry point.
+type PublishedDiff struct {
+	Name string `json:"name"`
+	// Missing are generated but not published, Extra published but not generated.
+	Missing []string `json:"missing,omitempty"`
+	Extra   []string `json:"extra,omitempty"`
+	// Error is set when the published records could not be fetched.
+	Error string `json:"error,omitempty"`
+	// Incomplete lists the records of our own chain that failed to resolve, in which case
+	// the comparison was not made.
+	Incomplete []string `json:"incomplete,omitempty"`
+}
+
+// writeReport writes the JSON report of the run to Out, with the phases timer measured
+// when it is not nil.
+func (p *Pipeline) writeReport(final cidr.NetAddrSlice, segments []string, timer *phaseTimer) error {
+	r := Report{
+		SchemaVersion:   SchemaVersion,
+		Domain:          p.cfg.TargetDomain,
+		Status:          p.summary.Status,
+		Lookups:         p.resolver.GetLookupCount(),
+		VerifierLookups: p.resolver.VerifierLookups(p.targetDomain),
+		MaxLookups:      p.cfg.MaxLookups,
+		CIDRs:           resolvedCIDRs(final),
+		Passthrough:     p.resolver.Passthrough(),
+		Published:       p.diffs,
+		External:        p.external,
+	}
+	r.ReceiverCost = p.cost
+	for i, rec := range p.records(segments) {
+		record := ReportRecord{TXTRecord: rec, Hash: formatter.RecordHash(rec.Value)}
+		if i < len(segments) {
+			record.Mechanisms = formatter.Mechanisms(rec.Value)
+		}
+		r.Records = append(r.Records, record)
+	}
+	if timer != nil {
+		r.Timings = timer.timings()
+	}
+
+	enc := json.NewEncoder(p.Out)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(r); err != nil {
+		return fmt.Errorf("ERROR: Cannot write the JSON report: %w", err)
+	}
+	return nil
+}
+
+// records returns the generated records with their owner names: the segments, then the
+// owner record when enabled.
+func (p *Pipeline) records(segments []string) []formatter.TXTRecord {
+	var records []formatter.TXTRecord
+	for i, segment := range segments {
+		records = append(records, formatter.TXTRecord{Name: formatter.RecordName(i, p.cfg.TargetDomain), Value: segment})
+	}
+	if p.cfg.OwnerRecord.Enabled && !p.adHoc {
+		records = append(records, formatter.TXTRecord{Name: "_spf-owner." + p.cfg.TargetDomain, Value: p.cfg.OwnerRecord.Value()})
+	}
+	return records
+}
+
+// recordValues maps the lowercased names of records to their values.
+func recordValues(records []formatter.TXTRecord) map[string]string {
+	values := make(map[string]string, len(records))
+	for _, rec := range records {
+		values[strings.ToLower(rec.Name)] = rec.Value
+	}
+	return values
+}
@@ -0,0 +1,46 @@
+// Fichier: pipeline/summary.go
+
+package pipeline
+
+import (
+	"fmt"
+	"time"
+)
+
+// Run outcomes reported in Summary.Status.
+const (
+	StatusOK         = "ok"         // the published records match the generated ones
+	StatusDrift      = "drift"      // the published records differ from the generated ones
+	StatusBootstrap  = "bootstrap"  // nothing is published yet at the entry points
+	StatusUnverified = "unverified" // the published records could not be fetched, or ad hoc run
+	StatusIncomplete = "incomplete" // a record of our own chain failed to resolve, not comparable
+	StatusError      = "error"      // the run failed
+)
+
+// Summary is the outcome of a run, for wrapper scripts. Its String form is the RESULT line
+// printed at the end of every run; the keys and their order are stable:
+//
+//	RESULT status=drift generated=412 published=398 missing=14 extra=0 lookups=8/10 segments=3 duration=12.4s receiverQueries=4 receiverBytes=1934
+//
+// published, missing and extra count CIDRs against the union of the entry points.
+type Summary struct {
+	Status     string
+	Generated  int
+	Published  int
+	Missing    int
+	Extra      int
+	Lookups    int
+	MaxLookups int
+	Segments   int
+	Duration   time.Duration
+	// ReceiverQueries and ReceiverBytes are the receiver cost of the generated records.
+	ReceiverQueries int
+	ReceiverBytes   int
+}
+
+// String formats the summary as the single RESULT line.
+func (s Summary) String() string {
+	return fmt.Sprintf("RESULT status=%s generated=%d published=%d missing=%d extra=%d lookups=%d/%d segments=%d duration=%.1fs receiverQueries=%d receiverBytes=%d",
+		s.Status, s.Generated, s.Published, s.Missing, s.Extra, s.Lookups, s.MaxLookups, s.Segments, s.Duration.Seconds(),
+		s.ReceiverQueries, s.ReceiverBytes)
+}
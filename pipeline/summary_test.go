@@ -0,0 +1,84 @@
+package pipeline
+
+import (
+	"context"
+	"io"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"project/spf-flattener/dns/dnstest"
+)
+
+// resultLine is the documented RESULT line format, keys in their stable order.
+var resultLine = regexp.MustCompile(`^RESULT status=(ok|drift|bootstrap|unverified|incomplete|error) generated=\d+ published=\d+ missing=\d+ extra=\d+ lookups=\d+/\d+ segments=\d+ duration=\d+\.\ds receiverQueries=\d+ receiverBytes=\d+$`)
+
+func TestSummaryString(t *testing.T) {
+	s := Summary{
+		Status: StatusDrift, Generated: 412, Published: 398, Missing: 14, Lookups: 8, MaxLookups: 10,
+		Segments: 3, Duration: 12436 * time.Millisecond, ReceiverQueries: 4, ReceiverBytes: 1934,
+	}
+	const want = "RESULT status=drift generated=412 published=398 missing=14 extra=0 lookups=8/10 segments=3 duration=12.4s receiverQueries=4 receiverBytes=1934"
+	if got := s.String(); got != want {
+		t.Errorf("String() =\n%s\nwant\n%s", got, want)
+	}
+	if !resultLine.MatchString(Summary{Status: StatusError}.String()) {
+		t.Errorf("zero summary %q does not match the RESULT format", Summary{Status: StatusError})
+	}
+}
+
+func TestSummaryOutcomes(t *testing.T) {
+	const source = `spf-unflat.example.com. 300 IN TXT "v=spf1 ip4:192.0.2.0/24 ip4:198.51.100.0/24 -all"` + "\n"
+	tests := []struct {
+		name string
+		zone string
+		fail string // name answering SERVFAIL
+		want Summary
+	}{
+		{
+			"success", source + `_spf.example.com. 300 IN TXT "v=spf1 ip4:192.0.2.0/24 ip4:198.51.100.0/24 -all"` + "\n", "",
+			Summary{Status: StatusOK, Generated: 2, Published: 2, Lookups: 1, MaxLookups: 10, Segments: 1},
+		},
+		{
+			"drift", source + `_spf.example.com. 300 IN TXT "v=spf1 ip4:192.0.2.0/24 ip4:203.0.113.0/24 -all"` + "\n", "",
+			Summary{Status: StatusDrift, Generated: 2, Published: 2, Missing: 1, Extra: 1, Lookups: 1, MaxLookups: 10, Segments: 1},
+		},
+		{
+			"bootstrap", source, "",
+			Summary{Status: StatusBootstrap, Generated: 2, Missing: 2, Lookups: 1, MaxLookups: 10, Segments: 1},
+		},
+		{
+			"error", source, "spf-unflat.example.com",
+			Summary{Status: StatusError, MaxLookups: 10},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			captureLog(t)
+			z := dnstest.New(t, tt.zone)
+			if tt.fail != "" {
+				z.Fail(tt.fail, dns.RcodeServerFailure)
+			}
+			p := newPipeline(t, "")
+			p.Out = io.Discard
+			p.SetExchanger(z)
+			err := p.Run(context.Background())
+			if (err != nil) != (tt.want.Status == StatusError) {
+				t.Fatalf("Run() error = %v", err)
+			}
+
+			got := p.Summary()
+			line := got.String()
+			if !resultLine.MatchString(line) {
+				t.Errorf("%q does not match the RESULT format", line)
+			}
+			// The duration and receiver cost vary with the run and the formatter
+			got.Duration, got.ReceiverQueries, got.ReceiverBytes = 0, 0, 0
+			if got != tt.want {
+				t.Errorf("Summary() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+// Fichier: pipeline/timing.go
+
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// BudgetError is returned when a run exceeds its maxRuntime budget. Phase names the phase
+// in progress, whose work is abandoned.
+type BudgetError struct {
+	Budget time.Duration
+	Phase  string
+}
+
+func (e *BudgetError) Error() string {
+	return fmt.Sprintf("MAX-RUNTIME: Run exceeded its %s budget during phase %q", e.Budget, e.Phase)
+}
+
+// phaseTiming records how long a phase of the run took.
+type phaseTiming struct {
+	name     string
+	duration time.Duration
+}
+
+// phaseTimer runs the phases of a run, measures them and enforces the runtime budget.
+type phaseTimer struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	budget time.Duration
+	start  time.Time
+	phases []phaseTiming
+	// abandoned is set when a phase was left running past the end of the context.
+	abandoned bool
+}
+
+// newPhaseTimer starts the run clock under ctx. A zero budget means no runtime limit.
+func newPhaseTimer(ctx context.Context, budget time.Duration) *phaseTimer {
+	var cancel context.CancelFunc
+	if budget > 0 {
+		ctx, cancel = context.WithTimeout(ctx, budget)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	return &phaseTimer{ctx: ctx, cancel: cancel, budget: budget, start: time.Now()}
+}
+
+// stop releases the run clock.
+func (t *phaseTimer) stop() {
+	t.cancel()
+}
+
+// run executes a phase and returns its error. When the run context ends first, the phase
+// is abandoned and run returns a *BudgetError if the budget expired, or the context error.
+func (t *phaseTimer) run(name string, fn func() error) error {
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+
+	select {
+	case err := <-done:
+		t.phases = append(t.phases, phaseTiming{name: name, duration: time.Since(start)})
+		return err
+	case <-t.ctx.Done():
+		t.abandoned = true
+		if t.budget > 0 && errors.Is(t.ctx.Err(), context.DeadlineExceeded) {
+			return &BudgetError{Budget: t.budget, Phase: name}
+		}
+		return t.ctx.Err()
+	}
+}
+
+// add records a duration measured across phases, such as the time spent in a shared step.
+func (t *phaseTimer) add(name string, d time.Duration) {
+	t.phases = append(t.phases, phaseTiming{name: name, duration: d})
+}
+
+// timings returns the durations of the completed phases, then the total, as the JSON
+// report holds them.
+func (t *phaseTimer) timings() []PhaseTiming {
+	var timings []PhaseTiming
+	for _, p := range t.phases {
+		timings = append(timings, PhaseTiming{Name: p.name, Milliseconds: p.duration.Milliseconds()})
+	}
+	return append(timings, PhaseTiming{Name: "total", Milliseconds: time.Since(t.start).Milliseconds()})
+}
+
+// report logs the timing breakdown of all completed phases.
+func (t *phaseTimer) report() {
+	log.Println("Timing Breakdown:")
+	for _, p := range t.phases {
+		log.Printf("  %-24s %s\n", p.name, p.duration.Round(time.Millisecond))
+	}
+	log.Printf("  %-24s %s\n", "total", time.Since(t.start).Round(time.Millisecond))
+}
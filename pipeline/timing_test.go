@@ -0,0 +1,116 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"project/spf-flattener/config"
+	"project/spf-flattener/dns/dnstest"
+)
+
+// slowZone answers from a zone after a delay.
+type slowZone struct {
+	*dnstest.Zone
+	delay time.Duration
+}
+
+func (z slowZone) Exchange(m *dns.Msg, server string) (*dns.Msg, error) {
+	time.Sleep(z.delay)
+	return z.Zone.Exchange(m, server)
+}
+
+func TestRunBudget(t *testing.T) {
+	const zone = `
+spf-unflat.example.com. 300 IN TXT "v=spf1 ip4:192.0.2.0/24 -all"
+_spf.example.com. 300 IN TXT "v=spf1 ip4:192.0.2.0/24 -all"
+`
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name      string
+		ctx       context.Context
+		budget    time.Duration
+		delay     time.Duration
+		wantPhase string
+		wantErr   error
+	}{
+		{"within budget", context.Background(), time.Minute, 0, "", nil},
+		{"no budget", context.Background(), 0, 0, "", nil},
+		{"budget exceeded", context.Background(), 20 * time.Millisecond, 300 * time.Millisecond, "main chain flatten", nil},
+		{"canceled", canceled, 0, 0, "", context.Canceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newPipeline(t, "", config.WithMaxRuntime(tt.budget))
+			p.Out = io.Discard
+			p.SetExchanger(slowZone{dnstest.New(t, zone), tt.delay})
+
+			start := time.Now()
+			err := p.Run(tt.ctx)
+			if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+				t.Errorf("Run() took %s, want it to return when the context ends", elapsed)
+			}
+			var budget *BudgetError
+			switch {
+			case tt.wantPhase != "":
+				if !errors.As(err, &budget) || budget.Phase != tt.wantPhase || budget.Budget != tt.budget {
+					t.Fatalf("Run() error = %v, want a *BudgetError in phase %q", err, tt.wantPhase)
+				}
+				if p.Summary().Status != StatusError {
+					t.Errorf("status = %s, want %s", p.Summary().Status, StatusError)
+				}
+				if _, err := p.resolver.LookupTXT("_spf.example.com"); err == nil {
+					t.Errorf("lookups of the abandoned run still reach the network")
+				}
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Run() error = %v, want %v", err, tt.wantErr)
+				}
+			default:
+				if err != nil {
+					t.Fatalf("Run() error = %v", err)
+				}
+				if _, err := p.resolver.LookupTXT("_spf.example.com"); err != nil {
+					t.Errorf("lookup after the run: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestReportTimings(t *testing.T) {
+	const zone = `spf-unflat.example.com. 300 IN TXT "v=spf1 ip4:192.0.2.0/24 -all"`
+	captureLog(t)
+	p := newPipeline(t, "")
+	p.cfg.OutputFormat = "json"
+	p.Offline = true
+	var out bytes.Buffer
+	p.Out = &out
+	p.SetExchanger(slowZone{dnstest.New(t, zone), 20 * time.Millisecond})
+	if err := p.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var report Report
+	if err := json.Unmarshal(out.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	ms := make(map[string]int64)
+	var names []string
+	for _, timing := range report.Timings {
+		ms[timing.Name] = timing.Milliseconds
+		names = append(names, timing.Name)
+	}
+	if len(names) == 0 || names[len(names)-1] != "total" {
+		t.Fatalf("timings = %v, want the phases then the total", report.Timings)
+	}
+	if ms["main chain flatten"] < 20 || ms["total"] < ms["main chain flatten"] {
+		t.Errorf("timings = %v, want the flatten phase to take the 20ms answer and the total more", report.Timings)
+	}
+}
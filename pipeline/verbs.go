@@ -0,0 +1,109 @@
+// Fichier: pipeline/verbs.go (verbes resolve et format)
+
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+
+	"project/spf-flattener/cidr"
+	"project/spf-flattener/formatter"
+)
+
+// SchemaVersion is the version of the JSON documents: the resolve document and the report.
+// It changes when a field changes meaning or is removed, not when one is added.
+const SchemaVersion = 1
+
+// Resolved is the JSON document written by the resolve verb and read by the format verb.
+// Users may filter or merge it between the two.
+type Resolved struct {
+	// SchemaVersion is the SchemaVersion of the writer, 0 for documents written before it.
+	SchemaVersion int `json:"schemaVersion"`
+	// Domain is the domain the generated record names are built under.
+	Domain string `json:"domain"`
+	// CIDRs are the final CIDRs, in output order.
+	CIDRs []ResolvedCIDR `json:"cidrs"`
+	// Passthrough holds the mechanisms kept verbatim.
+	Passthrough []string `json:"passthrough,omitempty"`
+}
+
+// ResolvedCIDR is a final CIDR with its provenance.
+type ResolvedCIDR struct {
+	CIDR          string `json:"cidr"`
+	Family        string `json:"family"`
+	Priority      bool   `json:"priority,omitempty"`
+	PriorityIndex int    `json:"priorityIndex,omitempty"`
+	Source        string `json:"source,omitempty"`
+}
+
+// Resolve runs the stages up to the final CIDRs under ctx and returns them as a Resolved
+// document.
+func (p *Pipeline) Resolve(ctx context.Context) (Resolved, error) {
+	timer := newPhaseTimer(ctx, p.cfg.MaxRuntime)
+	p.resolver.Context = timer.ctx
+	defer p.endRun(ctx, timer)
+
+	final, err := p.resolve(timer)
+	if err != nil {
+		return Resolved{}, err
+	}
+	return Resolved{SchemaVersion: SchemaVersion, Domain: p.cfg.TargetDomain, CIDRs: resolvedCIDRs(final), Passthrough: p.resolver.Passthrough()}, nil
+}
+
+// ReadResolved decodes a resolve document or a JSON report, which holds the same fields.
+// It rejects a document written with a SchemaVersion it does not know.
+func ReadResolved(in io.Reader) (Resolved, error) {
+	var doc Resolved
+	if err := json.NewDecoder(in).Decode(&doc); err != nil {
+		return doc, fmt.Errorf("failed to read resolved CIDRs: %w", err)
+	}
+	if doc.SchemaVersion != 0 && doc.SchemaVersion != SchemaVersion {
+		return doc, fmt.Errorf("document has schema version %d, this spf-flattener reads version %d", doc.SchemaVersion, SchemaVersion)
+	}
+	return doc, nil
+}
+
+// resolvedCIDRs returns the final CIDRs with their provenance.
+func resolvedCIDRs(final cidr.NetAddrSlice) []ResolvedCIDR {
+	var out []ResolvedCIDR
+	for _, n := range final {
+		c := ResolvedCIDR{CIDR: n.IPNet.String(), Family: n.Family(), Priority: n.IsPriority, Source: n.Source}
+		if n.IsPriority {
+			c.PriorityIndex = n.OriginalPriorityIndex
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// Format splits the CIDRs of a Resolved document into TXT record values of at most
+// maxLength bytes and maxMechanisms mechanisms (0 means no limit), whose generated
+// includes must fall within zone, with qualifier on every generated ip4/ip6 token. The
+// CIDRs are deduplicated and sorted again, so documents edited between the verbs produce
+// the same output as a full run would.
+func (doc Resolved) Format(maxLength, maxMechanisms int, zone, qualifier string) ([]string, error) {
+	var nets cidr.NetAddrSlice
+	for i, c := range doc.CIDRs {
+		_, ipNet, err := net.ParseCIDR(c.CIDR)
+		if err != nil {
+			return nil, fmt.Errorf("cidrs[%d]: %w", i, err)
+		}
+		nets = append(nets, &cidr.NetAddr{
+			IPNet:                 ipNet,
+			IsPriority:            c.Priority,
+			OriginalPriorityIndex: c.PriorityIndex,
+			Source:                c.Source,
+		})
+	}
+	segments, err := formatter.FormatSegments(cidr.DeduplicateAndSort(nets), doc.Passthrough, doc.Domain, maxLength, maxMechanisms, qualifier)
+	if err != nil {
+		return nil, err
+	}
+	if err := formatter.CheckIncludes(segments, doc.Passthrough, zone); err != nil {
+		return nil, err
+	}
+	return segments, nil
+}
@@ -0,0 +1,80 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"project/spf-flattener/config"
+	"project/spf-flattener/dns/dnstest"
+)
+
+// TestResolveFormatRoundTrip checks that resolve piped into format, through the JSON
+// document, prints the same records as a flatten run.
+func TestResolveFormatRoundTrip(t *testing.T) {
+	var many strings.Builder
+	for i := range 40 {
+		fmt.Fprintf(&many, " ip4:198.51.100.%d", i)
+	}
+	tests := []struct {
+		name string
+		zone string
+		opts []config.Option
+	}{
+		{"one record", `spf-unflat.example.com. 300 IN TXT "v=spf1 ip4:192.0.2.0/24 include:vendor.example.net -all"
+vendor.example.net. 300 IN TXT "v=spf1 ip4:203.0.113.0/24 ip6:2001:db8::/32 -all"
+`, nil},
+		{"chained segments", `spf-unflat.example.com. 300 IN TXT "v=spf1` + many.String() + ` -all"` + "\n", []config.Option{config.WithMaxTXTLength(200)}},
+		{"priority entries and passthrough", `spf-unflat.example.com. 300 IN TXT "v=spf1 ip4:192.0.2.0/24 exists:%{i}.rbl.example.com -all"
+mail.example.com. 300 IN A 203.0.113.7
+`, []config.Option{config.WithPriorityEntries("mail.example.com")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			captureLog(t)
+			// flatten
+			var flattened bytes.Buffer
+			p := newPipeline(t, "", tt.opts...)
+			p.Offline = true
+			p.Out = &flattened
+			p.SetExchanger(dnstest.New(t, tt.zone))
+			if err := p.Run(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			// resolve | format
+			p = newPipeline(t, "", tt.opts...)
+			p.SetExchanger(dnstest.New(t, tt.zone))
+			doc, err := p.Resolve(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var piped bytes.Buffer
+			if err := json.NewEncoder(&piped).Encode(doc); err != nil {
+				t.Fatal(err)
+			}
+			read, err := ReadResolved(&piped)
+			if err != nil {
+				t.Fatal(err)
+			}
+			segments, err := read.Format(p.cfg.MaxTXTLength, p.cfg.MaxMechanismsPerRecord, "example.com", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var formatted bytes.Buffer
+			if err := WriteRecords(&formatted, segments); err != nil {
+				t.Fatal(err)
+			}
+
+			if formatted.String() != flattened.String() {
+				t.Errorf("resolve | format =\n%s\nflatten =\n%s", formatted.String(), flattened.String())
+			}
+			if formatted.Len() == 0 {
+				t.Error("no records written")
+			}
+		})
+	}
+}
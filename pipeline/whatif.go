@@ -0,0 +1,136 @@
+// Fichier: pipeline/whatif.go (verbe whatif)
+
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// WhatIf is the impact of a proposed configuration relative to a baseline: a Resolved
+// document from an earlier run, or the published records. Nothing is ever published.
+type WhatIf struct {
+	// Baseline describes what the proposed records are compared with.
+	Baseline string `json:"baseline"`
+	// Added and Removed are the CIDRs the proposed configuration adds and removes.
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	// Segments and ReceiverLookups are given before and after the change. Before is -1
+	// when comparing with the published records, whose chain is not inspected.
+	Segments        Change `json:"segments"`
+	ReceiverLookups Change `json:"receiverLookups"`
+	// Lookups is the resolution lookup count of the proposed configuration.
+	Lookups    int `json:"lookups"`
+	MaxLookups int `json:"maxLookups"`
+}
+
+// Change is a count before and after a proposed change.
+type Change struct {
+	Before int `json:"before"`
+	After  int `json:"after"`
+}
+
+// WhatIf resolves and formats the configured records and compares them with baseline, or
+// with the records published at the configured entry points when baseline is nil.
+func (p *Pipeline) WhatIf(ctx context.Context, baseline *Resolved) (WhatIf, error) {
+	proposed, err := p.Resolve(ctx)
+	if err != nil {
+		return WhatIf{}, err
+	}
+	zone := p.cfg.Zone
+	if zone == "" {
+		zone = p.cfg.TargetDomain
+	}
+	segments, err := proposed.Format(p.cfg.MaxTXTLength, p.cfg.MaxMechanismsPerRecord, zone, p.cfg.MechanismQualifier)
+	if err != nil {
+		return WhatIf{}, err
+	}
+
+	w := WhatIf{
+		Segments:        Change{Before: -1, After: len(segments)},
+		ReceiverLookups: Change{Before: -1, After: len(segments) - 1 + len(proposed.Passthrough)},
+		Lookups:         p.resolver.GetLookupCount(),
+		MaxLookups:      p.cfg.MaxLookups,
+	}
+
+	var before []string
+	if baseline != nil {
+		w.Baseline = "baseline document for " + baseline.Domain
+		baseSegments, err := baseline.Format(p.cfg.MaxTXTLength, p.cfg.MaxMechanismsPerRecord, zone, p.cfg.MechanismQualifier)
+		if err != nil {
+			return WhatIf{}, fmt.Errorf("baseline: %w", err)
+		}
+		w.Segments.Before = len(baseSegments)
+		w.ReceiverLookups.Before = len(baseSegments) - 1 + len(baseline.Passthrough)
+		for _, c := range baseline.CIDRs {
+			before = append(before, c.CIDR)
+		}
+	} else {
+		var names []string
+		for _, published := range p.FetchPublished() {
+			if published.Err != nil {
+				return WhatIf{}, fmt.Errorf("failed to fetch published records at %s: %w", published.Name, published.Err)
+			}
+			if len(published.Incomplete) > 0 {
+				return WhatIf{}, fmt.Errorf("published records at %s are incomplete, %s failed to resolve",
+					published.Name, strings.Join(published.Incomplete, ", "))
+			}
+			names = append(names, published.Name)
+			before = append(before, published.CIDRs...)
+		}
+		w.Baseline = "published records at " + strings.Join(names, ", ")
+	}
+
+	var after []string
+	for _, c := range proposed.CIDRs {
+		after = append(after, c.CIDR)
+	}
+	w.Added, w.Removed = difference(after, before), difference(before, after)
+	return w, nil
+}
+
+// difference returns the sorted entries of a that are not in b.
+func difference(a, b []string) []string {
+	in := make(map[string]bool, len(b))
+	for _, s := range b {
+		in[s] = true
+	}
+	out := []string{}
+	for _, s := range a {
+		if !in[s] {
+			in[s] = true
+			out = append(out, s)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Write prints the impact in a human-readable form.
+func (w WhatIf) Write(out io.Writer) {
+	fmt.Fprintf(out, "Compared with %s:\n", w.Baseline)
+	for _, c := range w.Added {
+		fmt.Fprintf(out, "  + %s\n", c)
+	}
+	for _, c := range w.Removed {
+		fmt.Fprintf(out, "  - %s\n", c)
+	}
+	if len(w.Added) == 0 && len(w.Removed) == 0 {
+		fmt.Fprintln(out, "  no CIDR change")
+	}
+	fmt.Fprintf(out, "Segments: %s\n", w.Segments)
+	fmt.Fprintf(out, "Receiver lookups: %s\n", w.ReceiverLookups)
+	fmt.Fprintf(out, "Resolution lookups: %d / %d\n", w.Lookups, w.MaxLookups)
+}
+
+// String formats the change as "before -> after", or the new count alone when the
+// previous one is unknown.
+func (c Change) String() string {
+	if c.Before < 0 {
+		return fmt.Sprint(c.After)
+	}
+	return fmt.Sprintf("%d -> %d", c.Before, c.After)
+}
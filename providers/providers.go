@@ -0,0 +1,75 @@
+// Fichier: providers/providers.go
+
+package providers
+
+import (
+	_ "embed"
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+//go:embed providers.yaml
+var builtin []byte
+
+// Provider maps an include domain suffix to a well-known email provider.
+type Provider struct {
+	// Suffix is matched against include targets (exact match or subdomain).
+	Suffix string `yaml:"suffix"`
+	// Name is the provider's display name.
+	Name string `yaml:"name"`
+	// Guidance is the provider's documented advice about its SPF include.
+	Guidance string `yaml:"guidance"`
+	// AvoidFlattening is set when the provider explicitly warns against flattening.
+	AvoidFlattening bool `yaml:"avoidFlattening"`
+}
+
+// Registry holds the known providers.
+type Registry struct {
+	providers []Provider
+}
+
+// NewRegistry loads the built-in dataset, then applies extra entries on top of it.
+// An extra entry with the same suffix as a built-in one replaces it.
+func NewRegistry(extra []Provider) (*Registry, error) {
+	var list []Provider
+	if err := yaml.Unmarshal(builtin, &list); err != nil {
+		return nil, fmt.Errorf("failed to load built-in provider list: %w", err)
+	}
+
+	r := &Registry{}
+	for _, p := range append(list, extra...) {
+		p.Suffix = strings.ToLower(strings.TrimSuffix(p.Suffix, "."))
+		r.set(p)
+	}
+	return r, nil
+}
+
+// set adds or replaces the provider for p.Suffix.
+func (r *Registry) set(p Provider) {
+	for i := range r.providers {
+		if r.providers[i].Suffix == p.Suffix {
+			r.providers[i] = p
+			return
+		}
+	}
+	r.providers = append(r.providers, p)
+}
+
+// Match returns the provider whose suffix matches domain, preferring the longest suffix.
+func (r *Registry) Match(domain string) (Provider, bool) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	var best Provider
+	found := false
+	for _, p := range r.providers {
+		if domain != p.Suffix && !strings.HasSuffix(domain, "."+p.Suffix) {
+			continue
+		}
+		if !found || len(p.Suffix) > len(best.Suffix) {
+			best, found = p, true
+		}
+	}
+	return best, found
+}
@@ -0,0 +1,47 @@
+package providers
+
+import "testing"
+
+func TestMatch(t *testing.T) {
+	r, err := NewRegistry([]Provider{
+		{Suffix: "Example-Mail.NET.", Name: "Example Mail"},
+		{Suffix: "eu.mailgun.org", Name: "Mailgun EU"},
+		{Suffix: "sendgrid.net", Name: "SendGrid (override)"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		domain string
+		want   string // empty when no provider matches
+	}{
+		{"_spf.google.com", "Google Workspace"},
+		{"_netblocks.google.com", ""},
+		{"spf.protection.outlook.com", "Microsoft 365"},
+		{"eu.spf.protection.outlook.com", "Microsoft 365"},
+		{"SPF.Protection.Outlook.COM.", "Microsoft 365"},
+		{"mailgun.org", "Mailgun"},
+		{"us.mailgun.org", "Mailgun"},
+		// The longest suffix wins
+		{"eu.mailgun.org", "Mailgun EU"},
+		{"spf.eu.mailgun.org", "Mailgun EU"},
+		// Labels must match whole: no partial label match
+		{"notmailgun.org", ""},
+		{"mailgun.org.evil.example", ""},
+		{"xsendgrid.net", ""},
+		// Extra entries are normalized and replace built-in ones
+		{"u123.sendgrid.net", "SendGrid (override)"},
+		{"example-mail.net", "Example Mail"},
+		{"relay.example-mail.net.", "Example Mail"},
+		{"example.com", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.domain, func(t *testing.T) {
+			p, ok := r.Match(tt.domain)
+			if ok != (tt.want != "") || p.Name != tt.want {
+				t.Errorf("Match(%q) = %q, %v, want %q", tt.domain, p.Name, ok, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+// Fichier: publish/aws.go (identifiants et signature AWS)
+
+package publish
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// awsCreds are AWS access keys, with the session token of temporary credentials.
+type awsCreds struct {
+	AccessKeyID, SecretAccessKey, SessionToken string
+}
+
+// unsupportedProfileKeys are the shared config keys of credential sources other than
+// static keys, mapped to the source they select.
+var unsupportedProfileKeys = []struct{ key, source string }{
+	{"sso_session", "SSO"},
+	{"sso_start_url", "SSO"},
+	{"sso_account_id", "SSO"},
+	{"credential_process", "credential_process"},
+	{"role_arn", "assumed roles"},
+	{"web_identity_token_file", "web identity"},
+}
+
+// awsCredentials returns the static keys of the standard environment variables, or else
+// of the AWS_PROFILE (default "default") profile of the shared credentials and config
+// files. The rest of the AWS default chain (SSO, credential_process, assumed roles, web
+// identity, ECS and instance roles) is not supported: a configuration selecting one of
+// them is an error rather than a silent fallback to other keys.
+func awsCredentials() (awsCreds, error) {
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return awsCreds{id, os.Getenv("AWS_SECRET_ACCESS_KEY"), os.Getenv("AWS_SESSION_TOKEN")}, nil
+	}
+	for _, env := range []string{"AWS_WEB_IDENTITY_TOKEN_FILE", "AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "AWS_CONTAINER_CREDENTIALS_FULL_URI"} {
+		if os.Getenv(env) != "" {
+			return awsCreds{}, fmt.Errorf("%s is set, but only static AWS keys are supported: "+
+				"set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, e.g. from aws configure export-credentials", env)
+		}
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return awsCreds{}, err
+	}
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+	credsPath := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if credsPath == "" {
+		credsPath = filepath.Join(home, ".aws", "credentials")
+	}
+	configPath := os.Getenv("AWS_CONFIG_FILE")
+	if configPath == "" {
+		configPath = filepath.Join(home, ".aws", "config")
+	}
+
+	// The config file names its sections "profile <name>", except the default one
+	configSection := "profile " + profile
+	if profile == "default" {
+		configSection = profile
+	}
+	settings, err := readINISection(configPath, configSection)
+	if err != nil {
+		return awsCreds{}, err
+	}
+	keys, err := readINISection(credsPath, profile)
+	if err != nil {
+		return awsCreds{}, err
+	}
+	for key, value := range keys {
+		settings[key] = value
+	}
+	for _, u := range unsupportedProfileKeys {
+		if _, ok := settings[u.key]; ok {
+			return awsCreds{}, fmt.Errorf("AWS profile %s uses %s (%s), but only static AWS keys are supported: "+
+				"set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, e.g. from aws configure export-credentials", profile, u.source, u.key)
+		}
+	}
+
+	creds := awsCreds{settings["aws_access_key_id"], settings["aws_secret_access_key"], settings["aws_session_token"]}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return creds, fmt.Errorf("no static AWS keys: AWS_ACCESS_KEY_ID is not set and profile %s of %s has none "+
+			"(SSO, assumed roles and instance roles are not supported)", profile, credsPath)
+	}
+	return creds, nil
+}
+
+// readINISection returns the keys of section in the INI file at path. A missing file
+// has no keys.
+func readINISection(path, section string) (map[string]string, error) {
+	keys := make(map[string]string)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return keys, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	current := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			current = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if ok && current == section {
+			keys[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return keys, nil
+}
+
+// signV4 signs req with AWS Signature Version 4.
+func signV4(req *http.Request, body []byte, creds awsCreds, region, service string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	var names []string
+	for name := range req.Header {
+		names = append(names, strings.ToLower(name))
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, strings.TrimSpace(req.Header.Get(name)))
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method, path, req.URL.Query().Encode(), canonicalHeaders.String(), signedHeaders, payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	for _, part := range []string{region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,61 @@
+package publish
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAWSCredentials(t *testing.T) {
+	const static = "[default]\naws_access_key_id = AKIDEXAMPLE\naws_secret_access_key = secret\n"
+	tests := []struct {
+		name        string
+		env         map[string]string
+		credentials string
+		config      string
+		wantID      string
+		wantErr     string
+	}{
+		{"environment", map[string]string{"AWS_ACCESS_KEY_ID": "AKIDENV", "AWS_SECRET_ACCESS_KEY": "s"}, "", "", "AKIDENV", ""},
+		{"shared credentials", nil, static, "", "AKIDEXAMPLE", ""},
+		{"named profile", map[string]string{"AWS_PROFILE": "ops"}, "[ops]\naws_access_key_id = AKIDOPS\naws_secret_access_key = s\n", "", "AKIDOPS", ""},
+		{"keys in the config file", map[string]string{"AWS_PROFILE": "ops"}, "", "[profile ops]\naws_access_key_id = AKIDCFG\naws_secret_access_key = s\n", "AKIDCFG", ""},
+		{"no keys", nil, "", "", "", "no static AWS keys"},
+		{"SSO profile", nil, "", "[default]\nsso_session = corp\n", "", "uses SSO (sso_session)"},
+		{"credential process", nil, "", "[default]\ncredential_process = /bin/creds\n", "", "uses credential_process"},
+		{"assumed role over static keys", nil, static, "[default]\nrole_arn = arn:aws:iam::123456789012:role/dns\n", "", "uses assumed roles (role_arn)"},
+		{"web identity", map[string]string{"AWS_WEB_IDENTITY_TOKEN_FILE": "/var/run/token"}, static, "", "", "AWS_WEB_IDENTITY_TOKEN_FILE is set"},
+		{"ECS task role", map[string]string{"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI": "/v2/credentials"}, "", "", "", "AWS_CONTAINER_CREDENTIALS_RELATIVE_URI is set"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, env := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN", "AWS_PROFILE",
+				"AWS_WEB_IDENTITY_TOKEN_FILE", "AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "AWS_CONTAINER_CREDENTIALS_FULL_URI"} {
+				t.Setenv(env, tt.env[env])
+			}
+			t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "credentials"))
+			t.Setenv("AWS_CONFIG_FILE", filepath.Join(dir, "config"))
+			for name, content := range map[string]string{"credentials": tt.credentials, "config": tt.config} {
+				if content == "" {
+					continue
+				}
+				if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			creds, err := awsCredentials()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("awsCredentials() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || creds.AccessKeyID != tt.wantID {
+				t.Errorf("awsCredentials() = %q, %v, want %q", creds.AccessKeyID, err, tt.wantID)
+			}
+		})
+	}
+}
@@ -0,0 +1,343 @@
+// Fichier: publish/cloudflare.go (publication Cloudflare)
+
+package publish
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+
+	"project/spf-flattener/formatter"
+	"project/spf-flattener/spf"
+)
+
+// cloudflareEndpoint is the base URL of the Cloudflare v4 API.
+const cloudflareEndpoint = "https://api.cloudflare.com/client/v4"
+
+// cloudflareMaxContent is the longest TXT content Cloudflare accepts, quotes included.
+// It is shorter than what DNS allows, so it is checked before anything is changed.
+const cloudflareMaxContent = 2048
+
+// chainedName matches the names of our chained records, spfN.<domain>.
+var chainedName = regexp.MustCompile(`^spf[0-9]+\.`)
+
+// Cloudflare publishes to a Cloudflare zone. The API has no atomic batch, so records are
+// changed one by one: the tail of the chain first, the entry record next and the stale
+// records last, so that a record is never referenced before it exists. Only the listing
+// pages and the deletions, which nothing depends on, are sent Workers at a time.
+type Cloudflare struct {
+	// ZoneID is the zone identifier shown on the zone overview page.
+	ZoneID string
+	// Token is an API token with the Zone.DNS edit permission.
+	Token string
+	// Client sends the API requests; nil uses http.DefaultClient.
+	Client *http.Client
+	// Workers bounds the API calls in flight (concurrency.publishOps).
+	Workers int
+}
+
+// cloudflareRecord is a DNS record as listed, created and updated by the API.
+type cloudflareRecord struct {
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Content string `json:"content"`
+	TTL     int    `json:"ttl"`
+}
+
+// cloudflareOp is a create, update or delete call of the API.
+type cloudflareOp struct {
+	action string
+	record cloudflareRecord
+	// was is the content an update replaces.
+	was string
+}
+
+func (op cloudflareOp) String() string {
+	switch op.action {
+	case "create":
+		return fmt.Sprintf("create %s TXT %s", op.record.Name, op.record.Content)
+	case "update":
+		return fmt.Sprintf("update %s TXT (id %s) %s, was %s", op.record.Name, op.record.ID, op.record.Content, op.was)
+	}
+	return fmt.Sprintf("delete %s TXT (id %s) %s", op.record.Name, op.record.ID, op.record.Content)
+}
+
+// Publish lists the TXT records of the zone and creates, updates and deletes records so
+// that they match records. The records to delete are stale and any other SPF record
+// listed at the names of records or at a chained name of the domain, since a name with
+// two SPF records fails evaluation. In dry-run mode the
+// operations are written to w instead of being executed.
+func (c *Cloudflare) Publish(w io.Writer, records, stale []formatter.TXTRecord, dryRun bool) error {
+	if c.Token == "" {
+		return fmt.Errorf("cloudflare: no API token: set publish.apiToken or CLOUDFLARE_API_TOKEN")
+	}
+	existing, err := c.list()
+	if err != nil {
+		return err
+	}
+	ops, err := c.plan(records, stale, existing)
+	if err != nil {
+		return err
+	}
+
+	if dryRun {
+		if len(ops) == 0 {
+			fmt.Fprintln(w, "no change")
+		}
+		for _, op := range ops {
+			fmt.Fprintln(w, op)
+		}
+		return nil
+	}
+
+	var done []string
+	failed := func(op cloudflareOp, err error) error {
+		if len(done) == 0 {
+			return fmt.Errorf("cloudflare: %s: %w (no record was changed)", op, err)
+		}
+		return fmt.Errorf("cloudflare: %s: %w; the chain may be half-updated, already applied: %s; run again to converge",
+			op, err, strings.Join(done, "; "))
+	}
+	// The deletions come last in the plan
+	first := slices.IndexFunc(ops, func(op cloudflareOp) bool { return op.action == "delete" })
+	if first < 0 {
+		first = len(ops)
+	}
+	for _, op := range ops[:first] {
+		if err := c.apply(op); err != nil {
+			return failed(op, err)
+		}
+		log.Printf("INFO: Cloudflare: %s", op)
+		done = append(done, op.action+" "+op.record.Name)
+	}
+	deletes := ops[first:]
+	errs, peak := forEach(len(deletes), c.Workers, func(i int) error { return c.apply(deletes[i]) })
+	for i, op := range deletes {
+		if errs[i] == nil {
+			log.Printf("INFO: Cloudflare: %s", op)
+			done = append(done, op.action+" "+op.record.Name)
+		}
+	}
+	for i, op := range deletes {
+		if errs[i] != nil {
+			return failed(op, errs[i])
+		}
+	}
+	if len(deletes) > 0 {
+		log.Printf("INFO: Cloudflare: %d records deleted, peak %d / %d calls in flight", len(deletes), peak, max(c.Workers, 1))
+	}
+	log.Printf("INFO: Cloudflare zone %s updated: %d changes", c.ZoneID, len(ops))
+	return nil
+}
+
+// plan computes the operations turning existing into records, in the order they must be
+// applied.
+func (c *Cloudflare) plan(records, stale []formatter.TXTRecord, existing []cloudflareRecord) ([]cloudflareOp, error) {
+	byName := make(map[string][]cloudflareRecord)
+	for _, e := range existing {
+		byName[strings.ToLower(e.Name)] = append(byName[strings.ToLower(e.Name)], e)
+	}
+
+	var ops []cloudflareOp
+	wanted := make(map[string]bool)
+	kept := make(map[string]bool)
+	for _, rec := range slices.Backward(records) {
+		content, err := formatter.QuoteTXT(rec.Value)
+		if err != nil {
+			return nil, fmt.Errorf("cannot encode record %s: %w", rec.Name, err)
+		}
+		if len(content) > cloudflareMaxContent {
+			return nil, fmt.Errorf("record %s is %d characters long, Cloudflare accepts at most %d: lower maxTXTLength",
+				rec.Name, len(content), cloudflareMaxContent)
+		}
+		name := strings.ToLower(strings.TrimSuffix(rec.Name, "."))
+		wanted[name] = true
+		want := cloudflareRecord{Type: "TXT", Name: name, Content: content, TTL: formatter.DefaultTTL}
+
+		// The record to update is the one of the same kind, SPF or not, at the name:
+		// other TXT records sharing the name are left alone.
+		var match *cloudflareRecord
+		unchanged := false
+		for i, e := range byName[name] {
+			value := txtValue(e.Content)
+			if value == rec.Value {
+				unchanged = true
+				kept[e.ID] = true
+				break
+			}
+			if match == nil && spf.IsSPF(value) == spf.IsSPF(rec.Value) {
+				match = &byName[name][i]
+			}
+		}
+		switch {
+		case unchanged:
+		case match == nil:
+			ops = append(ops, cloudflareOp{action: "create", record: want})
+		default:
+			kept[match.ID] = true
+			want.ID = match.ID
+			ops = append(ops, cloudflareOp{action: "update", record: want, was: match.Content})
+		}
+	}
+
+	domain := ""
+	if len(records) > 0 {
+		_, domain, _ = strings.Cut(strings.ToLower(strings.TrimSuffix(records[0].Name, ".")), ".")
+	}
+	obsolete := make(map[string]bool)
+	for _, rec := range stale {
+		obsolete[strings.ToLower(strings.TrimSuffix(rec.Name, "."))] = true
+	}
+	for _, e := range existing {
+		name := strings.ToLower(e.Name)
+		chained := chainedName.MatchString(name) && strings.TrimPrefix(name, chainedName.FindString(name)) == domain
+		if kept[e.ID] || !(wanted[name] || obsolete[name] || chained) || !spf.IsSPF(txtValue(e.Content)) {
+			continue
+		}
+		ops = append(ops, cloudflareOp{action: "delete", record: e})
+	}
+	return ops, nil
+}
+
+// txtValue returns the value of TXT content listed by the API, which quotes it and splits
+// it in character-strings of at most 255 bytes, or returns it verbatim.
+func txtValue(content string) string {
+	if !strings.HasPrefix(content, `"`) {
+		return content
+	}
+	var b strings.Builder
+	quoted := false
+	for i := 0; i < len(content); i++ {
+		ch := content[i]
+		switch {
+		case ch == '"':
+			quoted = !quoted
+		case ch == '\\' && quoted && i+1 < len(content):
+			i++
+			b.WriteByte(content[i])
+		case quoted:
+			b.WriteByte(ch)
+		}
+	}
+	return b.String()
+}
+
+// list returns the TXT records of the zone, following the pagination of the API: the
+// first page gives the number of pages, the others are fetched Workers at a time.
+func (c *Cloudflare) list() ([]cloudflareRecord, error) {
+	get := func(page int) ([]cloudflareRecord, resultInfo, error) {
+		query := url.Values{"type": {"TXT"}, "per_page": {"100"}, "page": {fmt.Sprint(page)}}
+		var result []cloudflareRecord
+		info, err := c.call(http.MethodGet, "/dns_records?"+query.Encode(), nil, &result)
+		if err != nil {
+			return nil, info, fmt.Errorf("cloudflare: cannot list the records of zone %s: %w", c.ZoneID, err)
+		}
+		return result, info, nil
+	}
+	records, info, err := get(1)
+	if err != nil {
+		return nil, err
+	}
+	pages := make([][]cloudflareRecord, max(info.TotalPages-1, 0))
+	errs, _ := forEach(len(pages), c.Workers, func(i int) error {
+		var err error
+		pages[i], _, err = get(i + 2)
+		return err
+	})
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	for _, page := range pages {
+		records = append(records, page...)
+	}
+	return records, nil
+}
+
+// apply executes an operation.
+func (c *Cloudflare) apply(op cloudflareOp) error {
+	switch op.action {
+	case "create":
+		_, err := c.call(http.MethodPost, "/dns_records", op.record, nil)
+		return err
+	case "update":
+		body := op.record
+		body.ID = ""
+		_, err := c.call(http.MethodPatch, "/dns_records/"+op.record.ID, body, nil)
+		return err
+	}
+	_, err := c.call(http.MethodDelete, "/dns_records/"+op.record.ID, nil, nil)
+	return err
+}
+
+// resultInfo is the pagination of a list call.
+type resultInfo struct {
+	Page       int `json:"page"`
+	TotalPages int `json:"total_pages"`
+}
+
+// call sends a request to path under the zone and decodes the result of the response
+// envelope into result, if not nil.
+func (c *Cloudflare) call(method, path string, body, result any) (resultInfo, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return resultInfo{}, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, cloudflareEndpoint+"/zones/"+url.PathEscape(c.ZoneID)+path, reader)
+	if err != nil {
+		return resultInfo{}, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return resultInfo{}, err
+	}
+	defer resp.Body.Close()
+
+	var envelope struct {
+		Success bool `json:"success"`
+		Errors  []struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+		Result     json.RawMessage `json:"result"`
+		ResultInfo resultInfo      `json:"result_info"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return resultInfo{}, fmt.Errorf("%s: %w", resp.Status, err)
+	}
+	if !envelope.Success {
+		var msgs []string
+		for _, e := range envelope.Errors {
+			msgs = append(msgs, fmt.Sprintf("%d %s", e.Code, e.Message))
+		}
+		if len(msgs) == 0 {
+			msgs = append(msgs, resp.Status)
+		}
+		return resultInfo{}, fmt.Errorf("%s", strings.Join(msgs, "; "))
+	}
+	if result != nil {
+		if err := json.Unmarshal(envelope.Result, result); err != nil {
+			return resultInfo{}, err
+		}
+	}
+	return envelope.ResultInfo, nil
+}
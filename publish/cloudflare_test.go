@@ -0,0 +1,240 @@
+package publish
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"project/spf-flattener/formatter"
+)
+
+// fakeCloudflare serves the DNS records API of zone Z1 from records, perPage records per
+// listing page, and logs every call. The mutation numbered failAt (from 1) fails.
+type fakeCloudflare struct {
+	mu      sync.Mutex
+	t       *testing.T
+	records []cloudflareRecord
+	perPage int
+	failAt  int
+	calls   []string
+	changes int
+}
+
+func (f *fakeCloudflare) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if req.Header.Get("Authorization") != "Bearer token" {
+		f.t.Errorf("%s %s: Authorization = %q", req.Method, req.URL, req.Header.Get("Authorization"))
+	}
+	path, ok := strings.CutPrefix(req.URL.Path, "/client/v4/zones/Z1/dns_records")
+	if !ok {
+		f.t.Errorf("path = %s", req.URL.Path)
+	}
+	id := strings.TrimPrefix(path, "/")
+	if req.Method == http.MethodGet {
+		page, _ := strconv.Atoi(req.URL.Query().Get("page"))
+		f.calls = append(f.calls, fmt.Sprintf("list page %d", page))
+		start, end := min((page-1)*f.perPage, len(f.records)), min(page*f.perPage, len(f.records))
+		json.NewEncoder(w).Encode(map[string]any{
+			"success":     true,
+			"result":      f.records[start:end],
+			"result_info": resultInfo{Page: page, TotalPages: (len(f.records) + f.perPage - 1) / f.perPage},
+		})
+		return
+	}
+
+	var body cloudflareRecord
+	if req.Method != http.MethodDelete {
+		data, _ := io.ReadAll(req.Body)
+		if err := json.Unmarshal(data, &body); err != nil {
+			f.t.Errorf("%s body: %v", req.Method, err)
+		}
+	}
+	f.changes++
+	switch req.Method {
+	case http.MethodPost:
+		f.calls = append(f.calls, "create "+body.Name)
+	case http.MethodPatch:
+		f.calls = append(f.calls, "update "+id)
+	case http.MethodDelete:
+		f.calls = append(f.calls, "delete "+id)
+	}
+	if f.changes == f.failAt {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"success":false,"errors":[{"code":81058,"message":"An identical record already exists."}]}`)
+		return
+	}
+	fmt.Fprint(w, `{"success":true,"result":{}}`)
+}
+
+// newFakeCloudflare returns a Cloudflare publisher talking to f.
+func newFakeCloudflare(t *testing.T, f *fakeCloudflare) *Cloudflare {
+	f.t = t
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	target, _ := url.Parse(srv.URL)
+	return &Cloudflare{ZoneID: "Z1", Token: "token", Client: &http.Client{Transport: redirect{target}}}
+}
+
+func TestCloudflareListPages(t *testing.T) {
+	for _, n := range []int{0, 1, 3, 4, 7} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			f := &fakeCloudflare{perPage: 3}
+			for i := range n {
+				f.records = append(f.records, cloudflareRecord{ID: fmt.Sprint(i), Type: "TXT", Name: fmt.Sprintf("r%d.example.com", i), Content: `"x"`})
+			}
+			c := newFakeCloudflare(t, f)
+			got, err := c.list()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, f.records) {
+				t.Errorf("list() = %v, want %v", got, f.records)
+			}
+			if pages := max(1, (n+2)/3); len(f.calls) != pages {
+				t.Errorf("calls = %v, want %d pages", f.calls, pages)
+			}
+		})
+	}
+}
+
+func TestCloudflareMaxContent(t *testing.T) {
+	tests := []struct {
+		name    string
+		length  int
+		wantErr bool
+	}{
+		// The content is split in 8 quoted character-strings joined by spaces: 23 more bytes
+		{"under", 2000, false},
+		{"at the limit", 2048 - 23, false},
+		{"over", 2048 - 23 + 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeCloudflare{perPage: 100}
+			c := newFakeCloudflare(t, f)
+			value := "v=spf1 " + strings.Repeat("a", tt.length-len("v=spf1 "))
+			records := []formatter.TXTRecord{{Name: "_spf.example.com", Value: value}}
+			err := c.Publish(io.Discard, records, nil, false)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Publish() error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr && f.changes > 0 {
+				t.Errorf("calls = %v, want nothing changed", f.calls)
+			}
+		})
+	}
+}
+
+// chainRecords is a three-record chain of example.com.
+var chainRecords = []formatter.TXTRecord{
+	{Name: "_spf.example.com", Value: "v=spf1 ip4:192.0.2.0/24 include:spf1.example.com"},
+	{Name: "spf1.example.com", Value: "v=spf1 ip4:198.51.100.0/24 include:spf2.example.com"},
+	{Name: "spf2.example.com", Value: "v=spf1 ip6:2001:db8::/32 ~all"},
+}
+
+func TestCloudflarePlanOrder(t *testing.T) {
+	existing := []cloudflareRecord{
+		{ID: "e0", Type: "TXT", Name: "_spf.example.com", Content: `"v=spf1 ip4:203.0.113.0/24 include:spf1.example.com"`},
+		{ID: "e1", Type: "TXT", Name: "spf1.example.com", Content: `"v=spf1 ip4:198.51.100.0/24 include:spf2.example.com"`},
+		{ID: "v1", Type: "TXT", Name: "spf1.example.com", Content: `"site-verification=abc"`},
+		{ID: "d1", Type: "TXT", Name: "spf1.example.com", Content: `"v=spf1 -all"`},
+		{ID: "e3", Type: "TXT", Name: "spf3.example.com", Content: `"v=spf1 ~all"`},
+		{ID: "e4", Type: "TXT", Name: "spf4.example.com", Content: `"v=spf1 ~all"`},
+		{ID: "o1", Type: "TXT", Name: "spf1.example.org", Content: `"v=spf1 -all"`},
+	}
+	stale := []formatter.TXTRecord{{Name: "spf3.example.com", Value: "v=spf1 ~all"}}
+	c := &Cloudflare{ZoneID: "Z1"}
+	ops, err := c.plan(chainRecords, stale, existing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, op := range ops {
+		got = append(got, op.action+" "+op.record.Name+" "+op.record.ID)
+	}
+	// The tail first, the entry record next, deletes last; spf1 is unchanged, its
+	// duplicate SPF record and the chained spf4 left by an older chain are deleted.
+	want := []string{
+		"create spf2.example.com ",
+		"update _spf.example.com e0",
+		"delete spf1.example.com d1",
+		"delete spf3.example.com e3",
+		"delete spf4.example.com e4",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("plan =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestCloudflareHalfUpdated(t *testing.T) {
+	tests := []struct {
+		name   string
+		failAt int
+		want   []string
+	}{
+		{"first call", 1, []string{"(no record was changed)"}},
+		{"third call", 3, []string{"half-updated", "already applied: create spf2.example.com; update spf1.example.com;", "run again to converge"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeCloudflare{perPage: 100, failAt: tt.failAt, records: []cloudflareRecord{
+				{ID: "e0", Type: "TXT", Name: "_spf.example.com", Content: `"v=spf1 -all"`},
+				{ID: "e1", Type: "TXT", Name: "spf1.example.com", Content: `"v=spf1 -all"`},
+				{ID: "e3", Type: "TXT", Name: "spf3.example.com", Content: `"v=spf1 ~all"`},
+			}}
+			c := newFakeCloudflare(t, f)
+			err := c.Publish(io.Discard, chainRecords, nil, false)
+			if err == nil {
+				t.Fatal("Publish() succeeded, want an error")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Publish() error = %v, want it to contain %q", err, want)
+				}
+			}
+			// Nothing is attempted after the failure
+			if f.changes != tt.failAt {
+				t.Errorf("calls = %v, want %d changes", f.calls, tt.failAt)
+			}
+		})
+	}
+}
+
+func TestCloudflareWorkers(t *testing.T) {
+	f := &fakeCloudflare{perPage: 2}
+	for i := range 9 {
+		f.records = append(f.records, cloudflareRecord{ID: fmt.Sprintf("old%d", i), Type: "TXT", Name: fmt.Sprintf("spf%d.example.com", i+1), Content: `"v=spf1 -all"`})
+	}
+	c := newFakeCloudflare(t, f)
+	c.Workers = 3
+	if err := c.Publish(io.Discard, chainRecords[2:], nil, false); err != nil {
+		t.Fatal(err)
+	}
+	// spf2 is updated in place, the other eight chained records are deleted
+	var lists, updates, deletes []string
+	for _, call := range f.calls {
+		switch {
+		case strings.HasPrefix(call, "list"):
+			lists = append(lists, call)
+		case strings.HasPrefix(call, "update"):
+			if len(deletes) > 0 {
+				t.Errorf("calls = %v, want the update before the deletions", f.calls)
+			}
+			updates = append(updates, call)
+		case strings.HasPrefix(call, "delete"):
+			deletes = append(deletes, call)
+		}
+	}
+	if len(lists) != 5 || len(updates) != 1 || len(deletes) != 8 {
+		t.Errorf("calls = %v, want 5 pages listed, 1 update and 8 deletions", f.calls)
+	}
+}
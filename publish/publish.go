@@ -0,0 +1,39 @@
+// Fichier: publish/publish.go (publication des enregistrements)
+
+// Package publish pushes the generated records to the API of a DNS provider.
+package publish
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"project/spf-flattener/config"
+	"project/spf-flattener/formatter"
+)
+
+// Publisher pushes the generated records to a DNS provider.
+type Publisher interface {
+	// Publish creates or updates records and deletes stale, the records left over from a
+	// previous, longer chain. With dryRun it writes the changes it would make to w
+	// without calling the provider.
+	Publish(w io.Writer, records, stale []formatter.TXTRecord, dryRun bool) error
+}
+
+// New returns the publisher of the configured provider, sending at most workers API calls
+// at once.
+func New(cfg config.Publish, workers int) (Publisher, error) {
+	switch cfg.Provider {
+	case "route53":
+		return &Route53{ZoneID: cfg.ZoneID, Workers: workers}, nil
+	case "cloudflare":
+		token := cfg.APIToken
+		if token == "" {
+			token = os.Getenv("CLOUDFLARE_API_TOKEN")
+		}
+		return &Cloudflare{ZoneID: cfg.ZoneID, Token: token, Workers: workers}, nil
+	case "":
+		return nil, fmt.Errorf("no publish.provider configured")
+	}
+	return nil, fmt.Errorf("unknown publish provider %q", cfg.Provider)
+}
@@ -0,0 +1,252 @@
+// Fichier: publish/route53.go (publication Route53)
+
+package publish
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"project/spf-flattener/formatter"
+	"project/spf-flattener/spf"
+)
+
+// route53Endpoint is the global endpoint of the Route53 API, signed for us-east-1.
+const route53Endpoint = "https://route53.amazonaws.com/2013-04-01"
+
+// Route53 publishes to an AWS Route53 hosted zone with a single ChangeResourceRecordSets
+// call, which Route53 applies atomically: either every record changes or none does.
+type Route53 struct {
+	// ZoneID is the hosted zone ID, with or without the /hostedzone/ prefix.
+	ZoneID string
+	// Client sends the API requests; nil uses http.DefaultClient.
+	Client *http.Client
+	// Workers bounds the record sets read back at once (concurrency.publishOps).
+	Workers int
+}
+
+// changeBatch is the ChangeBatch of a ChangeResourceRecordSets request. The JSON form is
+// the one the AWS CLI takes with --change-batch, the XML form the one the API takes.
+type changeBatch struct {
+	Comment string   `json:"Comment" xml:"Comment"`
+	Changes []change `json:"Changes" xml:"Changes>Change"`
+}
+
+type change struct {
+	Action            string            `json:"Action" xml:"Action"`
+	ResourceRecordSet resourceRecordSet `json:"ResourceRecordSet" xml:"ResourceRecordSet"`
+}
+
+type resourceRecordSet struct {
+	Name            string           `json:"Name" xml:"Name"`
+	Type            string           `json:"Type" xml:"Type"`
+	TTL             int              `json:"TTL" xml:"TTL"`
+	ResourceRecords []resourceRecord `json:"ResourceRecords" xml:"ResourceRecords>ResourceRecord"`
+}
+
+type resourceRecord struct {
+	Value string `json:"Value" xml:"Value"`
+}
+
+// changeRequest is the XML body of ChangeResourceRecordSets.
+type changeRequest struct {
+	XMLName     xml.Name    `xml:"https://route53.amazonaws.com/doc/2013-04-01/ ChangeResourceRecordSetsRequest"`
+	ChangeBatch changeBatch `xml:"ChangeBatch"`
+}
+
+// listResponse is the XML body returned by ListResourceRecordSets.
+type listResponse struct {
+	RecordSets []resourceRecordSet `xml:"ResourceRecordSets>ResourceRecordSet"`
+}
+
+// batch builds the ChangeBatch: an UPSERT per record, then a change per stale name.
+// An UPSERT replaces the whole record set, so the non-SPF values live holds for the name
+// of a record are upserted along with it. Route53 only deletes a record set whose TTL and
+// values match exactly, so a stale set is deleted as live holds it, read back from the
+// hosted zone. Its non-SPF values are kept with an UPSERT instead. A stale name absent
+// from live is left alone.
+func (r *Route53) batch(records, stale []formatter.TXTRecord, live map[string]resourceRecordSet) (changeBatch, error) {
+	b := changeBatch{Comment: fmt.Sprintf("spf-flattener %s", time.Now().UTC().Format(time.RFC3339))}
+	for _, rec := range records {
+		value, err := formatter.QuoteTXT(rec.Value)
+		if err != nil {
+			return b, fmt.Errorf("cannot encode record %s: %w", rec.Name, err)
+		}
+		name := route53Name(rec.Name)
+		b.Changes = append(b.Changes, change{Action: "UPSERT", ResourceRecordSet: resourceRecordSet{
+			Name:            name,
+			Type:            "TXT",
+			TTL:             formatter.DefaultTTL,
+			ResourceRecords: append(nonSPF(live[name]), resourceRecord{Value: value}),
+		}})
+	}
+
+	done := make(map[string]bool)
+	for _, rec := range stale {
+		name := route53Name(rec.Name)
+		if done[name] {
+			continue
+		}
+		done[name] = true
+		set, ok := live[name]
+		if !ok {
+			log.Printf("WARN: %s has no TXT record set in hosted zone %s, nothing to delete", rec.Name, r.ZoneID)
+			continue
+		}
+		kept := nonSPF(set)
+		if len(kept) == 0 {
+			b.Changes = append(b.Changes, change{Action: "DELETE", ResourceRecordSet: set})
+			continue
+		}
+		set.ResourceRecords = kept
+		b.Changes = append(b.Changes, change{Action: "UPSERT", ResourceRecordSet: set})
+	}
+	return b, nil
+}
+
+// nonSPF returns the values of set that are not SPF records.
+func nonSPF(set resourceRecordSet) []resourceRecord {
+	var kept []resourceRecord
+	for _, rr := range set.ResourceRecords {
+		if text, err := formatter.UnquoteTXT(rr.Value); err != nil || !spf.IsSPF(strings.TrimSpace(text)) {
+			kept = append(kept, rr)
+		}
+	}
+	return kept
+}
+
+// route53Name returns name fully qualified, as Route53 writes record names.
+func route53Name(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, ".")) + "."
+}
+
+// recordSets reads back the TXT record sets of the names of records with
+// ListResourceRecordSets, Workers at a time, keyed by their Route53 name.
+func (r *Route53) recordSets(creds awsCreds, records []formatter.TXTRecord) (map[string]resourceRecordSet, error) {
+	var names []string
+	for _, rec := range records {
+		if name := route53Name(rec.Name); !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	found := make([]*resourceRecordSet, len(names))
+	errs, peak := forEach(len(names), r.Workers, func(i int) error {
+		name := names[i]
+		query := url.Values{"name": {name}, "type": {"TXT"}, "maxitems": {"1"}}
+		req, err := http.NewRequest(http.MethodGet, r.zoneURL()+"?"+query.Encode(), nil)
+		if err != nil {
+			return err
+		}
+		data, err := r.do(req, nil, creds)
+		if err != nil {
+			return err
+		}
+		var list listResponse
+		if err := xml.Unmarshal(data, &list); err != nil {
+			return fmt.Errorf("route53: cannot decode the record sets of %s: %w", name, err)
+		}
+		// The listing starts at name, so the first set may belong to the next name
+		for _, set := range list.RecordSets {
+			if strings.EqualFold(set.Name, name) && set.Type == "TXT" {
+				found[i] = &set
+			}
+		}
+		return nil
+	})
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	log.Printf("INFO: Route53: %d record sets read back, peak %d / %d calls in flight", len(names), peak, max(r.Workers, 1))
+
+	sets := make(map[string]resourceRecordSet)
+	for i, set := range found {
+		if set != nil {
+			sets[names[i]] = *set
+		}
+	}
+	return sets, nil
+}
+
+// Publish sends the ChangeBatch, or writes it as JSON to w in dry-run mode, ready for
+// aws route53 change-resource-record-sets --change-batch. The record sets of every name
+// are read back from the hosted zone first, so a dry run needs credentials too.
+func (r *Route53) Publish(w io.Writer, records, stale []formatter.TXTRecord, dryRun bool) error {
+	creds, err := awsCredentials()
+	if err != nil {
+		return err
+	}
+	live, err := r.recordSets(creds, append(slices.Clone(records), stale...))
+	if err != nil {
+		return fmt.Errorf("cannot read back the live records: %w", err)
+	}
+	b, err := r.batch(records, stale, live)
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(b)
+	}
+
+	body, err := xml.Marshal(changeRequest{ChangeBatch: b})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, r.zoneURL(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/xml")
+	data, err := r.do(req, body, creds)
+	if err != nil {
+		return fmt.Errorf("%w (no record was changed)", err)
+	}
+	var info struct {
+		ID     string `xml:"ChangeInfo>Id"`
+		Status string `xml:"ChangeInfo>Status"`
+	}
+	xml.Unmarshal(data, &info)
+	log.Printf("INFO: Route53 change %s submitted (%s): %d records upserted, %d stale records removed", info.ID, info.Status, len(records), len(stale))
+	return nil
+}
+
+// zoneURL is the rrset URL of the hosted zone.
+func (r *Route53) zoneURL() string {
+	return route53Endpoint + "/hostedzone/" + strings.TrimPrefix(r.ZoneID, "/hostedzone/") + "/rrset"
+}
+
+// do signs and sends req and returns the response body, or the Route53 error.
+func (r *Route53) do(req *http.Request, body []byte, creds awsCreds) ([]byte, error) {
+	signV4(req, body, creds, "us-east-1", "route53", time.Now())
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("route53: %w", err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Code    string `xml:"Error>Code"`
+			Message string `xml:"Error>Message"`
+		}
+		if xml.Unmarshal(data, &e) == nil && e.Code != "" {
+			return nil, fmt.Errorf("route53: %s: %s", e.Code, e.Message)
+		}
+		return nil, fmt.Errorf("route53: %s", resp.Status)
+	}
+	return data, nil
+}
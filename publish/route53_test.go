@@ -0,0 +1,251 @@
+package publish
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"project/spf-flattener/formatter"
+)
+
+// redirect sends every request to the test server instead of the AWS endpoint.
+type redirect struct{ target *url.URL }
+
+func (r redirect) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme, req.URL.Host = r.target.Scheme, r.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestRoute53DeletesLiveRecordSets(t *testing.T) {
+	records := []formatter.TXTRecord{{Name: "_spf.example.com", Value: "v=spf1 ip4:192.0.2.0/24 -all"}}
+	stale := []formatter.TXTRecord{{Name: "spf1.example.com", Value: "v=spf1 ip4:198.51.100.0/24 -all"}}
+	tests := []struct {
+		name string
+		// live is the ListResourceRecordSets answer for spf1.example.com.
+		live string
+		want []change
+	}{
+		{
+			"custom TTL",
+			`<ResourceRecordSet><Name>spf1.example.com.</Name><Type>TXT</Type><TTL>60</TTL><ResourceRecords><ResourceRecord><Value>"v=spf1 ip4:198.51.100.0/24 -all"</Value></ResourceRecord></ResourceRecords></ResourceRecordSet>`,
+			[]change{{"DELETE", resourceRecordSet{"spf1.example.com.", "TXT", 60, []resourceRecord{{`"v=spf1 ip4:198.51.100.0/24 -all"`}}}}},
+		},
+		{
+			"several values",
+			`<ResourceRecordSet><Name>spf1.example.com.</Name><Type>TXT</Type><TTL>300</TTL><ResourceRecords><ResourceRecord><Value>"v=spf1 ip4:198.51.100.0/24 -all"</Value></ResourceRecord><ResourceRecord><Value>"v=spf1 " "-all"</Value></ResourceRecord></ResourceRecords></ResourceRecordSet>`,
+			[]change{{"DELETE", resourceRecordSet{"spf1.example.com.", "TXT", 300, []resourceRecord{{`"v=spf1 ip4:198.51.100.0/24 -all"`}, {`"v=spf1 " "-all"`}}}}},
+		},
+		{
+			"other TXT values kept",
+			`<ResourceRecordSet><Name>spf1.example.com.</Name><Type>TXT</Type><TTL>300</TTL><ResourceRecords><ResourceRecord><Value>"v=spf1 ip4:198.51.100.0/24 -all"</Value></ResourceRecord><ResourceRecord><Value>"site-verification=abc"</Value></ResourceRecord></ResourceRecords></ResourceRecordSet>`,
+			[]change{{"UPSERT", resourceRecordSet{"spf1.example.com.", "TXT", 300, []resourceRecord{{`"site-verification=abc"`}}}}},
+		},
+		{
+			"not in the hosted zone",
+			`<ResourceRecordSet><Name>spf2.example.com.</Name><Type>TXT</Type><TTL>300</TTL><ResourceRecords><ResourceRecord><Value>"v=spf1 -all"</Value></ResourceRecord></ResourceRecords></ResourceRecordSet>`,
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+			t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+			var sent changeRequest
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if !strings.HasPrefix(req.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") {
+					t.Errorf("%s %s is not signed", req.Method, req.URL)
+				}
+				if req.URL.Path != "/2013-04-01/hostedzone/Z123/rrset" {
+					t.Errorf("path = %s", req.URL.Path)
+				}
+				switch req.Method {
+				case http.MethodGet:
+					q := req.URL.Query()
+					if q.Get("type") != "TXT" {
+						t.Errorf("list query = %v", q)
+					}
+					if q.Get("name") != "spf1.example.com." {
+						fmt.Fprint(w, `<ListResourceRecordSetsResponse><ResourceRecordSets></ResourceRecordSets></ListResourceRecordSetsResponse>`)
+						return
+					}
+					fmt.Fprintf(w, `<ListResourceRecordSetsResponse xmlns="https://route53.amazonaws.com/doc/2013-04-01/"><ResourceRecordSets>%s</ResourceRecordSets></ListResourceRecordSetsResponse>`, tt.live)
+				case http.MethodPost:
+					body, _ := io.ReadAll(req.Body)
+					if err := xml.Unmarshal(body, &sent); err != nil {
+						t.Errorf("change request: %v", err)
+					}
+					fmt.Fprint(w, `<ChangeResourceRecordSetsResponse><ChangeInfo><Id>/change/C1</Id><Status>PENDING</Status></ChangeInfo></ChangeResourceRecordSetsResponse>`)
+				}
+			}))
+			defer srv.Close()
+			target, _ := url.Parse(srv.URL)
+			r := &Route53{ZoneID: "/hostedzone/Z123", Client: &http.Client{Transport: redirect{target}}}
+
+			if err := r.Publish(io.Discard, records, stale, false); err != nil {
+				t.Fatal(err)
+			}
+			changes := sent.ChangeBatch.Changes
+			if len(changes) == 0 || changes[0].Action != "UPSERT" || changes[0].ResourceRecordSet.TTL != formatter.DefaultTTL {
+				t.Fatalf("changes = %+v, want the generated record upserted first", changes)
+			}
+			if got, want := fmt.Sprint(changes[1:]), fmt.Sprint(tt.want); got != want {
+				t.Errorf("stale changes = %s, want %s", got, want)
+			}
+
+			var dry bytes.Buffer
+			if err := r.Publish(&dry, records, stale, true); err != nil {
+				t.Fatal(err)
+			}
+			for _, c := range tt.want {
+				if !strings.Contains(dry.String(), fmt.Sprintf(`"Action": %q`, c.Action)) {
+					t.Errorf("dry run = %s, want a %s change", dry.String(), c.Action)
+				}
+			}
+		})
+	}
+}
+
+func TestRoute53Batch(t *testing.T) {
+	records := []formatter.TXTRecord{
+		{Name: "_spf.example.com", Value: "v=spf1 ip4:192.0.2.0/24 include:spf1.example.com"},
+		{Name: "spf1.example.com", Value: "v=spf1 ip6:2001:db8::/32 ~all"},
+	}
+	stale := []formatter.TXTRecord{{Name: "spf2.example.com", Value: "v=spf1 -all"}}
+	txt := func(name string, ttl int, values ...string) resourceRecordSet {
+		set := resourceRecordSet{Name: name, Type: "TXT", TTL: ttl}
+		for _, v := range values {
+			set.ResourceRecords = append(set.ResourceRecords, resourceRecord{v})
+		}
+		return set
+	}
+	tests := []struct {
+		name string
+		live map[string]resourceRecordSet
+		want []change
+	}{
+		{
+			"nothing live",
+			nil,
+			[]change{
+				{"UPSERT", txt("_spf.example.com.", 600, `"v=spf1 ip4:192.0.2.0/24 include:spf1.example.com"`)},
+				{"UPSERT", txt("spf1.example.com.", 600, `"v=spf1 ip6:2001:db8::/32 ~all"`)},
+			},
+		},
+		{
+			"live SPF value replaced",
+			map[string]resourceRecordSet{"_spf.example.com.": txt("_spf.example.com.", 300, `"v=spf1 ip4:198.51.100.0/24 -all"`)},
+			[]change{
+				{"UPSERT", txt("_spf.example.com.", 600, `"v=spf1 ip4:192.0.2.0/24 include:spf1.example.com"`)},
+				{"UPSERT", txt("spf1.example.com.", 600, `"v=spf1 ip6:2001:db8::/32 ~all"`)},
+			},
+		},
+		{
+			"other TXT values kept",
+			map[string]resourceRecordSet{
+				"_spf.example.com.": txt("_spf.example.com.", 300, `"site-verification=abc"`, `"v=spf1 -all"`),
+				"spf1.example.com.": txt("spf1.example.com.", 300, `"v=spf1 -all"`, `"owner=ops" "team"`),
+			},
+			[]change{
+				{"UPSERT", txt("_spf.example.com.", 600, `"site-verification=abc"`, `"v=spf1 ip4:192.0.2.0/24 include:spf1.example.com"`)},
+				{"UPSERT", txt("spf1.example.com.", 600, `"owner=ops" "team"`, `"v=spf1 ip6:2001:db8::/32 ~all"`)},
+			},
+		},
+		{
+			"stale name",
+			map[string]resourceRecordSet{
+				"_spf.example.com.": txt("_spf.example.com.", 300, `"site-verification=abc"`),
+				"spf2.example.com.": txt("spf2.example.com.", 60, `"v=spf1 -all"`, `"note"`),
+			},
+			[]change{
+				{"UPSERT", txt("_spf.example.com.", 600, `"site-verification=abc"`, `"v=spf1 ip4:192.0.2.0/24 include:spf1.example.com"`)},
+				{"UPSERT", txt("spf1.example.com.", 600, `"v=spf1 ip6:2001:db8::/32 ~all"`)},
+				{"UPSERT", txt("spf2.example.com.", 60, `"note"`)},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &Route53{ZoneID: "Z123"}
+			b, err := r.batch(records, stale, tt.live)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := fmt.Sprint(b.Changes), fmt.Sprint(tt.want); got != want {
+				t.Errorf("changes =\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
+
+// TestRoute53AtomicBatch checks that every change goes in a single
+// ChangeResourceRecordSets call, and that a rejected batch is reported as changing nothing.
+func TestRoute53AtomicBatch(t *testing.T) {
+	records := []formatter.TXTRecord{
+		{Name: "_spf.example.com", Value: "v=spf1 ip4:192.0.2.0/24 include:spf1.example.com"},
+		{Name: "spf1.example.com", Value: "v=spf1 ip6:2001:db8::/32 ~all"},
+	}
+	stale := []formatter.TXTRecord{{Name: "spf2.example.com", Value: "v=spf1 -all"}}
+	const live = `<ResourceRecordSet><Name>spf2.example.com.</Name><Type>TXT</Type><TTL>600</TTL><ResourceRecords><ResourceRecord><Value>"v=spf1 -all"</Value></ResourceRecord></ResourceRecords></ResourceRecordSet>`
+	for _, reject := range []bool{false, true} {
+		t.Run(fmt.Sprintf("reject=%v", reject), func(t *testing.T) {
+			t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+			t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+			var posts []changeRequest
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				switch req.Method {
+				case http.MethodGet:
+					sets := ""
+					if req.URL.Query().Get("name") == "spf2.example.com." {
+						sets = live
+					}
+					fmt.Fprintf(w, `<ListResourceRecordSetsResponse><ResourceRecordSets>%s</ResourceRecordSets></ListResourceRecordSetsResponse>`, sets)
+				case http.MethodPost:
+					var sent changeRequest
+					body, _ := io.ReadAll(req.Body)
+					if err := xml.Unmarshal(body, &sent); err != nil {
+						t.Errorf("change request: %v", err)
+					}
+					posts = append(posts, sent)
+					if reject {
+						w.WriteHeader(http.StatusBadRequest)
+						fmt.Fprint(w, `<ErrorResponse><Error><Code>InvalidChangeBatch</Code><Message>Tried to delete resource record set but it was not found</Message></Error></ErrorResponse>`)
+						return
+					}
+					fmt.Fprint(w, `<ChangeResourceRecordSetsResponse><ChangeInfo><Id>/change/C1</Id><Status>PENDING</Status></ChangeInfo></ChangeResourceRecordSetsResponse>`)
+				}
+			}))
+			defer srv.Close()
+			target, _ := url.Parse(srv.URL)
+			r := &Route53{ZoneID: "Z123", Client: &http.Client{Transport: redirect{target}}}
+
+			err := r.Publish(io.Discard, records, stale, false)
+			if len(posts) != 1 {
+				t.Fatalf("%d change requests, want 1", len(posts))
+			}
+			var actions []string
+			for _, c := range posts[0].ChangeBatch.Changes {
+				actions = append(actions, c.Action+" "+c.ResourceRecordSet.Name)
+			}
+			want := "UPSERT _spf.example.com., UPSERT spf1.example.com., DELETE spf2.example.com."
+			if got := strings.Join(actions, ", "); got != want {
+				t.Errorf("batch = %s, want %s", got, want)
+			}
+			if !reject {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), "InvalidChangeBatch") || !strings.Contains(err.Error(), "(no record was changed)") {
+				t.Errorf("Publish() error = %v, want the rejected batch reported as changing nothing", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,35 @@
+// Fichier: publish/workers.go (appels d'API en parallèle)
+
+package publish
+
+import "sync"
+
+// forEach calls fn for every index below n with at most workers calls in flight, one when
+// workers is not positive. It returns the error of each call, by index, and the peak
+// number of calls in flight, which the publishers log so that users can tune publishOps.
+func forEach(n, workers int, fn func(i int) error) (errs []error, peak int) {
+	workers = max(workers, 1)
+	errs = make([]error, n)
+	slots := make(chan struct{}, workers)
+	var mu sync.Mutex
+	inFlight := 0
+	var wg sync.WaitGroup
+	for i := range n {
+		slots <- struct{}{}
+		mu.Lock()
+		inFlight++
+		peak = max(peak, inFlight)
+		mu.Unlock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = fn(i)
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+			<-slots
+		}()
+	}
+	wg.Wait()
+	return errs, peak
+}
@@ -0,0 +1,55 @@
+package publish
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestForEach(t *testing.T) {
+	tests := []struct {
+		n, workers int
+		wantPeak   int
+	}{
+		{0, 4, 0},
+		{1, 4, 1},
+		{10, 1, 1},
+		{10, 0, 1},
+		{10, 3, 3},
+		{2, 8, 2},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d calls %d workers", tt.n, tt.workers), func(t *testing.T) {
+			var inFlight, peak, calls atomic.Int32
+			errs, gotPeak := forEach(tt.n, tt.workers, func(i int) error {
+				calls.Add(1)
+				now := inFlight.Add(1)
+				for old := peak.Load(); now > old && !peak.CompareAndSwap(old, now); old = peak.Load() {
+				}
+				time.Sleep(5 * time.Millisecond)
+				inFlight.Add(-1)
+				if i%2 == 1 {
+					return fmt.Errorf("call %d", i)
+				}
+				return nil
+			})
+			if int(calls.Load()) != tt.n || len(errs) != tt.n {
+				t.Fatalf("%d calls, %d errors, want %d", calls.Load(), len(errs), tt.n)
+			}
+			if gotPeak != tt.wantPeak || int(peak.Load()) > max(tt.workers, 1) {
+				t.Errorf("peak = %d (observed %d), want %d", gotPeak, peak.Load(), tt.wantPeak)
+			}
+			// Each error stays at the index of its call
+			for i, err := range errs {
+				want := ""
+				if i%2 == 1 {
+					want = fmt.Sprintf("call %d", i)
+				}
+				if got := fmt.Sprint(err); err != nil && got != want || err == nil && want != "" {
+					t.Errorf("errs[%d] = %v, want %q", i, err, want)
+				}
+			}
+		})
+	}
+}
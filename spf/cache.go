@@ -0,0 +1,72 @@
+// Fichier: spf/cache.go
+
+package spf
+
+import (
+	"sync"
+	"time"
+)
+
+// Cache memoizes parsed records by domain and record text, so a record met several times
+// in a run (flattening, published-record checks...) is parsed once. It is safe for
+// concurrent use.
+type Cache struct {
+	mu      sync.Mutex
+	entries map[cacheKey]cacheEntry
+	elapsed time.Duration
+	hits    int
+}
+
+type cacheKey struct {
+	domain, record string
+}
+
+type cacheEntry struct {
+	record *Record
+	err    error
+}
+
+// error returns the cached error. A *ParseError is copied, so that every caller may
+// Locate its own without racing with or overwriting the others.
+func (e cacheEntry) error() error {
+	if perr, ok := e.err.(*ParseError); ok {
+		cp := *perr
+		return &cp
+	}
+	return e.err
+}
+
+// NewCache returns an empty cache.
+func NewCache() *Cache {
+	return &Cache{entries: make(map[cacheKey]cacheEntry)}
+}
+
+// Parse returns the parsed record of domain, parsing it on first use. Errors are cached
+// too and, like Parse's, are *ParseError with Domain set; each call returns its own copy.
+func (c *Cache) Parse(domain, record string) (*Record, error) {
+	key := cacheKey{domain, record}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.hits++
+		return e.record, e.error()
+	}
+
+	start := time.Now()
+	rec, err := Parse(record)
+	if perr, ok := err.(*ParseError); ok {
+		perr.Domain = domain
+	}
+	c.elapsed += time.Since(start)
+	e := cacheEntry{rec, err}
+	c.entries[key] = e
+	return rec, e.error()
+}
+
+// Stats returns the time spent parsing, the number of distinct records and the number
+// of parses saved.
+func (c *Cache) Stats() (elapsed time.Duration, records, hits int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.elapsed, len(c.entries), c.hits
+}
@@ -0,0 +1,110 @@
+package spf
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestCacheParse(t *testing.T) {
+	c := NewCache()
+	tests := []struct {
+		domain, record string
+		wantErr        bool
+	}{
+		{"a.example", "v=spf1 ip4:192.0.2.0/24 -all", false},
+		{"a.example", "v=spf1 ip4:192.0.2.0/24 -all", false},
+		{"b.example", "v=spf1 ip4:192.0.2.0/24 -all", false},
+		{"c.example", "v=spf1 ~redirect=x.example -all", true},
+		{"c.example", "v=spf1 ~redirect=x.example -all", true},
+	}
+	for _, tt := range tests {
+		rec, err := c.Parse(tt.domain, tt.record)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("Parse(%q, %q) error = %v, want error %v", tt.domain, tt.record, err, tt.wantErr)
+		}
+		if err != nil {
+			var perr *ParseError
+			if !errors.As(err, &perr) || perr.Domain != tt.domain {
+				t.Errorf("Parse(%q) error = %#v, want *ParseError with Domain set", tt.domain, err)
+			}
+			continue
+		}
+		if len(rec.Terms) != 2 {
+			t.Errorf("Parse(%q) = %d terms, want 2", tt.record, len(rec.Terms))
+		}
+	}
+	if _, records, hits := c.Stats(); records != 3 || hits != 2 {
+		t.Errorf("Stats() = %d records, %d hits, want 3 and 2", records, hits)
+	}
+}
+
+// TestCacheParseErrorCopies checks that callers locating a cached error in parallel, with
+// different string lengths, each see their own location.
+func TestCacheParseErrorCopies(t *testing.T) {
+	c := NewCache()
+	record := "v=spf1 ip4:192.0.2.0/24 ~redirect=x.example -all"
+	var wg sync.WaitGroup
+	for i := range 16 {
+		wg.Go(func() {
+			_, err := c.Parse("d.example", record)
+			var perr *ParseError
+			if !errors.As(err, &perr) {
+				t.Errorf("Parse() error = %v, want *ParseError", err)
+				return
+			}
+			first := 5 + i
+			perr.Locate([]int{first, len(record) - first})
+			if want := perr.Offset - first; perr.String != 2 || perr.StringOffset != want {
+				t.Errorf("Locate(%d) = string %d offset %d, want string 2 offset %d", first, perr.String, perr.StringOffset, want)
+			}
+		})
+	}
+	wg.Wait()
+
+	_, err := c.Parse("d.example", record)
+	if perr := err.(*ParseError); perr.String != 0 {
+		t.Errorf("cached error was located by a caller: string %d", perr.String)
+	}
+}
+
+// batch returns the records of a 100-domain batch where every domain includes the same
+// provider records, as when flattening many customer domains of one hoster.
+func batch() [][2]string {
+	var records [][2]string
+	for i := range 100 {
+		domain := fmt.Sprintf("customer%d.example", i)
+		records = append(records, [2]string{domain, fmt.Sprintf("v=spf1 ip4:192.0.2.%d include:_spf.hoster.example include:_spf.mailer.example ~all", i)})
+		for j := range 5 {
+			records = append(records, [2]string{
+				fmt.Sprintf("_spf%d.hoster.example", j),
+				fmt.Sprintf("v=spf1 ip4:198.51.%d.0/24 ip4:203.0.%d.0/24 ip6:2001:db8:%d::/48 a:mx%d.hoster.example -all", j, j, j, j),
+			})
+		}
+	}
+	return records
+}
+
+func BenchmarkParseBatch(b *testing.B) {
+	records := batch()
+	b.Run("uncached", func(b *testing.B) {
+		for b.Loop() {
+			for _, r := range records {
+				if _, err := Parse(r[1]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("cached", func(b *testing.B) {
+		for b.Loop() {
+			c := NewCache()
+			for _, r := range records {
+				if _, err := c.Parse(r[0], r[1]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,374 @@
+// Fichier: spf/spf.go
+
+package spf
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+const version = "v=spf1"
+
+// Term is a single mechanism or modifier of an SPF record.
+type Term struct {
+	// Qualifier is the explicit qualifier (+ - ~ ?) or 0 when the mechanism has none.
+	Qualifier byte
+	// Name is the lowercased mechanism or modifier name (ip4, include, redirect...).
+	Name string
+	// Value is the text after ':' or '=' with its original case preserved.
+	Value string
+	// Prefix holds the dual-cidr-length of a and mx mechanisms (e.g. "/24").
+	Prefix string
+	// Modifier is true for name=value terms.
+	Modifier bool
+}
+
+// Record is a parsed SPF record.
+type Record struct {
+	Terms []Term
+}
+
+// ParseError reports a term of an SPF record that could not be parsed.
+type ParseError struct {
+	// Domain owns the record; it is empty unless the caller knows it.
+	Domain string
+	// Mechanism is the offending token, or the whole record for a version error.
+	Mechanism string
+	// Offset is the byte offset of the offending token in the record.
+	Offset int
+	// Reason describes what is wrong.
+	Reason string
+	// String and StringOffset locate Offset in the TXT character-strings the record was
+	// joined from (1-based string number, offset within it); String is 0 when the record
+	// came in a single string or the boundaries are unknown.
+	String       int
+	StringOffset int
+}
+
+func (e *ParseError) Error() string {
+	where := ""
+	if e.String > 0 {
+		where = fmt.Sprintf(" (string %d, character %d)", e.String, e.StringOffset)
+	}
+	if e.Domain != "" {
+		where += " in SPF record of " + e.Domain
+	}
+	return fmt.Sprintf("%s: %q at offset %d%s", e.Reason, e.Mechanism, e.Offset, where)
+}
+
+// Locate maps Offset back to the character-string containing it, given the lengths of
+// the strings the record was joined from, as shown by DNS consoles.
+func (e *ParseError) Locate(lengths []int) {
+	if len(lengths) < 2 {
+		return
+	}
+	offset := e.Offset
+	for i, n := range lengths {
+		if offset < n || i == len(lengths)-1 {
+			e.String, e.StringOffset = i+1, offset
+			return
+		}
+		offset -= n
+	}
+}
+
+// IsSPF reports whether a TXT string is an SPF record (version check is case-insensitive).
+func IsSPF(txt string) bool {
+	return strings.HasPrefix(strings.ToLower(strings.TrimSpace(txt)), version)
+}
+
+// SplitConcatenated detects a TXT RR whose character-strings each hold a complete SPF
+// record, which joins into "...~allv=spf1 ...". It returns the first record and true
+// when a second version tag follows the first.
+func SplitConcatenated(record string) (string, bool) {
+	lower := strings.ToLower(record)
+	if !strings.HasPrefix(strings.TrimSpace(lower), version) {
+		return record, false
+	}
+	start := strings.Index(lower, version) + len(version)
+	i := strings.Index(lower[start:], version)
+	if i < 0 {
+		return record, false
+	}
+	return strings.TrimSpace(record[:start+i]), true
+}
+
+// Parse tokenizes an SPF record. Mechanism and modifier names are matched
+// case-insensitively while domain-specs keep their case. Like a verifier, it rejects an
+// unknown mechanism name and a malformed value (RFC 7208 section 4.6); unknown modifiers
+// are accepted. Errors are *ParseError.
+func Parse(record string) (*Record, error) {
+	tokens, offsets := fields(record)
+	if len(tokens) == 0 || strings.ToLower(tokens[0]) != version {
+		return nil, &ParseError{Mechanism: record, Reason: "not an SPF record"}
+	}
+
+	rec := &Record{}
+	for i, tok := range tokens[1:] {
+		term, reason := parseTerm(tok)
+		if reason != "" {
+			return nil, &ParseError{Mechanism: tok, Offset: offsets[i+1], Reason: reason}
+		}
+		rec.Terms = append(rec.Terms, term)
+	}
+	return rec, nil
+}
+
+// fields splits a record on spaces like strings.Fields, also returning the byte offset
+// of each token.
+func fields(record string) ([]string, []int) {
+	var tokens []string
+	var offsets []int
+	start := -1
+	for i := 0; i <= len(record); i++ {
+		if i < len(record) && record[i] != ' ' && record[i] != '\t' {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 {
+			tokens = append(tokens, record[start:i])
+			offsets = append(offsets, start)
+			start = -1
+		}
+	}
+	return tokens, offsets
+}
+
+// parseTerm splits a single token into its qualifier, name and value. It returns a
+// non-empty reason when the token is invalid.
+func parseTerm(tok string) (Term, string) {
+	var t Term
+	if strings.ContainsAny(tok[:1], "+-~?") {
+		t.Qualifier = tok[0]
+		tok = tok[1:]
+	}
+
+	end := strings.IndexAny(tok, ":=/")
+	if end < 0 {
+		end = len(tok)
+	}
+	if end == 0 {
+		return t, "invalid SPF term"
+	}
+	t.Name = strings.ToLower(tok[:end])
+	rest := tok[end:]
+
+	switch {
+	case strings.HasPrefix(rest, "="):
+		if t.Qualifier != 0 {
+			return t, "qualifier not allowed on modifier"
+		}
+		t.Modifier = true
+		t.Value = rest[1:]
+	case strings.HasPrefix(rest, ":"):
+		t.Value = rest[1:]
+	default:
+		t.Prefix = rest
+	}
+
+	// a and mx carry an optional dual-cidr-length after the domain-spec
+	if (t.Name == "a" || t.Name == "mx") && t.Value != "" {
+		if i := strings.Index(t.Value, "/"); i >= 0 {
+			t.Value, t.Prefix = t.Value[:i], t.Value[i:]
+		}
+	}
+	return t, validate(t)
+}
+
+// validate checks the value of a term against the grammar of RFC 7208 section 5 and 6,
+// returning a non-empty reason when it does not match.
+func validate(t Term) string {
+	if t.Modifier {
+		if !validName(t.Name) {
+			return "invalid modifier name"
+		}
+		if t.Name == "redirect" || t.Name == "exp" {
+			return validDomainSpec(t.Value)
+		}
+		return ""
+	}
+	switch t.Name {
+	case "all":
+		if t.Value != "" || t.Prefix != "" {
+			return "all takes no value"
+		}
+	case "include", "exists":
+		if t.Prefix != "" {
+			return t.Name + " takes no prefix length"
+		}
+		if t.Value == "" {
+			return t.Name + " requires a domain"
+		}
+		return validDomainSpec(t.Value)
+	case "ptr":
+		if t.Prefix != "" {
+			return "ptr takes no prefix length"
+		}
+		if t.Value != "" {
+			return validDomainSpec(t.Value)
+		}
+	case "a", "mx":
+		if !validDualCIDR(t.Prefix) {
+			return "invalid prefix length"
+		}
+		if t.Value != "" {
+			return validDomainSpec(t.Value)
+		}
+	case "ip4", "ip6":
+		if t.Prefix != "" || t.Value == "" {
+			return t.Name + " requires an address"
+		}
+		addr, bits, ok := strings.Cut(t.Value, "/")
+		ip, err := netip.ParseAddr(addr)
+		if err != nil || ip.Zone() != "" || ip.Is4() != (t.Name == "ip4") {
+			return "invalid " + t.Name + " address"
+		}
+		if ok && !validLength(bits, ip.BitLen()) {
+			return "invalid prefix length"
+		}
+	default:
+		return "unknown mechanism"
+	}
+	return ""
+}
+
+// validName reports whether name is a valid modifier name: a letter, then letters,
+// digits, '-', '_' or '.'.
+func validName(name string) bool {
+	for i, c := range name {
+		letter := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+		if !letter && (i == 0 || !(c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.')) {
+			return false
+		}
+	}
+	return name != ""
+}
+
+// validDualCIDR reports whether prefix is empty or a dual-cidr-length: /n, //m or /n//m.
+func validDualCIDR(prefix string) bool {
+	if prefix == "" {
+		return true
+	}
+	v4, v6, dual := strings.Cut(prefix, "//")
+	if dual && !validLength(v6, 128) {
+		return false
+	}
+	if v4 == "" {
+		return dual
+	}
+	return strings.HasPrefix(v4, "/") && validLength(v4[1:], 32)
+}
+
+// validLength reports whether s is a decimal prefix length of at most bits.
+func validLength(s string, bits int) bool {
+	n, err := strconv.Atoi(s)
+	return err == nil && s[0] != '+' && s[0] != '-' && n <= bits && (len(s) == 1 || s[0] != '0')
+}
+
+// validDomainSpec checks a domain-spec: visible characters, each '%' starting a macro
+// (%{...}, %%, %_ or %-) with a known macro letter. It returns a non-empty reason when
+// it is malformed.
+func validDomainSpec(spec string) string {
+	if spec == "" {
+		return "empty domain"
+	}
+	for i := 0; i < len(spec); i++ {
+		c := spec[i]
+		if c < 0x21 || c > 0x7e {
+			return "illegal character in domain"
+		}
+		if c != '%' {
+			continue
+		}
+		if i+1 == len(spec) {
+			return "unterminated macro"
+		}
+		switch spec[i+1] {
+		case '%', '_', '-':
+			i++
+			continue
+		case '{':
+		default:
+			return "invalid macro"
+		}
+		end := strings.IndexByte(spec[i:], '}')
+		if end < 0 {
+			return "unterminated macro"
+		}
+		if body := spec[i+2 : i+end]; body == "" || !strings.ContainsRune("slodiphcrtvSLODIPHCRTV", rune(body[0])) {
+			return "invalid macro letter"
+		}
+		i += end
+	}
+	return ""
+}
+
+// String returns the canonical text of the term (lowercased name, original value).
+func (t Term) String() string {
+	var b strings.Builder
+	if t.Qualifier != 0 {
+		b.WriteByte(t.Qualifier)
+	}
+	b.WriteString(t.Name)
+	switch {
+	case t.Modifier:
+		b.WriteString("=" + t.Value)
+	case t.Value != "":
+		b.WriteString(":" + t.Value)
+	}
+	b.WriteString(t.Prefix)
+	return b.String()
+}
+
+// Explicit returns the text of the term with its qualifier spelled out: mechanisms without
+// one get the default '+'. Macros are left untouched.
+func (t Term) Explicit() string {
+	if t.Modifier || t.Qualifier != 0 {
+		return t.String()
+	}
+	return "+" + t.String()
+}
+
+// Pass reports whether the mechanism authorizes senders when it matches.
+func (t Term) Pass() bool {
+	return t.Qualifier == 0 || t.Qualifier == '+'
+}
+
+// Effective returns the terms a verifier evaluates: mechanisms up to and including the
+// first all, and modifiers wherever they appear. Verifiers never reach the mechanisms
+// after all (RFC 7208 section 5.1); they are returned as ignored.
+func (r *Record) Effective() (terms, ignored []Term) {
+	done := false
+	for _, t := range r.Terms {
+		switch {
+		case t.Modifier:
+			terms = append(terms, t)
+		case done:
+			ignored = append(ignored, t)
+		default:
+			terms = append(terms, t)
+			done = t.Name == "all"
+		}
+	}
+	return terms, ignored
+}
+
+// Lookups returns the number of DNS-querying terms (include, a, mx, ptr, exists, redirect)
+// a verifier evaluates at the top level of the record.
+func (r *Record) Lookups() int {
+	n := 0
+	terms, _ := r.Effective()
+	for _, t := range terms {
+		switch {
+		case t.Modifier && t.Name == "redirect":
+			n++
+		case !t.Modifier && (t.Name == "include" || t.Name == "a" || t.Name == "mx" || t.Name == "ptr" || t.Name == "exists"):
+			n++
+		}
+	}
+	return n
+}
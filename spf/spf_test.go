@@ -0,0 +1,181 @@
+package spf
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// terms returns the canonical text of the terms of record.
+func terms(t *testing.T, record string) []string {
+	t.Helper()
+	rec, err := Parse(record)
+	if err != nil {
+		t.Fatalf("Parse(%q): %v", record, err)
+	}
+	var out []string
+	for _, term := range rec.Terms {
+		out = append(out, term.String())
+	}
+	return out
+}
+
+func TestParseCase(t *testing.T) {
+	tests := []struct {
+		name, record, lower string
+	}{
+		{"uppercase", "V=SPF1 IP4:203.0.113.0/24 INCLUDE:relay.example.com -ALL", "v=spf1 ip4:203.0.113.0/24 include:relay.example.com -all"},
+		{"mixed case", "v=Spf1 Ip6:2001:DB8::/32 A/24 mX:mail.example.com/28 ~All", "v=spf1 ip6:2001:DB8::/32 a/24 mx:mail.example.com/28 ~all"},
+		{"modifiers", "v=spf1 Exists:%{i}.example.com REDIRECT=_spf.example.com Exp=explain.example.com", "v=spf1 exists:%{i}.example.com redirect=_spf.example.com exp=explain.example.com"},
+		{"domain-spec case kept", "V=SPF1 INCLUDE:Relay.Example.COM -ALL", "v=spf1 include:Relay.Example.COM -all"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, want := terms(t, tt.record), terms(t, tt.lower); !slices.Equal(got, want) {
+				t.Errorf("Parse(%q) = %v, want %v as for %q", tt.record, got, want, tt.lower)
+			}
+		})
+	}
+}
+
+func TestParseBareAll(t *testing.T) {
+	rec, err := Parse("v=spf1 A ALL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.Terms) != 2 || rec.Terms[0].Name != "a" || rec.Terms[1].Name != "all" {
+		t.Errorf("Parse(\"v=spf1 A ALL\") = %+v, want an a and an all mechanism", rec.Terms)
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+	tests := []struct {
+		term   string
+		reason string // empty when the term is valid
+	}{
+		{"ip4:192.0.2.0/24", ""},
+		{"ip6:2001:db8::/32", ""},
+		{"ip6:::ffff:192.0.2.1", ""},
+		{"a", ""},
+		{"a/24", ""},
+		{"a//64", ""},
+		{"mx:mail.example.com/24//64", ""},
+		{"ptr", ""},
+		{"exists:%{i}.%{l1r-}._spf.example.com", ""},
+		{"include:%{d}.example.com", ""},
+		{"redirect=_spf.example.com", ""},
+		{"unknown-modifier=anything", ""},
+		{"v=1", ""},
+
+		// Unknown mechanism names
+		{"ipv4:192.0.2.0/24", "unknown mechanism"},
+		{"inclde:example.com", "unknown mechanism"},
+		{"spf2.0", "unknown mechanism"},
+		{"+foo", "unknown mechanism"},
+
+		// Malformed values
+		{"ip4:192.0.2.300", "invalid ip4 address"},
+		{"ip4:2001:db8::1", "invalid ip4 address"},
+		{"ip6:192.0.2.1", "invalid ip6 address"},
+		{"ip4:192.0.2.0/33", "invalid prefix length"},
+		{"ip6:2001:db8::/129", "invalid prefix length"},
+		{"ip4:192.0.2.0/", "invalid prefix length"},
+		{"ip4", "ip4 requires an address"},
+		{"ip4/24", "ip4 requires an address"},
+		{"a/33", "invalid prefix length"},
+		{"mx//129", "invalid prefix length"},
+		{"a/024", "invalid prefix length"},
+		{"all:example.com", "all takes no value"},
+		{"include", "include requires a domain"},
+		{"include:", "include requires a domain"},
+		{"include/24", "include takes no prefix length"},
+		{"exists:%{i.example.com", "unterminated macro"},
+		{"exists:%{q}.example.com", "invalid macro letter"},
+		{"include:50%.example.com", "invalid macro"},
+		{"redirect=", "empty domain"},
+		{"1bad=value", "invalid modifier name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.term, func(t *testing.T) {
+			_, err := Parse("v=spf1 " + tt.term + " -all")
+			if tt.reason == "" {
+				if err != nil {
+					t.Errorf("Parse() error = %v, want none", err)
+				}
+				return
+			}
+			perr, ok := err.(*ParseError)
+			if !ok {
+				t.Fatalf("Parse() error = %v, want a *ParseError", err)
+			}
+			if perr.Reason != tt.reason || perr.Mechanism != tt.term || perr.Offset != len("v=spf1 ") {
+				t.Errorf("Parse() error = %+v, want reason %q for %q at offset 7", perr, tt.reason, tt.term)
+			}
+		})
+	}
+}
+
+func TestParseErrorLocate(t *testing.T) {
+	// A record published as three character-strings, joined without separator
+	tests := []struct {
+		name       string
+		chunks     []string
+		wantString int
+		// wantOffset is the offset of the offending token within its string.
+		wantOffset int
+	}{
+		{"first string", []string{"v=spf1 bogus:x ip4:192.0.2.0/24 ", "ip4:198.51.100.0/24 ", "ip6:2001:db8::/32 -all"}, 1, 7},
+		{"second string", []string{"v=spf1 ip4:192.0.2.0/24 ", "ip4:198.51.100.0/24 bogus:x ", "ip6:2001:db8::/32 -all"}, 2, 20},
+		{"third string", []string{"v=spf1 ip4:192.0.2.0/24 ", "ip4:198.51.100.0/24 ", "ip6:2001:db8::/32 bogus:x -all"}, 3, 18},
+		{"start of a string", []string{"v=spf1 ip4:192.0.2.0/24 ", "bogus:x ", "-all"}, 2, 0},
+		// A token split across strings is reported where it starts
+		{"across strings", []string{"v=spf1 ip4:192.0.2.0/24 bo", "gus:x ", "-all"}, 1, 24},
+		{"single string", []string{"v=spf1 ip4:192.0.2.0/24 bogus:x -all"}, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			record := strings.Join(tt.chunks, "")
+			_, err := Parse(record)
+			var perr *ParseError
+			if !errors.As(err, &perr) {
+				t.Fatalf("Parse(%q) error = %v, want *ParseError", record, err)
+			}
+			if perr.Mechanism != "bogus:x" {
+				t.Fatalf("Mechanism = %q, want bogus:x", perr.Mechanism)
+			}
+			lengths := make([]int, len(tt.chunks))
+			for i, c := range tt.chunks {
+				lengths[i] = len(c)
+			}
+			perr.Locate(lengths)
+			if perr.String != tt.wantString || perr.StringOffset != tt.wantOffset {
+				t.Errorf("Locate(%v) = string %d offset %d, want string %d offset %d", lengths, perr.String, perr.StringOffset, tt.wantString, tt.wantOffset)
+			}
+			if want := "(string "; (tt.wantString > 0) != strings.Contains(perr.Error(), want) {
+				t.Errorf("Error() = %q, want the string located: %v", perr.Error(), tt.wantString > 0)
+			}
+		})
+	}
+}
+
+func TestSplitConcatenated(t *testing.T) {
+	tests := []struct {
+		record, want string
+		wantSplit    bool
+	}{
+		{"v=spf1 ip4:192.0.2.0/24 -all", "v=spf1 ip4:192.0.2.0/24 -all", false},
+		// Two records as the character-strings of one RR, joined without separator
+		{"v=spf1 ip4:192.0.2.0/24 ~allv=spf1 include:_spf.example.net -all", "v=spf1 ip4:192.0.2.0/24 ~all", true},
+		{"v=spf1 ip4:192.0.2.0/24 ~all v=spf1 -all", "v=spf1 ip4:192.0.2.0/24 ~all", true},
+		{"V=SPF1 mx -allv=spf1 a -all", "V=SPF1 mx -all", true},
+		{" v=spf1 mx -all V=spf1 a", "v=spf1 mx -all", true},
+		{"google-site-verification=v=spf1", "google-site-verification=v=spf1", false},
+	}
+	for _, tt := range tests {
+		first, split := SplitConcatenated(tt.record)
+		if first != tt.want || split != tt.wantSplit {
+			t.Errorf("SplitConcatenated(%q) = %q, %v, want %q, %v", tt.record, first, split, tt.want, tt.wantSplit)
+		}
+	}
+}
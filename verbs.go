@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"project/spf-flattener/config"
+	"project/spf-flattener/formatter"
+	"project/spf-flattener/pipeline"
+)
+
+// runVerb runs the resolve, format, whatif, hash, analyze or expand verb named by args[0]. It reports false when args
+// do not start with a verb, so that the default flatten run proceeds.
+//
+//	spf-flattener resolve [-no-config] [domain] > resolved.json
+//	spf-flattener format [-domain d] [-zone z] [-max-txt-length n] [-max-mechanisms n] [-mechanism-qualifier q] [-vcs-friendly] [resolved.json]
+//	spf-flattener whatif [-config new.yaml] [-baseline resolved.json] [-json]
+//	spf-flattener hash -record-content 'v=spf1 ip4:192.0.2.0/24 ~all'
+//	spf-flattener analyze [-format markdown|csv] resolved.json
+//	spf-flattener analyze -diff old.json new.json
+//	spf-flattener expand [-deep] domain
+func runVerb(args []string) (bool, error) {
+	if len(args) == 0 {
+		return false, nil
+	}
+	switch args[0] {
+	case "resolve":
+		return true, resolveVerb(args[1:])
+	case "format":
+		return true, formatVerb(args[1:])
+	case "whatif":
+		return true, whatIfVerb(args[1:])
+	case "hash":
+		return true, hashVerb(args[1:])
+	case "analyze":
+		return true, analyzeVerb(args[1:])
+	case "expand":
+		return true, expandVerb(args[1:])
+	}
+	return false, nil
+}
+
+// resolveVerb writes the final CIDRs of the configured target, or of the given domain,
+// as JSON on standard output.
+func resolveVerb(args []string) error {
+	var opts options
+	fs := flag.NewFlagSet("spf-flattener resolve", flag.ContinueOnError)
+	fs.BoolVar(&opts.noConfig, "no-config", false, "do not read the configuration file, use defaults (requires a domain)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	opts.domain = fs.Arg(0)
+	if opts.noConfig && opts.domain == "" {
+		return fmt.Errorf("-no-config requires a domain")
+	}
+
+	cfg, err := loadConfig(opts)
+	if err != nil {
+		return err
+	}
+	p, err := pipeline.New(cfg, opts.domain)
+	if err != nil {
+		return err
+	}
+	doc, err := p.Resolve(context.Background())
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
+
+// formatVerb reads the JSON written by resolve from a file or standard input and prints
+// the TXT records, as the last stage of a flatten run would.
+func formatVerb(args []string) error {
+	fs := flag.NewFlagSet("spf-flattener format", flag.ContinueOnError)
+	domain := fs.String("domain", "", "domain the record names are built under (defaults to the document's)")
+	maxLength := fs.Int("max-txt-length", formatter.DefaultMaxRecordLength, "maximum length of each record value")
+	maxMechanisms := fs.Int("max-mechanisms", 0, "maximum number of mechanisms of each record (0 means no limit)")
+	vcsFriendly := fs.Bool("vcs-friendly", false, "write the records sorted by name, one mechanism per line")
+	zone := fs.String("zone", "", "zone every generated include must fall within (defaults to the domain)")
+	qualifier := fs.String("mechanism-qualifier", "", "qualifier of the generated ip4/ip6 mechanisms: + (default), ? or ~")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var in io.Reader = os.Stdin
+	if fs.NArg() > 0 {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	doc, err := pipeline.ReadResolved(in)
+	if err != nil {
+		return err
+	}
+	if *domain != "" {
+		doc.Domain = *domain
+	}
+	if doc.Domain == "" {
+		return fmt.Errorf("format requires -domain")
+	}
+
+	if *zone == "" {
+		*zone = doc.Domain
+	}
+	segments, err := doc.Format(*maxLength, *maxMechanisms, *zone, *qualifier)
+	if err != nil {
+		return err
+	}
+	if *vcsFriendly {
+		return pipeline.WriteRecordsVCS(os.Stdout, doc.Domain, segments)
+	}
+	return pipeline.WriteRecords(os.Stdout, segments)
+}
+
+// whatIfVerb resolves a proposed configuration and prints what would change relative to a
+// resolve document or, by default, to the published records. It only reads DNS.
+func whatIfVerb(args []string) error {
+	fs := flag.NewFlagSet("spf-flattener whatif", flag.ContinueOnError)
+	configPath := fs.String("config", defaultConfigFile, "proposed configuration file")
+	baselinePath := fs.String("baseline", "", "JSON written by resolve to compare with (defaults to the published records)")
+	asJSON := fs.Bool("json", false, "write the impact as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var baseline *pipeline.Resolved
+	if *baselinePath != "" {
+		data, err := os.ReadFile(*baselinePath)
+		if err != nil {
+			return err
+		}
+		baseline = new(pipeline.Resolved)
+		if err := json.Unmarshal(data, baseline); err != nil {
+			return fmt.Errorf("failed to read baseline %s: %w", *baselinePath, err)
+		}
+	}
+
+	cfg, err := config.LoadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	p, err := pipeline.New(cfg, "")
+	if err != nil {
+		return err
+	}
+	impact, err := p.WhatIf(context.Background(), baseline)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(impact)
+	}
+	impact.Write(os.Stdout)
+	return nil
+}
+
+// hashVerb prints the fingerprint of a record value, computed like the ones logged by a
+// flatten run, for monitors checking the published records.
+func hashVerb(args []string) error {
+	fs := flag.NewFlagSet("spf-flattener hash", flag.ContinueOnError)
+	content := fs.String("record-content", "", "TXT record value, its character-strings concatenated")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *content == "" {
+		return fmt.Errorf("hash requires -record-content")
+	}
+	fmt.Println(formatter.RecordHash(*content))
+	return nil
+}
+
+// readResolvedFile decodes the resolve document stored at path.
+func readResolvedFile(path string) (pipeline.Resolved, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return pipeline.Resolved{}, err
+	}
+	defer f.Close()
+	return pipeline.ReadResolved(f)
+}
+
+// analyzeVerb renders a saved resolve document, or diffs two of them, without any DNS
+// query.
+func analyzeVerb(args []string) error {
+	fs := flag.NewFlagSet("spf-flattener analyze", flag.ContinueOnError)
+	format := fs.String("format", "markdown", "output format: markdown or csv")
+	diff := fs.Bool("diff", false, "compare two documents: analyze -diff old.json new.json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *diff {
+		if fs.NArg() != 2 {
+			return fmt.Errorf("analyze -diff requires two documents")
+		}
+		old, err := readResolvedFile(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		new, err := readResolvedFile(fs.Arg(1))
+		if err != nil {
+			return err
+		}
+		pipeline.WriteDiff(os.Stdout, old, new)
+		return nil
+	}
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("analyze requires a document")
+	}
+	doc, err := readResolvedFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	switch *format {
+	case "markdown":
+		doc.WriteMarkdown(os.Stdout)
+		return nil
+	case "csv":
+		return doc.WriteCSV(os.Stdout)
+	}
+	return fmt.Errorf("unknown format %q (want markdown or csv)", *format)
+}
+
+// expandVerb prints a domain's SPF record normalized on one line, with its statistics and,
+// with -deep, its include tree. It needs no configuration file.
+func expandVerb(args []string) error {
+	fs := flag.NewFlagSet("spf-flattener expand", flag.ContinueOnError)
+	deep := fs.Bool("deep", false, "also print the include and redirect tree with the record of every node")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expand requires a domain")
+	}
+	domain := fs.Arg(0)
+
+	cfg, err := loadConfig(options{domain: domain, noConfig: true})
+	if err != nil {
+		return err
+	}
+	p, err := pipeline.New(cfg, domain)
+	if err != nil {
+		return err
+	}
+	return p.Expand(os.Stdout, domain, *deep)
+}
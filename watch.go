@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+
+	"project/spf-flattener/config"
+)
+
+// watchInterval is how often watched files are checked for changes.
+const watchInterval = 500 * time.Millisecond
+
+// watchDebounce is how long the files must stay unchanged before a run starts.
+const watchDebounce = time.Second
+
+// withoutWatch returns the command line arguments with the -watch flag removed.
+func withoutWatch(args []string) []string {
+	var out []string
+	for _, a := range args {
+		switch strings.TrimLeft(a, "-") {
+		case "watch", "watch=true", "watch=1":
+			continue
+		}
+		out = append(out, a)
+	}
+	return out
+}
+
+// watch re-runs the flattener whenever configFile or one of the files it extends
+// changes. Each run is a child process given args, so a run that fails (for
+// example on an invalid intermediate save) is reported without stopping the watcher.
+func watch(configFile string, args []string) {
+	exe, err := os.Executable()
+	if err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+
+	last := snapshot(config.Sources(configFile))
+	for {
+		log.Printf("WATCH: ===== running (watching %d files) =====", len(last))
+		cmd := exec.Command(exe, args...)
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		if err := cmd.Run(); err != nil {
+			log.Printf("WATCH: run failed: %v", err)
+		}
+
+		// Wait for a change, then for the files to settle
+		for {
+			time.Sleep(watchInterval)
+			current := snapshot(config.Sources(configFile))
+			if slices.Equal(current, last) {
+				continue
+			}
+			for {
+				time.Sleep(watchDebounce)
+				settled := snapshot(config.Sources(configFile))
+				if slices.Equal(settled, current) {
+					break
+				}
+				current = settled
+			}
+			last = current
+			break
+		}
+	}
+}
+
+// snapshot describes the files by name, size and modification time.
+func snapshot(files []string) []string {
+	out := make([]string, 0, len(files))
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			out = append(out, f+" missing")
+			continue
+		}
+		out = append(out, fmt.Sprintf("%s %s %d", f, info.ModTime(), info.Size()))
+	}
+	return out
+}